@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/pabotesu/kurohabaki-client/internal/acl"
+	"github.com/pabotesu/kurohabaki-client/internal/etcd"
+	"github.com/spf13/cobra"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var aclCmd = &cobra.Command{
+	Use:   "acl",
+	Short: "Manage the mesh ACL policy stored in etcd",
+}
+
+var aclShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Print the ACL policy",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		etcdCli, err := aclClient()
+		if err != nil {
+			return err
+		}
+		defer etcdCli.Close()
+
+		doc, rev, err := etcd.FetchACL(etcdCli)
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			fmt.Fprintln(cmd.OutOrStdout(), "No ACL policy set, all nodes can reach each other")
+			return nil
+		}
+		if _, err := acl.Parse(doc); err != nil {
+			fmt.Fprintf(cmd.ErrOrStderr(), "Warning: the stored policy is rejected by agents: %v\n", err)
+		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "# revision %d\n", rev)
+		fmt.Fprintln(cmd.OutOrStdout(), string(doc))
+		return nil
+	},
+}
+
+var aclPushCmd = &cobra.Command{
+	Use:   "push <policy.json>",
+	Short: "Validate and store a new ACL policy",
+	Long: `Validate a policy document and store it in etcd. The version must be greater
+than that of the stored policy, since agents refuse to go back to an older one.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		doc, err := os.ReadFile(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to read policy: %w", err)
+		}
+		policy, err := acl.Parse(doc)
+		if err != nil {
+			return err
+		}
+
+		etcdCli, err := aclClient()
+		if err != nil {
+			return err
+		}
+		defer etcdCli.Close()
+
+		current, rev, err := etcd.FetchACL(etcdCli)
+		if err != nil {
+			return err
+		}
+		if current != nil {
+			if old, err := acl.Parse(current); err == nil && policy.Version <= old.Version {
+				return fmt.Errorf("policy version %d must be greater than the stored version %d", policy.Version, old.Version)
+			}
+		}
+
+		if err := etcd.PutACL(etcdCli, doc, rev); err != nil {
+			if errors.Is(err, etcd.ErrACLChanged) {
+				return fmt.Errorf("%w, review it and try again", err)
+			}
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Stored ACL policy version %d (%d rules)\n", policy.Version, len(policy.Rules))
+		return nil
+	},
+}
+
+// aclClient connects to the etcd endpoint of the config file
+func aclClient() (*clientv3.Client, error) {
+	cfg, err := config.Load(configPath, configSets...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	etcdCli, err := etcd.NewClient(cfg.Etcd.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to etcd: %w", err)
+	}
+	return etcdCli, nil
+}
+
+func init() {
+	rootCmd.AddCommand(aclCmd)
+	aclCmd.AddCommand(aclShowCmd, aclPushCmd)
+	aclCmd.PersistentFlags().StringVar(&configPath, "config", "config.yaml", "Path to config file")
+}
@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/spf13/cobra"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Check, migrate and show the config",
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Report every problem in the config file",
+	Long: `Check the config file for unknown fields, values of the wrong type and invalid
+settings, and report all problems found with their line numbers. up runs the
+same checks before it starts.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.ValidateFile(configPath, configSets...)
+		if cfg != nil {
+			printMigrations(cmd.OutOrStdout(), cfg.Migrations())
+		}
+		var verr *config.ValidationError
+		if errors.As(err, &verr) {
+			printProblems(cmd.OutOrStdout(), verr)
+			cmd.SilenceUsage = true
+			return fmt.Errorf("%d problem(s) found in %s", len(verr.Problems), configPath)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "%s: OK\n", configPath)
+		return nil
+	},
+}
+
+var configMigrateDryRun bool
+
+var configMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Update the config files to the current layout",
+	Long: fmt.Sprintf(`Rewrite the config file and its conf.d fragments written for an older
+version of the client in the current layout (version %d), keeping their
+comments. The original of each file is kept next to it as
+<file>.v<version>.bak. Older layouts are also read as they are, with a
+warning for each change this would make.`, config.CurrentVersion),
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		fragments, err := config.Fragments(configPath)
+		if err != nil {
+			return err
+		}
+		out := cmd.OutOrStdout()
+		failed := 0
+		for _, file := range append([]string{configPath}, fragments...) {
+			from, changes, err := config.MigrateFile(file, configMigrateDryRun)
+			if err != nil {
+				// The other files are still migrated
+				fmt.Fprintf(out, "%s: failed to migrate: %v\n", file, err)
+				failed++
+				continue
+			}
+			if from == config.CurrentVersion {
+				fmt.Fprintf(out, "%s: already at version %d\n", file, from)
+				continue
+			}
+			for _, c := range changes {
+				fmt.Fprintf(out, "%s: %s\n", location(c.File, c.Line), c.Message)
+			}
+			if configMigrateDryRun {
+				fmt.Fprintf(out, "%s: would be migrated from version %d to %d\n", file, from, config.CurrentVersion)
+				continue
+			}
+			fmt.Fprintf(out, "%s: migrated from version %d to %d, the original is in %s.v%d.bak\n",
+				file, from, config.CurrentVersion, file, from)
+		}
+		if failed > 0 {
+			cmd.SilenceUsage = true
+			return fmt.Errorf("failed to migrate %d config file(s)", failed)
+		}
+		return nil
+	},
+}
+
+var (
+	configShowEffective bool
+	configShowSecrets   bool
+)
+
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show where the config comes from",
+	Long: `List the sources the config is merged from, each overriding the ones before
+it: the config file, the fragments in the conf.d directory next to it in
+lexical order, KH_* environment variables (e.g. KH_LOG_LEVEL for log.level)
+and --set flags. Files may be YAML, JSON or TOML.
+
+With --effective, print the merged config instead, with the origin of each
+value. Secrets are redacted unless --show-secrets is given.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.Load(configPath, configSets...)
+		var verr *config.ValidationError
+		if errors.As(err, &verr) {
+			printProblems(cmd.OutOrStdout(), verr)
+			cmd.SilenceUsage = true
+			return fmt.Errorf("%d problem(s) found in %s", len(verr.Problems), configPath)
+		}
+		if err != nil {
+			return err
+		}
+
+		out := cmd.OutOrStdout()
+		if !configShowEffective {
+			for _, source := range cfg.Sources() {
+				fmt.Fprintln(out, source)
+			}
+			return nil
+		}
+		data, err := cfg.Effective(configShowSecrets)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(data)
+		return err
+	},
+}
+
+// printMigrations warns about the changes made to read an older config.
+func printMigrations(w io.Writer, changes []config.Change) {
+	for _, c := range changes {
+		fmt.Fprintf(w, "%s: warning: %s\n", location(c.File, c.Line), c.Message)
+	}
+	if len(changes) > 0 {
+		fmt.Fprintln(w, "warning: run 'config migrate' to update the files")
+	}
+}
+
+// printProblems writes the problems of a config as file:line: messages.
+func printProblems(w io.Writer, verr *config.ValidationError) {
+	for _, p := range verr.Problems {
+		file := p.File
+		if file == "" {
+			file = verr.File
+		}
+		fmt.Fprintf(w, "%s: ", location(file, p.Line))
+		if p.Path != "" {
+			fmt.Fprintf(w, "%s: ", p.Path)
+		}
+		fmt.Fprintln(w, p.Message)
+	}
+}
+
+// location formats a position in a file as file:line, or file if the line
+// is unknown.
+func location(file string, line int) string {
+	if line > 0 {
+		return fmt.Sprintf("%s:%d", file, line)
+	}
+	return file
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configValidateCmd)
+	configValidateCmd.Flags().StringVar(&configPath, "config", "config.yaml", "Path to config file")
+	configCmd.AddCommand(configMigrateCmd)
+	configMigrateCmd.Flags().StringVar(&configPath, "config", "config.yaml", "Path to config file")
+	configMigrateCmd.Flags().BoolVar(&configMigrateDryRun, "dry-run", false, "Only show the changes")
+	configCmd.AddCommand(configShowCmd)
+	configShowCmd.Flags().StringVar(&configPath, "config", "config.yaml", "Path to config file")
+	configShowCmd.Flags().BoolVar(&configShowEffective, "effective", false, "Print the merged config with the origin of each value")
+	configShowCmd.Flags().BoolVar(&configShowSecrets, "show-secrets", false, "Don't redact keys and secrets")
+}
@@ -6,12 +6,16 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/pabotesu/kurohabaki-client/internal/logger"
 	"github.com/pabotesu/kurohabaki-client/internal/util"
 	"github.com/spf13/cobra"
 )
 
+// downTimeout bounds how long down waits for the agent to shut down
+const downTimeout = 10 * time.Second
+
 var downCmd = &cobra.Command{
 	Use:   "down",
 	Short: "Stop the running WireGuard interface and agent",
@@ -48,24 +52,45 @@ var downCmd = &cobra.Command{
 		}
 
 		// Send SIGTERM to gracefully shut down the agent
-		logger.Printf("Sending shutdown signal to agent (PID: %d)...", pid)
+		logger.Infof("Sending shutdown signal to agent (PID: %d)...", pid)
 		if err := process.Signal(syscall.SIGTERM); err != nil {
 			// If signal sending fails, process is likely already gone
 			os.Remove(pidFile)
-			logger.Println("Process not running, removed PID file")
+			os.Remove(util.GetStatusFilePath())
+			recoverHostDNS()
+			logger.Infof("Process not running, removed PID file")
 			return nil
 		}
 
+		// Wait for the agent to restore what it changed on the host
+		if !waitForExit(process, downTimeout) {
+			logger.Warnf("Agent did not exit within %s", downTimeout)
+		}
+
 		// Clean up PID file
-		if err := os.Remove(pidFile); err != nil {
-			logger.Printf("Warning: failed to remove PID file: %v", err)
+		if err := os.Remove(pidFile); err != nil && !os.IsNotExist(err) {
+			logger.Warnf("Failed to remove PID file: %v", err)
 		}
+		os.Remove(util.GetStatusFilePath())
+		recoverHostDNS()
 
-		logger.Println("Agent stopped successfully")
+		logger.Infof("Agent stopped successfully")
 		return nil
 	},
 }
 
+// waitForExit polls until the process is gone or the timeout expires.
+func waitForExit(process *os.Process, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if err := process.Signal(syscall.Signal(0)); err != nil {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
 func init() {
 	rootCmd.AddCommand(downCmd)
 }
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/spf13/cobra"
+)
+
+var encryptKeyCmd = &cobra.Command{
+	Use:   "encrypt-key",
+	Short: "Encrypt the private key with a passphrase",
+	Long: `Encrypt the private key in place, in the config file or the key file, with a
+passphrase that up asks for on the terminal or reads from KH_KEY_PASSPHRASE.
+Run it on an encrypted key to change the passphrase.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.Load(configPath, configSets...)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		switch source := cfg.Interface.KeySource(); source {
+		case "private_key_env", "private_key_command":
+			return fmt.Errorf("the private key is read from %s; store the encrypted key there yourself", source)
+		}
+		if source := cfg.Source("interface.private_key"); source != "" && source != configPath {
+			return fmt.Errorf("the private key is set by %s, which encrypt-key can't update; encrypt it there yourself", source)
+		}
+		if err := cfg.Interface.ResolvePrivateKey(keyPassphrase()); err != nil {
+			return fmt.Errorf("failed to load private key: %w", err)
+		}
+
+		pass, err := newPassphrase()
+		if err != nil {
+			return err
+		}
+		if err := config.StorePrivateKey(configPath, &cfg.Interface, cfg.Interface.PrivateKey, pass); err != nil {
+			return fmt.Errorf("failed to store encrypted private key: %w", err)
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Private key in %s encrypted\n", cfg.Interface.KeySource())
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(encryptKeyCmd)
+	encryptKeyCmd.Flags().StringVar(&configPath, "config", "config.yaml", "Path to config file")
+}
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/pabotesu/kurohabaki-client/internal/agent"
+	"github.com/pabotesu/kurohabaki-client/internal/forward"
+	"github.com/pabotesu/kurohabaki-client/internal/util"
+	"github.com/spf13/cobra"
+)
+
+var (
+	forwardUDP    bool // Forward UDP instead of TCP
+	forwardRemote bool // Listen on the mesh and connect to a host target
+)
+
+var forwardCmd = &cobra.Command{
+	Use:   "forward",
+	Short: "Manage port forwards between this host and the mesh",
+	Long: `Manage the forward rules of the config file. A local forward listens on this
+host and connects to a target on the mesh, a remote forward listens on this
+node's mesh address and connects to a target reachable from this host. A
+running agent applies changes to the config file and its conf.d fragments
+within a few seconds.`,
+}
+
+var forwardListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the forwards and their connections",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.Load(configPath, configSets...)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		// Connection counts are only known while the agent is up
+		st, _ := agent.ReadStatus(util.GetStatusFilePath())
+		printForwards(cmd.OutOrStdout(), cfg.Forwards, st)
+		return nil
+	},
+}
+
+var forwardAddCmd = &cobra.Command{
+	Use:   "add <name> <listen> <target>",
+	Short: "Add a forward",
+	Example: `  kurohabaki forward add db 127.0.0.1:5432 db.kh.internal:5432
+  kurohabaki forward add --remote --udp syslog :514 127.0.0.1:514`,
+	Args: cobra.ExactArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f := config.Forward{Name: args[0], Listen: args[1], Target: args[2]}
+		if forwardUDP {
+			f.Protocol = "udp"
+		}
+		if forwardRemote {
+			f.Direction = "remote"
+		}
+		if _, err := forward.RuleFromConfig(f); err != nil {
+			return err
+		}
+		if err := config.AddForward(configPath, f); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Added forward %s\n", f.Name)
+		return nil
+	},
+}
+
+var forwardRemoveCmd = &cobra.Command{
+	Use:   "remove <name>",
+	Short: "Remove a forward",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := config.RemoveForward(configPath, args[0]); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Removed forward %s\n", args[0])
+		return nil
+	},
+}
+
+// printForwards writes the configured forwards as a table, with the
+// connection counts of those running in st, which may be nil
+func printForwards(w io.Writer, forwards []config.Forward, st *agent.Status) {
+	running := make(map[string]agent.ForwardStatus)
+	if st != nil {
+		for _, f := range st.Forwards {
+			running[f.Name] = f
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tPROTO\tDIRECTION\tLISTEN\tTARGET\tACTIVE\tTOTAL")
+	for _, f := range forwards {
+		r, err := forward.RuleFromConfig(f)
+		if err != nil {
+			fmt.Fprintf(tw, "%s\t\t\t%s\t%s\tinvalid: %v\t\n", f.Name, f.Listen, f.Target, err)
+			continue
+		}
+		active, total, listen := "-", "-", r.Listen
+		if s, ok := running[r.Name]; ok {
+			active, total = strconv.FormatInt(s.Active, 10), strconv.FormatUint(s.Total, 10)
+			listen = s.Listen
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Name, r.Protocol(), r.Direction(), listen, r.Target, active, total)
+	}
+	tw.Flush()
+}
+
+func init() {
+	rootCmd.AddCommand(forwardCmd)
+	forwardCmd.AddCommand(forwardListCmd, forwardAddCmd, forwardRemoveCmd)
+	forwardCmd.PersistentFlags().StringVar(&configPath, "config", "config.yaml", "Path to config file")
+	forwardAddCmd.Flags().BoolVar(&forwardUDP, "udp", false, "Forward UDP instead of TCP")
+	forwardAddCmd.Flags().BoolVar(&forwardRemote, "remote", false, "Listen on the mesh address and connect to a target reachable from this host")
+}
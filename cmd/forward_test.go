@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/pabotesu/kurohabaki-client/internal/agent"
+)
+
+func TestPrintForwards(t *testing.T) {
+	forwards := []config.Forward{
+		{Name: "db", Listen: "127.0.0.1:5432", Target: "db.kh.internal:5432"},
+		{Name: "syslog", Protocol: "udp", Direction: "remote", Listen: ":514", Target: "127.0.0.1:514"},
+		{Name: "broken", Protocol: "sctp", Listen: ":1", Target: "a:1"},
+	}
+	st := &agent.Status{Forwards: []agent.ForwardStatus{
+		{Name: "syslog", Listen: "10.0.0.2:514", Active: 1, Total: 4},
+	}}
+
+	buf := new(bytes.Buffer)
+	printForwards(buf, forwards, st)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected a header and 3 rows, got:\n%s", buf)
+	}
+	for i, want := range []string{
+		"db tcp local 127.0.0.1:5432 db.kh.internal:5432 - -",
+		"syslog udp remote 10.0.0.2:514 127.0.0.1:514 1 4",
+	} {
+		if got := strings.Join(strings.Fields(lines[i+1]), " "); got != want {
+			t.Errorf("Row %d: expected %q, got %q", i, want, got)
+		}
+	}
+	if !strings.Contains(lines[3], "invalid: forward broken: protocol must be tcp or udp") {
+		t.Errorf("Expected the invalid rule to be flagged, got %q", lines[3])
+	}
+}
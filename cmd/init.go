@@ -0,0 +1,267 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// initOptions are the answers of the init wizard, given as flags or asked
+// for on the terminal.
+type initOptions struct {
+	privateKey     string
+	privateKeyFile string
+	address        string
+	dns            string
+	routes         string
+	serverKey      string
+	serverEndpoint string
+	serverIPs      string
+	keepalive      string
+	etcd           string
+	force          bool
+}
+
+var initOpts initOptions
+
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Create a config file",
+	Long: `Build a config file for this node from flags, asking on the terminal for
+whatever they leave out. A private key is generated unless one is given, and
+is kept in the config or, with --private-key-file, in a separate key file.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if _, err := os.Stat(configPath); err == nil && !initOpts.force {
+			return fmt.Errorf("config file %s already exists, use --force to overwrite it", configPath)
+		}
+
+		interactive := term.IsTerminal(int(os.Stdin.Fd()))
+		cfg, err := buildInitConfig(&initOpts, cmd.Flags().Changed, cmd.InOrStdin(), cmd.ErrOrStderr(), interactive)
+		if err != nil {
+			return err
+		}
+
+		key, err := wgtypes.ParseKey(cfg.Interface.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("failed to parse private key: %w", err)
+		}
+		if path := initOpts.privateKeyFile; path != "" {
+			if _, err := os.Stat(path); err == nil && !initOpts.force {
+				return fmt.Errorf("key file %s already exists, use --force to overwrite it", path)
+			}
+			if err := config.WriteKeyFile(path, cfg.Interface.PrivateKey); err != nil {
+				return fmt.Errorf("failed to write key file: %w", err)
+			}
+			cfg.Interface.PrivateKey = ""
+			cfg.Interface.PrivateKeyFile = path
+		}
+
+		if err := config.Write(configPath, cfg); err != nil {
+			return fmt.Errorf("failed to write config: %w", err)
+		}
+		out := cmd.OutOrStdout()
+		fmt.Fprintf(out, "Public key: %s\n", key.PublicKey().String())
+		fmt.Fprintf(out, "Config written to %s\n", configPath)
+		return nil
+	},
+}
+
+// initField is one answer of the init wizard.
+type initField struct {
+	flag     string
+	prompt   string
+	value    *string
+	optional bool
+	validate func(string) error
+}
+
+// buildInitConfig fills in the options not given as flags, asking on in
+// when interactive, validates them and builds the config.
+func buildInitConfig(opts *initOptions, given func(flag string) bool, in io.Reader, out io.Writer, interactive bool) (*config.Config, error) {
+	fields := []initField{
+		{"private-key-file", "Private key file (empty to keep the key in the config)", &opts.privateKeyFile, true, nil},
+		{"address", "Interface address (CIDR, e.g. 10.0.0.2/24)", &opts.address, false, validatePrefix},
+		{"dns", "DNS servers while up (comma-separated, empty for none)", &opts.dns, true, validateIPList},
+		{"routes", "Routes through the mesh (comma-separated CIDRs)", &opts.routes, true, validatePrefixList},
+		{"server-public-key", "Server public key", &opts.serverKey, false, validateKey},
+		{"server-endpoint", "Server endpoint (host:port)", &opts.serverEndpoint, false, validateHostPort},
+		{"server-allowed-ips", "Server allowed IPs (CIDR)", &opts.serverIPs, false, validatePrefix},
+		{"keepalive", "Persistent keepalive in seconds", &opts.keepalive, false, validateKeepalive},
+		{"etcd", "etcd endpoint (host:port)", &opts.etcd, false, validateEtcdEndpoint},
+	}
+
+	scanner := bufio.NewScanner(in)
+	for _, f := range fields {
+		if given(f.flag) || !interactive {
+			if *f.value == "" && !f.optional {
+				return nil, fmt.Errorf("--%s is required", f.flag)
+			}
+			if *f.value != "" && f.validate != nil {
+				if err := f.validate(*f.value); err != nil {
+					return nil, fmt.Errorf("invalid --%s: %w", f.flag, err)
+				}
+			}
+			continue
+		}
+		for {
+			if *f.value != "" {
+				fmt.Fprintf(out, "%s [%s]: ", f.prompt, *f.value)
+			} else {
+				fmt.Fprintf(out, "%s: ", f.prompt)
+			}
+			if !scanner.Scan() {
+				return nil, fmt.Errorf("no answer for %s", f.flag)
+			}
+			if answer := strings.TrimSpace(scanner.Text()); answer != "" {
+				*f.value = answer
+			}
+			if *f.value == "" {
+				if f.optional {
+					break
+				}
+				fmt.Fprintln(out, "  a value is required")
+				continue
+			}
+			if f.validate != nil {
+				if err := f.validate(*f.value); err != nil {
+					fmt.Fprintf(out, "  %v\n", err)
+					continue
+				}
+			}
+			break
+		}
+	}
+
+	if opts.privateKey == "" {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate private key: %w", err)
+		}
+		opts.privateKey = key.String()
+	} else if err := validateKey(opts.privateKey); err != nil {
+		return nil, fmt.Errorf("invalid --private-key: %w", err)
+	}
+
+	keepalive, _ := strconv.Atoi(opts.keepalive)
+	cfg := &config.Config{
+		Interface: config.InterfaceConfig{
+			PrivateKey: opts.privateKey,
+			Address:    opts.address,
+			DNS:        strings.Join(splitList(opts.dns), ","),
+			Routes:     splitList(opts.routes),
+		},
+		ServerConfig: config.ServerPeer{
+			PublicKey:           opts.serverKey,
+			Endpoint:            opts.serverEndpoint,
+			AllowedIPs:          opts.serverIPs,
+			PersistentKeepalive: keepalive,
+		},
+	}
+	cfg.Etcd.Endpoint = opts.etcd
+	return cfg, nil
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func validateKey(s string) error {
+	_, err := wgtypes.ParseKey(s)
+	return err
+}
+
+func validatePrefix(s string) error {
+	_, err := netip.ParsePrefix(s)
+	return err
+}
+
+func validatePrefixList(s string) error {
+	for _, item := range splitList(s) {
+		if err := validatePrefix(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateIPList(s string) error {
+	for _, item := range splitList(s) {
+		if _, err := netip.ParseAddr(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateHostPort(s string) error {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("missing host in %q", s)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+func validateKeepalive(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("must be a number of seconds between 0 and 65535")
+	}
+	return nil
+}
+
+// validateEtcdEndpoint accepts a host:port endpoint, or a URL of one.
+func validateEtcdEndpoint(s string) error {
+	if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("unsupported scheme in %q", s)
+		}
+		s = u.Host
+	}
+	return validateHostPort(s)
+}
+
+func init() {
+	rootCmd.AddCommand(initCmd)
+	f := initCmd.Flags()
+	f.StringVar(&configPath, "config", "config.yaml", "Path of the config file to write")
+	f.StringVar(&initOpts.privateKey, "private-key", "", "Private key to use instead of generating one")
+	f.StringVar(&initOpts.privateKeyFile, "private-key-file", "", "Store the private key in this file instead of the config")
+	f.StringVar(&initOpts.address, "address", "", "Interface address in CIDR notation")
+	f.StringVar(&initOpts.dns, "dns", "", "Comma-separated DNS servers used while up")
+	f.StringVar(&initOpts.routes, "routes", "", "Comma-separated CIDRs routed through the mesh")
+	f.StringVar(&initOpts.serverKey, "server-public-key", "", "Public key of the server peer")
+	f.StringVar(&initOpts.serverEndpoint, "server-endpoint", "", "Endpoint of the server peer (host:port)")
+	f.StringVar(&initOpts.serverIPs, "server-allowed-ips", "", "Allowed IPs of the server peer (CIDR)")
+	f.StringVar(&initOpts.keepalive, "keepalive", "25", "Persistent keepalive with the server peer in seconds")
+	f.StringVar(&initOpts.etcd, "etcd", "", "Endpoint of the etcd server (host:port)")
+	f.BoolVar(&initOpts.force, "force", false, "Overwrite existing files")
+}
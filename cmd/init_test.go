@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const testServerKey = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+
+func TestBuildInitConfigInteractive(t *testing.T) {
+	opts := initOptions{keepalive: "25"}
+	answers := strings.Join([]string{
+		"",                  // key stays in the config
+		"10.0.0.2",          // not a CIDR, asked again
+		"10.0.0.2/24",       // address
+		"",                  // no DNS
+		"10.0.0.0/24",       // routes
+		testServerKey,       // server key
+		"vpn.example:51820", // server endpoint
+		"10.0.0.1/32",       // server allowed IPs
+		"",                  // default keepalive
+		"https://etcd1:2379",
+	}, "\n") + "\n"
+	out := new(bytes.Buffer)
+
+	never := func(string) bool { return false }
+	cfg, err := buildInitConfig(&opts, never, strings.NewReader(answers), out, true)
+	if err != nil {
+		t.Fatalf("buildInitConfig failed: %v\n%s", err, out)
+	}
+
+	if _, err := wgtypes.ParseKey(cfg.Interface.PrivateKey); err != nil {
+		t.Errorf("Expected a generated private key, got %q", cfg.Interface.PrivateKey)
+	}
+	if cfg.Interface.Address != "10.0.0.2/24" || cfg.ServerConfig.Endpoint != "vpn.example:51820" {
+		t.Errorf("Unexpected config: %+v", cfg)
+	}
+	if cfg.ServerConfig.PersistentKeepalive != 25 {
+		t.Errorf("Expected the default keepalive, got %d", cfg.ServerConfig.PersistentKeepalive)
+	}
+	if cfg.Etcd.Endpoint != "https://etcd1:2379" {
+		t.Errorf("Unexpected etcd endpoint %q", cfg.Etcd.Endpoint)
+	}
+	if strings.Count(out.String(), "Interface address") != 2 {
+		t.Errorf("Expected the invalid address to be asked for again, got:\n%s", out)
+	}
+}
+
+func TestBuildInitConfigFlags(t *testing.T) {
+	opts := initOptions{
+		address:        "10.0.0.2/24",
+		serverKey:      testServerKey,
+		serverEndpoint: "192.168.1.1:51820",
+		serverIPs:      "10.0.0.1/32",
+		keepalive:      "25",
+		etcd:           "192.168.1.100:2379",
+	}
+	given := func(string) bool { return true }
+	if _, err := buildInitConfig(&opts, given, strings.NewReader(""), new(bytes.Buffer), false); err != nil {
+		t.Fatalf("buildInitConfig failed: %v", err)
+	}
+
+	for name, mutate := range map[string]func(o *initOptions){
+		"missing address": func(o *initOptions) { o.address = "" },
+		"bad server key":  func(o *initOptions) { o.serverKey = "not-a-key" },
+		"bad endpoint":    func(o *initOptions) { o.serverEndpoint = "192.168.1.1" },
+		"bad etcd":        func(o *initOptions) { o.etcd = "ftp://etcd:2379" },
+		"bad keepalive":   func(o *initOptions) { o.keepalive = "-1" },
+		"bad route":       func(o *initOptions) { o.routes = "10.0.0.0/24,nope" },
+	} {
+		t.Run(name, func(t *testing.T) {
+			o := opts
+			mutate(&o)
+			if _, err := buildInitConfig(&o, given, strings.NewReader(""), new(bytes.Buffer), false); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+func TestReadKey(t *testing.T) {
+	key, err := readKey(strings.NewReader(testServerKey + "\n"))
+	if err != nil || key != testServerKey {
+		t.Errorf("Expected %q, got %q, %v", testServerKey, key, err)
+	}
+	if _, err := readKey(strings.NewReader("")); err == nil {
+		t.Error("Expected an error for empty input")
+	}
+}
@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/spf13/cobra"
+)
+
+// defaultUnitPath is where install writes the unit unless told otherwise
+const defaultUnitPath = "/etc/systemd/system/kurohabaki.service"
+
+var installOutput string // Unit file to write, - for stdout
+
+var installCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Install a systemd unit that runs the agent",
+	Long: `Write a hardened systemd unit that runs "up --foreground" with the given
+config file. The agent notifies systemd once it is connected to the mesh,
+keeps its watchdog fed and logs to the journal. Only the paths the config
+makes the agent change are writable. Overrides given with --set are passed on
+to the agent, KH_* environment variables are not. Keys and secrets can't be
+given with --set, as every user can read the unit.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := filepath.Abs(configPath)
+		if err != nil {
+			return fmt.Errorf("failed to resolve config path: %w", err)
+		}
+		if err := checkUnitOverrides(configSets); err != nil {
+			return err
+		}
+		cfg, err := config.Load(path, configSets...)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		exe, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("failed to find the executable: %w", err)
+		}
+		if exe, err = filepath.EvalSymlinks(exe); err != nil {
+			return fmt.Errorf("failed to find the executable: %w", err)
+		}
+
+		unit := serviceUnit(exe, cfg)
+		if installOutput == "-" {
+			_, err := fmt.Fprint(cmd.OutOrStdout(), unit)
+			return err
+		}
+		if err := os.WriteFile(installOutput, []byte(unit), 0644); err != nil {
+			return fmt.Errorf("failed to write unit file: %w", err)
+		}
+		name := filepath.Base(installOutput)
+		fmt.Fprintf(cmd.OutOrStdout(), "Wrote %s\nStart it with: systemctl daemon-reload && systemctl enable --now %s\n", installOutput, name)
+		return nil
+	},
+}
+
+// checkUnitOverrides refuses --set overrides of keys and secrets, which
+// would be readable by every user in the unit file and systemctl show.
+func checkUnitOverrides(sets []string) error {
+	for _, set := range sets {
+		key, _, _ := strings.Cut(set, "=")
+		if config.IsSecret(key) {
+			return fmt.Errorf("--set %s would put a secret in the unit, which every user can read; set it in the config file instead", key)
+		}
+	}
+	return nil
+}
+
+// serviceUnit renders the unit running exe with the config cfg, which must
+// have been loaded from an absolute path. Its --set overrides are kept.
+func serviceUnit(exe string, cfg *config.Config) string {
+	var b strings.Builder
+	line := func(format string, args ...any) {
+		fmt.Fprintf(&b, format+"\n", args...)
+	}
+
+	line("[Unit]")
+	line("Description=Kurohabaki WireGuard mesh client")
+	line("Wants=network-online.target")
+	line("After=network-online.target")
+	line("")
+	line("[Service]")
+	line("Type=notify")
+	line("NotifyAccess=main")
+	start := fmt.Sprintf("%s up --foreground --config %s", unitQuote(exe), unitQuote(cfg.Path))
+	for _, set := range cfg.Overrides() {
+		start += " --set " + unitQuote(set)
+	}
+	line("ExecStart=%s", start)
+	line("Restart=on-failure")
+	line("RestartSec=5s")
+	line("TimeoutStartSec=2min")
+	line("WatchdogSec=1min")
+	line("")
+	line("# The agent runs as root, but only with the capabilities it needs to")
+	line("# manage the interface, its routes and firewall, and to serve DNS")
+	line("CapabilityBoundingSet=CAP_NET_ADMIN CAP_NET_BIND_SERVICE")
+	line("NoNewPrivileges=yes")
+	line("DevicePolicy=closed")
+	line("DeviceAllow=/dev/net/tun rw")
+	line("RestrictAddressFamilies=AF_UNIX AF_INET AF_INET6 AF_NETLINK")
+	line("ProtectSystem=strict")
+	if strings.HasPrefix(cfg.Path, "/home/") || strings.HasPrefix(cfg.Path, "/root/") {
+		line("ProtectHome=read-only")
+	} else {
+		line("ProtectHome=yes")
+	}
+	line("ReadWritePaths=%s", strings.Join(unitWritablePaths(cfg), " "))
+	line("StateDirectory=kurohabaki")
+	line("PrivateTmp=yes")
+	line("ProtectClock=yes")
+	line("ProtectHostname=yes")
+	line("ProtectKernelLogs=yes")
+	line("ProtectKernelModules=yes")
+	line("ProtectKernelTunables=yes")
+	line("ProtectControlGroups=yes")
+	line("RestrictNamespaces=yes")
+	line("RestrictRealtime=yes")
+	line("RestrictSUIDSGID=yes")
+	line("LockPersonality=yes")
+	line("MemoryDenyWriteExecute=yes")
+	line("SystemCallArchitectures=native")
+	line("")
+	line("[Install]")
+	line("WantedBy=multi-user.target")
+	return b.String()
+}
+
+// unitWritablePaths lists what the agent writes: its PID and status files,
+// and the hosts file and resolv.conf if the config has it manage them. A
+// leading - makes systemd ignore paths that don't exist.
+func unitWritablePaths(cfg *config.Config) []string {
+	paths := []string{"/run"}
+	if cfg.Log.File != "" {
+		paths = append(paths, "-"+filepath.Dir(cfg.Log.File))
+	}
+	// Both are replaced by renaming a file written next to them
+	if cfg.HostsFile.Enabled || (cfg.Interface.DNS != "" && cfg.Interface.DNSMode != "off" && cfg.Interface.DNSMode != "resolved") {
+		paths = append(paths, "/etc")
+	}
+	return paths
+}
+
+// unitQuote quotes a command line argument of a unit file if needed, and
+// escapes the specifiers systemd would expand.
+func unitQuote(s string) string {
+	s = strings.NewReplacer("%", "%%", "$", "$$").Replace(s)
+	if !strings.ContainsAny(s, " \t\"'\\") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func init() {
+	rootCmd.AddCommand(installCmd)
+	installCmd.Flags().StringVar(&configPath, "config", "config.yaml", "Path to config file")
+	installCmd.Flags().StringVarP(&installOutput, "output", "o", defaultUnitPath, "Unit file to write, - for stdout")
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/pabotesu/kurohabaki-client/internal/agent"
+)
+
+func TestServiceUnit(t *testing.T) {
+	cfg := &config.Config{Path: "/etc/kurohabaki/my config.yaml"}
+	cfg.HostsFile.Enabled = true
+
+	unit := serviceUnit("/usr/local/bin/kurohabaki", cfg)
+	for _, want := range []string{
+		"Type=notify",
+		`ExecStart=/usr/local/bin/kurohabaki up --foreground --config "/etc/kurohabaki/my config.yaml"`,
+		"WatchdogSec=",
+		"CapabilityBoundingSet=CAP_NET_ADMIN CAP_NET_BIND_SERVICE",
+		"DeviceAllow=/dev/net/tun rw",
+		"ProtectSystem=strict",
+		"ProtectHome=yes",
+		"ReadWritePaths=/run /etc\n",
+	} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("Unit missing %q:\n%s", want, unit)
+		}
+	}
+
+	cfg = &config.Config{Path: "/home/me/kh.yaml"}
+	unit = serviceUnit("/usr/bin/kurohabaki", cfg)
+	for _, want := range []string{"ProtectHome=read-only", "ReadWritePaths=/run\n"} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("Unit missing %q:\n%s", want, unit)
+		}
+	}
+}
+
+func TestCheckUnitOverrides(t *testing.T) {
+	if err := checkUnitOverrides([]string{"log.level=debug", "interface.routes=10.1.0.0/16"}); err != nil {
+		t.Errorf("Expected plain overrides to be kept, got %v", err)
+	}
+	for _, set := range []string{"interface.private_key=yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=", "psk.secret=hunter2"} {
+		if err := checkUnitOverrides([]string{"log.level=debug", set}); err == nil {
+			t.Errorf("Expected %s to be refused", set)
+		}
+	}
+}
+
+func TestUnitQuote(t *testing.T) {
+	for in, want := range map[string]string{
+		"/etc/kh.yaml":      "/etc/kh.yaml",
+		"/etc/100%.yaml":    "/etc/100%%.yaml",
+		`/etc/a "b".yaml`:   `"/etc/a \"b\".yaml"`,
+		"/etc/kh $HOME.yml": `"/etc/kh $$HOME.yml"`,
+	} {
+		if got := unitQuote(in); got != want {
+			t.Errorf("unitQuote(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestServiceStatus(t *testing.T) {
+	st := &agent.Status{Interface: "kh0", Peers: make([]agent.PeerStatus, 2)}
+	if got, want := serviceStatus(st), "Connected to 2 peer(s) on kh0"; got != want {
+		t.Errorf("serviceStatus = %q, want %q", got, want)
+	}
+}
+
+func TestAgentRunning(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "kh.pid")
+	if agentRunning(pidFile) {
+		t.Error("Expected no agent without a PID file")
+	}
+
+	os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())), 0644)
+	if !agentRunning(pidFile) {
+		t.Error("Expected the agent in the PID file to be running")
+	}
+
+	// A PID that can't be a live process
+	os.WriteFile(pidFile, []byte("2147483647\n"), 0644)
+	if agentRunning(pidFile) {
+		t.Error("Expected a stale PID file")
+	}
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Error("Expected the stale PID file to be removed")
+	}
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/pabotesu/kurohabaki-client/internal/enroll"
+	"github.com/pabotesu/kurohabaki-client/internal/etcd"
+	"github.com/spf13/cobra"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var joinForce bool // Overwrite an existing config file
+
+var joinCmd = &cobra.Command{
+	Use:   "join <token>",
+	Short: "Enroll this node using a join token",
+	Long: `Generate a key pair, claim an address with a join token created by an admin
+and write a complete config file for this node.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		token, err := enroll.ParseToken(args[0])
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(configPath); err == nil && !joinForce {
+			return fmt.Errorf("config file %s already exists, use --force to overwrite it", configPath)
+		}
+
+		privKey, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return fmt.Errorf("failed to generate private key: %w", err)
+		}
+		pubKey := privKey.PublicKey().String()
+
+		etcdCli, err := etcd.NewClient(token.Etcd)
+		if err != nil {
+			return fmt.Errorf("failed to connect to etcd: %w", err)
+		}
+		defer etcdCli.Close()
+
+		res, err := enroll.Join(etcdCli, token, pubKey)
+		if err != nil {
+			return err
+		}
+
+		cfg := &config.Config{
+			Interface: config.InterfaceConfig{
+				PrivateKey: privKey.String(),
+				Address:    res.Address,
+				DNS:        res.Grant.DNS,
+				Routes:     res.Grant.Routes,
+			},
+			ServerConfig: config.ServerPeer{
+				PublicKey:           res.Grant.Server.PublicKey,
+				Endpoint:            res.Grant.Server.Endpoint,
+				AllowedIPs:          res.Grant.Server.AllowedIPs,
+				PersistentKeepalive: res.Grant.Server.PersistentKeepalive,
+			},
+		}
+		cfg.Etcd.Endpoint = token.Etcd
+
+		if err := config.Write(configPath, cfg); err != nil {
+			if rerr := enroll.Release(etcdCli, pubKey, res); rerr != nil {
+				return fmt.Errorf("failed to write config: %w (releasing address %s also failed: %v)", err, res.Address, rerr)
+			}
+			return fmt.Errorf("failed to write config: %w", err)
+		}
+
+		out := cmd.OutOrStdout()
+		fmt.Fprintf(out, "Joined with public key %s\n", pubKey)
+		fmt.Fprintf(out, "Address: %s\n", res.Address)
+		fmt.Fprintf(out, "Config written to %s\n", configPath)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(joinCmd)
+	joinCmd.Flags().StringVar(&configPath, "config", "config.yaml", "Path of the config file to write")
+	joinCmd.Flags().BoolVar(&joinForce, "force", false, "Overwrite an existing config file")
+}
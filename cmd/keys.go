@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var (
+	genkeyOutput  string // Key file to write instead of printing the key
+	genkeyEncrypt bool   // Encrypt the key with a passphrase
+)
+
+var genkeyCmd = &cobra.Command{
+	Use:   "genkey",
+	Short: "Generate a private key",
+	Long: `Print a new private key, or write it to a key file readable only by its owner
+and print the public key.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return fmt.Errorf("failed to generate private key: %w", err)
+		}
+		stored := key.String()
+		if genkeyEncrypt {
+			pass, err := newPassphrase()
+			if err != nil {
+				return err
+			}
+			if stored, err = config.EncryptPrivateKey(stored, pass); err != nil {
+				return err
+			}
+		}
+
+		out := cmd.OutOrStdout()
+		if genkeyOutput == "" {
+			fmt.Fprintln(out, stored)
+			return nil
+		}
+		if _, err := os.Stat(genkeyOutput); err == nil {
+			return fmt.Errorf("key file %s already exists", genkeyOutput)
+		}
+		if err := config.WriteKeyFile(genkeyOutput, stored); err != nil {
+			return fmt.Errorf("failed to write key file: %w", err)
+		}
+		fmt.Fprintln(out, key.PublicKey().String())
+		return nil
+	},
+}
+
+var pubkeyCmd = &cobra.Command{
+	Use:   "pubkey",
+	Short: "Print the public key of a private key",
+	Long: `Print the public key of the private key read from stdin, like wg pubkey, or
+of this node's private key if stdin is a terminal or --config is given.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var iface config.InterfaceConfig
+		if !cmd.Flags().Changed("config") && !term.IsTerminal(int(os.Stdin.Fd())) {
+			key, err := readKey(cmd.InOrStdin())
+			if err != nil {
+				return err
+			}
+			iface.PrivateKey = key
+		} else {
+			cfg, err := config.Load(configPath, configSets...)
+			if err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
+			}
+			iface = cfg.Interface
+		}
+
+		if err := iface.ResolvePrivateKey(keyPassphrase()); err != nil {
+			return fmt.Errorf("failed to load private key: %w", err)
+		}
+		key, err := wgtypes.ParseKey(iface.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("failed to parse private key: %w", err)
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), key.PublicKey().String())
+		return nil
+	},
+}
+
+// readKey reads a key from the first line of r.
+func readKey(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read key: %w", err)
+	}
+	key := strings.TrimSpace(line)
+	if key == "" {
+		return "", fmt.Errorf("no key on stdin")
+	}
+	return key, nil
+}
+
+func init() {
+	rootCmd.AddCommand(genkeyCmd)
+	genkeyCmd.Flags().StringVarP(&genkeyOutput, "output", "o", "", "Write the key to this file instead of printing it")
+	genkeyCmd.Flags().BoolVar(&genkeyEncrypt, "encrypt", false, "Encrypt the key with a passphrase")
+
+	rootCmd.AddCommand(pubkeyCmd)
+	pubkeyCmd.Flags().StringVar(&configPath, "config", "config.yaml", "Path to config file")
+}
@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"golang.org/x/term"
+)
+
+const (
+	// keyPassphraseEnv holds the passphrase of an encrypted private key,
+	// e.g. for a service that can't be asked for it
+	keyPassphraseEnv = "KH_KEY_PASSPHRASE"
+	// keyPassphraseFDEnv is the file descriptor the background agent reads
+	// the passphrase from, written by the process that started it
+	keyPassphraseFDEnv = "KH_KEY_PASSPHRASE_FD"
+)
+
+// keyPassphrase returns a PassphraseFunc that gets the passphrase of the
+// private key once, from the process that started the agent, the
+// environment or the terminal, and remembers it.
+func keyPassphrase() config.PassphraseFunc {
+	return sync.OnceValues(func() ([]byte, error) {
+		if fd := os.Getenv(keyPassphraseFDEnv); fd != "" {
+			n, err := strconv.Atoi(fd)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", keyPassphraseFDEnv, err)
+			}
+			f := os.NewFile(uintptr(n), "passphrase")
+			defer f.Close()
+			return io.ReadAll(f)
+		}
+		if pass, ok := os.LookupEnv(keyPassphraseEnv); ok {
+			return []byte(pass), nil
+		}
+		return readPassphrase("Private key passphrase: ")
+	})
+}
+
+// readPassphrase asks for a passphrase on the terminal without echoing it.
+func readPassphrase(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("no terminal to ask for the passphrase, set %s", keyPassphraseEnv)
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	pass, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return pass, err
+}
+
+// newPassphrase asks for a new passphrase twice, unless it is set in the
+// environment.
+func newPassphrase() ([]byte, error) {
+	if pass, ok := os.LookupEnv(keyPassphraseEnv); ok {
+		return []byte(pass), nil
+	}
+	pass, err := readPassphrase("New passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	again, err := readPassphrase("Repeat passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(pass, again) {
+		return nil, fmt.Errorf("passphrases do not match")
+	}
+	if len(pass) == 0 {
+		return nil, fmt.Errorf("passphrase must not be empty")
+	}
+	return pass, nil
+}
+
+// passphrasePipe returns the read end of a pipe holding the passphrase, to
+// be inherited by the background agent.
+func passphrasePipe(passphrase config.PassphraseFunc) (*os.File, error) {
+	pass, err := passphrase()
+	if err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create passphrase pipe: %w", err)
+	}
+	defer w.Close()
+	if _, err := w.Write(pass); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("failed to write passphrase pipe: %w", err)
+	}
+	return r, nil
+}
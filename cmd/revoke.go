@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/pabotesu/kurohabaki-client/internal/etcd"
+	"github.com/spf13/cobra"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var revokeReason string // Reason recorded with the revocation
+
+var revokeCmd = &cobra.Command{
+	Use:   "revoke <public-key>",
+	Short: "Revoke a node's key and remove it from the mesh",
+	Long: `Add a public key to the revocation list in etcd and delete its node record.
+Every client removes the key from its device immediately and refuses to add it
+again, even if its node record reappears.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		pubKey, err := wgtypes.ParseKey(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid public key: %w", err)
+		}
+
+		cfg, err := config.Load(configPath, configSets...)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+
+		etcdCli, err := etcd.NewClient(cfg.Etcd.Endpoint)
+		if err != nil {
+			return fmt.Errorf("failed to connect to etcd: %w", err)
+		}
+		defer etcdCli.Close()
+
+		r := etcd.Revocation{
+			PublicKey: pubKey.String(),
+			Reason:    revokeReason,
+			RevokedAt: time.Now().UTC(),
+		}
+		if err := etcd.PutRevocation(etcdCli, r); err != nil {
+			return err
+		}
+		if err := etcd.DeleteNode(etcdCli, r.PublicKey); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(cmd.OutOrStdout(), "Revoked %s\n", r.PublicKey)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(revokeCmd)
+	revokeCmd.Flags().StringVar(&configPath, "config", "config.yaml", "Path to config file")
+	revokeCmd.Flags().StringVar(&revokeReason, "reason", "", "Reason for the revocation")
+}
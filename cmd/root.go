@@ -7,6 +7,8 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var configSets []string // Overrides of config values, key=value
+
 var rootCmd = &cobra.Command{
 	Use:   "kurohabaki",
 	Short: "Kurohabaki client CLI",
@@ -16,6 +18,7 @@ var rootCmd = &cobra.Command{
 func init() {
 	// vewrsion flag
 	rootCmd.Version = "0.1.0"
+	rootCmd.PersistentFlags().StringArrayVar(&configSets, "set", nil, "Override a config value, e.g. --set log.level=debug (repeatable)")
 }
 
 // Execute runs the root command
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/pabotesu/kurohabaki-client/internal/etcd"
+	"github.com/pabotesu/kurohabaki-client/internal/rotation"
+	"github.com/spf13/cobra"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// rotationRecordGrace is how long a rotation record is kept after the switch,
+// for peers that were offline during the overlap window
+const rotationRecordGrace = 24 * time.Hour
+
+var rotateOverlap time.Duration // How long peers accept both keys
+
+var rotateKeyCmd = &cobra.Command{
+	Use:   "rotate-key",
+	Short: "Rotate the node's private key without downtime",
+	Long: `Generate a new private key, publish it in etcd linked to the current key and
+store it in place of the current one, in the config file or the key file.
+Peers accept both keys during the overlap window, after which the running
+agent switches to the new key and retires the old record.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if rotateOverlap < 30*time.Second {
+			return fmt.Errorf("overlap must be at least 30s so that all peers pick up the new key")
+		}
+
+		cfg, err := config.Load(configPath, configSets...)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		switch source := cfg.Interface.KeySource(); source {
+		case "private_key_env", "private_key_command":
+			return fmt.Errorf("the private key is read from %s, which rotate-key can't update; use private_key or private_key_file", source)
+		}
+		if source := cfg.Source("interface.private_key"); source != "" && source != configPath {
+			return fmt.Errorf("the private key is set by %s, which rotate-key can't update; move it to %s or a private_key_file", source, configPath)
+		}
+		passphrase := keyPassphrase()
+		if err := cfg.Interface.ResolvePrivateKey(passphrase); err != nil {
+			return fmt.Errorf("failed to load private key: %w", err)
+		}
+		// The new key is stored encrypted like the old one
+		var storePassphrase []byte
+		if cfg.Interface.KeyEncrypted() {
+			if storePassphrase, err = passphrase(); err != nil {
+				return err
+			}
+		}
+		oldKey, err := wgtypes.ParseKey(cfg.Interface.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("failed to parse private key: %w", err)
+		}
+		newKey, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return fmt.Errorf("failed to generate private key: %w", err)
+		}
+		oldPub := oldKey.PublicKey().String()
+		newPub := newKey.PublicKey().String()
+
+		etcdCli, err := etcd.NewClient(cfg.Etcd.Endpoint)
+		if err != nil {
+			return fmt.Errorf("failed to connect to etcd: %w", err)
+		}
+		defer etcdCli.Close()
+
+		fields, err := etcd.FetchNode(etcdCli, oldPub)
+		if err != nil {
+			return err
+		}
+		if len(fields) == 0 {
+			return fmt.Errorf("no node record found for the current key %s", oldPub)
+		}
+
+		record, err := rotation.New(oldKey, newKey, time.Now().Add(rotateOverlap))
+		if err != nil {
+			return err
+		}
+
+		// Publish the new record before the link to it, so that peers
+		// never see a rotation to a node they can't find.
+		for field, value := range fields {
+			// Leased fields belong to the running agent, which
+			// republishes them under the new key after the switch
+			if field == "mlkem_ek" {
+				continue
+			}
+			if err := etcd.PutNodeField(etcdCli, newPub, field, value, 0); err != nil {
+				return err
+			}
+		}
+		ttl := int64((rotateOverlap + rotationRecordGrace) / time.Second)
+		if err := etcd.PutRotation(etcdCli, oldPub, record.Marshal(), ttl); err != nil {
+			etcd.DeleteNode(etcdCli, newPub)
+			return err
+		}
+
+		if err := config.StorePrivateKey(configPath, &cfg.Interface, newKey.String(), storePassphrase); err != nil {
+			// Roll back so that peers don't wait for a key nobody holds
+			etcd.DeleteRotation(etcdCli, oldPub)
+			etcd.DeleteNode(etcdCli, newPub)
+			return fmt.Errorf("failed to store new private key: %w", err)
+		}
+
+		out := cmd.OutOrStdout()
+		fmt.Fprintf(out, "Old public key: %s\n", oldPub)
+		fmt.Fprintf(out, "New public key: %s\n", newPub)
+		fmt.Fprintf(out, "The agent switches to the new key at %s\n", record.SwitchAt.Local().Format(time.RFC3339))
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rotateKeyCmd)
+	rotateKeyCmd.Flags().StringVar(&configPath, "config", "config.yaml", "Path to config file")
+	rotateKeyCmd.Flags().DurationVar(&rotateOverlap, "overlap", 5*time.Minute, "How long peers accept both the old and the new key")
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/pabotesu/kurohabaki-client/internal/etcd"
+	"github.com/spf13/cobra"
+)
+
+var (
+	servicesTags []string // Only list services carrying all of these tags
+	servicesJSON bool     // Print the list as JSON
+)
+
+// serviceEntry is a service instance on a mesh node
+type serviceEntry struct {
+	Name      string   `json:"name"`
+	Protocol  string   `json:"protocol"`
+	Port      int      `json:"port"`
+	Hostname  string   `json:"hostname,omitempty"`
+	Address   string   `json:"address"`
+	PublicKey string   `json:"public_key"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
+var servicesCmd = &cobra.Command{
+	Use:   "services",
+	Short: "List the services published by mesh nodes",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.Load(configPath, configSets...)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+
+		etcdCli, err := etcd.NewClient(cfg.Etcd.Endpoint)
+		if err != nil {
+			return fmt.Errorf("failed to connect to etcd: %w", err)
+		}
+		defer etcdCli.Close()
+
+		nodes, err := etcd.FetchPeers(etcdCli, "")
+		if err != nil {
+			return err
+		}
+
+		entries := collectServices(nodes, servicesTags)
+		if servicesJSON {
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetIndent("", "  ")
+			return enc.Encode(entries)
+		}
+		printServices(cmd.OutOrStdout(), entries)
+		return nil
+	},
+}
+
+// collectServices returns the services of all nodes that carry every tag
+// in tags, sorted by name and host.
+func collectServices(nodes []etcd.Node, tags []string) []serviceEntry {
+	entries := []serviceEntry{}
+	for _, n := range nodes {
+		for _, svc := range n.Services {
+			if !hasTags(svc.Tags, tags) {
+				continue
+			}
+			entries = append(entries, serviceEntry{
+				Name:      svc.Name,
+				Protocol:  svc.Proto(),
+				Port:      svc.Port,
+				Hostname:  n.Hostname,
+				Address:   n.IP,
+				PublicKey: n.PublicKey,
+				Tags:      svc.Tags,
+			})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].Hostname < entries[j].Hostname
+	})
+	return entries
+}
+
+func hasTags(have, want []string) bool {
+	for _, t := range want {
+		if !slices.Contains(have, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// printServices writes entries to w as a table
+func printServices(w io.Writer, entries []serviceEntry) {
+	if len(entries) == 0 {
+		fmt.Fprintln(w, "No services found")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVICE\tPROTO\tADDRESS\tHOST\tTAGS")
+	for _, e := range entries {
+		host := e.Hostname
+		if host == "" {
+			host = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s:%d\t%s\t%s\n", e.Name, e.Protocol, e.Address, e.Port, host, strings.Join(e.Tags, ","))
+	}
+	tw.Flush()
+}
+
+func init() {
+	rootCmd.AddCommand(servicesCmd)
+	servicesCmd.Flags().StringVar(&configPath, "config", "config.yaml", "Path to config file")
+	servicesCmd.Flags().StringSliceVar(&servicesTags, "tag", nil, "Only list services with this tag (repeatable)")
+	servicesCmd.Flags().BoolVar(&servicesJSON, "json", false, "Print the services as JSON")
+}
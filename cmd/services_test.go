@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/pabotesu/kurohabaki-client/internal/etcd"
+)
+
+func TestCollectServices(t *testing.T) {
+	nodes := []etcd.Node{
+		{
+			PublicKey: "key-b",
+			IP:        "10.0.0.3",
+			Hostname:  "node-b",
+			Services: []config.Service{
+				{Name: "web", Port: 443, Tags: []string{"prod"}},
+				{Name: "syslog", Port: 514, Protocol: "udp"},
+			},
+		},
+		{
+			PublicKey: "key-a",
+			IP:        "10.0.0.2",
+			Hostname:  "node-a",
+			Services:  []config.Service{{Name: "web", Port: 8443, Tags: []string{"prod", "eu"}}},
+		},
+	}
+
+	entries := collectServices(nodes, nil)
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 services, got %d", len(entries))
+	}
+	if entries[0].Name != "syslog" || entries[0].Protocol != "udp" {
+		t.Errorf("Expected syslog/udp first, got %+v", entries[0])
+	}
+	if entries[1].Hostname != "node-a" || entries[2].Hostname != "node-b" {
+		t.Errorf("Expected web instances sorted by host, got %+v", entries[1:])
+	}
+
+	entries = collectServices(nodes, []string{"prod", "eu"})
+	if len(entries) != 1 || entries[0].Port != 8443 {
+		t.Errorf("Expected only the eu web instance, got %+v", entries)
+	}
+
+	buf := new(bytes.Buffer)
+	printServices(buf, collectServices(nodes, []string{"prod"}))
+	for _, want := range []string{"SERVICE", "web", "10.0.0.2:8443", "node-b", "prod,eu"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, buf.String())
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/internal/agent"
+	"github.com/pabotesu/kurohabaki-client/internal/util"
+	"github.com/spf13/cobra"
+)
+
+var statusJSON bool // Print the raw status instead of the summary
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the state of the running agent",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		st, err := agent.ReadStatus(util.GetStatusFilePath())
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no running agent found: status file does not exist")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read status: %w", err)
+		}
+
+		if statusJSON {
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetIndent("", "  ")
+			return enc.Encode(st)
+		}
+		printStatus(cmd.OutOrStdout(), st, time.Now())
+		return nil
+	},
+}
+
+// printStatus writes a human readable summary of st to w
+func printStatus(w io.Writer, st *agent.Status, now time.Time) {
+	fmt.Fprintf(w, "Interface:  %s\n", st.Interface)
+	fmt.Fprintf(w, "Public key: %s\n", st.PublicKey)
+	fmt.Fprintf(w, "PID:        %d\n", st.PID)
+	fmt.Fprintf(w, "Updated:    %s ago\n", now.Sub(st.UpdatedAt).Round(time.Second))
+	if len(st.Proxies) > 0 {
+		fmt.Fprintf(w, "Proxies:    %s\n", strings.Join(st.Proxies, ", "))
+	}
+	if st.Revoked {
+		fmt.Fprintln(w, "WARNING:    this node's key has been revoked")
+	}
+	if r := st.KeyRotation; r != nil {
+		fmt.Fprintf(w, "Rotating to %s at %s\n", r.NewPublicKey, r.SwitchAt.Local().Format(time.RFC3339))
+	}
+	if acl := st.ACL; acl != nil {
+		fmt.Fprintf(w, "ACL:        version %d, %d rule(s), %d node(s) denied\n", acl.Version, acl.Rules, len(acl.Denied))
+		if acl.Error != "" {
+			fmt.Fprintf(w, "WARNING:    rejected ACL policy at revision %d: %s\n", acl.Revision, acl.Error)
+		}
+	}
+
+	if f := st.Filter; f != nil {
+		if f.Table != "" {
+			fmt.Fprintf(w, "Firewall:   nftables table inet %s\n", f.Table)
+		} else {
+			fmt.Fprintf(w, "Filter:     %d tracked flow(s)\n", f.Connections)
+		}
+		names := make([]string, 0, len(f.Drops))
+		for name := range f.Drops {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "  dropped by %s: %d\n", name, f.Drops[name])
+		}
+	}
+
+	if len(st.Forwards) > 0 {
+		fmt.Fprintf(w, "Forwards:   %d\n", len(st.Forwards))
+		for _, f := range st.Forwards {
+			fmt.Fprintf(w, "  %s: %s %s %s -> %s, %d active, %d total\n", f.Name, f.Direction, f.Protocol, f.Listen, f.Target, f.Active, f.Total)
+		}
+	}
+
+	fmt.Fprintf(w, "\nPeers (%d):\n", len(st.Peers))
+	for _, p := range st.Peers {
+		fmt.Fprintf(w, "  %s\n", p.PublicKey)
+		if p.Hostname != "" {
+			fmt.Fprintf(w, "    hostname:      %s\n", p.Hostname)
+		}
+		if p.Endpoint != "" {
+			fmt.Fprintf(w, "    endpoint:      %s\n", p.Endpoint)
+		}
+		if len(p.AllowedIPs) > 0 {
+			fmt.Fprintf(w, "    allowed ips:   %s\n", strings.Join(p.AllowedIPs, ", "))
+		}
+		fmt.Fprintf(w, "    preshared key: %s\n", p.PresharedKey)
+		if a := p.Access; a != nil {
+			fmt.Fprintf(w, "    inbound:       %s\n", portList(a.Inbound))
+			fmt.Fprintf(w, "    outbound:      %s\n", portList(a.Outbound))
+		}
+		if pq := p.PQ; pq != nil {
+			fmt.Fprintf(w, "    pq exchange:   %s, %s, %d rotation(s)", pq.Role, pq.State, pq.Rotations)
+			if !pq.LastRotation.IsZero() {
+				fmt.Fprintf(w, ", last %s ago", now.Sub(pq.LastRotation).Round(time.Second))
+			}
+			fmt.Fprintln(w)
+		}
+	}
+
+	if len(st.Revocations) > 0 {
+		fmt.Fprintf(w, "\nRevoked keys (%d):\n", len(st.Revocations))
+		for _, r := range st.Revocations {
+			fmt.Fprintf(w, "  %s", r.PublicKey)
+			if !r.RevokedAt.IsZero() {
+				fmt.Fprintf(w, " (%s)", r.RevokedAt.Local().Format(time.RFC3339))
+			}
+			if r.Reason != "" {
+				fmt.Fprintf(w, ": %s", r.Reason)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// portList formats allowed ports for printing
+func portList(ports []string) string {
+	if len(ports) == 0 {
+		return "none"
+	}
+	return strings.Join(ports, ", ")
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+	statusCmd.Flags().BoolVar(&statusJSON, "json", false, "Print the status as JSON")
+}
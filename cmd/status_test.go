@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/internal/agent"
+	"github.com/pabotesu/kurohabaki-client/internal/pqpsk"
+)
+
+func TestStatusCommandRegistration(t *testing.T) {
+	found := false
+	for _, cmd := range rootCmd.Commands() {
+		if cmd.Use == "status" {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Error("status command not registered to rootCmd")
+	}
+}
+
+func TestPrintStatus(t *testing.T) {
+	now := time.Now()
+	st := &agent.Status{
+		PID:       42,
+		Interface: "kh0",
+		PublicKey: "self-key",
+		UpdatedAt: now.Add(-3 * time.Second),
+		Peers: []agent.PeerStatus{
+			{
+				PublicKey:    "peer-key",
+				Endpoint:     "192.168.1.2:51820",
+				AllowedIPs:   []string{"10.0.0.3/32"},
+				PresharedKey: "pq",
+				Access:       &agent.PeerAccessStatus{Outbound: []string{"tcp:5432"}},
+				PQ: &pqpsk.PeerState{
+					Role:         "initiator",
+					State:        "established",
+					Rotations:    2,
+					LastRotation: now.Add(-time.Minute),
+				},
+			},
+		},
+		Proxies: []string{"socks5://127.0.0.1:1080"},
+		Forwards: []agent.ForwardStatus{
+			{Name: "db", Protocol: "tcp", Direction: "local", Listen: "127.0.0.1:5432", Target: "db:5432", Active: 2, Total: 7},
+		},
+		Filter: &agent.FilterStatus{Connections: 5, Drops: map[string]uint64{"acl-in": 3}},
+		ACL:    &agent.ACLStatus{Version: 3, Rules: 2, Denied: []string{"denied-key"}},
+		Revocations: []agent.RevocationStatus{
+			{PublicKey: "revoked-key", Reason: "laptop stolen"},
+		},
+	}
+
+	buf := new(bytes.Buffer)
+	printStatus(buf, st, now)
+	output := buf.String()
+
+	for _, want := range []string{"kh0", "peer-key", "10.0.0.3/32", "preshared key: pq", "initiator, established, 2 rotation(s), last 1m0s ago", "revoked-key: laptop stolen", "version 3, 2 rule(s), 1 node(s) denied", "inbound:       none", "outbound:      tcp:5432", "5 tracked flow(s)", "dropped by acl-in: 3", "Proxies:    socks5://127.0.0.1:1080", "db: local tcp 127.0.0.1:5432 -> db:5432, 2 active, 7 total"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, output)
+		}
+	}
+}
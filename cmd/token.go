@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/internal/enroll"
+	"github.com/pabotesu/kurohabaki-client/internal/etcd"
+	"github.com/spf13/cobra"
+)
+
+var (
+	tokenEtcd   string
+	tokenTTL    time.Duration
+	tokenUses   int
+	tokenGrant  enroll.Grant
+	tokenServer enroll.ServerPeer
+)
+
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Manage join tokens",
+}
+
+var tokenCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create a join token in etcd and print it",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		token, err := enroll.NewToken(tokenEtcd)
+		if err != nil {
+			return err
+		}
+
+		grant := tokenGrant
+		grant.Server = tokenServer
+		grant.MaxUses = tokenUses
+		if tokenTTL > 0 {
+			grant.ExpiresAt = time.Now().Add(tokenTTL).UTC()
+		}
+
+		etcdCli, err := etcd.NewClient(tokenEtcd)
+		if err != nil {
+			return fmt.Errorf("failed to connect to etcd: %w", err)
+		}
+		defer etcdCli.Close()
+
+		if err := enroll.CreateGrant(etcdCli, token, &grant); err != nil {
+			return err
+		}
+
+		fmt.Fprintln(cmd.OutOrStdout(), token.String())
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(tokenCmd)
+	tokenCmd.AddCommand(tokenCreateCmd)
+
+	f := tokenCreateCmd.Flags()
+	f.StringVar(&tokenEtcd, "etcd", "", "etcd endpoint the joining node connects to")
+	f.DurationVar(&tokenTTL, "ttl", 24*time.Hour, "How long the token stays valid (0 for no expiry)")
+	f.IntVar(&tokenUses, "uses", 1, "How many nodes can join with the token")
+	f.StringVar(&tokenGrant.AddressPool, "pool", "", "CIDR to allocate node addresses from")
+	f.StringSliceVar(&tokenGrant.Routes, "route", nil, "Route to add on joining nodes (repeatable)")
+	f.StringVar(&tokenGrant.DNS, "dns", "", "DNS server for joining nodes")
+	f.StringVar(&tokenServer.PublicKey, "server-public-key", "", "Public key of the server peer")
+	f.StringVar(&tokenServer.Endpoint, "server-endpoint", "", "Endpoint of the server peer")
+	f.StringVar(&tokenServer.AllowedIPs, "server-allowed-ips", "", "Allowed IPs of the server peer")
+	f.IntVar(&tokenServer.PersistentKeepalive, "server-keepalive", 5, "Persistent keepalive for the server peer")
+	for _, name := range []string{"etcd", "pool", "server-public-key", "server-endpoint", "server-allowed-ips"} {
+		tokenCreateCmd.MarkFlagRequired(name)
+	}
+}
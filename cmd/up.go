@@ -3,55 +3,123 @@ package cmd
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"net/netip"
 	"os"
 	"os/exec"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/pabotesu/kurohabaki-client/config"
 	"github.com/pabotesu/kurohabaki-client/internal/agent"
 	"github.com/pabotesu/kurohabaki-client/internal/etcd"
+	"github.com/pabotesu/kurohabaki-client/internal/filter"
 	"github.com/pabotesu/kurohabaki-client/internal/logger"
+	"github.com/pabotesu/kurohabaki-client/internal/metrics"
+	"github.com/pabotesu/kurohabaki-client/internal/nft"
+	"github.com/pabotesu/kurohabaki-client/internal/resolver"
+	"github.com/pabotesu/kurohabaki-client/internal/sandbox"
+	"github.com/pabotesu/kurohabaki-client/internal/systemd"
 	"github.com/pabotesu/kurohabaki-client/internal/util"
 	"github.com/pabotesu/kurohabaki-client/internal/wg"
 	"github.com/spf13/cobra"
-	clientv3 "go.etcd.io/etcd/client/v3"
-	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/tun"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 var (
 	configPath string
 	debugMode  bool // Debug flag specific to up command
+	foreground bool // Run as a service without forking, e.g. under systemd
 )
 
 var upCmd = &cobra.Command{
 	Use:   "up",
 	Short: "Start WireGuard interface and connect to peers",
-	PreRun: func(cmd *cobra.Command, args []string) {
-		// Initialize logger with debug mode setting
-		logger.Init(debugMode)
-	},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		// Check if agent is already running
 		pidFile := util.GetPidFilePath()
-		if _, err := os.Stat(pidFile); err == nil {
+		if agentRunning(pidFile) {
 			return fmt.Errorf("agent is already running. Use 'down' command to stop it first")
 		}
 
-		logger.Println("Bringing up WireGuard interface...")
+		// The same checks as config validate, reporting every problem
+		cfg, err := config.ValidateFile(configPath, configSets...)
+		if err != nil {
+			return fmt.Errorf("invalid config: %w", err)
+		}
+		if err := initLogger(cfg); err != nil {
+			return err
+		}
+		defer logger.Close()
+		for _, c := range cfg.Migrations() {
+			logger.Warnf("%s: %s, run 'config migrate' to update the file", location(c.File, c.Line), c.Message)
+		}
 
-		cfg, err := config.Load(configPath)
+		passphrase := keyPassphrase()
+		if err := cfg.Interface.ResolvePrivateKey(passphrase); err != nil {
+			return fmt.Errorf("failed to load private key: %w", err)
+		}
+
+		conf, err := wg.BuildWGConfig(cfg)
 		if err != nil {
-			return fmt.Errorf("failed to load config: %w", err)
+			return err
 		}
 
+		logger.Infof("Bringing up WireGuard interface...")
+
+		// Undo DNS changes left behind by an agent that did not shut down cleanly
+		recoverHostDNS()
+
 		// Use fixed interface name for now
 		ifaceName := "kh0"
-		wgIf, err := wg.NewWireGuardInterface(ifaceName)
+		var wrappers []wg.TUNWrapper
+		var packetFilter *filter.Filter
+		var firewall *nft.Firewall
+		switch cfg.Firewall.Mode {
+		case "", "off":
+		case "userspace":
+			rules, err := filter.RulesFromConfig(cfg.Firewall.Rules)
+			if err != nil {
+				return err
+			}
+			wrappers = append(wrappers, func(dev tun.Device) tun.Device {
+				packetFilter = filter.New(dev, rules)
+				return packetFilter
+			})
+		case "nftables":
+			if cfg.Netstack.Enabled {
+				return fmt.Errorf("the nftables firewall needs a TUN interface, use the userspace firewall with netstack")
+			}
+			rules, err := filter.RulesFromConfig(cfg.Firewall.Rules)
+			if err != nil {
+				return err
+			}
+			if firewall, err = nft.New(ifaceName, rules); err != nil {
+				return err
+			}
+			// Replace a table left behind by an agent that didn't shut down
+			// cleanly; until the first peer update only local rules apply
+			if err := firewall.Update(nil); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown firewall mode %q", cfg.Firewall.Mode)
+		}
+		var wgIf *wg.WireGuardInterface
+		if cfg.Netstack.Enabled {
+			prefix, perr := netip.ParsePrefix(cfg.Interface.Address)
+			if perr != nil {
+				return fmt.Errorf("invalid interface address: %w", perr)
+			}
+			wgIf, err = wg.NewNetstackInterface(ifaceName, []netip.Addr{prefix.Addr()}, wrappers...)
+		} else {
+			wgIf, err = wg.NewWireGuardInterface(ifaceName, wrappers...)
+		}
 		if err != nil {
 			return fmt.Errorf("failed to create interface: %w", err)
 		}
@@ -64,25 +132,21 @@ var upCmd = &cobra.Command{
 			return fmt.Errorf("failed to set interface up: %w", err)
 		}
 
-		conf := wg.BuildWGConfig(cfg)
 		if err := wgIf.Up(conf); err != nil {
 			return fmt.Errorf("failed to apply WireGuard config: %w", err)
 		}
-		logger.Println("WireGuard interface is up")
+		logger.Infof("WireGuard interface is up")
 		// Prevent process from exiting to keep interface alive
 
-		// Configure etcd logging based on debug mode
-		etcd.ConfigureEtcdLogger(debugMode)
-
-		// Get the logger
-		zapLogger := zap.L()
-
 		// Initialize etcd client with custom logger
-		etcdCli, err := clientv3.New(clientv3.Config{
-			Endpoints:   []string{cfg.Etcd.Endpoint},
-			DialTimeout: 5 * time.Second,
-			Logger:      zapLogger,
-		})
+		var agentMetrics *metrics.Metrics
+		if cfg.Metrics.Listen != "" {
+			agentMetrics, err = metrics.New(cfg.Metrics)
+			if err != nil {
+				return fmt.Errorf("invalid metrics config: %w", err)
+			}
+		}
+		etcdCli, err := etcd.NewClient(cfg.Etcd.Endpoint, agentMetrics.DialOptions()...)
 		if err != nil {
 			return fmt.Errorf("failed to connect to etcd: %w", err)
 		}
@@ -94,9 +158,7 @@ var upCmd = &cobra.Command{
 
 		// Check etcd health
 		if err := etcd.CheckEtcdHealth(etcdCli); err != nil {
-			// 改行を避け、一貫した形式でログを出力
-			logger.Println("⚠️ Warning: " + err.Error())
-			logger.Println("⚠️ Will continue with local configuration but peer discovery may not work")
+			logger.Warnf("%v; continuing with the local configuration, peer discovery may not work", err)
 			// Don't return error here, allow to continue with local config
 		}
 
@@ -106,16 +168,10 @@ var upCmd = &cobra.Command{
 		}
 		pubKey := privKey.PublicKey()
 		selfPubKey := base64.StdEncoding.EncodeToString(pubKey[:])
-		logger.Printf("🔑 selfPubKey: %s", selfPubKey)
-		logger.Printf("🔎 Peer count in conf: %d", len(conf.Peers))
-		logger.Printf("✅ Peers in config: %d", len(conf.Peers))
-		logger.Printf("✅ PublicKey (self): %s", selfPubKey)
-		logger.Printf("✅ etcd endpoint: %s", cfg.Etcd.Endpoint)
-		logger.Println("✅ Starting Agent...")
-
-		// Debug mode behavior differs from normal mode
-		if debugMode {
-			// In debug mode, run in foreground with signals
+		logger.Infow("Starting agent", "public_key", selfPubKey, "etcd", cfg.Etcd.Endpoint, "peers", len(conf.Peers))
+
+		// Debug and service modes run in the foreground
+		if debugMode || foreground {
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
 
@@ -125,14 +181,31 @@ var upCmd = &cobra.Command{
 
 			go func() {
 				sig := <-sigCh
-				logger.Printf("🛑 Caught signal: %v, shutting down...", sig)
+				logger.Infof("Caught signal: %v, shutting down...", sig)
+				systemd.Notify(systemd.Stopping)
 				cancel()
 			}()
 
-			a := agent.New(wgIf, etcdCli, selfPubKey)
+			a := agent.New(cfg, wgIf, etcdCli, selfPubKey)
+			a.SetFilter(packetFilter)
+			a.SetFirewall(firewall)
+			a.SetMetrics(agentMetrics)
+			a.SetKeyPassphrase(passphrase)
+
+			if foreground {
+				// Let down find the agent like one started in the background
+				if err := os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+					return fmt.Errorf("failed to write PID file: %w", err)
+				}
+				defer os.Remove(pidFile)
+				go notifyService(ctx, a)
+			}
+			if err := applySandbox(cfg); err != nil {
+				return err
+			}
 			a.Run(ctx)
 
-			logger.Println("🏁 Agent stopped, exiting normally.")
+			logger.Infof("Agent stopped, exiting normally.")
 			return nil
 		} else {
 			// Non-debug mode: run in background
@@ -142,17 +215,30 @@ var upCmd = &cobra.Command{
 				// Parent process - fork and exit
 				cmd := exec.Command(os.Args[0], append([]string{"up", "--config", configPath}, os.Args[2:]...)...)
 				cmd.Env = append(os.Environ(), "KH_BACKGROUND=1")
+				if cfg.Interface.KeyEncrypted() {
+					// Hand the passphrase over so the child needn't ask
+					r, err := passphrasePipe(passphrase)
+					if err != nil {
+						return err
+					}
+					defer r.Close()
+					cmd.ExtraFiles = []*os.File{r}
+					cmd.Env = append(cmd.Env, keyPassphraseFDEnv+"=3")
+				}
 
-				// Redirect stdout and stderr to log file
-				logFilePath := "/var/log/kh-client.log"
-				logFile, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+				// The agent writes its log itself, rotating the file. What
+				// the runtime prints on a crash goes to a file of its own
+				// that isn't rotated away
+				logFilePath := agentLogFile(cfg)
+				stderrPath := logFilePath + ".stderr"
+				stderrFile, err := os.OpenFile(stderrPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 				if err != nil {
 					return fmt.Errorf("failed to open log file: %w", err)
 				}
-				defer logFile.Close()
+				defer stderrFile.Close()
 
-				cmd.Stdout = logFile
-				cmd.Stderr = logFile
+				cmd.Stdout = stderrFile
+				cmd.Stderr = stderrFile
 
 				// Create a new process group so signals to the parent don't affect the child
 				cmd.SysProcAttr = &syscall.SysProcAttr{
@@ -169,7 +255,7 @@ var upCmd = &cobra.Command{
 
 				// Check if the process is still running
 				if cmd.ProcessState != nil && cmd.ProcessState.Exited() {
-					return fmt.Errorf("child process exited immediately - check logs at %s", logFilePath)
+					return fmt.Errorf("child process exited immediately - check logs at %s and %s", logFilePath, stderrPath)
 				}
 
 				// Write PID to file
@@ -178,75 +264,220 @@ var upCmd = &cobra.Command{
 					return fmt.Errorf("failed to write PID file: %w", err)
 				}
 
-				logger.Printf("Agent started in background with PID: %s (logs at %s)", pid, logFilePath)
+				logger.Infof("Agent started in background with PID: %s (logs at %s)", pid, logFilePath)
 				return nil
 			}
 
 			// Child process - continue execution
-			logger.Println("Starting agent in background mode...")
+			logger.Infof("Starting agent in background mode...")
 
-			// Create a fresh context that is never cancelled
-			ctx := context.Background()
+			// Cancel the agent on a signal so that it can clean up
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
 
-			// Set up signal handling for clean shutdown
 			sigCh := make(chan os.Signal, 1)
 			signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
 			go func() {
 				sig := <-sigCh
-				logger.Printf("Received signal: %v, shutting down...", sig)
-
-				// Clean up PID file
-				os.Remove(pidFile)
-
-				// Exit the process
-				os.Exit(0)
+				logger.Infof("Received signal: %v, shutting down...", sig)
+				cancel()
 			}()
 
 			// Start the agent
-			a := agent.New(wgIf, etcdCli, selfPubKey)
+			a := agent.New(cfg, wgIf, etcdCli, selfPubKey)
+			a.SetFilter(packetFilter)
+			a.SetFirewall(firewall)
+			a.SetMetrics(agentMetrics)
+			a.SetKeyPassphrase(passphrase)
+			if err := applySandbox(cfg); err != nil {
+				return err
+			}
 
 			// Run agent in a goroutine and monitor for errors
 			errCh := make(chan error, 1)
 			go func() {
-				logger.Println("Starting agent.Run in background...")
+				logger.Debugf("Starting agent.Run in background...")
 
 				// Catch panics
 				defer func() {
 					if r := recover(); r != nil {
-						logger.Printf("PANIC in Agent.Run: %v", r)
+						logger.Errorf("PANIC in Agent.Run: %v", r)
 						errCh <- fmt.Errorf("agent panicked: %v", r)
 					}
 				}()
 
-				// Run()がエラーを返す場合は、それをキャプチャする
 				a.Run(ctx)
 
-				// Agent.Run does not return an error, so just log and send nil
-				logger.Println("Agent.Run returned (should not happen under normal operation)")
-
-				// エラーかnilかにかかわらず、結果をチャネルに送信
 				errCh <- nil
 			}()
 
-			// Block forever, but also monitor for agent errors
-			logger.Println("Agent running in background mode")
+			// Block until the agent stops
+			logger.Debugf("Agent running in background mode")
 			err := <-errCh
+
+			// Clean up PID and status files
+			os.Remove(pidFile)
+			os.Remove(util.GetStatusFilePath())
+
 			if err != nil {
-				logger.Printf("Agent stopped with error: %v", err)
-				os.Remove(pidFile)
+				logger.Errorf("Agent stopped with error: %v", err)
+				// The agent's own cleanup did not run
+				recoverHostDNS()
 				return fmt.Errorf("agent stopped with error: %w", err)
-			} else {
-				logger.Println("Agent stopped unexpectedly without error")
-				os.Remove(pidFile)
+			}
+			if ctx.Err() == nil {
+				logger.Warnf("Agent stopped unexpectedly without error")
 				return fmt.Errorf("agent stopped unexpectedly")
 			}
+			logger.Infof("Agent stopped")
+			return nil
 		}
 	},
 }
 
+// initLogger sets up the log of up. With --debug everything is logged to
+// stderr, the agent in the background logs to the log file, and the process
+// that starts it only reports problems. In the foreground the agent logs to
+// journald when systemd runs it, and to stderr otherwise.
+func initLogger(cfg *config.Config) error {
+	logCfg := cfg.Log
+	switch {
+	case debugMode:
+		logCfg.Level = "debug"
+		logCfg.File = ""
+	case foreground:
+		if logger.JournalAvailable() {
+			if err := logger.InitJournal(logCfg); err != nil {
+				return fmt.Errorf("invalid log config: %w", err)
+			}
+			return nil
+		}
+		logCfg.File = ""
+	case os.Getenv("KH_BACKGROUND") == "1":
+		logCfg.File = agentLogFile(cfg)
+	default:
+		logCfg.Level = "warn"
+		logCfg.Levels = nil
+		logCfg.File = ""
+	}
+	if err := logger.Init(logCfg); err != nil {
+		return fmt.Errorf("invalid log config: %w", err)
+	}
+	return nil
+}
+
+// applySandbox confines the process running the agent, once the interface
+// is set up and before the agent starts. The parent that forks the
+// background agent is never sandboxed, as it has to exec the child.
+func applySandbox(cfg *config.Config) error {
+	if cfg.Sandbox.Disabled {
+		logger.Warnf("Sandbox disabled, the agent keeps all privileges")
+		return nil
+	}
+	err := sandbox.Apply()
+	if errors.Is(err, sandbox.ErrUnsupported) {
+		logger.Warnf("Sandbox not supported on this platform, the agent keeps all privileges")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to sandbox the agent: %w (set sandbox.disabled to run without it)", err)
+	}
+	logger.Debugf("Sandbox applied")
+	return nil
+}
+
+// agentRunning reports whether the process in the PID file is alive. A PID
+// file left behind by an agent that crashed is removed, so that a service
+// manager can restart it.
+func agentRunning(pidFile string) bool {
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err == nil && pid > 0 && syscall.Kill(pid, 0) != syscall.ESRCH {
+		return true
+	}
+	logger.Warnf("Removing stale PID file %s", pidFile)
+	os.Remove(pidFile)
+	return false
+}
+
+// notifyService reports the agent's state to systemd: ready once the
+// interface is up and the peers have been synced, a status line, and
+// watchdog keep-alives for as long as the peer watcher keeps running.
+func notifyService(ctx context.Context, a *agent.Agent) {
+	interval := 5 * time.Second
+	watchdog := systemd.WatchdogInterval()
+	if watchdog > 0 && watchdog/2 < interval {
+		interval = watchdog / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	ready := a.Ready()
+	var lastStatus string
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ready:
+			ready = nil
+			lastStatus = serviceStatus(a.Status())
+			if _, err := systemd.Notify(systemd.Ready, systemd.Status(lastStatus)); err != nil {
+				logger.Warnf("Failed to notify systemd: %v", err)
+			}
+		case <-ticker.C:
+			if watchdog > 0 {
+				if _, err := a.Alive(); err != nil {
+					// systemd restarts the service once the keep-alives stop
+					logger.Errorf("Not sending watchdog keep-alive: %v", err)
+				} else {
+					systemd.Notify(systemd.Watchdog)
+				}
+			}
+			if ready == nil {
+				if status := serviceStatus(a.Status()); status != lastStatus {
+					lastStatus = status
+					systemd.Notify(systemd.Status(status))
+				}
+			}
+		}
+	}
+}
+
+// serviceStatus is the status line of the service.
+func serviceStatus(st *agent.Status) string {
+	status := fmt.Sprintf("Connected to %d peer(s) on %s", len(st.Peers), st.Interface)
+	if st.Revoked {
+		status += ", key revoked"
+	}
+	return status
+}
+
+// agentLogFile returns where the agent in the background logs.
+func agentLogFile(cfg *config.Config) string {
+	if cfg.Log.File != "" {
+		return cfg.Log.File
+	}
+	return util.GetLogFilePath()
+}
+
+// recoverHostDNS restores a host resolver configuration recorded by an agent
+// that is no longer running.
+func recoverHostDNS() {
+	restored, err := resolver.Recover(util.GetResolverStatePath())
+	if err != nil {
+		logger.Warnf("%v", err)
+	} else if restored {
+		logger.Infof("Restored host DNS configuration left by a previous agent")
+	}
+}
+
 func init() {
 	rootCmd.AddCommand(upCmd)
 	upCmd.Flags().StringVar(&configPath, "config", "config.yaml", "Path to config file")
 	upCmd.Flags().BoolVar(&debugMode, "debug", false, "Enable debug logging")
+	upCmd.Flags().BoolVar(&foreground, "foreground", false, "Run in the foreground as a service, notifying systemd when ready")
 }
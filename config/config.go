@@ -1,17 +1,41 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type InterfaceConfig struct {
-	PrivateKey string   `yaml:"private_key"`
-	Address    string   `yaml:"address"`
-	DNS        string   `yaml:"dns"`
-	Routes     []string `yaml:"routes"`
+	// The private key is set inline or read from one of the other
+	// sources; any of them may hold a key encrypted with a passphrase
+	PrivateKey string `yaml:"private_key,omitempty"`
+	// PrivateKeyFile must be mode 0600 and owned by the running user
+	PrivateKeyFile string `yaml:"private_key_file,omitempty"`
+	// PrivateKeyEnv is the environment variable holding the key
+	PrivateKeyEnv string `yaml:"private_key_env,omitempty"`
+	// PrivateKeyCommand is run by /bin/sh and prints the key
+	PrivateKeyCommand string `yaml:"private_key_command,omitempty"`
+	Address           string `yaml:"address"`
+	// ListenPort is the WireGuard UDP port; random if unset
+	ListenPort int `yaml:"listen_port,omitempty"`
+	// DNS is a comma-separated list of servers the host resolver uses while up
+	DNS string `yaml:"dns,omitempty"`
+	// DNSDomains, if set, are the only domains sent to DNS (split DNS)
+	DNSDomains []string `yaml:"dns_domains,omitempty"`
+	// DNSMode is auto (default), resolved, file or off
+	DNSMode string   `yaml:"dns_mode,omitempty"`
+	Routes  []string `yaml:"routes,omitempty"`
+	// Hostname is published in the node record; defaults to the OS hostname
+	Hostname string `yaml:"hostname,omitempty"`
+
+	// Set by ResolvePrivateKey
+	keyResolved  bool
+	keyEncrypted bool
 }
 
 type ServerPeer struct {
@@ -19,26 +43,349 @@ type ServerPeer struct {
 	Endpoint            string `yaml:"endpoint"`
 	AllowedIPs          string `yaml:"allowed_ips"`
 	PersistentKeepalive int    `yaml:"persistent_keepalive"`
+	PresharedKey        string `yaml:"preshared_key,omitempty"`
+}
+
+// PSKConfig holds the network secret from which per-pair preshared keys
+// for discovered peers are derived. SecretFile takes precedence over Secret
+// and is re-read periodically so the secret can be rotated without a restart.
+type PSKConfig struct {
+	Secret     string `yaml:"secret,omitempty"`
+	SecretFile string `yaml:"secret_file,omitempty"`
+}
+
+// PQConfig enables the post-quantum preshared key exchange, in which peers
+// encapsulate fresh ML-KEM-768 secrets to each other through etcd.
+type PQConfig struct {
+	Enabled          bool          `yaml:"enabled"`
+	RotationInterval time.Duration `yaml:"rotation_interval,omitempty"`
+}
+
+// MeshDNSConfig runs a DNS server on the mesh interface address that
+// resolves <hostname>.<domain> for all nodes and forwards other queries.
+type MeshDNSConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Domain  string `yaml:"domain,omitempty"`
+	// Listen defaults to port 53 on the interface address
+	Listen string `yaml:"listen,omitempty"`
+	// Upstream defaults to the nameservers in /etc/resolv.conf
+	Upstream []string `yaml:"upstream,omitempty"`
+}
+
+// Service is a service this node offers to the mesh. It is published in the
+// node record and answered by the mesh DNS as _<name>._<protocol>.<domain>.
+type Service struct {
+	Name string `yaml:"name" json:"name"`
+	Port int    `yaml:"port" json:"port"`
+	// Protocol is tcp (default) or udp
+	Protocol string   `yaml:"protocol,omitempty" json:"protocol,omitempty"`
+	Tags     []string `yaml:"tags,omitempty" json:"tags,omitempty"`
+}
+
+// Proto returns the service protocol, defaulting to tcp.
+func (s Service) Proto() string {
+	if s.Protocol == "" {
+		return "tcp"
+	}
+	return strings.ToLower(s.Protocol)
+}
+
+// HostsFileConfig keeps a block of node hostnames in a hosts file, for
+// hosts that cannot use the mesh DNS.
+type HostsFileConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Path defaults to /etc/hosts
+	Path string `yaml:"path,omitempty"`
+}
+
+// FirewallConfig filters the traffic with mesh peers, enforcing the ports of
+// the ACL policy and the local rules.
+type FirewallConfig struct {
+	// Mode is off (default), userspace, which filters packets between the
+	// TUN device and WireGuard, or nftables, which has the kernel enforce
+	// the rules in a table of the interface
+	Mode  string         `yaml:"mode,omitempty"`
+	Rules []FirewallRule `yaml:"rules,omitempty"`
+}
+
+// FirewallRule allows or drops new flows in one direction. Rules are checked
+// in order before the ACL policy and the first match decides.
+type FirewallRule struct {
+	Name      string `yaml:"name"`
+	Action    string `yaml:"action"`    // allow or drop
+	Direction string `yaml:"direction"` // in or out
+	// Ports use the ACL syntax, e.g. tcp:22 or udp:5000-6000; default all
+	Ports []string `yaml:"ports,omitempty"`
+	// Tags selects the peers the rule applies to; default all
+	Tags []string `yaml:"tags,omitempty"`
+}
+
+// NetstackConfig runs the interface on a userspace network stack instead of
+// a TUN device, so that no privileges are needed. Local applications reach
+// the mesh through the SOCKS5 and HTTP proxies, which also resolve node
+// names.
+type NetstackConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// SOCKS5 defaults to 127.0.0.1:1080; "off" disables it
+	SOCKS5 string `yaml:"socks5,omitempty"`
+	// HTTP defaults to 127.0.0.1:3128; "off" disables it
+	HTTP string `yaml:"http,omitempty"`
+}
+
+// Forward relays connections between the host and the mesh, like the -L and
+// -R options of ssh.
+type Forward struct {
+	Name string `yaml:"name"`
+	// Protocol is tcp (default) or udp
+	Protocol string `yaml:"protocol,omitempty"`
+	// Direction is local (default), which listens on the host and connects
+	// to a mesh target, or remote, which listens on this node's mesh
+	// address and connects to a target reachable from the host
+	Direction string `yaml:"direction,omitempty"`
+	Listen    string `yaml:"listen"`
+	Target    string `yaml:"target"`
+}
+
+// MetricsConfig serves Prometheus metrics over HTTP.
+type MetricsConfig struct {
+	// Listen is the address of the metrics listener, e.g. 127.0.0.1:9586;
+	// metrics are off if unset
+	Listen string `yaml:"listen,omitempty"`
+	// PeerLabels are the labels of per-peer series: public_key and/or
+	// hostname (default both), or none to aggregate all peers
+	PeerLabels []string `yaml:"peer_labels,omitempty"`
+	// MaxPeers caps the peers with series of their own, the others are
+	// aggregated under the label value "other"; 0 means no limit
+	MaxPeers int `yaml:"max_peers,omitempty"`
+}
+
+// HealthConfig serves /healthz and /readyz over HTTP. The thresholds
+// default to DefaultStallTimeout, DefaultSyncMaxAge and
+// DefaultHandshakeMaxAge.
+type HealthConfig struct {
+	// Listen is the address of the health listener, e.g. 127.0.0.1:9587;
+	// the endpoints are off if unset
+	Listen string `yaml:"listen,omitempty"`
+	// StallTimeout is how long the peer watcher may go without running
+	// before the agent is no longer live
+	StallTimeout time.Duration `yaml:"stall_timeout,omitempty"`
+	// SyncMaxAge is how old the latest peer sync with etcd may be for the
+	// agent to be ready
+	SyncMaxAge time.Duration `yaml:"sync_max_age,omitempty"`
+	// HandshakeMaxAge is how old the latest handshake with the server peer
+	// may be for the agent to be ready
+	HandshakeMaxAge time.Duration `yaml:"handshake_max_age,omitempty"`
+}
+
+// Health check thresholds used when not configured
+const (
+	DefaultStallTimeout    = time.Minute
+	DefaultSyncMaxAge      = time.Minute
+	DefaultHandshakeMaxAge = 3 * time.Minute
+)
+
+// LogConfig configures the agent's log. Levels are debug, info, warn and
+// error.
+type LogConfig struct {
+	// Level applies to all subsystems without a level of their own;
+	// defaults to info
+	Level string `yaml:"level,omitempty"`
+	// Levels set the level of the subsystems agent, wg, etcd and wireguard;
+	// etcd logs at warn or above unless set here
+	Levels map[string]string `yaml:"levels,omitempty"`
+	// Format is text (default) or json
+	Format string `yaml:"format,omitempty"`
+	// File is where the agent running in the background logs; defaults to
+	// /var/log/kh-client.log as root and a file next to the status file
+	// otherwise
+	File string `yaml:"file,omitempty"`
+	// MaxSize is the size in megabytes at which File is rotated (default 10)
+	MaxSize int `yaml:"max_size,omitempty"`
+	// MaxFiles is the number of rotated files kept (default 5)
+	MaxFiles int `yaml:"max_files,omitempty"`
+}
+
+// SandboxConfig confines the agent once the interface is set up: it keeps
+// only CAP_NET_ADMIN and CAP_NET_BIND_SERVICE and loads a seccomp filter
+// denying syscalls it never needs, such as execve. Linux only.
+type SandboxConfig struct {
+	// Disabled runs the agent with the privileges it was started with
+	Disabled bool `yaml:"disabled,omitempty"`
 }
 
 type Config struct {
+	// Version is the layout of the file; older layouts are migrated to
+	// CurrentVersion when loaded
+	Version      int             `yaml:"version,omitempty"`
 	Interface    InterfaceConfig `yaml:"interface"`
 	ServerConfig ServerPeer      `yaml:"peer"`
 	Etcd         struct {
 		Endpoint string `yaml:"endpoint"`
 	} `yaml:"etcd"`
+	PSK PSKConfig `yaml:"psk,omitempty"`
+	PQ  PQConfig  `yaml:"pq,omitempty"`
+
+	MeshDNS   MeshDNSConfig   `yaml:"mesh_dns,omitempty"`
+	HostsFile HostsFileConfig `yaml:"hosts_file,omitempty"`
+
+	Services []Service `yaml:"services,omitempty"`
+
+	// Tags are published in the node record and select the ACL rules
+	// that apply to this node
+	Tags []string `yaml:"tags,omitempty"`
+
+	Firewall FirewallConfig `yaml:"firewall,omitempty"`
+
+	Netstack NetstackConfig `yaml:"netstack,omitempty"`
+
+	Forwards []Forward `yaml:"forward,omitempty"`
+
+	Metrics MetricsConfig `yaml:"metrics,omitempty"`
+	Health  HealthConfig  `yaml:"health,omitempty"`
+
+	Log LogConfig `yaml:"log,omitempty"`
+
+	Sandbox SandboxConfig `yaml:"sandbox,omitempty"`
+
+	// Path is the file the config was loaded from
+	Path string `yaml:"-"`
+	// node is the root of the merged document, for line numbers
+	node *yaml.Node
+	// origins are the sources of the nodes under node
+	origins map[*yaml.Node]string
+	sources []string
+	sets    []string
+	// changes made to migrate the files to CurrentVersion
+	changes []Change
 }
 
-func Load(path string) (*Config, error) {
-	data, err := os.ReadFile(path)
+// Load reads the config file at path, merged with its conf.d fragments, the
+// KH_* environment variables and the key=value overrides in sets, in that
+// order of precedence. Unknown fields and values of the wrong type are
+// reported as a ValidationError; the settings themselves are only checked
+// by Validate.
+func Load(path string, sets ...string) (*Config, error) {
+	cfg, problems, err := load(path, sets)
+	if err != nil {
+		return nil, err
+	}
+	if len(problems) > 0 {
+		return nil, &ValidationError{File: path, Problems: problems}
+	}
+	return cfg, nil
+}
+
+// load merges the layers of the config at path, after migrating the files
+// to CurrentVersion, and decodes the result strictly. It returns what could
+// be decoded along with the problems found in each layer.
+func load(path string, sets []string) (*Config, []Problem, error) {
+	base, err := readLayer(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	layers := []*layer{base}
+	fragments, err := Fragments(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, f := range fragments {
+		l, err := readLayer(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		layers = append(layers, l)
+	}
+	layers = append(layers, envLayers(os.Environ())...)
+	overrides, err := setLayers(sets)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
+		return nil, nil, err
+	}
+	layers = append(layers, overrides...)
+
+	cfg := &Config{
+		Path:    path,
+		node:    &yaml.Node{Kind: yaml.MappingNode},
+		origins: make(map[*yaml.Node]string),
+		sets:    sets,
+	}
+	var problems []Problem
+	for _, l := range layers {
+		cfg.sources = append(cfg.sources, l.source)
+		lp, err := cfg.addLayer(l)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Problems are reported in the base file unless told otherwise
+		for i := range lp {
+			if l.source != path {
+				lp[i].File = l.source
+			}
+		}
+		problems = append(problems, lp...)
+	}
+
+	if err := cfg.node.Decode(cfg); err != nil {
+		// Values of the wrong type were reported with their layer
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return nil, nil, fmt.Errorf("failed to parse YAML: %w", err)
+		}
+	}
+	cfg.Version = CurrentVersion
+	return cfg, problems, nil
+}
+
+// addLayer migrates and checks l, then merges it into the config.
+func (c *Config) addLayer(l *layer) ([]Problem, error) {
+	if l.file {
+		_, changes, err := migrate(l.root, false)
+		if err != nil {
+			k, _ := mappingValue(l.root, "version")
+			return []Problem{{Line: k.Line, Path: "version", Message: err.Error()}}, nil
+		}
+		for _, change := range changes {
+			change.File = l.source
+			c.changes = append(c.changes, change)
+		}
 	}
 
-	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, fmt.Errorf("failed to parse YAML: %w", err)
+	problems := unknownFields(l.root, configType, "")
+	if err := l.root.Decode(new(Config)); err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return nil, fmt.Errorf("failed to parse YAML: %w", err)
+		}
+		problems = append(problems, decodeProblems(typeErr)...)
 	}
 
-	return &cfg, nil
+	if l.root.Kind == yaml.MappingNode {
+		setOrigin(c.origins, l.root, l.source)
+		merge(c.node, l.root)
+	}
+	return problems, nil
+}
+
+// Migrations returns the changes made to bring the files up to
+// CurrentVersion when the config was loaded, to be reported as warnings
+// until the files are migrated.
+func (c *Config) Migrations() []Change {
+	return c.changes
+}
+
+// LoadSecret returns the current network secret, or nil if none is configured.
+func (p PSKConfig) LoadSecret() ([]byte, error) {
+	secret := p.Secret
+	if p.SecretFile != "" {
+		data, err := os.ReadFile(p.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PSK secret file: %w", err)
+		}
+		secret = string(data)
+	}
+
+	secret = strings.TrimSpace(secret)
+	if secret == "" {
+		return nil, nil
+	}
+	return []byte(secret), nil
 }
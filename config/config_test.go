@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -29,8 +30,11 @@ peer:
   endpoint: 192.168.1.1:51820
   allowed_ips: 0.0.0.0/0
   persistent_keepalive: 25
+  preshared_key: ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789abcdefghi=
 etcd:
   endpoint: 192.168.1.100:2379
+psk:
+  secret: network-secret
 `
 		if err := os.WriteFile(configPath, []byte(configData), 0644); err != nil {
 			t.Fatalf("Failed to write test config file: %v", err)
@@ -70,6 +74,33 @@ etcd:
 		if cfg.Etcd.Endpoint != "192.168.1.100:2379" {
 			t.Errorf("Expected Etcd endpoint to be 192.168.1.100:2379, got %s", cfg.Etcd.Endpoint)
 		}
+		if cfg.ServerConfig.PresharedKey != "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789abcdefghi=" {
+			t.Errorf("Expected PresharedKey to be ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789abcdefghi=, got %s", cfg.ServerConfig.PresharedKey)
+		}
+		if cfg.PSK.Secret != "network-secret" {
+			t.Errorf("Expected PSK secret to be network-secret, got %s", cfg.PSK.Secret)
+		}
+	})
+
+	t.Run("PSKSecretFile", func(t *testing.T) {
+		secretPath := filepath.Join(tempDir, "psk-secret")
+		if err := os.WriteFile(secretPath, []byte("from-file\n"), 0600); err != nil {
+			t.Fatalf("Failed to write secret file: %v", err)
+		}
+
+		psk := PSKConfig{Secret: "inline", SecretFile: secretPath}
+		secret, err := psk.LoadSecret()
+		if err != nil {
+			t.Fatalf("Failed to load secret: %v", err)
+		}
+		if string(secret) != "from-file" {
+			t.Errorf("Expected secret file to take precedence, got %q", secret)
+		}
+
+		secret, err = PSKConfig{}.LoadSecret()
+		if err != nil || secret != nil {
+			t.Errorf("Expected no secret when unconfigured, got %q (err %v)", secret, err)
+		}
 	})
 
 	t.Run("FileNotExist", func(t *testing.T) {
@@ -118,3 +149,138 @@ interface:
 		}
 	})
 }
+
+func TestSetPrivateKey(t *testing.T) {
+	tempDir := t.TempDir()
+	configPath := filepath.Join(tempDir, "config.yaml")
+	configData := `# Client YAML configuration
+interface:
+  private_key: OLDKEY # replaced by rotate-key
+  address: 10.0.0.2/24
+peer:
+  public_key: SERVERKEY
+`
+	if err := os.WriteFile(configPath, []byte(configData), 0600); err != nil {
+		t.Fatalf("Failed to write test config file: %v", err)
+	}
+
+	if err := SetPrivateKey(configPath, "NEWKEY"); err != nil {
+		t.Fatalf("Failed to set private key: %v", err)
+	}
+
+	cfg, err := Load(configPath)
+	if err != nil {
+		t.Fatalf("Failed to load updated config: %v", err)
+	}
+	if cfg.Interface.PrivateKey != "NEWKEY" {
+		t.Errorf("Expected PrivateKey to be NEWKEY, got %s", cfg.Interface.PrivateKey)
+	}
+	if cfg.Interface.Address != "10.0.0.2/24" || cfg.ServerConfig.PublicKey != "SERVERKEY" {
+		t.Errorf("Expected other values to be preserved, got %+v", cfg)
+	}
+
+	data, _ := os.ReadFile(configPath)
+	for _, comment := range []string{"# Client YAML configuration", "# replaced by rotate-key"} {
+		if !strings.Contains(string(data), comment) {
+			t.Errorf("Expected comment %q to be preserved, got:\n%s", comment, data)
+		}
+	}
+
+	info, err := os.Stat(configPath)
+	if err != nil {
+		t.Fatalf("Failed to stat config file: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected permissions 0600 to be preserved, got %o", info.Mode().Perm())
+	}
+}
+
+func TestWrite(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+
+	cfg := &Config{
+		Interface: InterfaceConfig{
+			PrivateKey: "PRIVATEKEY",
+			Address:    "10.0.0.5/24",
+		},
+		ServerConfig: ServerPeer{
+			PublicKey:  "SERVERKEY",
+			Endpoint:   "192.168.1.1:51820",
+			AllowedIPs: "10.0.0.1/32",
+		},
+	}
+	cfg.Etcd.Endpoint = "192.168.1.100:2379"
+
+	if err := Write(configPath, cfg); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	info, err := os.Stat(configPath)
+	if err != nil {
+		t.Fatalf("Failed to stat config file: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected permissions 0600, got %o", info.Mode().Perm())
+	}
+
+	loaded, err := Load(configPath)
+	if err != nil {
+		t.Fatalf("Failed to load written config: %v", err)
+	}
+	if loaded.Interface.PrivateKey != cfg.Interface.PrivateKey || loaded.Interface.Address != cfg.Interface.Address || loaded.ServerConfig != cfg.ServerConfig || loaded.Etcd != cfg.Etcd {
+		t.Errorf("Expected %+v, got %+v", cfg, loaded)
+	}
+
+	data, _ := os.ReadFile(configPath)
+	if strings.Contains(string(data), "psk") || strings.Contains(string(data), "dns") {
+		t.Errorf("Expected unset optional sections to be omitted, got:\n%s", data)
+	}
+}
+
+func TestForwardEdit(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	configData := `interface:
+  address: 10.0.0.2/24 # mesh address
+`
+	if err := os.WriteFile(configPath, []byte(configData), 0600); err != nil {
+		t.Fatalf("Failed to write test config file: %v", err)
+	}
+
+	web := Forward{Name: "web", Listen: "127.0.0.1:8080", Target: "web.kh.internal:80"}
+	dns := Forward{Name: "dns", Protocol: "udp", Direction: "remote", Listen: ":53", Target: "127.0.0.1:53"}
+	for _, f := range []Forward{web, dns} {
+		if err := AddForward(configPath, f); err != nil {
+			t.Fatalf("AddForward(%s): %v", f.Name, err)
+		}
+	}
+	if err := AddForward(configPath, web); err == nil {
+		t.Error("Expected a duplicate name to be rejected")
+	}
+
+	cfg, err := Load(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Forwards) != 2 || cfg.Forwards[0] != web || cfg.Forwards[1] != dns {
+		t.Errorf("Unexpected forwards %+v", cfg.Forwards)
+	}
+
+	if err := RemoveForward(configPath, "web"); err != nil {
+		t.Fatalf("RemoveForward: %v", err)
+	}
+	if err := RemoveForward(configPath, "web"); err == nil {
+		t.Error("Expected removing a missing forward to fail")
+	}
+	cfg, err = Load(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Forwards) != 1 || cfg.Forwards[0] != dns {
+		t.Errorf("Unexpected forwards after removal %+v", cfg.Forwards)
+	}
+
+	data, _ := os.ReadFile(configPath)
+	if !strings.Contains(string(data), "# mesh address") {
+		t.Errorf("Expected comments to be preserved, got:\n%s", data)
+	}
+}
@@ -0,0 +1,203 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// UpdateFile applies fn to the YAML document tree of the config file at path
+// and writes the result back atomically. Working on the tree rather than on
+// Config keeps comments, key order and unknown keys intact.
+func UpdateFile(path string, fn func(doc *yaml.Node) error) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse YAML: %w", err)
+	}
+	if doc.Kind == 0 {
+		// Empty file: start from an empty mapping
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	if err := fn(&doc); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return fmt.Errorf("failed to encode YAML: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return fmt.Errorf("failed to encode YAML: %w", err)
+	}
+
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	return writeFileAtomic(path, buf.Bytes(), mode)
+}
+
+// Write stores cfg as a new YAML config file at path, readable only by its
+// owner since it contains the private key.
+func Write(path string, cfg *Config) error {
+	c := *cfg
+	c.Version = CurrentVersion
+	data, err := yaml.Marshal(&c)
+	if err != nil {
+		return fmt.Errorf("failed to encode YAML: %w", err)
+	}
+	return writeFileAtomic(path, append([]byte("# Client YAML configuration\n"), data...), 0600)
+}
+
+// SetPrivateKey replaces interface.private_key in the config file at path.
+func SetPrivateKey(path, key string) error {
+	return UpdateFile(path, func(doc *yaml.Node) error {
+		iface := mappingChild(doc.Content[0], "interface", true)
+		setScalar(iface, "private_key", key)
+		return nil
+	})
+}
+
+// StorePrivateKey replaces the private key where iface, loaded from the
+// config file at path, reads it from: inline or in the key file. The key is
+// encrypted with passphrase unless it is nil. Keys from the environment or
+// a command can't be stored.
+func StorePrivateKey(path string, iface *InterfaceConfig, key string, passphrase []byte) error {
+	if passphrase != nil {
+		var err error
+		if key, err = EncryptPrivateKey(key, passphrase); err != nil {
+			return err
+		}
+	}
+	switch source := iface.KeySource(); source {
+	case "private_key", "":
+		return SetPrivateKey(path, key)
+	case "private_key_file":
+		if err := CheckKeyFile(iface.PrivateKeyFile); err != nil {
+			return err
+		}
+		return WriteKeyFile(iface.PrivateKeyFile, key)
+	default:
+		return fmt.Errorf("can't store a private key read from %s", source)
+	}
+}
+
+// AddForward appends a forward rule to the config file at path. Names must
+// be unique.
+func AddForward(path string, f Forward) error {
+	return UpdateFile(path, func(doc *yaml.Node) error {
+		root := doc.Content[0]
+		seq := sequenceChild(root, "forward")
+		for _, item := range seq.Content {
+			if name := mappingChild(item, "name", false); name != nil && name.Value == f.Name {
+				return fmt.Errorf("forward %q already exists", f.Name)
+			}
+		}
+		var item yaml.Node
+		if err := item.Encode(f); err != nil {
+			return fmt.Errorf("failed to encode forward: %w", err)
+		}
+		seq.Content = append(seq.Content, &item)
+		return nil
+	})
+}
+
+// RemoveForward deletes the forward rule called name from the config file at
+// path.
+func RemoveForward(path, name string) error {
+	return UpdateFile(path, func(doc *yaml.Node) error {
+		seq := sequenceChild(doc.Content[0], "forward")
+		for i, item := range seq.Content {
+			if n := mappingChild(item, "name", false); n != nil && n.Value == name {
+				seq.Content = append(seq.Content[:i], seq.Content[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("forward %q not found", name)
+	})
+}
+
+// sequenceChild returns the sequence stored under key in m, creating it if
+// it doesn't exist yet.
+func sequenceChild(m *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			v := m.Content[i+1]
+			if v.Kind != yaml.SequenceNode {
+				// e.g. "forward:" with no value
+				v.Kind, v.Tag, v.Value, v.Style, v.Content = yaml.SequenceNode, "", "", 0, nil
+			}
+			return v
+		}
+	}
+	child := &yaml.Node{Kind: yaml.SequenceNode}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, child)
+	return child
+}
+
+// mappingChild returns the mapping stored under key in m, creating it if
+// create is set and it doesn't exist yet.
+func mappingChild(m *yaml.Node, key string, create bool) *yaml.Node {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	if !create {
+		return nil
+	}
+	child := &yaml.Node{Kind: yaml.MappingNode}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, child)
+	return child
+}
+
+// setScalar sets key in mapping m to a plain scalar value.
+func setScalar(m *yaml.Node, key, value string) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			v := m.Content[i+1]
+			v.Kind, v.Tag, v.Value, v.Style, v.Content = yaml.ScalarNode, "", value, 0, nil
+			return
+		}
+	}
+	m.Content = append(m.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Value: key},
+		&yaml.Node{Kind: yaml.ScalarNode, Value: value})
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place, so readers never see a partially written file.
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set file permissions: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
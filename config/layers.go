@@ -0,0 +1,379 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// A config is merged from layers, each overriding the ones before it:
+//
+//  1. the base file
+//  2. the fragments in the conf.d directory next to it, in lexical order
+//  3. KH_* environment variables, e.g. KH_LOG_LEVEL for log.level
+//  4. --set key=value flags, e.g. --set log.level=debug
+//
+// Mappings are merged key by key, any other value replaces the one below.
+// Files may be YAML, JSON (.json) or TOML (.toml).
+
+// ConfDir is the directory of fragments next to the base file.
+const ConfDir = "conf.d"
+
+// EnvPrefix starts the environment variables overriding config values. The
+// rest of the name is the path of the value in upper case, with each dot
+// replaced by an underscore; variables matching no value are ignored.
+const EnvPrefix = "KH_"
+
+// layer is one source of config values.
+type layer struct {
+	// source is the file path, $NAME of the variable or --set key
+	source string
+	root   *yaml.Node
+	file   bool
+}
+
+var configType = reflect.TypeOf(Config{})
+
+// Fragments returns the conf.d fragments of the base config file at path,
+// in the order they are merged.
+func Fragments(path string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(filepath.Dir(path), ConfDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", ConfDir, err)
+	}
+	var fragments []string
+	for _, e := range entries {
+		switch filepath.Ext(e.Name()) {
+		case ".yaml", ".yml", ".json", ".toml":
+			if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+				fragments = append(fragments, filepath.Join(filepath.Dir(path), ConfDir, e.Name()))
+			}
+		}
+	}
+	return fragments, nil
+}
+
+// readLayer parses the config file at path according to its extension.
+func readLayer(path string) (*layer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	root, err := parseDocument(path, data)
+	if err != nil {
+		return nil, err
+	}
+	return &layer{source: path, root: root, file: true}, nil
+}
+
+// parseDocument returns the root of the config document data read from
+// path, an empty mapping if there is none.
+func parseDocument(path string, data []byte) (*yaml.Node, error) {
+	if filepath.Ext(path) == ".toml" {
+		var values map[string]any
+		if _, err := toml.Decode(string(data), &values); err != nil {
+			return nil, fmt.Errorf("failed to parse TOML in %s: %w", path, err)
+		}
+		var root yaml.Node
+		if err := root.Encode(values); err != nil {
+			return nil, fmt.Errorf("failed to parse TOML in %s: %w", path, err)
+		}
+		return &root, nil
+	}
+
+	// JSON is parsed as the subset of YAML it is
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.MappingNode}, nil
+	}
+	return doc.Content[0], nil
+}
+
+// isYAML reports whether the config file at path is YAML rather than JSON
+// or TOML.
+func isYAML(path string) bool {
+	ext := filepath.Ext(path)
+	return ext != ".json" && ext != ".toml"
+}
+
+// envLayers returns a layer for each variable of environ overriding a
+// config value, sorted by name.
+func envLayers(environ []string) []*layer {
+	slices.Sort(environ)
+	var layers []*layer
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		rest, ok := strings.CutPrefix(name, EnvPrefix)
+		if !ok {
+			continue
+		}
+		path, t, ok := envPath(rest, configType)
+		if !ok {
+			continue
+		}
+		layers = append(layers, &layer{source: "$" + name, root: overrideNode(path, valueNode(value, t))})
+	}
+	return layers
+}
+
+// envPath resolves the upper case, underscore separated name of a value
+// under type t to its path and type.
+func envPath(name string, t reflect.Type) ([]string, reflect.Type, bool) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		fields := yamlFields(t)
+		// Longest first, so that DNS_MODE is dns_mode rather than dns
+		keys := make([]string, 0, len(fields))
+		for key := range fields {
+			keys = append(keys, key)
+		}
+		slices.SortFunc(keys, func(a, b string) int { return len(b) - len(a) })
+		for _, key := range keys {
+			upper := strings.ToUpper(key)
+			if name == upper {
+				return []string{key}, fields[key], true
+			}
+			if rest, ok := strings.CutPrefix(name, upper+"_"); ok {
+				if path, vt, ok := envPath(rest, fields[key]); ok {
+					return append([]string{key}, path...), vt, true
+				}
+			}
+		}
+	case reflect.Map:
+		if t.Key().Kind() == reflect.String && name != "" {
+			return []string{strings.ToLower(name)}, t.Elem(), true
+		}
+	}
+	return nil, nil, false
+}
+
+// setLayers returns a layer for each key=value override.
+func setLayers(sets []string) ([]*layer, error) {
+	var layers []*layer
+	for _, s := range sets {
+		key, value, ok := strings.Cut(s, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid override %q: must be key=value", s)
+		}
+		path := strings.Split(key, ".")
+		layers = append(layers, &layer{source: "--set " + key, root: overrideNode(path, valueNode(value, pathType(path)))})
+	}
+	return layers, nil
+}
+
+// pathType returns the type of the value at path in a Config, or nil if
+// there is none.
+func pathType(path []string) reflect.Type {
+	t := configType
+	for _, key := range path {
+		switch t.Kind() {
+		case reflect.Struct:
+			if t = yamlFields(t)[key]; t == nil {
+				return nil
+			}
+		case reflect.Map:
+			t = t.Elem()
+		default:
+			return nil
+		}
+	}
+	return t
+}
+
+// valueNode parses an override value for a value of type t. Strings are
+// taken as they are and lists may be given comma-separated; anything else
+// is YAML, e.g. a number or [a, b].
+func valueNode(value string, t reflect.Type) *yaml.Node {
+	str := func(s string) *yaml.Node {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: s}
+	}
+	if t != nil && t.Kind() == reflect.String {
+		return str(value)
+	}
+	if t != nil && t.Kind() == reflect.Slice && !strings.HasPrefix(strings.TrimSpace(value), "[") {
+		seq := &yaml.Node{Kind: yaml.SequenceNode}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				seq.Content = append(seq.Content, str(item))
+			}
+		}
+		return seq
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(value), &doc); err != nil || len(doc.Content) == 0 {
+		// Left for decoding to report if it doesn't fit
+		return str(value)
+	}
+	// Lines within the value would be taken for lines of a file
+	var clearLines func(n *yaml.Node)
+	clearLines = func(n *yaml.Node) {
+		n.Line, n.Column = 0, 0
+		for _, c := range n.Content {
+			clearLines(c)
+		}
+	}
+	clearLines(doc.Content[0])
+	return doc.Content[0]
+}
+
+// overrideNode returns a document setting the value at path.
+func overrideNode(path []string, value *yaml.Node) *yaml.Node {
+	n := value
+	for i := len(path) - 1; i >= 0; i-- {
+		n = &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{
+			{Kind: yaml.ScalarNode, Value: path[i]}, n,
+		}}
+	}
+	return n
+}
+
+// merge merges the mapping src into dst: mappings are merged key by key,
+// any other value of src replaces the one in dst.
+func merge(dst, src *yaml.Node) {
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		k, v := src.Content[i], src.Content[i+1]
+		j := keyIndex(dst, k.Value)
+		switch {
+		case j < 0:
+			dst.Content = append(dst.Content, k, v)
+		case dst.Content[j+1].Kind == yaml.MappingNode && v.Kind == yaml.MappingNode:
+			merge(dst.Content[j+1], v)
+		default:
+			dst.Content[j], dst.Content[j+1] = k, v
+		}
+	}
+}
+
+// keyIndex returns the index of key in mapping m, or -1.
+func keyIndex(m *yaml.Node, key string) int {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// setOrigin records source as the origin of n and the nodes under it.
+func setOrigin(origins map[*yaml.Node]string, n *yaml.Node, source string) {
+	origins[n] = source
+	for _, c := range n.Content {
+		setOrigin(origins, c, source)
+	}
+}
+
+// Origin returns where the value at path comes from: file:line, a file if
+// the line is unknown, $NAME of an environment variable or --set key.
+// It returns "" for values that are not set.
+func (c *Config) Origin(path string) string {
+	return origin(c.position(path))
+}
+
+// Source returns the file, $NAME or --set key the value at path comes
+// from, or "" if it is not set.
+func (c *Config) Source(path string) string {
+	source, _ := c.position(path)
+	return source
+}
+
+func origin(source string, line int) string {
+	if source == "" || line == 0 {
+		return source
+	}
+	return source + ":" + strconv.Itoa(line)
+}
+
+// secretFields are redacted from the effective config.
+var secretFields = []string{"interface.private_key", "peer.preshared_key", "psk.secret"}
+
+// IsSecret reports whether the value at path is a key or secret.
+func IsSecret(path string) bool {
+	return slices.Contains(secretFields, path)
+}
+
+// Effective returns the merged config as YAML, with the origin of each
+// value in a comment. Secrets are redacted unless showSecrets is set.
+func (c *Config) Effective(showSecrets bool) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(c.annotate(c.node, "", showSecrets)); err != nil {
+		return nil, fmt.Errorf("failed to encode YAML: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode YAML: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// annotate returns a copy of n, the value at path, with the comments of
+// the files replaced by the origins of the values.
+func (c *Config) annotate(n *yaml.Node, path string, showSecrets bool) *yaml.Node {
+	out := *n
+	out.HeadComment, out.LineComment, out.FootComment = "", "", ""
+	out.Content = nil
+	if n.Kind != yaml.ScalarNode {
+		// Block style, as JSON fragments would print in flow style
+		out.Style = 0
+	}
+	if n.Kind != yaml.MappingNode {
+		for _, item := range n.Content {
+			out.Content = append(out.Content, c.annotate(item, path, showSecrets))
+		}
+		return &out
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		key := *k
+		key.HeadComment, key.LineComment, key.FootComment = "", "", ""
+		key.Style = 0
+		p := joinPath(path, k.Value)
+		value := c.annotate(v, p, showSecrets)
+		switch v.Kind {
+		case yaml.MappingNode:
+			// Merged from several sources, which its values show
+		case yaml.ScalarNode:
+			if !showSecrets && v.Value != "" && IsSecret(p) {
+				value.Value, value.Tag, value.Style = "<redacted>", "!!str", 0
+			}
+			value.LineComment = origin(c.origins[k], k.Line)
+		default:
+			key.LineComment = origin(c.origins[k], k.Line)
+		}
+		out.Content = append(out.Content, &key, value)
+	}
+	return &out
+}
+
+// Sources returns the files, environment variables and flags the config
+// was merged from, in order.
+func (c *Config) Sources() []string {
+	return c.sources
+}
+
+// Overrides returns the key=value overrides the config was loaded with.
+func (c *Config) Overrides() []string {
+	return c.sets
+}
+
+// Reload loads the config again from the same sources.
+func (c *Config) Reload() (*Config, error) {
+	return Load(c.Path, c.sets...)
+}
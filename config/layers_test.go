@@ -0,0 +1,156 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadLayers(t *testing.T) {
+	path := writeConfig(t, validConfig)
+	dir := filepath.Join(filepath.Dir(path), ConfDir)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{
+		"10-log.yaml":     "log:\n  level: warn\n  format: json\n",
+		"20-metrics.json": `{"metrics": {"listen": "127.0.0.1:9586"}, "log": {"level": "error"}}`,
+		"30-peer.toml":    "[peer]\npersistent_keepalive = 10\n",
+		"README":          "not a fragment",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("KH_LOG_FORMAT", "text")
+	t.Setenv("KH_INTERFACE_DNS_MODE", "off")
+	t.Setenv("KH_LOG_LEVELS_WG", "debug")
+	t.Setenv("KH_NOT_A_FIELD", "ignored")
+
+	cfg, err := ValidateFile(path, "interface.routes=10.1.0.0/16, 10.2.0.0/16", "log.level=debug")
+	if err != nil {
+		t.Fatalf("ValidateFile failed: %v", err)
+	}
+
+	if cfg.Log.Level != "debug" || cfg.Log.Format != "text" || cfg.Log.Levels["wg"] != "debug" || cfg.Log.Levels["etcd"] != "error" {
+		t.Errorf("Unexpected log config %+v", cfg.Log)
+	}
+	if cfg.Metrics.Listen != "127.0.0.1:9586" || cfg.ServerConfig.PersistentKeepalive != 10 || cfg.Interface.DNSMode != "off" {
+		t.Errorf("Fragments or variables not merged: %+v", cfg)
+	}
+	if !slices.Equal(cfg.Interface.Routes, []string{"10.1.0.0/16", "10.2.0.0/16"}) {
+		t.Errorf("Unexpected routes %v", cfg.Interface.Routes)
+	}
+	// Untouched values of merged mappings are kept
+	if cfg.ServerConfig.Endpoint != "vpn.example.com:51820" {
+		t.Errorf("Expected the base endpoint, got %q", cfg.ServerConfig.Endpoint)
+	}
+
+	wantSources := []string{
+		path,
+		filepath.Join(dir, "10-log.yaml"),
+		filepath.Join(dir, "20-metrics.json"),
+		filepath.Join(dir, "30-peer.toml"),
+		"$KH_INTERFACE_DNS_MODE",
+		"$KH_LOG_FORMAT",
+		"$KH_LOG_LEVELS_WG",
+		"--set interface.routes",
+		"--set log.level",
+	}
+	if !slices.Equal(cfg.Sources(), wantSources) {
+		t.Errorf("Expected sources %v, got %v", wantSources, cfg.Sources())
+	}
+
+	for key, want := range map[string]string{
+		"interface.address":         path + ":3",
+		"metrics.listen":            filepath.Join(dir, "20-metrics.json") + ":1",
+		"peer.persistent_keepalive": filepath.Join(dir, "30-peer.toml"),
+		"log.format":                "$KH_LOG_FORMAT",
+		"log.level":                 "--set log.level",
+		"psk.secret":                "",
+	} {
+		if got := cfg.Origin(key); got != want {
+			t.Errorf("Expected origin %q of %s, got %q", want, key, got)
+		}
+	}
+}
+
+func TestLoadLayerProblems(t *testing.T) {
+	path := writeConfig(t, validConfig)
+	dir := filepath.Join(filepath.Dir(path), ConfDir)
+	fragment := filepath.Join(dir, "10-log.yaml")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fragment, []byte("log:\n  formt: json\n  level: loud\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := ValidateFile(path, "peer.persistent_keepalive=often")
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Expected a ValidationError, got %v", err)
+	}
+	want := []Problem{
+		{File: fragment, Line: 2, Path: "log", Message: "unknown field formt"},
+		{File: fragment, Line: 3, Path: "log.level", Message: `unknown log level "loud", use debug, info, warn, error`},
+		{File: "--set peer.persistent_keepalive", Message: "cannot unmarshal !!str `often` into int"},
+	}
+	if !slices.Equal(verr.Problems, want) {
+		t.Errorf("Expected problems %v, got %v", want, verr.Problems)
+	}
+
+	if _, err := Load(path, "log.level"); err == nil || !strings.Contains(err.Error(), "key=value") {
+		t.Errorf("Expected an override without a value to be rejected, got %v", err)
+	}
+}
+
+func TestEnvPath(t *testing.T) {
+	for name, want := range map[string]string{
+		"INTERFACE_DNS":         "interface.dns",
+		"INTERFACE_DNS_MODE":    "interface.dns_mode",
+		"INTERFACE_PRIVATE_KEY": "interface.private_key",
+		"PEER_ENDPOINT":         "peer.endpoint",
+		"LOG_LEVELS_ETCD":       "log.levels.etcd",
+		"HEALTH_STALL_TIMEOUT":  "health.stall_timeout",
+		"KEY_PASSPHRASE":        "",
+		"SANDBOX_CHILD":         "",
+		"PATH":                  "",
+	} {
+		path, _, _ := envPath(name, configType)
+		if got := strings.Join(path, "."); got != want {
+			t.Errorf("Expected %s to be %q, got %q", name, want, got)
+		}
+	}
+}
+
+func TestEffective(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "# comment\n"+validConfig), "log.level=debug")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	data, err := cfg.Effective(false)
+	if err != nil {
+		t.Fatalf("Effective failed: %v", err)
+	}
+	out := string(data)
+	for _, s := range []string{
+		"private_key: <redacted> # " + cfg.Path + ":3\n",
+		"  routes: # " + cfg.Path + ":6\n    - 10.0.0.0/24\n",
+		"level: debug # --set log.level\n",
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Expected %q in:\n%s", s, out)
+		}
+	}
+	if strings.Contains(out, "# comment") {
+		t.Errorf("Expected the comments of the file to be dropped, got:\n%s", out)
+	}
+
+	if data, _ := cfg.Effective(true); !strings.Contains(string(data), "yAnz5TF") {
+		t.Errorf("Expected the private key with showSecrets, got:\n%s", data)
+	}
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CurrentVersion is the version of the config layout this client writes.
+// Files without a version field are version 0.
+const CurrentVersion = 1
+
+// Change is a change a migration made to a config document.
+type Change struct {
+	// File the change applies to
+	File string
+	// Line in the original file, 0 if unknown
+	Line    int
+	Message string
+}
+
+func (c Change) String() string {
+	if c.Line > 0 {
+		return fmt.Sprintf("line %d: %s", c.Line, c.Message)
+	}
+	return c.Message
+}
+
+// migrations[v] upgrades the root mapping of a version v document to
+// version v+1.
+var migrations = []func(root *yaml.Node) []Change{
+	migrateServerPeer,
+}
+
+// migrateServerPeer renames server_peer, which the sample config used to
+// document, to peer, under which it was always read.
+func migrateServerPeer(root *yaml.Node) []Change {
+	k, _ := mappingValue(root, "server_peer")
+	if k == nil {
+		return nil
+	}
+	if _, peer := mappingValue(root, "peer"); peer != nil && !isEmpty(peer) {
+		// Left for validation to report as an unknown field
+		return nil
+	}
+	removeKey(root, "peer")
+	k.Value = "peer"
+	return []Change{{Line: k.Line, Message: "server_peer renamed to peer"}}
+}
+
+// isEmpty reports whether n is null or an empty mapping.
+func isEmpty(n *yaml.Node) bool {
+	return n.Tag == "!!null" || (n.Kind == yaml.MappingNode && len(n.Content) == 0)
+}
+
+// removeKey deletes key from mapping m.
+func removeKey(m *yaml.Node, key string) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content = append(m.Content[:i], m.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// docVersion returns the version of the document with root mapping root.
+func docVersion(root *yaml.Node) (int, *yaml.Node, error) {
+	k, v := mappingValue(root, "version")
+	if k == nil {
+		return 0, nil, nil
+	}
+	version, err := strconv.Atoi(v.Value)
+	if err != nil || version < 0 {
+		return 0, k, fmt.Errorf("version must be a number, got %q", v.Value)
+	}
+	if version > CurrentVersion {
+		return 0, k, fmt.Errorf("config version %d is newer than this client supports (%d), upgrade the client", version, CurrentVersion)
+	}
+	return version, k, nil
+}
+
+// migrate upgrades the document with root mapping root to CurrentVersion
+// in place, returning the version it had and the changes made. The version
+// field itself is only updated if setVersion is set.
+func migrate(root *yaml.Node, setVersion bool) (int, []Change, error) {
+	from, _, err := docVersion(root)
+	if err != nil {
+		return 0, nil, err
+	}
+	var changes []Change
+	for v := from; v < CurrentVersion; v++ {
+		changes = append(changes, migrations[v](root)...)
+	}
+	if setVersion && from < CurrentVersion {
+		setVersionKey(root)
+	}
+	return from, changes, nil
+}
+
+// setVersionKey sets the version field to CurrentVersion, adding it as the
+// first field so that it is seen first.
+func setVersionKey(root *yaml.Node) {
+	value := strconv.Itoa(CurrentVersion)
+	if k, v := mappingValue(root, "version"); k != nil {
+		v.Kind, v.Tag, v.Value, v.Style, v.Content = yaml.ScalarNode, "", value, 0, nil
+		return
+	}
+	key := &yaml.Node{Kind: yaml.ScalarNode, Value: "version"}
+	if len(root.Content) > 0 {
+		// Keep the file's leading comment at the top
+		key.HeadComment, root.Content[0].HeadComment = root.Content[0].HeadComment, ""
+	}
+	root.Content = append([]*yaml.Node{key, {Kind: yaml.ScalarNode, Value: value}}, root.Content...)
+}
+
+// MigrateFile upgrades the config file at path to CurrentVersion, keeping
+// its comments and the order of its fields, and returns the version it had
+// and the changes made. The original file is kept as path.v<version>.bak.
+// Nothing is written if the file is current or dryRun is set. JSON and TOML
+// files are not rewritten: one that needs no changes is reported as current,
+// for any other MigrateFile fails.
+func MigrateFile(path string, dryRun bool) (int, []Change, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	root, err := parseDocument(path, data)
+	if err != nil {
+		return 0, nil, err
+	}
+	if root.Kind != yaml.MappingNode {
+		return 0, nil, fmt.Errorf("%s is not a mapping", path)
+	}
+	from, changes, err := migrate(root, false)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i := range changes {
+		changes[i].File = path
+	}
+	if !isYAML(path) && len(changes) == 0 {
+		return CurrentVersion, nil, nil
+	}
+	if from == CurrentVersion || dryRun {
+		return from, changes, nil
+	}
+	if !isYAML(path) {
+		return from, changes, fmt.Errorf("%s is not YAML, update it by hand", path)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	backup := fmt.Sprintf("%s.v%d.bak", path, from)
+	if err := writeFileAtomic(backup, data, info.Mode().Perm()); err != nil {
+		return 0, nil, fmt.Errorf("failed to back up config file: %w", err)
+	}
+	err = UpdateFile(path, func(doc *yaml.Node) error {
+		_, _, err := migrate(doc.Content[0], true)
+		return err
+	})
+	return from, changes, err
+}
@@ -0,0 +1,144 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// legacyConfig is the layout of the sample config before version 1.
+const legacyConfig = `# Client YAML configuration
+interface:
+  private_key: yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+  address: 10.0.0.2/24 # node address
+# The server
+server_peer:
+  public_key: yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+  endpoint: vpn.example.com:51820
+  allowed_ips: 10.0.0.1/32
+  persistent_keepalive: 25
+etcd:
+  endpoint: 10.0.0.1:2379
+`
+
+func TestLoadMigrates(t *testing.T) {
+	path := writeConfig(t, legacyConfig)
+	cfg, err := ValidateFile(path)
+	if err != nil {
+		t.Fatalf("Expected the legacy config to be valid, got %v", err)
+	}
+	if cfg.ServerConfig.Endpoint != "vpn.example.com:51820" {
+		t.Errorf("Expected the server peer to be read from server_peer, got %+v", cfg.ServerConfig)
+	}
+	if cfg.Version != CurrentVersion {
+		t.Errorf("Expected version %d, got %d", CurrentVersion, cfg.Version)
+	}
+	want := []Change{{File: path, Line: 6, Message: "server_peer renamed to peer"}}
+	if got := cfg.Migrations(); len(got) != 1 || got[0] != want[0] {
+		t.Errorf("Expected changes %v, got %v", want, got)
+	}
+
+	// A current config has nothing to migrate
+	cfg, err = Load(writeConfig(t, "version: 1\n"+validConfig))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(cfg.Migrations()) != 0 {
+		t.Errorf("Expected no changes, got %v", cfg.Migrations())
+	}
+
+	_, err = Load(writeConfig(t, "version: 99\n"+validConfig))
+	var verr *ValidationError
+	if !errors.As(err, &verr) || verr.Problems[0].Path != "version" {
+		t.Errorf("Expected a newer version to be rejected, got %v", err)
+	}
+}
+
+func TestMigrateFile(t *testing.T) {
+	path := writeConfig(t, legacyConfig)
+
+	from, changes, err := MigrateFile(path, true)
+	if err != nil || from != 0 || len(changes) != 1 {
+		t.Fatalf("Unexpected dry run result %d, %v, %v", from, changes, err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != legacyConfig {
+		t.Fatalf("Expected a dry run to leave the file alone, got:\n%s", data)
+	}
+
+	if _, _, err := MigrateFile(path, false); err != nil {
+		t.Fatalf("MigrateFile failed: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(data)
+	if !strings.HasPrefix(out, "# Client YAML configuration\nversion: 1\n") {
+		t.Errorf("Expected the version after the leading comment, got:\n%s", out)
+	}
+	for _, s := range []string{"# node address", "# The server\npeer:"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Expected %q in the migrated file, got:\n%s", s, out)
+		}
+	}
+	if strings.Contains(out, "server_peer") {
+		t.Errorf("Expected server_peer to be renamed, got:\n%s", out)
+	}
+	if backup, err := os.ReadFile(path + ".v0.bak"); err != nil || string(backup) != legacyConfig {
+		t.Errorf("Expected the original in the backup, got %q, %v", backup, err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load of the migrated file failed: %v", err)
+	}
+	if len(cfg.Migrations()) != 0 {
+		t.Errorf("Expected no changes left, got %v", cfg.Migrations())
+	}
+	if from, _, err := MigrateFile(path, false); err != nil || from != CurrentVersion {
+		t.Errorf("Expected the file to be current, got %d, %v", from, err)
+	}
+}
+
+func TestMigrateFileNotYAML(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"10-metrics.json": `{"metrics": {"listen": "127.0.0.1:9586"}}`,
+		"20-peer.toml":    "[peer]\npersistent_keepalive = 10\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		from, changes, err := MigrateFile(path, false)
+		if err != nil || from != CurrentVersion || len(changes) != 0 {
+			t.Errorf("Expected %s to be current, got %d, %v, %v", name, from, changes, err)
+		}
+		if got, _ := os.ReadFile(path); string(got) != data {
+			t.Errorf("Expected %s to be left alone, got:\n%s", name, got)
+		}
+	}
+
+	// One that needs changes has to be updated by hand
+	path := filepath.Join(dir, "30-server.json")
+	if err := os.WriteFile(path, []byte(`{"server_peer": {"persistent_keepalive": 10}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := MigrateFile(path, false); err == nil || !strings.Contains(err.Error(), "by hand") {
+		t.Errorf("Expected an error for a JSON file to rewrite, got %v", err)
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	_, err := Load(writeConfig(t, validConfig+"firewall:\n  rules:\n    - name: a\n      port: 22\n"))
+	var verr *ValidationError
+	if !errors.As(err, &verr) || len(verr.Problems) != 1 {
+		t.Fatalf("Expected one problem, got %v", err)
+	}
+	want := Problem{Line: 25, Path: "firewall.rules[0]", Message: "unknown field port"}
+	if verr.Problems[0] != want {
+		t.Errorf("Expected %v, got %v", want, verr.Problems[0])
+	}
+}
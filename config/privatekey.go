@@ -0,0 +1,214 @@
+package config
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// encryptedKeyPrefix marks a private key encrypted with EncryptPrivateKey.
+// The rest is base64 of the scrypt salt, the nonce and the sealed key.
+const encryptedKeyPrefix = "kh-encrypted-v1:"
+
+// scrypt parameters of encrypted keys, about 100ms on current hardware
+const (
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+	scryptSaltLen = 16
+)
+
+var (
+	// ErrNoPrivateKey is returned when no private key source is configured.
+	ErrNoPrivateKey = errors.New("no private key configured")
+	// ErrBadPassphrase is returned when an encrypted key can't be opened.
+	ErrBadPassphrase = errors.New("wrong passphrase or corrupted private key")
+)
+
+// PassphraseFunc returns the passphrase of an encrypted private key. It is
+// only called if the key is encrypted.
+type PassphraseFunc func() ([]byte, error)
+
+// KeySource returns the option the private key is read from, or "" if none
+// is set.
+func (i *InterfaceConfig) KeySource() string {
+	switch {
+	case i.PrivateKeyFile != "":
+		return "private_key_file"
+	case i.PrivateKeyEnv != "":
+		return "private_key_env"
+	case i.PrivateKeyCommand != "":
+		return "private_key_command"
+	case i.PrivateKey != "":
+		return "private_key"
+	}
+	return ""
+}
+
+// ResolvePrivateKey reads the private key from its configured source,
+// decrypts it if needed and stores it in PrivateKey. Exactly one source may
+// be set. Key files must be private to the running user. Once resolved,
+// further calls do nothing.
+func (i *InterfaceConfig) ResolvePrivateKey(passphrase PassphraseFunc) error {
+	if i.keyResolved {
+		return nil
+	}
+	set := 0
+	for _, value := range []string{i.PrivateKey, i.PrivateKeyFile, i.PrivateKeyEnv, i.PrivateKeyCommand} {
+		if value != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return fmt.Errorf("only one of private_key, private_key_file, private_key_env and private_key_command may be set")
+	}
+
+	var key string
+	switch i.KeySource() {
+	case "":
+		return ErrNoPrivateKey
+	case "private_key":
+		key = i.PrivateKey
+	case "private_key_file":
+		if err := CheckKeyFile(i.PrivateKeyFile); err != nil {
+			return err
+		}
+		data, err := os.ReadFile(i.PrivateKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read private key file: %w", err)
+		}
+		key = string(data)
+	case "private_key_env":
+		var ok bool
+		key, ok = os.LookupEnv(i.PrivateKeyEnv)
+		if !ok {
+			return fmt.Errorf("private key environment variable %s is not set", i.PrivateKeyEnv)
+		}
+	case "private_key_command":
+		var stderr bytes.Buffer
+		cmd := exec.Command("/bin/sh", "-c", i.PrivateKeyCommand)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return fmt.Errorf("private key command failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		key = string(out)
+	}
+
+	key = strings.TrimSpace(key)
+	if IsEncryptedKey(key) {
+		if passphrase == nil {
+			return fmt.Errorf("the private key is encrypted and no passphrase is available")
+		}
+		pass, err := passphrase()
+		if err != nil {
+			return fmt.Errorf("failed to read passphrase: %w", err)
+		}
+		key, err = DecryptPrivateKey(key, pass)
+		if err != nil {
+			return err
+		}
+		i.keyEncrypted = true
+	}
+	if key == "" {
+		return fmt.Errorf("private key from %s is empty", i.KeySource())
+	}
+	i.PrivateKey = key
+	i.keyResolved = true
+	return nil
+}
+
+// KeyEncrypted reports whether the resolved private key was stored
+// encrypted.
+func (i *InterfaceConfig) KeyEncrypted() bool {
+	return i.keyEncrypted
+}
+
+// CheckKeyFile makes sure the key file at path is a regular file owned by
+// the running user and neither readable nor writable by anyone else.
+func CheckKeyFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to read private key file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("private key file %s is not a regular file", path)
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return fmt.Errorf("private key file %s has mode %04o, it must not be accessible by group or others (chmod 600)", path, perm)
+	}
+	if uid, ok := fileOwner(info); ok && uid != os.Geteuid() {
+		return fmt.Errorf("private key file %s is owned by uid %d, not by the running user (uid %d)", path, uid, os.Geteuid())
+	}
+	return nil
+}
+
+// WriteKeyFile stores key in a new key file at path, readable only by its
+// owner.
+func WriteKeyFile(path, key string) error {
+	return writeFileAtomic(path, []byte(key+"\n"), 0600)
+}
+
+// IsEncryptedKey reports whether key was encrypted with EncryptPrivateKey.
+func IsEncryptedKey(key string) bool {
+	return strings.HasPrefix(strings.TrimSpace(key), encryptedKeyPrefix)
+}
+
+// EncryptPrivateKey seals key with a key derived from passphrase by scrypt,
+// using XChaCha20-Poly1305.
+func EncryptPrivateKey(key string, passphrase []byte) (string, error) {
+	if len(passphrase) == 0 {
+		return "", fmt.Errorf("passphrase must not be empty")
+	}
+	buf := make([]byte, scryptSaltLen+chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+	salt, nonce := buf[:scryptSaltLen], buf[scryptSaltLen:]
+	aead, err := keyAEAD(passphrase, salt)
+	if err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(buf, nonce, []byte(key), []byte(encryptedKeyPrefix))
+	return encryptedKeyPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptPrivateKey opens a key encrypted with EncryptPrivateKey.
+func DecryptPrivateKey(encrypted string, passphrase []byte) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(encrypted), encryptedKeyPrefix))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode encrypted private key: %w", err)
+	}
+	if len(data) < scryptSaltLen+chacha20poly1305.NonceSizeX+chacha20poly1305.Overhead {
+		return "", fmt.Errorf("encrypted private key is truncated")
+	}
+	salt := data[:scryptSaltLen]
+	nonce := data[scryptSaltLen : scryptSaltLen+chacha20poly1305.NonceSizeX]
+	aead, err := keyAEAD(passphrase, salt)
+	if err != nil {
+		return "", err
+	}
+	key, err := aead.Open(nil, nonce, data[len(salt)+len(nonce):], []byte(encryptedKeyPrefix))
+	if err != nil {
+		return "", ErrBadPassphrase
+	}
+	return string(key), nil
+}
+
+// keyAEAD derives the cipher of an encrypted key from passphrase and salt.
+func keyAEAD(passphrase, salt []byte) (cipher.AEAD, error) {
+	k, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	return chacha20poly1305.NewX(k)
+}
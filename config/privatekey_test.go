@@ -0,0 +1,148 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testKey = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+
+func TestEncryptPrivateKey(t *testing.T) {
+	enc, err := EncryptPrivateKey(testKey, []byte("correct horse"))
+	if err != nil {
+		t.Fatalf("EncryptPrivateKey failed: %v", err)
+	}
+	if !IsEncryptedKey(enc) || strings.Contains(enc, testKey) {
+		t.Fatalf("Expected an encrypted key, got %q", enc)
+	}
+
+	key, err := DecryptPrivateKey(enc, []byte("correct horse"))
+	if err != nil || key != testKey {
+		t.Errorf("Expected %q, got %q, %v", testKey, key, err)
+	}
+	if _, err := DecryptPrivateKey(enc, []byte("battery staple")); !errors.Is(err, ErrBadPassphrase) {
+		t.Errorf("Expected ErrBadPassphrase for a wrong passphrase, got %v", err)
+	}
+	if _, err := EncryptPrivateKey(testKey, nil); err == nil {
+		t.Error("Expected an empty passphrase to be rejected")
+	}
+}
+
+func TestResolvePrivateKey(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "private.key")
+	if err := WriteKeyFile(keyFile, testKey); err != nil {
+		t.Fatal(err)
+	}
+	enc, err := EncryptPrivateKey(testKey, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KH_TEST_KEY", testKey)
+	t.Setenv("KH_TEST_ENCRYPTED_KEY", enc)
+	passphrase := func() ([]byte, error) { return []byte("secret"), nil }
+
+	for name, iface := range map[string]InterfaceConfig{
+		"inline":    {PrivateKey: testKey},
+		"file":      {PrivateKeyFile: keyFile},
+		"env":       {PrivateKeyEnv: "KH_TEST_KEY"},
+		"command":   {PrivateKeyCommand: "echo " + testKey},
+		"encrypted": {PrivateKeyEnv: "KH_TEST_ENCRYPTED_KEY"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := iface.ResolvePrivateKey(passphrase); err != nil {
+				t.Fatalf("ResolvePrivateKey failed: %v", err)
+			}
+			if iface.PrivateKey != testKey {
+				t.Errorf("Expected %q, got %q", testKey, iface.PrivateKey)
+			}
+			if iface.KeyEncrypted() != (name == "encrypted") {
+				t.Errorf("Unexpected KeyEncrypted %v", iface.KeyEncrypted())
+			}
+			// Resolving again keeps the key
+			if err := iface.ResolvePrivateKey(nil); err != nil || iface.PrivateKey != testKey {
+				t.Errorf("Second resolve changed the key: %q, %v", iface.PrivateKey, err)
+			}
+		})
+	}
+
+	for name, iface := range map[string]InterfaceConfig{
+		"none":          {},
+		"two sources":   {PrivateKey: testKey, PrivateKeyEnv: "KH_TEST_KEY"},
+		"unset env":     {PrivateKeyEnv: "KH_TEST_UNSET"},
+		"failing cmd":   {PrivateKeyCommand: "exit 1"},
+		"no passphrase": {PrivateKey: enc},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := iface.ResolvePrivateKey(nil); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+func TestCheckKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "private.key")
+	if err := os.WriteFile(path, []byte(testKey), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckKeyFile(path); err == nil || !strings.Contains(err.Error(), "chmod 600") {
+		t.Errorf("Expected a world readable key file to be rejected, got %v", err)
+	}
+	iface := InterfaceConfig{PrivateKeyFile: path}
+	if err := iface.ResolvePrivateKey(nil); err == nil {
+		t.Error("Expected ResolvePrivateKey to refuse the key file")
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckKeyFile(path); err != nil {
+		t.Errorf("Expected a private key file to pass, got %v", err)
+	}
+	if err := CheckKeyFile(filepath.Dir(path)); err == nil {
+		t.Error("Expected a directory to be rejected")
+	}
+}
+
+func TestStorePrivateKey(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "config.yaml")
+	keyFile := filepath.Join(dir, "private.key")
+	if err := os.WriteFile(cfgPath, []byte("interface:\n  private_key_file: "+keyFile+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteKeyFile(keyFile, "old"); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := StorePrivateKey(cfgPath, &cfg.Interface, testKey, []byte("secret")); err != nil {
+		t.Fatalf("StorePrivateKey failed: %v", err)
+	}
+
+	cfg, err = Load(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Interface.PrivateKey != "" {
+		t.Errorf("Expected the key to stay out of the config, got %q", cfg.Interface.PrivateKey)
+	}
+	if err := cfg.Interface.ResolvePrivateKey(func() ([]byte, error) { return []byte("secret"), nil }); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Interface.PrivateKey != testKey || !cfg.Interface.KeyEncrypted() {
+		t.Errorf("Expected the encrypted new key, got %q", cfg.Interface.PrivateKey)
+	}
+
+	cfg.Interface = InterfaceConfig{PrivateKeyEnv: "KH_TEST_KEY"}
+	if err := StorePrivateKey(cfgPath, &cfg.Interface, testKey, nil); err == nil {
+		t.Error("Expected a key from the environment not to be stored")
+	}
+}
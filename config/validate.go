@@ -0,0 +1,561 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pabotesu/kurohabaki-client/internal/acl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is one problem found in a config.
+type Problem struct {
+	// File is the source of the problem if not the base file: a conf.d
+	// fragment, $NAME of an environment variable or --set key
+	File string
+	// Line in the file, 0 if unknown
+	Line int
+	// Path of the offending value, e.g. interface.address or forward[1];
+	// empty if unknown
+	Path    string
+	Message string
+}
+
+func (p Problem) String() string {
+	var b strings.Builder
+	if p.File != "" {
+		b.WriteString(p.File + ": ")
+	}
+	if p.Line > 0 {
+		fmt.Fprintf(&b, "line %d: ", p.Line)
+	}
+	if p.Path != "" {
+		b.WriteString(p.Path + ": ")
+	}
+	b.WriteString(p.Message)
+	return b.String()
+}
+
+// ValidationError lists all problems found in a config.
+type ValidationError struct {
+	// File the config was loaded from, if any
+	File     string
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	if e.File != "" {
+		fmt.Fprintf(&b, "%s: ", e.File)
+	}
+	fmt.Fprintf(&b, "%d problem(s) found", len(e.Problems))
+	for _, p := range e.Problems {
+		b.WriteString("\n  " + p.String())
+	}
+	return b.String()
+}
+
+// renamedFields are fields that used to be documented under another name.
+var renamedFields = map[string]string{
+	"server_peer": "peer",
+}
+
+var typeErrorLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// decodeProblems turns the errors of a decode into problems.
+func decodeProblems(err *yaml.TypeError) []Problem {
+	var problems []Problem
+	for _, msg := range err.Errors {
+		var p Problem
+		if m := typeErrorLine.FindStringSubmatch(msg); m != nil {
+			p.Line, _ = strconv.Atoi(m[1])
+			msg = m[2]
+		}
+		p.Message = msg
+		problems = append(problems, p)
+	}
+	return problems
+}
+
+// unknownFields reports the keys under n that have no field in t, the type
+// n is decoded into. Values of the wrong kind are left to the decoder.
+func unknownFields(n *yaml.Node, t reflect.Type, path string) []Problem {
+	for n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var problems []Problem
+	switch {
+	case t.Kind() == reflect.Struct && n.Kind == yaml.MappingNode:
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			if k.Value == "<<" {
+				// Merge key
+				problems = append(problems, unknownFields(v, t, path)...)
+				continue
+			}
+			ft, ok := fields[k.Value]
+			if !ok {
+				msg := "unknown field " + k.Value
+				if name, ok := renamedFields[k.Value]; ok && path == "" {
+					msg += ", did you mean " + name + "?"
+				}
+				problems = append(problems, Problem{Line: k.Line, Path: path, Message: msg})
+				continue
+			}
+			problems = append(problems, unknownFields(v, ft, joinPath(path, k.Value))...)
+		}
+	case t.Kind() == reflect.Map && n.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			problems = append(problems, unknownFields(n.Content[i+1], t.Elem(), joinPath(path, n.Content[i].Value))...)
+		}
+	case t.Kind() == reflect.Slice && n.Kind == yaml.SequenceNode:
+		for i, item := range n.Content {
+			problems = append(problems, unknownFields(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return problems
+}
+
+// yamlFields returns the types of the fields of struct t by YAML key.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		switch name {
+		case "-":
+			continue
+		case "":
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// ValidateFile loads the config at path like Load and checks it, returning
+// a ValidationError with every problem found: unknown fields, values of the
+// wrong type and invalid settings.
+func ValidateFile(path string, sets ...string) (*Config, error) {
+	cfg, problems, err := load(path, sets)
+	if err != nil {
+		return nil, err
+	}
+	problems = append(problems, cfg.problems()...)
+	if len(problems) > 0 {
+		// By source, in the order of the layers, then by line
+		order := func(p Problem) int {
+			if p.File == "" {
+				return 0
+			}
+			return slices.Index(cfg.sources, p.File)
+		}
+		slices.SortStableFunc(problems, func(a, b Problem) int {
+			if a.File != b.File {
+				return order(a) - order(b)
+			}
+			return a.Line - b.Line
+		})
+		return nil, &ValidationError{File: path, Problems: problems}
+	}
+	return cfg, nil
+}
+
+// Validate checks the settings of the config, returning a ValidationError
+// with every problem found.
+func (c *Config) Validate() error {
+	if problems := c.problems(); len(problems) > 0 {
+		return &ValidationError{File: c.Path, Problems: problems}
+	}
+	return nil
+}
+
+// validator collects the problems of a config.
+type validator struct {
+	cfg      *Config
+	problems []Problem
+}
+
+func (v *validator) add(path, format string, args ...any) {
+	file, line := v.cfg.position(path)
+	if file == v.cfg.Path {
+		file = ""
+	}
+	v.problems = append(v.problems, Problem{
+		File:    file,
+		Line:    line,
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// check adds err, if any, as a problem of path.
+func (v *validator) check(path string, err error) {
+	if err != nil {
+		v.add(path, "%v", err)
+	}
+}
+
+func (c *Config) problems() []Problem {
+	v := &validator{cfg: c}
+
+	c.checkInterface(v)
+
+	p := c.ServerConfig
+	if p.PublicKey == "" {
+		v.add("peer.public_key", "the server peer's public key is required")
+	} else {
+		v.check("peer.public_key", checkKey(p.PublicKey))
+	}
+	if p.Endpoint == "" {
+		v.add("peer.endpoint", "the server peer's endpoint is required")
+	} else {
+		v.check("peer.endpoint", checkHostPort(p.Endpoint, false))
+	}
+	if p.AllowedIPs == "" {
+		v.add("peer.allowed_ips", "the server peer's allowed IPs are required")
+	} else {
+		v.check("peer.allowed_ips", checkPrefix(p.AllowedIPs))
+	}
+	if p.PersistentKeepalive < 0 || p.PersistentKeepalive > 65535 {
+		v.add("peer.persistent_keepalive", "must be between 0 and 65535 seconds")
+	}
+	if p.PresharedKey != "" {
+		v.check("peer.preshared_key", checkKey(p.PresharedKey))
+	}
+
+	if c.Etcd.Endpoint != "" {
+		v.check("etcd.endpoint", checkEtcdEndpoint(c.Etcd.Endpoint))
+	}
+
+	if c.PQ.RotationInterval < 0 {
+		v.add("pq.rotation_interval", "must not be negative")
+	}
+
+	if c.MeshDNS.Listen != "" {
+		v.check("mesh_dns.listen", checkHostPort(c.MeshDNS.Listen, true))
+	}
+	for i, u := range c.MeshDNS.Upstream {
+		v.check(fmt.Sprintf("mesh_dns.upstream[%d]", i), checkHostPort(u, false))
+	}
+
+	for i, s := range c.Services {
+		path := fmt.Sprintf("services[%d]", i)
+		if s.Name == "" {
+			v.add(path+".name", "service name is empty")
+		}
+		if s.Port < 1 || s.Port > 65535 {
+			v.add(path+".port", "must be between 1 and 65535")
+		}
+		if s.Proto() != "tcp" && s.Proto() != "udp" {
+			v.add(path+".protocol", "must be tcp or udp")
+		}
+	}
+	for i, tag := range c.Tags {
+		v.check(fmt.Sprintf("tags[%d]", i), acl.ValidateTag(tag))
+	}
+
+	switch c.Firewall.Mode {
+	case "", "off", "userspace":
+	case "nftables":
+		if c.Netstack.Enabled {
+			v.add("firewall.mode", "the nftables firewall needs a TUN interface, use the userspace firewall with netstack")
+		}
+	default:
+		v.add("firewall.mode", "unknown firewall mode %q, use off, userspace or nftables", c.Firewall.Mode)
+	}
+	names := make(map[string]bool)
+	for i, r := range c.Firewall.Rules {
+		path := fmt.Sprintf("firewall.rules[%d]", i)
+		if r.Name == "" || names[r.Name] {
+			v.add(path+".name", "name %q is empty or not unique", r.Name)
+		}
+		names[r.Name] = true
+		v.check(path, r.Validate())
+	}
+
+	for _, addr := range []struct{ path, value string }{
+		{"netstack.socks5", c.Netstack.SOCKS5},
+		{"netstack.http", c.Netstack.HTTP},
+	} {
+		if addr.value != "" && addr.value != "off" {
+			v.check(addr.path, checkHostPort(addr.value, true))
+		}
+	}
+
+	names = make(map[string]bool)
+	for i, f := range c.Forwards {
+		path := fmt.Sprintf("forward[%d]", i)
+		if f.Name == "" || names[f.Name] {
+			v.add(path+".name", "name %q is empty or not unique", f.Name)
+		}
+		names[f.Name] = true
+		v.check(path, f.Validate())
+	}
+
+	if c.Metrics.Listen != "" {
+		v.check("metrics.listen", checkHostPort(c.Metrics.Listen, true))
+	}
+	for i, l := range c.Metrics.PeerLabels {
+		if l != "public_key" && l != "hostname" && l != "none" {
+			v.add(fmt.Sprintf("metrics.peer_labels[%d]", i), "unknown peer label %q, use public_key, hostname or none", l)
+		}
+	}
+	if c.Metrics.MaxPeers < 0 {
+		v.add("metrics.max_peers", "must not be negative")
+	}
+
+	if c.Health.Listen != "" {
+		v.check("health.listen", checkHostPort(c.Health.Listen, true))
+	}
+	for _, d := range []struct {
+		path  string
+		value int64
+	}{
+		{"health.stall_timeout", int64(c.Health.StallTimeout)},
+		{"health.sync_max_age", int64(c.Health.SyncMaxAge)},
+		{"health.handshake_max_age", int64(c.Health.HandshakeMaxAge)},
+	} {
+		if d.value < 0 {
+			v.add(d.path, "must not be negative")
+		}
+	}
+
+	c.checkLog(v)
+
+	return v.problems
+}
+
+func (c *Config) checkInterface(v *validator) {
+	i := c.Interface
+	if !i.keyResolved {
+		set := 0
+		for _, value := range []string{i.PrivateKey, i.PrivateKeyFile, i.PrivateKeyEnv, i.PrivateKeyCommand} {
+			if value != "" {
+				set++
+			}
+		}
+		switch {
+		case set == 0:
+			v.add("interface.private_key", "a private key is required: set private_key, private_key_file, private_key_env or private_key_command")
+		case set > 1:
+			v.add("interface."+i.KeySource(), "only one of private_key, private_key_file, private_key_env and private_key_command may be set")
+		case i.PrivateKey != "" && !IsEncryptedKey(i.PrivateKey):
+			v.check("interface.private_key", checkKey(i.PrivateKey))
+		case i.PrivateKeyFile != "":
+			v.check("interface.private_key_file", CheckKeyFile(i.PrivateKeyFile))
+		}
+	}
+
+	if i.Address == "" {
+		v.add("interface.address", "the interface address is required")
+	} else {
+		v.check("interface.address", checkPrefix(i.Address))
+	}
+	if i.ListenPort < 0 || i.ListenPort > 65535 {
+		v.add("interface.listen_port", "must be between 0 and 65535")
+	}
+	for _, s := range strings.Split(i.DNS, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			if _, err := netip.ParseAddr(s); err != nil {
+				v.add("interface.dns", "invalid IP address %q", s)
+			}
+		}
+	}
+	switch i.DNSMode {
+	case "", "auto", "resolved", "file", "off":
+	default:
+		v.add("interface.dns_mode", "unknown DNS mode %q, use auto, resolved, file or off", i.DNSMode)
+	}
+	for n, r := range i.Routes {
+		v.check(fmt.Sprintf("interface.routes[%d]", n), checkPrefix(r))
+	}
+}
+
+// logLevels and logSubsystems are the names accepted by the logger.
+var (
+	logLevels     = []string{"debug", "info", "warn", "error"}
+	logSubsystems = []string{"agent", "wg", "etcd", "wireguard"}
+)
+
+func (c *Config) checkLog(v *validator) {
+	l := c.Log
+	if l.Level != "" && !slices.Contains(logLevels, l.Level) {
+		v.add("log.level", "unknown log level %q, use %s", l.Level, strings.Join(logLevels, ", "))
+	}
+	names := make([]string, 0, len(l.Levels))
+	for name := range l.Levels {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		level := l.Levels[name]
+		path := "log.levels." + name
+		if !slices.Contains(logSubsystems, name) {
+			v.add(path, "unknown log subsystem %q, use one of %s", name, strings.Join(logSubsystems, ", "))
+		}
+		if !slices.Contains(logLevels, level) {
+			v.add(path, "unknown log level %q, use %s", level, strings.Join(logLevels, ", "))
+		}
+	}
+	switch l.Format {
+	case "", "text", "json":
+	default:
+		v.add("log.format", "unknown log format %q, use text or json", l.Format)
+	}
+	if l.MaxSize < 0 {
+		v.add("log.max_size", "must not be negative")
+	}
+	if l.MaxFiles < 0 {
+		v.add("log.max_files", "must not be negative")
+	}
+}
+
+// Validate checks the settings of a forward, except its name.
+func (f Forward) Validate() error {
+	switch f.Protocol {
+	case "", "tcp", "udp":
+	default:
+		return errors.New("protocol must be tcp or udp")
+	}
+	switch f.Direction {
+	case "", "local", "remote":
+	default:
+		return errors.New("direction must be local or remote")
+	}
+	if _, _, err := net.SplitHostPort(f.Listen); err != nil {
+		return fmt.Errorf("invalid listen address: %w", err)
+	}
+	if host, _, err := net.SplitHostPort(f.Target); err != nil || host == "" {
+		return errors.New("target must be host:port")
+	}
+	return nil
+}
+
+// Validate checks the settings of a firewall rule, except its name.
+func (r FirewallRule) Validate() error {
+	if r.Action != "allow" && r.Action != "drop" {
+		return errors.New("action must be allow or drop")
+	}
+	if r.Direction != "in" && r.Direction != "out" {
+		return errors.New("direction must be in or out")
+	}
+	for _, spec := range r.Ports {
+		if _, err := acl.ParsePortRange(spec); err != nil {
+			return err
+		}
+	}
+	for _, tag := range r.Tags {
+		if err := acl.ValidateTag(tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkKey(s string) error {
+	if _, err := wgtypes.ParseKey(s); err != nil {
+		return errors.New("invalid key: must be 32 bytes in base64")
+	}
+	return nil
+}
+
+func checkPrefix(s string) error {
+	if _, err := netip.ParsePrefix(s); err != nil {
+		return fmt.Errorf("invalid CIDR %q", s)
+	}
+	return nil
+}
+
+// checkHostPort checks a host:port address; listen addresses may leave out
+// the host.
+func checkHostPort(s string, listen bool) error {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: must be host:port", s)
+	}
+	if host == "" && !listen {
+		return fmt.Errorf("invalid address %q: missing host", s)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 || (n == 0 && !listen) {
+		return fmt.Errorf("invalid port in %q", s)
+	}
+	return nil
+}
+
+// checkEtcdEndpoint accepts host:port, optionally as an http or https URL.
+func checkEtcdEndpoint(s string) error {
+	if scheme, rest, ok := strings.Cut(s, "://"); ok {
+		if scheme != "http" && scheme != "https" {
+			return fmt.Errorf("unsupported scheme in %q, use http or https", s)
+		}
+		s = strings.TrimSuffix(rest, "/")
+	}
+	return checkHostPort(s, false)
+}
+
+// position returns the source and line of the value at path, or of the
+// closest parent found; the line is 0 if unknown. Path elements are
+// separated by dots, sequence items are selected by [i].
+func (c *Config) position(path string) (string, int) {
+	n := c.node
+	if n == nil {
+		return "", 0
+	}
+	source, line := "", 0
+	for _, elem := range strings.Split(path, ".") {
+		key, index := elem, -1
+		if name, idx, ok := strings.Cut(elem, "["); ok {
+			key = name
+			index, _ = strconv.Atoi(strings.TrimSuffix(idx, "]"))
+		}
+		k, v := mappingValue(n, key)
+		if v == nil {
+			return source, line
+		}
+		n, source, line = v, c.origins[k], k.Line
+		if index >= 0 {
+			if n.Kind != yaml.SequenceNode || index >= len(n.Content) {
+				return source, line
+			}
+			n = n.Content[index]
+			source, line = c.origins[n], n.Line
+		}
+	}
+	return source, line
+}
+
+// mappingValue returns the key and value nodes of key in mapping m, or nil.
+func mappingValue(m *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if m.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i], m.Content[i+1]
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,158 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const validConfig = `interface:
+  private_key: yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+  address: 10.0.0.2/24
+  dns: 1.1.1.1
+  routes:
+    - 10.0.0.0/24
+peer:
+  public_key: yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+  endpoint: vpn.example.com:51820
+  allowed_ips: 10.0.0.1/32
+  persistent_keepalive: 25
+etcd:
+  endpoint: https://10.0.0.1:2379
+forward:
+  - name: db
+    listen: 127.0.0.1:5432
+    target: db.kh.internal:5432
+log:
+  level: info
+  levels:
+    etcd: error
+`
+
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidateFile(t *testing.T) {
+	if _, err := ValidateFile(writeConfig(t, validConfig)); err != nil {
+		t.Fatalf("Expected the config to be valid, got %v", err)
+	}
+
+	path := writeConfig(t, `version: 1
+interface:
+  private_key: yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+  address: 10.0.0.2
+server_peer:
+  public_key: yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+forward:
+  - name: db
+    listen: 127.0.0.1:5432
+    target: db:5432
+  - name: db
+    protocol: sctp
+    listen: :514
+    target: 127.0.0.1:514
+log:
+  max_files: five
+`)
+	_, err := ValidateFile(path)
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Expected a ValidationError, got %v", err)
+	}
+
+	want := []Problem{
+		{Line: 4, Path: "interface.address", Message: `invalid CIDR "10.0.0.2"`},
+		{Line: 5, Message: "unknown field server_peer, did you mean peer?"},
+		{Line: 11, Path: "forward[1].name", Message: `name "db" is empty or not unique`},
+		{Line: 11, Path: "forward[1]", Message: "protocol must be tcp or udp"},
+		{Line: 16, Message: "cannot unmarshal !!str `five` into int"},
+	}
+	got := make(map[Problem]bool)
+	for _, p := range verr.Problems {
+		got[p] = true
+	}
+	for _, p := range want {
+		if !got[p] {
+			t.Errorf("Missing problem %q in:\n%v", p, verr)
+		}
+	}
+	// The server peer is missing since it is under the wrong key, which a
+	// current file isn't migrated from
+	if !strings.Contains(verr.Error(), "peer.public_key: the server peer's public key is required") {
+		t.Errorf("Expected the missing server peer to be reported, got:\n%v", verr)
+	}
+}
+
+func TestLoadStrict(t *testing.T) {
+	_, err := Load(writeConfig(t, validConfig+"unknown: 1\n"))
+	var verr *ValidationError
+	if !errors.As(err, &verr) || len(verr.Problems) != 1 || verr.Problems[0].Message != "unknown field unknown" {
+		t.Errorf("Expected the unknown field to be rejected, got %v", err)
+	}
+
+	// Load leaves the settings to Validate
+	cfg, err := Load(writeConfig(t, "interface:\n  address: nope\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "line 2: interface.address") {
+		t.Errorf("Expected Validate to report the address with its line, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *Config {
+		cfg := &Config{
+			Interface: InterfaceConfig{PrivateKey: testKey, Address: "10.0.0.2/24"},
+			ServerConfig: ServerPeer{
+				PublicKey:  testKey,
+				Endpoint:   "192.168.1.1:51820",
+				AllowedIPs: "10.0.0.1/32",
+			},
+		}
+		cfg.Etcd.Endpoint = "192.168.1.100:2379"
+		return cfg
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("Expected the config to be valid, got %v", err)
+	}
+
+	for name, mutate := range map[string]func(c *Config){
+		"two key sources":   func(c *Config) { c.Interface.PrivateKeyEnv = "KEY" },
+		"no key":            func(c *Config) { c.Interface.PrivateKey = "" },
+		"listen port":       func(c *Config) { c.Interface.ListenPort = 70000 },
+		"dns mode":          func(c *Config) { c.Interface.DNSMode = "magic" },
+		"etcd scheme":       func(c *Config) { c.Etcd.Endpoint = "ftp://etcd:2379" },
+		"service port":      func(c *Config) { c.Services = []Service{{Name: "web"}} },
+		"firewall mode":     func(c *Config) { c.Firewall.Mode = "iptables" },
+		"nftables netstack": func(c *Config) { c.Firewall.Mode, c.Netstack.Enabled = "nftables", true },
+		"firewall rule": func(c *Config) {
+			c.Firewall.Rules = []FirewallRule{{Name: "r", Action: "allow", Direction: "in", Ports: []string{"tcp:x"}}}
+		},
+		"metrics label":       func(c *Config) { c.Metrics.PeerLabels = []string{"ip"} },
+		"health listen":       func(c *Config) { c.Health.Listen = "localhost" },
+		"log subsystem":       func(c *Config) { c.Log.Levels = map[string]string{"dns": "debug"} },
+		"log format":          func(c *Config) { c.Log.Format = "xml" },
+		"negative keepalive":  func(c *Config) { c.ServerConfig.PersistentKeepalive = -1 },
+		"bad upstream":        func(c *Config) { c.MeshDNS.Upstream = []string{"1.1.1.1"} },
+		"forward target":      func(c *Config) { c.Forwards = []Forward{{Name: "f", Listen: ":1", Target: ":2"}} },
+		"netstack socks5":     func(c *Config) { c.Netstack.SOCKS5 = "1080" },
+		"unreadable key file": func(c *Config) { c.Interface.PrivateKey, c.Interface.PrivateKeyFile = "", "/nonexistent" },
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := valid()
+			mutate(cfg)
+			if err := cfg.Validate(); err == nil {
+				t.Error("Expected a problem")
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+// Package acl evaluates the mesh access policy. The policy is a list of allow
+// rules from source tags to destination tags and ports; traffic that no rule
+// allows is denied.
+package acl
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Wildcard matches every node as a tag and every port as a port spec.
+const Wildcard = "*"
+
+// Policy is the ACL document stored in etcd.
+type Policy struct {
+	// Version must increase with every change so that agents can refuse
+	// to go back to an older policy.
+	Version int    `json:"version"`
+	Rules   []Rule `json:"rules"`
+}
+
+// Rule allows nodes tagged with any of Src to reach nodes tagged with any
+// of Dst on Ports. Ports are "*", "<proto>", "<proto>:<port>",
+// "<proto>:<from>-<to>" or a bare port or range for both tcp and udp, with
+// proto one of tcp, udp or icmp. No ports means all.
+type Rule struct {
+	Src   []string `json:"src"`
+	Dst   []string `json:"dst"`
+	Ports []string `json:"ports,omitempty"`
+
+	ranges []PortRange
+}
+
+// PortRange is a protocol and an inclusive port range. An empty Proto
+// matches tcp and udp; icmp has no ports.
+type PortRange struct {
+	Proto string
+	From  uint16
+	To    uint16
+}
+
+// Parse decodes and validates a policy. Unknown fields are rejected so that
+// a misspelt key cannot silently widen access.
+func Parse(data []byte) (*Policy, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	var p Policy
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Validate checks the policy and prepares its port ranges. It reports every
+// problem found.
+func (p *Policy) Validate() error {
+	var errs []error
+	if p.Version < 1 {
+		errs = append(errs, errors.New("version must be at least 1"))
+	}
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if len(r.Src) == 0 {
+			errs = append(errs, fmt.Errorf("rule %d: src is empty", i))
+		}
+		if len(r.Dst) == 0 {
+			errs = append(errs, fmt.Errorf("rule %d: dst is empty", i))
+		}
+		for _, tag := range append(slices.Clone(r.Src), r.Dst...) {
+			if err := ValidateTag(tag); err != nil && tag != Wildcard {
+				errs = append(errs, fmt.Errorf("rule %d: %w", i, err))
+			}
+		}
+
+		r.ranges = nil
+		ports := r.Ports
+		if len(ports) == 0 {
+			ports = []string{Wildcard}
+		}
+		for _, spec := range ports {
+			pr, err := ParsePortRange(spec)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("rule %d: %w", i, err))
+				continue
+			}
+			r.ranges = append(r.ranges, pr)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid policy: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// ValidateTag checks that tag is a lowercase name made of letters, digits,
+// '-', '_' and ':'.
+func ValidateTag(tag string) error {
+	if tag == "" {
+		return errors.New("empty tag")
+	}
+	for _, c := range tag {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == ':') {
+			return fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+	return nil
+}
+
+// ParsePortRange parses a port spec as described on Rule.
+func ParsePortRange(spec string) (PortRange, error) {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	if spec == Wildcard {
+		return PortRange{From: 0, To: 65535}, nil
+	}
+
+	proto, ports, hasPorts := strings.Cut(spec, ":")
+	if !hasPorts {
+		switch spec {
+		case "tcp", "udp":
+			return PortRange{Proto: spec, From: 0, To: 65535}, nil
+		case "icmp":
+			return PortRange{Proto: spec}, nil
+		}
+		proto, ports = "", spec
+	}
+	switch proto {
+	case "", "tcp", "udp":
+	case "icmp":
+		return PortRange{}, fmt.Errorf("invalid port spec %q: icmp has no ports", spec)
+	default:
+		return PortRange{}, fmt.Errorf("invalid port spec %q: unknown protocol", spec)
+	}
+
+	if ports == Wildcard {
+		return PortRange{Proto: proto, From: 0, To: 65535}, nil
+	}
+	fromStr, toStr, isRange := strings.Cut(ports, "-")
+	if !isRange {
+		toStr = fromStr
+	}
+	from, err1 := strconv.ParseUint(fromStr, 10, 16)
+	to, err2 := strconv.ParseUint(toStr, 10, 16)
+	if err1 != nil || err2 != nil || from > to {
+		return PortRange{}, fmt.Errorf("invalid port spec %q", spec)
+	}
+	return PortRange{Proto: proto, From: uint16(from), To: uint16(to)}, nil
+}
+
+// Match reports whether the range covers proto and port.
+func (r PortRange) Match(proto string, port uint16) bool {
+	switch {
+	case r.Proto == "icmp" || proto == "icmp":
+		return r.Proto == proto || (r.Proto == "" && r.From == 0 && r.To == 65535)
+	case r.Proto != "" && r.Proto != proto:
+		return false
+	}
+	return port >= r.From && port <= r.To
+}
+
+func (r PortRange) String() string {
+	var ports string
+	switch {
+	case r.Proto == "icmp":
+		return r.Proto
+	case r.From == 0 && r.To == 65535:
+		ports = Wildcard
+	case r.From == r.To:
+		ports = strconv.Itoa(int(r.From))
+	default:
+		ports = fmt.Sprintf("%d-%d", r.From, r.To)
+	}
+	if r.Proto == "" {
+		return ports
+	}
+	return r.Proto + ":" + ports
+}
+
+// Access is what a policy allows between this node and one peer.
+type Access struct {
+	// Inbound lists what the peer may reach on this node
+	Inbound []PortRange
+	// Outbound lists what this node may reach on the peer
+	Outbound []PortRange
+}
+
+// Allowed reports whether any traffic is allowed, i.e. whether the peer
+// should be installed at all.
+func (a Access) Allowed() bool {
+	return len(a.Inbound) > 0 || len(a.Outbound) > 0
+}
+
+// AllowsInbound reports whether the peer may reach this node on proto/port.
+func (a Access) AllowsInbound(proto string, port uint16) bool {
+	return matchAny(a.Inbound, proto, port)
+}
+
+// AllowsOutbound reports whether this node may reach the peer on proto/port.
+func (a Access) AllowsOutbound(proto string, port uint16) bool {
+	return matchAny(a.Outbound, proto, port)
+}
+
+func matchAny(ranges []PortRange, proto string, port uint16) bool {
+	for _, r := range ranges {
+		if r.Match(proto, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate returns the access between a node tagged selfTags and a peer
+// tagged peerTags. A nil policy allows everything.
+func (p *Policy) Evaluate(selfTags, peerTags []string) Access {
+	if p == nil {
+		all := []PortRange{{From: 0, To: 65535}}
+		return Access{Inbound: all, Outbound: all}
+	}
+
+	var access Access
+	for _, r := range p.Rules {
+		if matchTags(r.Src, peerTags) && matchTags(r.Dst, selfTags) {
+			access.Inbound = append(access.Inbound, r.ranges...)
+		}
+		if matchTags(r.Src, selfTags) && matchTags(r.Dst, peerTags) {
+			access.Outbound = append(access.Outbound, r.ranges...)
+		}
+	}
+	return access
+}
+
+// matchTags reports whether a node with tags is selected by ruleTags.
+func matchTags(ruleTags, tags []string) bool {
+	for _, t := range ruleTags {
+		if t == Wildcard || slices.Contains(tags, t) {
+			return true
+		}
+	}
+	return false
+}
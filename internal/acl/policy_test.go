@@ -0,0 +1,107 @@
+package acl
+
+import (
+	"strings"
+	"testing"
+)
+
+const testPolicy = `{
+  "version": 2,
+  "rules": [
+    {"src": ["dev"], "dst": ["db"], "ports": ["tcp:5432"]},
+    {"src": ["*"], "dst": ["dns"], "ports": ["53", "icmp"]},
+    {"src": ["admin"], "dst": ["*"]}
+  ]
+}`
+
+func TestEvaluate(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	// dev -> db: outbound postgres only, nothing inbound
+	a := p.Evaluate([]string{"dev"}, []string{"db"})
+	if !a.Allowed() {
+		t.Fatal("Expected dev to reach db")
+	}
+	if !a.AllowsOutbound("tcp", 5432) || a.AllowsOutbound("tcp", 22) || a.AllowsOutbound("udp", 5432) {
+		t.Errorf("Unexpected outbound access: %v", a.Outbound)
+	}
+	if len(a.Inbound) != 0 {
+		t.Errorf("Expected no inbound access, got %v", a.Inbound)
+	}
+
+	// The db sees the same rule from the other side
+	a = p.Evaluate([]string{"db"}, []string{"dev"})
+	if !a.AllowsInbound("tcp", 5432) || len(a.Outbound) != 0 {
+		t.Errorf("Unexpected access for db: %+v", a)
+	}
+
+	// Wildcard source, bare port for tcp and udp, icmp
+	a = p.Evaluate([]string{"web"}, []string{"dns"})
+	if !a.AllowsOutbound("udp", 53) || !a.AllowsOutbound("tcp", 53) || !a.AllowsOutbound("icmp", 0) || a.AllowsOutbound("tcp", 80) {
+		t.Errorf("Unexpected access to dns: %v", a.Outbound)
+	}
+
+	// No ports means everything, including icmp
+	a = p.Evaluate([]string{"admin"}, nil)
+	if !a.AllowsOutbound("tcp", 22) || !a.AllowsOutbound("icmp", 0) {
+		t.Errorf("Expected admin to reach everything, got %v", a.Outbound)
+	}
+
+	// Untagged peers with no matching rule are not installed
+	if a := p.Evaluate([]string{"web"}, []string{"web"}); a.Allowed() {
+		t.Errorf("Expected no access between web nodes, got %+v", a)
+	}
+
+	// Without a policy the mesh is open
+	var none *Policy
+	if a := none.Evaluate(nil, nil); !a.AllowsInbound("udp", 1) || !a.AllowsOutbound("tcp", 65535) {
+		t.Errorf("Expected nil policy to allow everything, got %+v", a)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want []string
+	}{
+		{"NotJSON", `version: 1`, []string{"invalid policy"}},
+		{"UnknownField", `{"version": 1, "rules": [{"source": ["a"], "dst": ["b"]}]}`, []string{"unknown field"}},
+		{"AllProblems", `{"rules": [{"src": ["Dev"], "dst": [], "ports": ["sctp:1", "tcp:9-1", "icmp:8"]}]}`, []string{
+			"version must be at least 1",
+			`invalid tag "Dev"`,
+			"rule 0: dst is empty",
+			"unknown protocol",
+			`"tcp:9-1"`,
+			"icmp has no ports",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.doc))
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Expected error to contain %q, got: %v", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestPortRangeString(t *testing.T) {
+	for _, spec := range []string{"*", "tcp:*", "udp:53", "tcp:8000-8100", "443", "icmp"} {
+		pr, err := ParsePortRange(spec)
+		if err != nil {
+			t.Fatalf("ParsePortRange(%q): %v", spec, err)
+		}
+		if pr.String() != spec {
+			t.Errorf("ParsePortRange(%q).String() = %q", spec, pr.String())
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/netip"
+	"reflect"
+
+	"github.com/pabotesu/kurohabaki-client/internal/acl"
+	"github.com/pabotesu/kurohabaki-client/internal/etcd"
+	"github.com/pabotesu/kurohabaki-client/internal/filter"
+	"github.com/pabotesu/kurohabaki-client/internal/logger"
+)
+
+// aclState is the policy in force and the outcome of the last update.
+type aclState struct {
+	policy   *acl.Policy
+	fetched  bool   // whether the document has been read at all
+	revision int64  // etcd revision of the document last seen
+	err      string // why the document at revision was rejected
+	denied   []string
+}
+
+// publishTags stores this node's tags in its record.
+func (a *Agent) publishTags() {
+	var tags []string
+	for _, tag := range a.cfg.Tags {
+		if err := acl.ValidateTag(tag); err != nil {
+			logger.Warnf("Ignoring tag: %v", err)
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	if len(tags) == 0 {
+		if err := etcd.DeleteNodeField(a.etcdClient, a.selfPubKey, "tags"); err != nil {
+			logger.Errorf("Failed to clear tags: %v", err)
+		}
+		return
+	}
+
+	data, err := json.Marshal(tags)
+	if err != nil {
+		logger.Errorf("Failed to encode tags: %v", err)
+		return
+	}
+	if err := etcd.PutNodeField(a.etcdClient, a.selfPubKey, "tags", string(data), 0); err != nil {
+		logger.Errorf("Failed to publish tags: %v", err)
+	}
+}
+
+// refreshACL loads the policy if it changed. A policy that fails to parse or
+// validate, or differs from the one in force without a newer version, is
+// rejected and the last good policy stays in force. Without one, all
+// discovered peers are denied, as they are until the document is first read.
+func (a *Agent) refreshACL() {
+	doc, rev, err := etcd.FetchACL(a.etcdClient)
+	if err != nil {
+		logger.Errorf("Failed to fetch ACL policy: %v", err)
+		if !a.acl.fetched {
+			a.acl.err = "failed to fetch policy: " + err.Error()
+		}
+		return
+	}
+	a.acl.fetched = true
+	a.updateACL(doc, rev)
+}
+
+// updateACL puts the policy document doc read at etcd revision rev in force
+// if it is valid, nil meaning there is none.
+func (a *Agent) updateACL(doc []byte, rev int64) {
+	if rev == a.acl.revision {
+		return
+	}
+	a.acl.revision = rev
+	a.acl.err = ""
+
+	if doc == nil {
+		if a.acl.policy != nil {
+			logger.Infof("ACL policy removed, all peers are allowed")
+		}
+		a.acl.policy = nil
+		return
+	}
+
+	policy, err := acl.Parse(doc)
+	if err == nil && a.acl.policy != nil && policy.Version <= a.acl.policy.Version {
+		if reflect.DeepEqual(policy, a.acl.policy) {
+			// Rewritten as it was
+			return
+		}
+		err = errACLVersion
+	}
+	if err != nil {
+		a.acl.err = err.Error()
+		if a.acl.policy != nil {
+			logger.Warnf("Rejected ACL policy at revision %d, keeping version %d: %v", rev, a.acl.policy.Version, err)
+			return
+		}
+		// Failing open would give every node full access, so until a valid
+		// policy arrives an empty one denies all discovered peers
+		logger.Warnf("Rejected ACL policy at revision %d, denying all peers: %v", rev, err)
+		a.acl.policy = &acl.Policy{}
+		return
+	}
+
+	logger.Infof("ACL policy version %d in force (%d rules)", policy.Version, len(policy.Rules))
+	a.acl.policy = policy
+}
+
+// applyACL returns the nodes the policy allows any traffic with, and records
+// the access to each of them. Until the policy has been read, no node is
+// allowed.
+func (a *Agent) applyACL(nodes []etcd.Node) []etcd.Node {
+	policy := a.acl.policy
+	if !a.acl.fetched {
+		policy = &acl.Policy{}
+	}
+	access := make(map[string]acl.Access, len(nodes))
+	var allowed []etcd.Node
+	var denied []string
+	for _, n := range nodes {
+		ac := policy.Evaluate(a.cfg.Tags, n.Tags)
+		if !ac.Allowed() {
+			denied = append(denied, n.PublicKey)
+			continue
+		}
+		access[n.PublicKey] = ac
+		allowed = append(allowed, n)
+	}
+	a.acl.denied = denied
+
+	a.accessMu.Lock()
+	a.access = access
+	a.accessMu.Unlock()
+
+	if a.filter != nil {
+		a.filter.SetPeers(a.filterPeers(allowed, access))
+	}
+	if a.firewall != nil {
+		if err := a.firewall.Update(a.filterPeers(allowed, access)); err != nil {
+			logger.Errorf("Failed to update firewall: %v", err)
+		}
+	}
+	return allowed
+}
+
+// filterPeers returns the packet filter's view of the installed nodes. The
+// ACL access is only enforced while a policy is in force.
+func (a *Agent) filterPeers(nodes []etcd.Node, access map[string]acl.Access) []filter.Peer {
+	peers := make([]filter.Peer, 0, len(nodes))
+	for _, n := range nodes {
+		addr, err := netip.ParseAddr(n.IP)
+		if err != nil {
+			continue
+		}
+		p := filter.Peer{Addrs: []netip.Addr{addr}, Tags: n.Tags}
+		if a.acl.policy != nil {
+			ac := access[n.PublicKey]
+			p.Access = &ac
+		}
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// filterStatus reports the packet filter's or the firewall's counters.
+func (a *Agent) filterStatus() *FilterStatus {
+	switch {
+	case a.filter != nil:
+		return &FilterStatus{
+			Connections: a.filter.Connections(),
+			Drops:       a.filter.Drops(),
+		}
+	case a.firewall != nil:
+		drops, err := a.firewall.Drops()
+		if err != nil {
+			logger.Errorf("Failed to read firewall counters: %v", err)
+		}
+		return &FilterStatus{Table: a.firewall.Table(), Drops: drops}
+	}
+	return nil
+}
+
+// removeFirewall deletes the nftables table of the interface.
+func (a *Agent) removeFirewall() {
+	if a.firewall == nil {
+		return
+	}
+	if err := a.firewall.Remove(); err != nil {
+		logger.Errorf("Failed to remove firewall: %v", err)
+	}
+}
+
+// PeerAccess returns what the ACL policy allows between this node and the
+// peer with the given public key.
+func (a *Agent) PeerAccess(pubKey string) (acl.Access, bool) {
+	a.accessMu.RLock()
+	defer a.accessMu.RUnlock()
+	ac, ok := a.access[pubKey]
+	return ac, ok
+}
+
+// aclStatus reports the policy in force, or nil if there is none and none
+// was rejected.
+func (a *Agent) aclStatus() *ACLStatus {
+	if a.acl.policy == nil && a.acl.err == "" {
+		return nil
+	}
+	st := &ACLStatus{
+		Revision: a.acl.revision,
+		Error:    a.acl.err,
+		Denied:   a.acl.denied,
+	}
+	if p := a.acl.policy; p != nil {
+		st.Version = p.Version
+		st.Rules = len(p.Rules)
+	}
+	return st
+}
+
+// peerAccessStatus lists the allowed ports for a peer while a policy is in
+// force.
+func (a *Agent) peerAccessStatus(pubKey string) *PeerAccessStatus {
+	if a.acl.policy == nil {
+		return nil
+	}
+	ac, ok := a.PeerAccess(pubKey)
+	if !ok {
+		return nil
+	}
+	st := &PeerAccessStatus{}
+	for _, r := range ac.Inbound {
+		st.Inbound = append(st.Inbound, r.String())
+	}
+	for _, r := range ac.Outbound {
+		st.Outbound = append(st.Outbound, r.String())
+	}
+	return st
+}
@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/pabotesu/kurohabaki-client/internal/acl"
+	"github.com/pabotesu/kurohabaki-client/internal/etcd"
+)
+
+func TestApplyACL(t *testing.T) {
+	a := &Agent{cfg: &config.Config{Tags: []string{"dev"}}}
+	nodes := []etcd.Node{
+		{PublicKey: "db", Tags: []string{"db"}},
+		{PublicKey: "web", Tags: []string{"web"}},
+		{PublicKey: "untagged"},
+	}
+
+	// Until the policy has been read no node is installed
+	if got := a.applyACL(nodes); len(got) != 0 {
+		t.Fatalf("Expected no nodes before the policy is read, got %+v", got)
+	}
+	a.acl.fetched = true
+
+	// Without a policy every node is installed with full access
+	if got := a.applyACL(nodes); len(got) != 3 {
+		t.Fatalf("Expected all nodes without a policy, got %+v", got)
+	}
+	if a.peerAccessStatus("db") != nil || a.aclStatus() != nil {
+		t.Error("Expected no ACL status without a policy")
+	}
+
+	policy, err := acl.Parse([]byte(`{"version": 1, "rules": [{"src": ["dev"], "dst": ["db"], "ports": ["tcp:5432"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.acl.policy = policy
+
+	got := a.applyACL(nodes)
+	if len(got) != 1 || got[0].PublicKey != "db" {
+		t.Fatalf("Expected only db to be installed, got %+v", got)
+	}
+	if ac, ok := a.PeerAccess("db"); !ok || !ac.AllowsOutbound("tcp", 5432) || ac.AllowsInbound("tcp", 5432) {
+		t.Errorf("Unexpected access to db: %+v", ac)
+	}
+	if st := a.peerAccessStatus("db"); st == nil || len(st.Outbound) != 1 || st.Outbound[0] != "tcp:5432" {
+		t.Errorf("Unexpected access status: %+v", st)
+	}
+	if st := a.aclStatus(); st == nil || st.Version != 1 || len(st.Denied) != 2 {
+		t.Errorf("Unexpected ACL status: %+v", st)
+	}
+
+	// The fail-closed placeholder denies everything
+	a.acl.policy = &acl.Policy{}
+	if got := a.applyACL(nodes); len(got) != 0 {
+		t.Errorf("Expected no nodes with an empty policy, got %+v", got)
+	}
+}
+
+func TestUpdateACL(t *testing.T) {
+	a := &Agent{cfg: &config.Config{}}
+	v1 := `{"version": 1, "rules": [{"src": ["dev"], "dst": ["db"]}]}`
+
+	a.updateACL([]byte(v1), 10)
+	if a.acl.policy == nil || a.acl.policy.Version != 1 {
+		t.Fatalf("Expected version 1 in force, got %+v", a.acl.policy)
+	}
+
+	// The same policy rewritten is kept without an error
+	a.updateACL([]byte(`{"rules": [{"src": ["dev"], "dst": ["db"]}], "version": 1}`), 11)
+	if a.acl.err != "" {
+		t.Errorf("Expected the same policy to be accepted, got %q", a.acl.err)
+	}
+
+	// A different policy needs a newer version
+	for rev, doc := range map[int64]string{
+		12: `{"version": 1, "rules": [{"src": ["*"], "dst": ["*"]}]}`,
+		13: `{"version": 0, "rules": []}`,
+	} {
+		a.updateACL([]byte(doc), rev)
+		if a.acl.err == "" || len(a.acl.policy.Rules) != 1 || a.acl.policy.Rules[0].Src[0] != "dev" {
+			t.Errorf("Expected %s to be rejected, got %+v, %q", doc, a.acl.policy, a.acl.err)
+		}
+	}
+
+	a.updateACL([]byte(`{"version": 2, "rules": [{"src": ["*"], "dst": ["*"]}]}`), 14)
+	if a.acl.err != "" || a.acl.policy.Version != 2 {
+		t.Errorf("Expected version 2 in force, got %+v, %q", a.acl.policy, a.acl.err)
+	}
+}
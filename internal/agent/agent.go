@@ -2,31 +2,134 @@ package agent
 
 import (
 	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
 
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/pabotesu/kurohabaki-client/internal/acl"
+	"github.com/pabotesu/kurohabaki-client/internal/etcd"
+	"github.com/pabotesu/kurohabaki-client/internal/filter"
+	"github.com/pabotesu/kurohabaki-client/internal/forward"
+	"github.com/pabotesu/kurohabaki-client/internal/health"
+	"github.com/pabotesu/kurohabaki-client/internal/hostsfile"
 	"github.com/pabotesu/kurohabaki-client/internal/logger"
+	"github.com/pabotesu/kurohabaki-client/internal/meshdns"
+	"github.com/pabotesu/kurohabaki-client/internal/metrics"
+	"github.com/pabotesu/kurohabaki-client/internal/nft"
+	"github.com/pabotesu/kurohabaki-client/internal/pqpsk"
+	"github.com/pabotesu/kurohabaki-client/internal/proxy"
+	"github.com/pabotesu/kurohabaki-client/internal/resolver"
+	"github.com/pabotesu/kurohabaki-client/internal/util"
 	"github.com/pabotesu/kurohabaki-client/internal/wg"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
+var (
+	errInvalidAddress = errors.New("interface address is not a valid CIDR")
+	errACLVersion     = errors.New("policy differs from the one in force without a newer version")
+)
+
 type Agent struct {
+	cfg        *config.Config
 	wgIf       *wg.WireGuardInterface
 	etcdClient *clientv3.Client
 	selfPubKey string
 	cancel     context.CancelFunc
+
+	// Post-quantum PSK exchange, nil unless enabled in the config
+	pq          *pqpsk.Exchange
+	pqLease     clientv3.LeaseID
+	pqLeaseLost chan struct{} // closed once the lease is no longer kept alive
+	pqPublished map[string]pqpsk.Message
+
+	// Passphrase of the private key, for reloading it after a rotation
+	keyPassphrase config.PassphraseFunc
+
+	// Old keys of this node whose records have been retired after a rotation
+	retired map[string]bool
+
+	// Revocation list, updated by the revocation watch
+	revokedMu sync.RWMutex
+	revoked   map[string]etcd.Revocation
+
+	// Current node table as seen by the peer watcher
+	nodesMu sync.RWMutex
+	nodes   []etcd.Node
+
+	// ACL policy, only used by the peer watcher, and the resulting access
+	// to each installed peer
+	acl      aclState
+	accessMu sync.RWMutex
+	access   map[string]acl.Access
+
+	// Userspace packet filter or kernel firewall, nil unless enabled in the
+	// config
+	filter   *filter.Filter
+	firewall *nft.Firewall
+
+	// Mesh DNS server, nil unless enabled in the config
+	dns *meshdns.Server
+
+	// Managed hosts file block, nil unless enabled in the config
+	hosts *hostsfile.File
+
+	// Host resolver configuration, restored on shutdown
+	resolver *resolver.Manager
+
+	// Proxies to the mesh, only run on a userspace network stack
+	proxy      *proxy.Server
+	proxyAddrs []string
+
+	// Running forwards by name; none are started once stopped
+	forwardsMu      sync.Mutex
+	forwards        map[string]*forward.Forwarder
+	forwardsStopped bool
+
+	// Prometheus metrics, nil unless enabled in the config
+	metrics *metrics.Metrics
+
+	// Health endpoints, nil unless enabled in the config, and the times
+	// they judge the peer watcher by
+	health   *health.Server
+	healthMu sync.RWMutex
+	lastTick time.Time
+	lastSync time.Time
+
+	// Closed after the first successful reconcile of the peers
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	// Latest status snapshot, also written to statusPath unless empty
+	statusMu   sync.RWMutex
+	lastStatus *Status
+	statusPath string
 }
 
-func New(wgIf *wg.WireGuardInterface, etcdClient *clientv3.Client, selfPubKey string) *Agent {
+func New(cfg *config.Config, wgIf *wg.WireGuardInterface, etcdClient *clientv3.Client, selfPubKey string) *Agent {
 	return &Agent{
+		cfg:        cfg,
 		wgIf:       wgIf,
 		etcdClient: etcdClient,
 		selfPubKey: selfPubKey,
+		retired:    make(map[string]bool),
+		revoked:    make(map[string]etcd.Revocation),
+		statusPath: util.GetStatusFilePath(),
+		ready:      make(chan struct{}),
 	}
 }
 
+// SetStatusPath changes where the status file is written; an empty path
+// disables it, e.g. when the agent is embedded in another process.
+func (a *Agent) SetStatusPath(path string) {
+	a.statusPath = path
+}
+
 // Run should block until context is cancelled
 func (a *Agent) Run(ctx context.Context) {
 	// Log agent startup (debug mode only)
-	logger.Println("🟢 Agent.Run started")
+	logger.Debugf("Agent.Run started")
 
 	ctx, cancel := context.WithCancel(ctx)
 	a.cancel = cancel
@@ -34,20 +137,162 @@ func (a *Agent) Run(ctx context.Context) {
 	// Note: Signal handling is managed in the up.go command,
 	// removing duplicate signal handling here
 
+	a.publishHostname()
+	a.publishServices()
+	a.publishTags()
+
+	if a.cfg.MeshDNS.Enabled {
+		if err := a.startDNS(); err != nil {
+			logger.Warnf("Mesh DNS disabled: %v", err)
+		}
+	}
+
+	if a.netstack() {
+		// The host can't reach mesh addresses, so it gets the proxies
+		// instead of the hosts file and resolver configuration
+		if err := a.startProxies(); err != nil {
+			logger.Warnf("Mesh proxies disabled: %v", err)
+		}
+	} else {
+		if a.cfg.HostsFile.Enabled {
+			a.hosts = hostsfile.New(a.cfg.HostsFile.Path)
+		}
+
+		// After the mesh DNS has read the original upstreams
+		if err := a.applyHostDNS(); err != nil {
+			logger.Errorf("Failed to configure host DNS: %v", err)
+		}
+	}
+
+	if a.cfg.PQ.Enabled {
+		if err := a.startPQ(ctx); err != nil {
+			logger.Warnf("Post-quantum PSK exchange disabled: %v", err)
+		}
+	}
+
+	// Load the revocation list before any peer is added, then keep
+	// watching it so that revocations take effect immediately
+	rev, err := a.loadRevocations()
+	if err != nil {
+		logger.Errorf("Failed to load revocations: %v", err)
+	}
+	go a.watchRevocations(ctx, rev)
+
+	if a.metrics != nil {
+		a.metrics.SetPeerSource(a.wgIf.PeerStats, a.peerHostnames)
+		if err := a.metrics.ListenAndServe(a.cfg.Metrics.Listen); err != nil {
+			logger.Warnf("Metrics disabled: %v", err)
+		}
+	}
+
+	// Until the peer watcher's first run, the agent counts as live
+	a.markTick(time.Now())
+	if a.cfg.Health.Listen != "" {
+		if err := a.startHealth(); err != nil {
+			logger.Warnf("Health endpoints disabled: %v", err)
+		}
+	}
+
+	a.applyForwards(a.cfg.Forwards)
+	go a.watchForwards(ctx)
+
 	// Start peer watcher (debug mode only)
-	logger.Println("🟢 Launching StartPeerWatcher goroutine")
-	go StartPeerWatcher(ctx, a.etcdClient, a.wgIf, a.selfPubKey)
+	logger.Debugf("Launching peer watcher goroutine")
+	go a.watchPeers(ctx)
 
 	// Block until context is done - THIS IS CRUCIAL
 	<-ctx.Done()
 
 	// Always log shutdown as it's important operational info
-	logger.Println("Agent shutting down...")
+	logger.Infof("Agent shutting down...")
 
 	// Clean up resources
+	if a.dns != nil {
+		a.dns.Close()
+	}
+	a.stopForwards()
+	a.metrics.Close()
+	if a.health != nil {
+		a.health.Close()
+	}
+	if a.proxy != nil {
+		a.proxy.Close()
+	}
+	a.stopPQ()
+	a.restoreHostDNS()
+	a.removeHostsBlock()
+	a.removeFirewall()
+	if a.statusPath != "" {
+		os.Remove(a.statusPath)
+	}
 	a.wgIf.Close()
 }
 
+// Nodes returns the current node table.
+func (a *Agent) Nodes() []etcd.Node {
+	a.nodesMu.RLock()
+	defer a.nodesMu.RUnlock()
+	return append([]etcd.Node(nil), a.nodes...)
+}
+
+// setNodes records the node table and updates everything derived from it.
+func (a *Agent) setNodes(nodes []etcd.Node) {
+	a.nodesMu.Lock()
+	a.nodes = nodes
+	a.nodesMu.Unlock()
+
+	if a.dns == nil && a.hosts == nil {
+		return
+	}
+	hosts := a.meshHosts(nodes)
+	if a.dns != nil {
+		a.dns.SetHosts(hosts)
+		a.dns.SetServices(a.meshServices(nodes))
+	}
+	if a.hosts != nil {
+		a.updateHostsBlock(hosts)
+	}
+}
+
+// peerHostnames maps the public keys of the node table to hostnames.
+func (a *Agent) peerHostnames() map[string]string {
+	hostnames := make(map[string]string)
+	for _, n := range a.Nodes() {
+		hostnames[n.PublicKey] = n.Hostname
+	}
+	return hostnames
+}
+
+// SetMetrics gives the agent the metrics to record its work in and serve
+// on the configured listener.
+func (a *Agent) SetMetrics(m *metrics.Metrics) {
+	a.metrics = m
+}
+
+// SetKeyPassphrase gives the agent the passphrase of an encrypted private
+// key, so that it can load the new key after a rotation.
+func (a *Agent) SetKeyPassphrase(p config.PassphraseFunc) {
+	a.keyPassphrase = p
+}
+
+// SetFilter gives the agent the packet filter wrapping the interface's TUN
+// device, so that it can keep the filter's peer table current.
+func (a *Agent) SetFilter(f *filter.Filter) {
+	a.filter = f
+}
+
+// SetFirewall gives the agent the nftables firewall of the interface, so
+// that it can keep the peer sets current and remove the table on shutdown.
+func (a *Agent) SetFirewall(f *nft.Firewall) {
+	a.firewall = f
+}
+
+// Ready is closed once the interface is configured and the peers have been
+// synced from etcd and applied to it for the first time.
+func (a *Agent) Ready() <-chan struct{} {
+	return a.ready
+}
+
 // Stop cancels the agent's context, triggering shutdown
 func (a *Agent) Stop() {
 	if a.cancel != nil {
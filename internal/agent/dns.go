@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"net"
+	"net/netip"
+	"os"
+
+	"github.com/pabotesu/kurohabaki-client/internal/etcd"
+	"github.com/pabotesu/kurohabaki-client/internal/logger"
+	"github.com/pabotesu/kurohabaki-client/internal/meshdns"
+	"github.com/pabotesu/kurohabaki-client/internal/resolver"
+	"github.com/pabotesu/kurohabaki-client/internal/util"
+)
+
+// defaultMeshDomain is used when mesh_dns.domain is unset
+const defaultMeshDomain = "kh.internal"
+
+// hostname returns the name this node publishes in its record.
+func (a *Agent) hostname() string {
+	if a.cfg.Interface.Hostname != "" {
+		return a.cfg.Interface.Hostname
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// meshDomain returns the domain node names are qualified with.
+func (a *Agent) meshDomain() string {
+	if a.cfg.MeshDNS.Domain != "" {
+		return a.cfg.MeshDNS.Domain
+	}
+	return defaultMeshDomain
+}
+
+// selfAddr returns this node's mesh address.
+func (a *Agent) selfAddr() (netip.Addr, bool) {
+	prefix, err := netip.ParsePrefix(a.cfg.Interface.Address)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return prefix.Addr(), true
+}
+
+// publishHostname stores this node's hostname in its record so that other
+// nodes can resolve it.
+func (a *Agent) publishHostname() {
+	name := a.hostname()
+	if name == "" {
+		return
+	}
+	if err := etcd.PutNodeField(a.etcdClient, a.selfPubKey, "hostname", name, 0); err != nil {
+		logger.Errorf("Failed to publish hostname: %v", err)
+	}
+}
+
+// startDNS runs the mesh DNS server on the interface address.
+func (a *Agent) startDNS() error {
+	cfg := a.cfg.MeshDNS
+	domain := a.meshDomain()
+
+	listen := cfg.Listen
+	self, ok := a.selfAddr()
+	if listen == "" {
+		if !ok {
+			return errInvalidAddress
+		}
+		listen = net.JoinHostPort(self.String(), "53")
+	}
+
+	upstreams := cfg.Upstream
+	if len(upstreams) == 0 {
+		// Never forward to ourselves, e.g. once the host resolver points here
+		upstreams = meshdns.SystemUpstreams("/etc/resolv.conf", self.String())
+	}
+
+	server := meshdns.New(domain, upstreams)
+	if a.netstack() && cfg.Listen == "" {
+		if err := a.listenDNSNetstack(server, self); err != nil {
+			return err
+		}
+	} else if err := server.ListenAndServe(listen); err != nil {
+		return err
+	}
+	a.dns = server
+	logger.Infof("Mesh DNS listening on %s for *.%s", listen, domain)
+	return nil
+}
+
+// applyHostDNS points the host resolver at interface.dns while the agent is up.
+func (a *Agent) applyHostDNS() error {
+	servers, err := resolver.ParseServers(a.cfg.Interface.DNS)
+	if err != nil || len(servers) == 0 {
+		return err
+	}
+
+	m, err := resolver.New(a.cfg.Interface.DNSMode, a.wgIf.Name(), util.GetResolverStatePath())
+	if err != nil {
+		return err
+	}
+	mode, err := m.Apply(resolver.Config{Servers: servers, Domains: a.cfg.Interface.DNSDomains})
+	if err != nil {
+		return err
+	}
+	if mode != resolver.ModeOff {
+		a.resolver = m
+		logger.Infof("Host DNS set to %s via %s", a.cfg.Interface.DNS, mode)
+	}
+	return nil
+}
+
+// restoreHostDNS puts back the host resolver configuration.
+func (a *Agent) restoreHostDNS() {
+	if a.resolver == nil {
+		return
+	}
+	if err := a.resolver.Restore(); err != nil {
+		logger.Errorf("Failed to restore host DNS: %v", err)
+	}
+	a.resolver = nil
+}
+
+// updateHostsBlock writes the node table to the managed hosts file block.
+func (a *Agent) updateHostsBlock(hosts map[string][]netip.Addr) {
+	written, err := a.hosts.Update(hosts, a.meshDomain())
+	if err != nil {
+		logger.Errorf("Failed to update %s: %v", a.hosts.Path(), err)
+		return
+	}
+	if written {
+		logger.Debugf("Updated %s with %d node names", a.hosts.Path(), len(hosts))
+	}
+}
+
+// removeHostsBlock removes the managed block from the hosts file.
+func (a *Agent) removeHostsBlock() {
+	if a.hosts == nil {
+		return
+	}
+	if err := a.hosts.Remove(); err != nil {
+		logger.Errorf("Failed to clean up %s: %v", a.hosts.Path(), err)
+	}
+}
+
+// meshHosts returns the hostname table of the given nodes and this node.
+// Hostnames come from etcd and end up in the hosts file, so they are
+// normalized to DNS labels; nodes whose name can't be are left out.
+func (a *Agent) meshHosts(nodes []etcd.Node) map[string][]netip.Addr {
+	hosts := make(map[string][]netip.Addr)
+	for _, n := range nodes {
+		addr, err := netip.ParseAddr(n.IP)
+		if n.Hostname == "" || err != nil {
+			continue
+		}
+		name := meshdns.NormalizeHostname(n.Hostname)
+		if name == "" {
+			logger.Warnf("Ignoring invalid hostname %q of node %s", n.Hostname, n.PublicKey)
+			continue
+		}
+		hosts[name] = append(hosts[name], addr)
+	}
+	if self, ok := a.selfAddr(); ok {
+		if name := meshdns.NormalizeHostname(a.hostname()); name != "" {
+			hosts[name] = append(hosts[name], self)
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/pabotesu/kurohabaki-client/internal/forward"
+	"github.com/pabotesu/kurohabaki-client/internal/logger"
+)
+
+// forwardReloadInterval is how often the config files are checked for
+// changed forward rules.
+const forwardReloadInterval = 5 * time.Second
+
+// meshNetwork listens on this node's mesh address and dials mesh
+// destinations, through the TUN device or the network stack.
+type meshNetwork struct{ a *Agent }
+
+func (m meshNetwork) Listen(network, address string) (net.Listener, error) {
+	addr, err := m.a.meshListenAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	if m.a.netstack() {
+		return m.a.wgIf.Net().ListenTCPAddrPort(addr)
+	}
+	return net.Listen(network, addr.String())
+}
+
+func (m meshNetwork) ListenPacket(network, address string) (net.PacketConn, error) {
+	addr, err := m.a.meshListenAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	if m.a.netstack() {
+		return m.a.wgIf.Net().ListenUDPAddrPort(addr)
+	}
+	return net.ListenPacket(network, addr.String())
+}
+
+func (m meshNetwork) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return m.a.MeshDialer().DialContext(ctx, network, address)
+}
+
+// meshListenAddr resolves a listen address on the mesh, which must be a
+// port on no address or on this node's mesh address.
+func (a *Agent) meshListenAddr(address string) (netip.AddrPort, error) {
+	self, ok := a.selfAddr()
+	if !ok {
+		return netip.AddrPort{}, errInvalidAddress
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if host != "" && host != self.String() {
+		return netip.AddrPort{}, fmt.Errorf("%s is not this node's mesh address %s", host, self)
+	}
+	p, err := net.LookupPort("tcp", port)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(self, uint16(p)), nil
+}
+
+// applyForwards starts the forwards that aren't running yet and stops those
+// that were removed or changed.
+func (a *Agent) applyForwards(forwards []config.Forward) {
+	rules, err := forward.RulesFromConfig(forwards)
+	if err != nil {
+		logger.Warnf("Ignoring forward rules: %v", err)
+		return
+	}
+
+	a.forwardsMu.Lock()
+	defer a.forwardsMu.Unlock()
+	if a.forwardsStopped {
+		return
+	}
+	if a.forwards == nil {
+		a.forwards = make(map[string]*forward.Forwarder)
+	}
+
+	wanted := make(map[string]forward.Rule)
+	for _, r := range rules {
+		wanted[r.Name] = r
+	}
+	for name, f := range a.forwards {
+		if r, ok := wanted[name]; !ok || r != f.Rule() {
+			f.Close()
+			delete(a.forwards, name)
+			logger.Infof("Forward %s stopped", name)
+		}
+	}
+
+	for _, r := range rules {
+		if a.forwards[r.Name] != nil {
+			continue
+		}
+		var listen, dial forward.Network = forward.Host, meshNetwork{a}
+		if r.Remote {
+			listen, dial = dial, listen
+		}
+		f, err := forward.Start(r, listen, dial)
+		if err != nil {
+			logger.Errorf("Failed to start forward: %v", err)
+			continue
+		}
+		a.forwards[r.Name] = f
+		logger.Infof("Forward %s: %s %s -> %s", r.Name, r.Protocol(), f.Addr(), r.Target)
+	}
+}
+
+// watchForwards applies the forward rules of the config whenever the config
+// file or its conf.d fragments change, so that the forward command takes
+// effect without a restart.
+func (a *Agent) watchForwards(ctx context.Context) {
+	if a.cfg.Path == "" {
+		return
+	}
+	stamp, _ := configStamp(a.cfg.Path)
+
+	ticker := time.NewTicker(forwardReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s, err := configStamp(a.cfg.Path)
+			if err != nil || s == stamp {
+				continue
+			}
+			stamp = s
+			cfg, err := a.cfg.Reload()
+			if err != nil {
+				logger.Errorf("Failed to reload forward rules: %v", err)
+				continue
+			}
+			a.applyForwards(cfg.Forwards)
+		}
+	}
+}
+
+// configStamp returns the names and modification times of the config file
+// at path and its fragments, which differ whenever a file is changed, added
+// or removed.
+func configStamp(path string) (string, error) {
+	fragments, err := config.Fragments(path)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, file := range append([]string{path}, fragments...) {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%s %d %d\n", file, info.ModTime().UnixNano(), info.Size())
+	}
+	return b.String(), nil
+}
+
+// stopForwards closes all forwards.
+func (a *Agent) stopForwards() {
+	a.forwardsMu.Lock()
+	defer a.forwardsMu.Unlock()
+	a.forwardsStopped = true
+	for name, f := range a.forwards {
+		f.Close()
+		delete(a.forwards, name)
+	}
+}
+
+// forwardStatus reports the running forwards and their connections.
+func (a *Agent) forwardStatus() []ForwardStatus {
+	a.forwardsMu.Lock()
+	defer a.forwardsMu.Unlock()
+
+	var out []ForwardStatus
+	for _, f := range a.forwards {
+		r, st := f.Rule(), f.Stats()
+		out = append(out, ForwardStatus{
+			Name:      r.Name,
+			Protocol:  r.Protocol(),
+			Direction: r.Direction(),
+			Listen:    f.Addr().String(),
+			Target:    r.Target,
+			Active:    st.Active,
+			Total:     st.Total,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
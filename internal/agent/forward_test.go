@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/pabotesu/kurohabaki-client/internal/wg"
+)
+
+func TestForwards(t *testing.T) {
+	wgIf, err := wg.NewNetstackInterface("test", []netip.Addr{netip.MustParseAddr("10.97.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wgIf.Close()
+	cfg := &config.Config{}
+	cfg.Interface.Address = "10.97.0.1/24"
+	a := &Agent{cfg: cfg, wgIf: wgIf}
+	defer a.stopForwards()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	// A host client reaches the local forward, which connects into the mesh
+	// to the remote forward, which connects to the echo server on the host
+	a.applyForwards([]config.Forward{
+		{Name: "expose", Direction: "remote", Listen: ":7000", Target: l.Addr().String()},
+		{Name: "reach", Listen: "127.0.0.1:0", Target: "10.97.0.1:7000"},
+	})
+	st := a.forwardStatus()
+	if len(st) != 2 || st[0].Name != "expose" || st[0].Listen != "10.97.0.1:7000" {
+		t.Fatalf("Unexpected forwards %+v", st)
+	}
+
+	c, err := net.Dial("tcp", st[1].Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("hi"))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hi" {
+		t.Fatalf("Expected the echo through both forwards, got %q, %v", buf, err)
+	}
+	for _, f := range a.forwardStatus() {
+		if f.Active != 1 || f.Total != 1 {
+			t.Errorf("Expected one active connection on %s, got %+v", f.Name, f)
+		}
+	}
+
+	// Changed and removed rules are stopped
+	a.applyForwards([]config.Forward{
+		{Name: "expose", Direction: "remote", Listen: ":7001", Target: l.Addr().String()},
+	})
+	st = a.forwardStatus()
+	if len(st) != 1 || st[0].Listen != "10.97.0.1:7001" || st[0].Total != 0 {
+		t.Errorf("Expected only the restarted forward, got %+v", st)
+	}
+
+	if _, err := a.meshListenAddr("10.97.0.2:80"); err == nil {
+		t.Error("Expected listening on another node's address to fail")
+	}
+}
+
+func TestConfigStamp(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte("log:\n  level: info\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stamp, err := configStamp(path)
+	if err != nil {
+		t.Fatalf("configStamp failed: %v", err)
+	}
+
+	// Adding a fragment and changing it are both noticed
+	fragment := filepath.Join(dir, config.ConfDir, "10-forward.yaml")
+	if err := os.Mkdir(filepath.Dir(fragment), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"forward: []\n", "forward:\n  - name: db\n"} {
+		if err := os.WriteFile(fragment, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		s, err := configStamp(path)
+		if err != nil {
+			t.Fatalf("configStamp failed: %v", err)
+		}
+		if s == stamp {
+			t.Errorf("Expected the stamp to change with %q in the fragment", data)
+		}
+		stamp = s
+	}
+}
@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/pabotesu/kurohabaki-client/internal/health"
+	"github.com/pabotesu/kurohabaki-client/internal/wg"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// startHealth serves the liveness and readiness endpoints. The agent is
+// live while the peer watcher keeps running, and ready once the interface
+// is configured, the peers have been synced from etcd and the server peer
+// has completed a recent handshake.
+func (a *Agent) startHealth() error {
+	cfg := a.cfg.Health
+	syncAge := durationOr(cfg.SyncMaxAge, config.DefaultSyncMaxAge)
+	handshakeAge := durationOr(cfg.HandshakeMaxAge, config.DefaultHandshakeMaxAge)
+
+	h := health.New()
+	h.Live("peer_watcher", a.Alive)
+	h.Ready("interface", func() (string, error) {
+		stats, err := a.wgIf.PeerStats()
+		if err != nil {
+			return "", fmt.Errorf("failed to read device state: %w", err)
+		}
+		return fmt.Sprintf("%s is up with %d peer(s)", a.wgIf.Name(), len(stats)), nil
+	})
+	h.Ready("discovery", func() (string, error) {
+		a.healthMu.RLock()
+		last := a.lastSync
+		a.healthMu.RUnlock()
+		if last.IsZero() {
+			return "", errors.New("peers not synced from etcd yet")
+		}
+		return checkRecent("peers synced from etcd", last, syncAge, time.Now())
+	})
+	if a.cfg.ServerConfig.PublicKey != "" {
+		server, err := wg.ParsePublicKey(a.cfg.ServerConfig.PublicKey)
+		if err != nil {
+			return fmt.Errorf("invalid server peer public key: %w", err)
+		}
+		h.Ready("server_handshake", func() (string, error) {
+			stats, err := a.wgIf.PeerStats()
+			if err != nil {
+				return "", fmt.Errorf("failed to read device state: %w", err)
+			}
+			return checkHandshake(stats, server, handshakeAge, time.Now())
+		})
+	}
+
+	if err := h.ListenAndServe(a.cfg.Health.Listen); err != nil {
+		return err
+	}
+	a.health = h
+	return nil
+}
+
+// Alive fails if the peer watcher has not run within the stall timeout,
+// which means the agent is stuck. On success it tells when it last ran.
+func (a *Agent) Alive() (string, error) {
+	a.healthMu.RLock()
+	last := a.lastTick
+	a.healthMu.RUnlock()
+	stall := durationOr(a.cfg.Health.StallTimeout, config.DefaultStallTimeout)
+	return checkRecent("peer watcher ran", last, stall, time.Now())
+}
+
+// markTick records a run of the peer watcher.
+func (a *Agent) markTick(now time.Time) {
+	a.healthMu.Lock()
+	defer a.healthMu.Unlock()
+	a.lastTick = now
+}
+
+// markSynced records a successful fetch of the peers from etcd.
+func (a *Agent) markSynced(now time.Time) {
+	a.healthMu.Lock()
+	defer a.healthMu.Unlock()
+	a.lastSync = now
+}
+
+// checkRecent fails if last is more than maxAge before now.
+func checkRecent(what string, last time.Time, maxAge time.Duration, now time.Time) (string, error) {
+	age := now.Sub(last).Round(time.Second)
+	if now.Sub(last) > maxAge {
+		return "", fmt.Errorf("%s %s ago, limit %s", what, age, maxAge)
+	}
+	return fmt.Sprintf("%s %s ago", what, age), nil
+}
+
+// checkHandshake fails unless the handshake with the server peer is at
+// most maxAge old.
+func checkHandshake(stats []wg.PeerStat, server device.NoisePublicKey, maxAge time.Duration, now time.Time) (string, error) {
+	for _, st := range stats {
+		if st.PublicKey != server {
+			continue
+		}
+		if st.LastHandshake.IsZero() {
+			return "", errors.New("no handshake with the server peer yet")
+		}
+		return checkRecent("handshake with the server peer", st.LastHandshake, maxAge, now)
+	}
+	return "", errors.New("server peer is not configured on the device")
+}
+
+func durationOr(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/internal/wg"
+)
+
+func TestCheckHandshake(t *testing.T) {
+	now := time.Now()
+	var server, other wg.PeerStat
+	server.PublicKey[0] = 1
+	other.PublicKey[0] = 2
+	other.LastHandshake = now
+
+	tests := []struct {
+		name      string
+		handshake time.Time
+		stats     bool
+		wantErr   string
+	}{
+		{"recent", now.Add(-30 * time.Second), true, ""},
+		{"stale", now.Add(-5 * time.Minute), true, "handshake with the server peer 5m0s ago, limit 3m0s"},
+		{"never", time.Time{}, true, "no handshake"},
+		{"missing", time.Time{}, false, "not configured"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := []wg.PeerStat{other}
+			if tt.stats {
+				server.LastHandshake = tt.handshake
+				stats = append(stats, server)
+			}
+			detail, err := checkHandshake(stats, server.PublicKey, 3*time.Minute, now)
+			if tt.wantErr == "" {
+				if err != nil || !strings.Contains(detail, "30s ago") {
+					t.Errorf("checkHandshake = %q, %v; want ok", detail, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkHandshake error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckRecent(t *testing.T) {
+	now := time.Now()
+	if _, err := checkRecent("peers synced", now.Add(-10*time.Second), time.Minute, now); err != nil {
+		t.Errorf("Expected a sync 10s ago to pass: %v", err)
+	}
+	if _, err := checkRecent("peers synced", now.Add(-2*time.Minute), time.Minute, now); err == nil {
+		t.Error("Expected a sync 2m ago to fail")
+	}
+}
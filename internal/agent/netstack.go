@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/pabotesu/kurohabaki-client/internal/logger"
+	"github.com/pabotesu/kurohabaki-client/internal/meshdns"
+	"github.com/pabotesu/kurohabaki-client/internal/proxy"
+)
+
+// Default listen addresses of the netstack proxies
+const (
+	defaultSOCKS5Listen = "127.0.0.1:1080"
+	defaultHTTPListen   = "127.0.0.1:3128"
+)
+
+// netstack reports whether the interface runs on a userspace network stack,
+// which the host can neither route to nor resolve names for.
+func (a *Agent) netstack() bool {
+	return a.wgIf.Net() != nil
+}
+
+// startProxies runs the SOCKS5 and HTTP proxies through which local
+// applications reach the mesh.
+func (a *Agent) startProxies() error {
+	cfg := a.cfg.Netstack
+	dialer := a.MeshDialer()
+	dialer.Direct = &net.Dialer{}
+	server := proxy.New(dialer.DialContext)
+
+	listen := map[string]string{"socks5": cfg.SOCKS5, "http": cfg.HTTP}
+	defaults := map[string]string{"socks5": defaultSOCKS5Listen, "http": defaultHTTPListen}
+	serve := map[string]func(net.Listener){"socks5": server.ServeSOCKS5, "http": server.ServeHTTP}
+	for _, kind := range []string{"socks5", "http"} {
+		addr := listen[kind]
+		if addr == "off" {
+			continue
+		}
+		if addr == "" {
+			addr = defaults[kind]
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			server.Close()
+			return err
+		}
+		serve[kind](l)
+		a.proxyAddrs = append(a.proxyAddrs, kind+"://"+l.Addr().String())
+		logger.Infof("%s proxy to the mesh listening on %s", strings.ToUpper(kind), l.Addr())
+	}
+	a.proxy = server
+	return nil
+}
+
+// MeshDialer returns a dialer for the interface subnet and routes, through
+// the network stack if there is one, resolving node names from the node
+// table. It refuses other destinations unless its Direct dialer is set.
+func (a *Agent) MeshDialer() *proxy.Dialer {
+	var prefixes []netip.Prefix
+	if p, err := netip.ParsePrefix(a.cfg.Interface.Address); err == nil {
+		prefixes = append(prefixes, p.Masked())
+	}
+	for _, route := range a.cfg.Interface.Routes {
+		if p, err := netip.ParsePrefix(route); err == nil {
+			prefixes = append(prefixes, p.Masked())
+		}
+	}
+	var mesh proxy.ContextDialer = &net.Dialer{}
+	if a.netstack() {
+		mesh = a.wgIf.Net()
+	}
+	return &proxy.Dialer{
+		Mesh:     mesh,
+		Prefixes: prefixes,
+		Lookup:   a.LookupMesh,
+	}
+}
+
+// LookupMesh returns the mesh addresses of a node named <hostname> or
+// <hostname>.<domain>.
+func (a *Agent) LookupMesh(name string) []netip.Addr {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if strings.Contains(name, ".") {
+		var ok bool
+		if name, ok = strings.CutSuffix(name, "."+a.meshDomain()); !ok {
+			return nil
+		}
+	}
+	for host, addrs := range a.meshHosts(a.Nodes()) {
+		if meshdns.NormalizeHostname(host) == name {
+			return addrs
+		}
+	}
+	return nil
+}
+
+// listenDNSNetstack serves the mesh DNS on the network stack, where peers
+// reach it on this node's mesh address.
+func (a *Agent) listenDNSNetstack(server *meshdns.Server, self netip.Addr) error {
+	addr := netip.AddrPortFrom(self, 53)
+	udp, err := a.wgIf.Net().ListenUDPAddrPort(addr)
+	if err != nil {
+		return err
+	}
+	tcp, err := a.wgIf.Net().ListenTCPAddrPort(addr)
+	if err != nil {
+		udp.Close()
+		return err
+	}
+	server.Serve(udp, tcp)
+	return nil
+}
@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/pabotesu/kurohabaki-client/internal/etcd"
+)
+
+func TestLookupMesh(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Interface.Address = "10.0.0.1/24"
+	cfg.Interface.Hostname = "self"
+	a := &Agent{cfg: cfg}
+	a.setNodes([]etcd.Node{
+		{PublicKey: "db-key", IP: "10.0.0.2", Hostname: "DB.example.com"},
+		{PublicKey: "web-key", IP: "10.0.0.3"},
+	})
+
+	db := []netip.Addr{netip.MustParseAddr("10.0.0.2")}
+	for _, name := range []string{"db", "db.kh.internal", "DB.KH.internal."} {
+		if got := a.LookupMesh(name); len(got) != 1 || got[0] != db[0] {
+			t.Errorf("LookupMesh(%q) = %v, want %v", name, got, db)
+		}
+	}
+	if got := a.LookupMesh("self.kh.internal"); len(got) != 1 || got[0] != netip.MustParseAddr("10.0.0.1") {
+		t.Errorf("Expected this node to resolve, got %v", got)
+	}
+	for _, name := range []string{"db.example.com", "web", "unknown.kh.internal"} {
+		if got := a.LookupMesh(name); len(got) != 0 {
+			t.Errorf("LookupMesh(%q) = %v, want none", name, got)
+		}
+	}
+}
+
+func TestMeshHostsInvalidNames(t *testing.T) {
+	a := &Agent{cfg: &config.Config{}}
+	hosts := a.meshHosts([]etcd.Node{
+		{PublicKey: "db-key", IP: "10.0.0.2", Hostname: "DB.example.com"},
+		{PublicKey: "evil-key", IP: "10.0.0.3", Hostname: "evil\n1.2.3.4 bank.example"},
+		{PublicKey: "space-key", IP: "10.0.0.4", Hostname: "has spaces"},
+		{PublicKey: "long-key", IP: "10.0.0.5", Hostname: strings.Repeat("a", 64)},
+	})
+	for name := range hosts {
+		if strings.ContainsAny(name, " \t\n") {
+			t.Errorf("Unexpected hostname %q", name)
+		}
+	}
+	if len(hosts["db"]) != 1 || len(hosts) != 3 {
+		t.Errorf("Expected db, evil-1 and has-spaces, got %v", hosts)
+	}
+}
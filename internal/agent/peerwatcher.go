@@ -2,16 +2,22 @@ package agent
 
 import (
 	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
 	"time"
 
 	"github.com/pabotesu/kurohabaki-client/internal/etcd"
 	"github.com/pabotesu/kurohabaki-client/internal/logger"
+	"github.com/pabotesu/kurohabaki-client/internal/pqpsk"
+	"github.com/pabotesu/kurohabaki-client/internal/rotation"
 	"github.com/pabotesu/kurohabaki-client/internal/wg"
-	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.zx2c4.com/wireguard/device"
 )
 
-func StartPeerWatcher(ctx context.Context, cli *clientv3.Client, wgIf *wg.WireGuardInterface, selfPubKey string) {
-	logger.Println("StartPeerWatcher: launched") // debug mode only
+func (a *Agent) watchPeers(ctx context.Context) {
+	logger.Debugf("Peer watcher: launched")
+
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
 
@@ -21,47 +27,194 @@ func StartPeerWatcher(ctx context.Context, cli *clientv3.Client, wgIf *wg.WireGu
 		select {
 		case <-ctx.Done():
 			// shutdown signal received
-			logger.Println("Peer watcher shutting down...")
+			logger.Debugf("Peer watcher shutting down...")
 			return
 
 		case <-ticker.C:
-			// get current peers from etcd
-			logger.Println("FetchPeers: start fetching from etcd...")
-
-			peers, err := etcd.FetchPeers(cli, selfPubKey)
+			start := time.Now()
+			a.markTick(start)
+			applied, err := a.reconcilePeers(ctx, prevPeers)
+			a.metrics.ObserveReconcile(time.Since(start), err)
 			if err != nil {
-				logger.Printf("Failed to fetch peers: %s", err.Error())
-				continue
+				logger.Errorf("Peer watcher: %v", err)
+			} else {
+				a.readyOnce.Do(func() { close(a.ready) })
 			}
+			prevPeers = applied
+		}
+	}
+}
 
-			// debug mode only
-			logger.Printf("FetchPeers: %d node(s) fetched", len(peers))
-			if logger.IsDebugMode() {
-				for _, n := range peers {
-					logger.Printf("Node details: %+v", n)
-				}
-			}
+// reconcilePeers brings the WireGuard device in line with the node table and
+// returns the peers now applied to it.
+func (a *Agent) reconcilePeers(ctx context.Context, prevPeers []wg.WGPeerConfig) ([]wg.WGPeerConfig, error) {
+	now := time.Now()
 
-			currentPeers, err := wg.ConvertNodesToPeers(peers)
-			if err != nil {
-				logger.Printf("Failed to convert nodes to peers: %v", err)
-				continue
+	// Key rotations may change this node's own key, so they are
+	// handled before anything that depends on it.
+	records := a.fetchRotations()
+	a.handleSelfRotation(ctx, records, now)
+
+	selfKey, err := wg.ParsePublicKey(a.selfPubKey)
+	if err != nil {
+		return prevPeers, fmt.Errorf("invalid self public key: %w", err)
+	}
+
+	// get current peers from etcd
+	logger.Debugf("FetchPeers: start fetching from etcd...")
+
+	peers, err := etcd.FetchPeers(a.etcdClient, a.selfPubKey)
+	if err != nil {
+		return prevPeers, fmt.Errorf("failed to fetch peers: %w", err)
+	}
+	a.markSynced(time.Now())
+	peers = a.excludeSelf(peers, records)
+	revoked := a.revokedKeys(records)
+	peers = filterRevoked(peers, revoked)
+	a.setNodes(peers)
+
+	// Names stay resolvable, but peers the ACL policy does not
+	// allow any traffic with are not installed
+	a.refreshACL()
+	peers = a.applyACL(peers)
+
+	// debug mode only
+	logger.Debugf("FetchPeers: %d node(s) fetched", len(peers))
+	if logger.DebugEnabled() {
+		for _, n := range peers {
+			logger.Debugf("Node details: %+v", n)
+		}
+	}
+
+	currentPeers := wg.ConvertNodesToPeers(peers)
+
+	// The secret is re-read on every tick so that replacing it
+	// rotates the preshared keys of all discovered peers.
+	secret, err := a.cfg.PSK.LoadSecret()
+	if err != nil {
+		return prevPeers, fmt.Errorf("failed to load PSK secret: %w", err)
+	}
+	wg.SetPresharedKeys(currentPeers, secret, selfKey)
+	if a.pq != nil {
+		a.syncPQ(ctx, peers, currentPeers, selfKey)
+	}
+
+	stats, err := a.wgIf.PeerStats()
+	if err != nil {
+		logger.Errorf("Failed to read peer stats: %v", err)
+	}
+	a.metrics.ObservePeers(stats)
+	handshakes := make(map[device.NoisePublicKey]time.Time, len(stats))
+	for _, st := range stats {
+		if !st.LastHandshake.IsZero() {
+			handshakes[st.PublicKey] = st.LastHandshake
+		}
+	}
+	currentPeers = rotation.Apply(currentPeers, records, handshakes, now)
+
+	// debug mode only
+	logger.Debugf("Peers converted: %d", len(currentPeers))
+
+	applied := prevPeers
+	var updateErr error
+	if !wg.SamePeers(prevPeers, currentPeers) {
+		logger.Debugf("Peer list updated, applying to interface...")
+		removed := removedPeers(prevPeers, currentPeers)
+		if len(removed) > 0 {
+			if err := a.wgIf.RemovePeers(removed); err != nil {
+				logger.Errorf("Failed to remove WireGuard peers: %v", err)
 			}
+		}
+		if err := a.wgIf.UpdatePeers(currentPeers); err != nil {
+			updateErr = fmt.Errorf("failed to update WireGuard peers: %w", err)
+		} else {
+			added := len(removedPeers(currentPeers, prevPeers))
+			a.metrics.PeersChanged(added, len(removed))
+			applied = currentPeers
+			logger.Infow("Peers updated", "peers", len(currentPeers), "added", added, "removed", len(removed))
+		}
+	} else {
+		logger.Debugf("No peer changes detected")
+	}
 
-			// debug mode only
-			logger.Printf("Peers converted: %d", len(currentPeers))
-
-			if !wg.SamePeers(prevPeers, currentPeers) {
-				logger.Println("Peer list updated, applying to interface...")
-				if err := wgIf.UpdatePeers(currentPeers); err != nil {
-					logger.Printf("Failed to update WireGuard peers: %v", err)
-				} else {
-					prevPeers = currentPeers
-					logger.Println("Peers updated successfully")
-				}
-			} else {
-				logger.Println("No peer changes detected")
+	st := a.status(applied, secret != nil, records, revoked)
+	a.statusMu.Lock()
+	a.lastStatus = st
+	a.statusMu.Unlock()
+	if a.statusPath != "" {
+		if err := WriteStatus(a.statusPath, st); err != nil {
+			logger.Errorf("Failed to write status file: %v", err)
+		}
+	}
+	return applied, updateErr
+}
+
+// status builds a snapshot of the agent from the peers currently applied.
+func (a *Agent) status(peers []wg.WGPeerConfig, staticPSK bool, records map[string]*rotation.Record, revoked map[string]etcd.Revocation) *Status {
+	st := &Status{
+		PID:         os.Getpid(),
+		Interface:   a.wgIf.Name(),
+		PublicKey:   a.selfPubKey,
+		UpdatedAt:   time.Now(),
+		Revocations: revocationStatus(revoked),
+		ACL:         a.aclStatus(),
+		Filter:      a.filterStatus(),
+		Proxies:     a.proxyAddrs,
+		Forwards:    a.forwardStatus(),
+	}
+	if _, ok := revoked[a.selfPubKey]; ok {
+		st.Revoked = true
+	}
+	if r := records[a.selfPubKey]; r != nil {
+		st.KeyRotation = &KeyRotationStatus{NewPublicKey: r.NewPublicKey, SwitchAt: r.SwitchAt}
+	}
+
+	var pqStates map[string]pqpsk.PeerState
+	if a.pq != nil {
+		pqStates = a.pq.State()
+	}
+
+	hostnames := a.peerHostnames()
+
+	for _, p := range peers {
+		pub := base64.StdEncoding.EncodeToString(p.PublicKey[:])
+		ps := PeerStatus{
+			PublicKey:    pub,
+			Hostname:     hostnames[pub],
+			PresharedKey: "none",
+			Access:       a.peerAccessStatus(pub),
+		}
+		if p.Endpoint != nil {
+			ps.Endpoint = p.Endpoint.String()
+		}
+		for _, ipnet := range p.AllowedIPs {
+			ps.AllowedIPs = append(ps.AllowedIPs, ipnet.String())
+		}
+		if staticPSK {
+			ps.PresharedKey = "static"
+		}
+		if pq, ok := pqStates[pub]; ok {
+			ps.PQ = &pq
+			if a.pq.Secret(pub) != nil {
+				ps.PresharedKey = "pq"
 			}
 		}
+		st.Peers = append(st.Peers, ps)
+	}
+	return st
+}
+
+// removedPeers returns the keys of peers in prev that are missing from current.
+func removedPeers(prev, current []wg.WGPeerConfig) []device.NoisePublicKey {
+	keep := make(map[device.NoisePublicKey]bool, len(current))
+	for _, p := range current {
+		keep[p.PublicKey] = true
+	}
+	var removed []device.NoisePublicKey
+	for _, p := range prev {
+		if !keep[p.PublicKey] {
+			removed = append(removed, p.PublicKey)
+		}
 	}
+	return removed
 }
@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/internal/etcd"
+	"github.com/pabotesu/kurohabaki-client/internal/logger"
+	"github.com/pabotesu/kurohabaki-client/internal/pqpsk"
+	"github.com/pabotesu/kurohabaki-client/internal/wg"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+const (
+	// defaultPQRotationInterval is used when pq.rotation_interval is unset
+	defaultPQRotationInterval = 10 * time.Minute
+	// pqLeaseTTL bounds how long the encapsulation key and exchange
+	// messages outlive an agent that stopped without cleaning up
+	pqLeaseTTL = 30
+)
+
+// startPQ generates this run's ML-KEM key and publishes the encapsulation
+// key in the node record, bound to a lease that is kept alive until shutdown.
+func (a *Agent) startPQ(ctx context.Context) error {
+	interval := a.cfg.PQ.RotationInterval
+	if interval <= 0 {
+		interval = defaultPQRotationInterval
+	}
+
+	ex, err := pqpsk.New(a.selfPubKey, interval)
+	if err != nil {
+		return err
+	}
+	if err := a.publishPQ(ctx, ex); err != nil {
+		return err
+	}
+	a.pq = ex
+	logger.Infof("Post-quantum PSK exchange enabled (rotation every %s)", interval)
+	return nil
+}
+
+// publishPQ publishes the encapsulation key of ex under a new lease. The
+// exchange messages published under the previous lease are gone with it,
+// so they are all published again.
+func (a *Agent) publishPQ(ctx context.Context, ex *pqpsk.Exchange) error {
+	grantCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	lease, err := a.etcdClient.Grant(grantCtx, pqLeaseTTL)
+	if err != nil {
+		return fmt.Errorf("failed to grant etcd lease: %w", err)
+	}
+	keepAlive, err := a.etcdClient.KeepAlive(ctx, lease.ID)
+	if err != nil {
+		return fmt.Errorf("failed to keep etcd lease alive: %w", err)
+	}
+	lost := make(chan struct{})
+	go func() {
+		for range keepAlive {
+		}
+		close(lost)
+	}()
+
+	if err := etcd.PutNodeField(a.etcdClient, a.selfPubKey, "mlkem_ek", ex.EncapsulationKey(), lease.ID); err != nil {
+		return err
+	}
+
+	a.pqLease = lease.ID
+	a.pqLeaseLost = lost
+	a.pqPublished = make(map[string]pqpsk.Message)
+	return nil
+}
+
+// stopPQ revokes the lease so peers stop using this run's encapsulation key.
+func (a *Agent) stopPQ() {
+	if a.pq == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := a.etcdClient.Revoke(ctx, a.pqLease); err != nil {
+		logger.Errorf("Failed to revoke PQ PSK lease: %v", err)
+	}
+}
+
+// syncPQ runs one step of the exchange with the given nodes and installs the
+// resulting secrets as preshared keys of the matching peers.
+func (a *Agent) syncPQ(ctx context.Context, nodes []etcd.Node, peers []wg.WGPeerConfig, selfKey device.NoisePublicKey) {
+	// The lease expires when etcd is out of reach for longer than its TTL,
+	// taking the encapsulation key and the messages with it
+	select {
+	case <-a.pqLeaseLost:
+		if ctx.Err() != nil {
+			return
+		}
+		if err := a.publishPQ(ctx, a.pq); err != nil {
+			logger.Errorf("Failed to publish the PQ PSK encapsulation key again: %v", err)
+			return
+		}
+		logger.Infof("PQ PSK lease expired, encapsulation key published again")
+	default:
+	}
+
+	raw, err := etcd.FetchPQMessages(a.etcdClient, a.selfPubKey)
+	if err != nil {
+		logger.Errorf("Failed to fetch PQ PSK messages: %v", err)
+		return
+	}
+	inbound := make(map[string]pqpsk.Message, len(raw))
+	for from, data := range raw {
+		msg, err := pqpsk.ParseMessage(data)
+		if err != nil {
+			logger.Warnf("Ignoring PQ PSK message from %s: %v", from, err)
+			continue
+		}
+		inbound[from] = msg
+	}
+
+	peerKeys := make(map[string]string)
+	for _, n := range nodes {
+		if n.MLKEMKey != "" {
+			peerKeys[n.PublicKey] = n.MLKEMKey
+		}
+	}
+
+	for to, msg := range a.pq.Step(time.Now(), peerKeys, inbound) {
+		if a.pqPublished[to] == msg {
+			continue
+		}
+		if err := etcd.PutPQMessage(a.etcdClient, to, a.selfPubKey, msg.Marshal(), a.pqLease); err != nil {
+			logger.Errorf("Failed to publish PQ PSK message: %v", err)
+			continue
+		}
+		a.pqPublished[to] = msg
+	}
+	for to := range a.pqPublished {
+		if _, ok := peerKeys[to]; !ok {
+			delete(a.pqPublished, to)
+		}
+	}
+
+	for i := range peers {
+		secret := a.pq.Secret(base64.StdEncoding.EncodeToString(peers[i].PublicKey[:]))
+		if secret == nil {
+			continue
+		}
+		psk := wg.MixPresharedKey(peers[i].PresharedKey, secret, selfKey, peers[i].PublicKey)
+		peers[i].PresharedKey = &psk
+	}
+}
@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/internal/etcd"
+	"github.com/pabotesu/kurohabaki-client/internal/logger"
+	"github.com/pabotesu/kurohabaki-client/internal/rotation"
+	"github.com/pabotesu/kurohabaki-client/internal/wg"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// loadRevocations replaces the revocation list with the one in etcd and
+// returns the revision to watch from.
+func (a *Agent) loadRevocations() (int64, error) {
+	revoked, rev, err := etcd.FetchRevocations(a.etcdClient)
+	if err != nil {
+		return 0, err
+	}
+
+	a.revokedMu.Lock()
+	a.revoked = revoked
+	a.revokedMu.Unlock()
+
+	a.removeRevokedPeers(revoked)
+	return rev, nil
+}
+
+// watchRevocations applies changes to the revocation list as soon as they
+// are made, instead of waiting for the next peer watcher tick.
+func (a *Agent) watchRevocations(ctx context.Context, rev int64) {
+	for {
+		for resp := range etcd.WatchRevocations(ctx, a.etcdClient, rev) {
+			a.metrics.WatchResponse("revocations", len(resp.Events), resp.Err())
+			if err := resp.Err(); err != nil {
+				logger.Warnf("Revocation watch failed: %v", err)
+				break
+			}
+			for _, ev := range resp.Events {
+				r, revoked := etcd.RevocationFromEvent(ev)
+				a.revokedMu.Lock()
+				if revoked {
+					a.revoked[r.PublicKey] = r
+				} else {
+					delete(a.revoked, r.PublicKey)
+				}
+				a.revokedMu.Unlock()
+
+				if revoked {
+					logger.Infof("Peer %s revoked: %s", r.PublicKey, r.Reason)
+					a.removeRevokedPeers(map[string]etcd.Revocation{r.PublicKey: r})
+				}
+			}
+			rev = resp.Header.Revision
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		// The watch ended, e.g. because the revision was compacted;
+		// resynchronise the full list before watching again.
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+		if newRev, err := a.loadRevocations(); err != nil {
+			logger.Errorf("Failed to reload revocations: %v", err)
+		} else {
+			rev = newRev
+		}
+	}
+}
+
+// removeRevokedPeers removes the given keys from the device right away.
+func (a *Agent) removeRevokedPeers(revoked map[string]etcd.Revocation) {
+	var keys []device.NoisePublicKey
+	for pub := range revoked {
+		if key, err := wg.ParsePublicKey(pub); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	if err := a.wgIf.RemovePeers(keys); err != nil {
+		logger.Errorf("Failed to remove revoked peers: %v", err)
+	}
+}
+
+// revokedKeys returns the revoked keys, extended by the keys that revoked
+// keys rotated to, so a revoked node can't rejoin by rotating its key.
+func (a *Agent) revokedKeys(records map[string]*rotation.Record) map[string]etcd.Revocation {
+	a.revokedMu.RLock()
+	revoked := make(map[string]etcd.Revocation, len(a.revoked))
+	for pub, r := range a.revoked {
+		revoked[pub] = r
+	}
+	a.revokedMu.RUnlock()
+
+	for changed := true; changed; {
+		changed = false
+		for old, rec := range records {
+			r, ok := revoked[old]
+			if _, done := revoked[rec.NewPublicKey]; ok && !done {
+				r.PublicKey = rec.NewPublicKey
+				revoked[rec.NewPublicKey] = r
+				changed = true
+			}
+		}
+	}
+	return revoked
+}
+
+// filterRevoked drops revoked nodes, even if their records reappear.
+func filterRevoked(nodes []etcd.Node, revoked map[string]etcd.Revocation) []etcd.Node {
+	if len(revoked) == 0 {
+		return nodes
+	}
+	var kept []etcd.Node
+	for _, n := range nodes {
+		if _, ok := revoked[n.PublicKey]; ok {
+			logger.Warnf("Refusing to add revoked peer %s", n.PublicKey)
+			continue
+		}
+		kept = append(kept, n)
+	}
+	return kept
+}
+
+// revocationStatus lists the revocations for the status file.
+func revocationStatus(revoked map[string]etcd.Revocation) []RevocationStatus {
+	var list []RevocationStatus
+	for pub, r := range revoked {
+		list = append(list, RevocationStatus{PublicKey: pub, Reason: r.Reason, RevokedAt: r.RevokedAt})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].PublicKey < list[j].PublicKey })
+	return list
+}
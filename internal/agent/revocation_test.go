@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/pabotesu/kurohabaki-client/internal/etcd"
+	"github.com/pabotesu/kurohabaki-client/internal/rotation"
+)
+
+func TestRevokedKeys(t *testing.T) {
+	a := &Agent{
+		revoked: map[string]etcd.Revocation{
+			"A": {PublicKey: "A", Reason: "compromised"},
+		},
+	}
+
+	// A rotated to B and B to C; all of them stay revoked
+	records := map[string]*rotation.Record{
+		"A": {OldPublicKey: "A", NewPublicKey: "B"},
+		"B": {OldPublicKey: "B", NewPublicKey: "C"},
+		"X": {OldPublicKey: "X", NewPublicKey: "Y"},
+	}
+
+	revoked := a.revokedKeys(records)
+	for _, pub := range []string{"A", "B", "C"} {
+		if r, ok := revoked[pub]; !ok || r.Reason != "compromised" {
+			t.Errorf("Expected %s to be revoked, got %+v", pub, revoked)
+		}
+	}
+	if _, ok := revoked["Y"]; ok {
+		t.Error("Expected unrelated rotation not to be revoked")
+	}
+
+	nodes := []etcd.Node{{PublicKey: "A"}, {PublicKey: "C"}, {PublicKey: "X"}}
+	kept := filterRevoked(nodes, revoked)
+	if len(kept) != 1 || kept[0].PublicKey != "X" {
+		t.Errorf("Expected only X to be kept, got %+v", kept)
+	}
+}
@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/internal/etcd"
+	"github.com/pabotesu/kurohabaki-client/internal/logger"
+	"github.com/pabotesu/kurohabaki-client/internal/rotation"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// fetchRotations returns the key rotation records whose signatures verify,
+// keyed by the old public key.
+func (a *Agent) fetchRotations() map[string]*rotation.Record {
+	raw, err := etcd.FetchRotations(a.etcdClient)
+	if err != nil {
+		logger.Errorf("Failed to fetch key rotations: %v", err)
+		return nil
+	}
+
+	records := make(map[string]*rotation.Record, len(raw))
+	for old, data := range raw {
+		r, err := rotation.Parse(data)
+		if err != nil || r.OldPublicKey != old {
+			logger.Warnf("Ignoring invalid key rotation record for %s: %v", old, err)
+			continue
+		}
+		records[old] = r
+	}
+	return records
+}
+
+// handleSelfRotation switches the device to the new private key once the
+// switch time of this node's own rotation has passed, and retires the node
+// record of the old key afterwards.
+func (a *Agent) handleSelfRotation(ctx context.Context, records map[string]*rotation.Record, now time.Time) {
+	if r := records[a.selfPubKey]; r != nil && !now.Before(r.SwitchAt) {
+		if err := a.switchKey(ctx, r); err != nil {
+			logger.Errorf("Failed to switch to the rotated key: %v", err)
+		}
+	}
+
+	for old, r := range records {
+		if r.NewPublicKey != a.selfPubKey || now.Before(r.SwitchAt) || a.retired[old] {
+			continue
+		}
+		if err := etcd.DeleteNode(a.etcdClient, old); err != nil {
+			logger.Errorf("Failed to retire old node record: %v", err)
+			continue
+		}
+		a.retired[old] = true
+		logger.Infof("Retired node record of old key %s", old)
+	}
+}
+
+// switchKey loads the new private key stored by the rotate-key command and
+// installs it on the device.
+func (a *Agent) switchKey(ctx context.Context, r *rotation.Record) error {
+	cfg, err := a.cfg.Reload()
+	if err != nil {
+		return err
+	}
+	// The sandbox denies exec, so the command can't run in the agent
+	if cfg.Interface.KeySource() == "private_key_command" && !a.cfg.Sandbox.Disabled {
+		return fmt.Errorf("the private key is read from private_key_command, which the sandboxed agent can't run; restart the agent to use %s", r.NewPublicKey)
+	}
+	if err := cfg.Interface.ResolvePrivateKey(a.keyPassphrase); err != nil {
+		return err
+	}
+	key, err := wgtypes.ParseKey(cfg.Interface.PrivateKey)
+	if err != nil {
+		return err
+	}
+	if key.PublicKey().String() != r.NewPublicKey {
+		logger.Warnf("Waiting for the private key of %s in %s", r.NewPublicKey, a.cfg.Path)
+		return nil
+	}
+
+	if err := a.wgIf.SetPrivateKey(device.NoisePrivateKey(key)); err != nil {
+		return err
+	}
+	a.cfg.Interface.PrivateKey = cfg.Interface.PrivateKey
+	a.selfPubKey = r.NewPublicKey
+	logger.Infof("Switched to rotated key %s", a.selfPubKey)
+
+	// The encapsulation key is published under the node's public key, so
+	// the exchange starts over under the new one.
+	if a.pq != nil {
+		a.stopPQ()
+		a.pq = nil
+		if err := a.startPQ(ctx); err != nil {
+			logger.Warnf("Post-quantum PSK exchange disabled: %v", err)
+		}
+	}
+	return nil
+}
+
+// excludeSelf drops the records of this node's other key from nodes while a
+// rotation is in progress, so the node never peers with itself.
+func (a *Agent) excludeSelf(nodes []etcd.Node, records map[string]*rotation.Record) []etcd.Node {
+	own := make(map[string]bool)
+	for old, r := range records {
+		if old == a.selfPubKey {
+			own[r.NewPublicKey] = true
+		}
+		if r.NewPublicKey == a.selfPubKey {
+			own[old] = true
+		}
+	}
+	if len(own) == 0 {
+		return nodes
+	}
+
+	var kept []etcd.Node
+	for _, n := range nodes {
+		if !own[n.PublicKey] {
+			kept = append(kept, n)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,38 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/pabotesu/kurohabaki-client/internal/rotation"
+)
+
+func TestSwitchKeyCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := `interface:
+  private_key_command: echo yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+  address: 10.0.0.2/24
+peer:
+  public_key: yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+  endpoint: vpn.example.com:51820
+  allowed_ips: 10.0.0.1/32
+etcd:
+  endpoint: 10.0.0.1:2379
+`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	a := &Agent{cfg: cfg}
+
+	err = a.switchKey(t.Context(), &rotation.Record{NewPublicKey: "B"})
+	if err == nil || !strings.Contains(err.Error(), "private_key_command") {
+		t.Errorf("Expected the command to be refused in the sandbox, got %v", err)
+	}
+}
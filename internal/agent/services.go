@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"encoding/json"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/pabotesu/kurohabaki-client/internal/etcd"
+	"github.com/pabotesu/kurohabaki-client/internal/logger"
+	"github.com/pabotesu/kurohabaki-client/internal/meshdns"
+)
+
+// localServices returns the configured services, leaving out invalid ones.
+func (a *Agent) localServices() []config.Service {
+	var services []config.Service
+	for _, svc := range a.cfg.Services {
+		proto := svc.Proto()
+		if svc.Name == "" || svc.Port < 1 || svc.Port > 65535 || (proto != "tcp" && proto != "udp") {
+			logger.Warnf("Ignoring invalid service %q (port %d, protocol %q)", svc.Name, svc.Port, svc.Protocol)
+			continue
+		}
+		svc.Protocol = proto
+		services = append(services, svc)
+	}
+	return services
+}
+
+// publishServices stores this node's services in its record. The field is
+// removed when none are configured so that stale services disappear.
+func (a *Agent) publishServices() {
+	services := a.localServices()
+	if len(services) == 0 {
+		if err := etcd.DeleteNodeField(a.etcdClient, a.selfPubKey, "services"); err != nil {
+			logger.Errorf("Failed to clear services: %v", err)
+		}
+		return
+	}
+
+	data, err := json.Marshal(services)
+	if err != nil {
+		logger.Errorf("Failed to encode services: %v", err)
+		return
+	}
+	if err := etcd.PutNodeField(a.etcdClient, a.selfPubKey, "services", string(data), 0); err != nil {
+		logger.Errorf("Failed to publish services: %v", err)
+	}
+}
+
+// meshServices returns the services of the given nodes and this node for
+// the mesh DNS.
+func (a *Agent) meshServices(nodes []etcd.Node) []meshdns.Service {
+	var services []meshdns.Service
+	add := func(host string, list []config.Service) {
+		for _, svc := range list {
+			if host == "" || svc.Port < 1 || svc.Port > 65535 {
+				continue
+			}
+			services = append(services, meshdns.Service{
+				Name:     svc.Name,
+				Protocol: svc.Proto(),
+				Host:     host,
+				Port:     uint16(svc.Port),
+			})
+		}
+	}
+	for _, n := range nodes {
+		add(n.Hostname, n.Services)
+	}
+	add(a.hostname(), a.cfg.Services)
+	return services
+}
@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/internal/pqpsk"
+)
+
+// Status is a snapshot of the agent's state. The agent rewrites the status
+// file on every peer watcher tick and the status command reads it.
+type Status struct {
+	PID       int          `json:"pid"`
+	Interface string       `json:"interface"`
+	PublicKey string       `json:"public_key"`
+	UpdatedAt time.Time    `json:"updated_at"`
+	Peers     []PeerStatus `json:"peers"`
+
+	KeyRotation *KeyRotationStatus `json:"key_rotation,omitempty"`
+
+	// Revoked is set if this node's own key has been revoked
+	Revoked     bool               `json:"revoked,omitempty"`
+	Revocations []RevocationStatus `json:"revocations,omitempty"`
+
+	ACL    *ACLStatus    `json:"acl,omitempty"`
+	Filter *FilterStatus `json:"filter,omitempty"`
+
+	Forwards []ForwardStatus `json:"forwards,omitempty"`
+
+	// Proxies are the URLs of the proxies to the mesh, in netstack mode
+	Proxies []string `json:"proxies,omitempty"`
+}
+
+// ForwardStatus describes a running forward.
+type ForwardStatus struct {
+	Name      string `json:"name"`
+	Protocol  string `json:"protocol"`
+	Direction string `json:"direction"`
+	Listen    string `json:"listen"`
+	Target    string `json:"target"`
+	// Active is the number of open connections, or UDP client sessions
+	Active int64  `json:"active"`
+	Total  uint64 `json:"total"`
+}
+
+// FilterStatus describes the userspace packet filter or the nftables
+// firewall.
+type FilterStatus struct {
+	// Connections is the number of flows the userspace filter tracks
+	Connections int `json:"connections"`
+	// Table is the nftables table, set when the kernel enforces the rules
+	Table string `json:"table,omitempty"`
+	// Drops counts dropped packets by rule name
+	Drops map[string]uint64 `json:"drops"`
+}
+
+// ACLStatus describes the ACL policy in force.
+type ACLStatus struct {
+	Version  int   `json:"version,omitempty"`
+	Revision int64 `json:"revision"`
+	Rules    int   `json:"rules"`
+	// Error is set if the latest policy was rejected
+	Error string `json:"error,omitempty"`
+	// Denied lists the nodes that are not installed because of the policy
+	Denied []string `json:"denied,omitempty"`
+}
+
+// PeerAccessStatus lists the ports the ACL policy allows with a peer.
+type PeerAccessStatus struct {
+	Inbound  []string `json:"inbound,omitempty"`
+	Outbound []string `json:"outbound,omitempty"`
+}
+
+// RevocationStatus describes a revoked key.
+type RevocationStatus struct {
+	PublicKey string    `json:"public_key"`
+	Reason    string    `json:"reason,omitempty"`
+	RevokedAt time.Time `json:"revoked_at,omitempty"`
+}
+
+// KeyRotationStatus describes a pending rotation of this node's key.
+type KeyRotationStatus struct {
+	NewPublicKey string    `json:"new_public_key"`
+	SwitchAt     time.Time `json:"switch_at"`
+}
+
+// PeerStatus describes a single discovered peer.
+type PeerStatus struct {
+	PublicKey  string   `json:"public_key"`
+	Hostname   string   `json:"hostname,omitempty"`
+	Endpoint   string   `json:"endpoint,omitempty"`
+	AllowedIPs []string `json:"allowed_ips,omitempty"`
+	// PresharedKey is "none", "static" (derived from the network secret)
+	// or "pq" (from the post-quantum exchange).
+	PresharedKey string            `json:"preshared_key"`
+	PQ           *pqpsk.PeerState  `json:"pq,omitempty"`
+	Access       *PeerAccessStatus `json:"access,omitempty"`
+}
+
+// Status returns the latest status snapshot, taken on every peer watcher
+// tick. Before the first one only the identity of the node is known.
+func (a *Agent) Status() *Status {
+	a.statusMu.RLock()
+	defer a.statusMu.RUnlock()
+	if a.lastStatus != nil {
+		return a.lastStatus
+	}
+	return &Status{
+		PID:       os.Getpid(),
+		Interface: a.wgIf.Name(),
+		PublicKey: a.selfPubKey,
+		UpdatedAt: time.Now(),
+	}
+}
+
+// WriteStatus atomically replaces the status file at path.
+func WriteStatus(path string, st *Status) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode status: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".kh-status-*")
+	if err != nil {
+		return fmt.Errorf("failed to create status file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write status file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write status file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to set status file permissions: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ReadStatus reads the status file at path.
+func ReadStatus(path string) (*Status, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var st Status
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("invalid status file: %w", err)
+	}
+	return &st, nil
+}
@@ -0,0 +1,181 @@
+package enroll
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/internal/etcd"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	tokensPrefix    = "/kurohabaki/join-tokens/"
+	addressesPrefix = "/kurohabaki/addresses/"
+
+	// maxJoinAttempts bounds the retries when concurrent joins race for
+	// the same token or address
+	maxJoinAttempts = 5
+)
+
+// Result is what a node learns from joining.
+type Result struct {
+	// Address is the claimed address with the prefix length of the pool
+	Address string
+	Grant   *Grant
+}
+
+// CreateGrant stores g for token t. It fails if a grant with the same ID exists.
+func CreateGrant(cli *clientv3.Client, t *Token, g *Grant) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := netip.ParsePrefix(g.AddressPool); err != nil {
+		return fmt.Errorf("invalid address pool: %w", err)
+	}
+	g.SecretHash = t.SecretHash()
+
+	key := tokensPrefix + t.ID
+	resp, err := cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, g.Marshal())).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("failed to store join token: %w", err)
+	}
+	if !resp.Succeeded {
+		return fmt.Errorf("join token %s already exists", t.ID)
+	}
+	return nil
+}
+
+// Join consumes one use of the token's grant, claims a free address from
+// its pool for pubKey and registers the node. Everything happens in a single
+// etcd transaction that only succeeds if neither the grant nor the address
+// changed since they were read, so a single-use token can't be used twice.
+func Join(cli *clientv3.Client, t *Token, pubKey string) (*Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	tokenKey := tokensPrefix + t.ID
+	for attempt := 0; attempt < maxJoinAttempts; attempt++ {
+		resp, err := cli.Get(ctx, tokenKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch join token: %w", err)
+		}
+		if len(resp.Kvs) == 0 {
+			return nil, fmt.Errorf("join token not found")
+		}
+		kv := resp.Kvs[0]
+
+		grant, err := ParseGrant(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		if err := grant.Check(t, time.Now()); err != nil {
+			return nil, err
+		}
+		pool, err := netip.ParsePrefix(grant.AddressPool)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address pool in join token: %w", err)
+		}
+
+		used, err := usedAddresses(ctx, cli)
+		if err != nil {
+			return nil, err
+		}
+		if _, ipnet, err := net.ParseCIDR(grant.Server.AllowedIPs); err == nil {
+			used[ipnet.IP.String()] = true
+		}
+		addr, err := NextAddress(pool, used)
+		if err != nil {
+			return nil, err
+		}
+
+		addrKey := addressesPrefix + addr.String()
+		grant.Uses++
+		ops := []clientv3.Op{
+			clientv3.OpPut(addrKey, pubKey),
+			clientv3.OpPut(etcd.NodeKey(pubKey, "ip"), addr.String()),
+		}
+		if grant.Exhausted() {
+			ops = append(ops, clientv3.OpDelete(tokenKey))
+		} else {
+			ops = append(ops, clientv3.OpPut(tokenKey, grant.Marshal()))
+		}
+
+		txn, err := cli.Txn(ctx).
+			If(
+				clientv3.Compare(clientv3.ModRevision(tokenKey), "=", kv.ModRevision),
+				clientv3.Compare(clientv3.CreateRevision(addrKey), "=", 0),
+			).
+			Then(ops...).
+			Commit()
+		if err != nil {
+			return nil, fmt.Errorf("failed to claim join token: %w", err)
+		}
+		if txn.Succeeded {
+			return &Result{
+				Address: netip.PrefixFrom(addr, pool.Bits()).String(),
+				Grant:   grant,
+			}, nil
+		}
+		// Another node joined concurrently; start over with fresh data
+	}
+	return nil, fmt.Errorf("failed to claim join token: too many concurrent joins, try again")
+}
+
+// Release undoes the address claim and registration of a join whose config
+// could not be written. The consumed token use is not given back.
+func Release(cli *clientv3.Client, pubKey string, res *Result) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	addr := strings.SplitN(res.Address, "/", 2)[0]
+	_, err := cli.Txn(ctx).Then(
+		clientv3.OpDelete(addressesPrefix+addr),
+		clientv3.OpDelete(etcd.NodeKey(pubKey, ""), clientv3.WithPrefix()),
+	).Commit()
+	return err
+}
+
+// usedAddresses collects the claimed addresses and the addresses of all
+// registered nodes, including ones that joined without a token.
+func usedAddresses(ctx context.Context, cli *clientv3.Client) (map[string]bool, error) {
+	used := make(map[string]bool)
+
+	resp, err := cli.Get(ctx, addressesPrefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch claimed addresses: %w", err)
+	}
+	for _, kv := range resp.Kvs {
+		used[strings.TrimPrefix(string(kv.Key), addressesPrefix)] = true
+	}
+
+	ips, err := etcd.FetchNodeIPs(cli)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		used[ip] = true
+	}
+	return used, nil
+}
+
+// NextAddress returns the first address of pool that isn't in used, skipping
+// the network address and, for IPv4, the broadcast address.
+func NextAddress(pool netip.Prefix, used map[string]bool) (netip.Addr, error) {
+	pool = pool.Masked()
+	for addr := pool.Addr().Next(); addr.IsValid() && pool.Contains(addr); addr = addr.Next() {
+		if addr.Is4() && !pool.Contains(addr.Next()) {
+			break
+		}
+		if !used[addr.String()] {
+			return addr, nil
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("no free address left in %s", pool)
+}
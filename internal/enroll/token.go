@@ -0,0 +1,138 @@
+package enroll
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// tokenPrefix marks the version of the token encoding
+const tokenPrefix = "kh1."
+
+// Token is what an admin hands to a new node. It carries everything needed
+// to reach etcd and claim the matching grant; only a hash of the secret is
+// stored in etcd.
+type Token struct {
+	Etcd   string `json:"etcd"`
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+// NewToken creates a token with a random ID and secret for the etcd server
+// at endpoint.
+func NewToken(endpoint string) (*Token, error) {
+	var buf [24]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return nil, fmt.Errorf("failed to read random bytes: %w", err)
+	}
+	return &Token{
+		Etcd:   endpoint,
+		ID:     hex.EncodeToString(buf[:8]),
+		Secret: base64.RawURLEncoding.EncodeToString(buf[8:]),
+	}, nil
+}
+
+// ParseToken decodes a token string created by Token.String.
+func ParseToken(s string) (*Token, error) {
+	encoded, ok := strings.CutPrefix(strings.TrimSpace(s), tokenPrefix)
+	if !ok {
+		return nil, fmt.Errorf("invalid join token: unknown format")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid join token: %w", err)
+	}
+
+	var t Token
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("invalid join token: %w", err)
+	}
+	if t.Etcd == "" || t.ID == "" || t.Secret == "" {
+		return nil, fmt.Errorf("invalid join token: missing fields")
+	}
+	if strings.Contains(t.ID, "/") {
+		return nil, fmt.Errorf("invalid join token: malformed ID")
+	}
+	return &t, nil
+}
+
+// String encodes the token for handing out.
+func (t *Token) String() string {
+	data, _ := json.Marshal(t)
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(data)
+}
+
+// SecretHash returns the hash of the secret stored in the grant.
+func (t *Token) SecretHash() string {
+	sum := sha256.Sum256([]byte(t.Secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// ServerPeer describes the server peer written to the new node's config.
+type ServerPeer struct {
+	PublicKey           string `json:"public_key"`
+	Endpoint            string `json:"endpoint"`
+	AllowedIPs          string `json:"allowed_ips"`
+	PersistentKeepalive int    `json:"persistent_keepalive,omitempty"`
+}
+
+// Grant is the record an admin stores at /kurohabaki/join-tokens/<id>. It
+// limits how often and until when the token can be used and holds the
+// network settings handed to nodes that join with it.
+type Grant struct {
+	SecretHash  string     `json:"secret_hash"`
+	ExpiresAt   time.Time  `json:"expires_at,omitempty"`
+	MaxUses     int        `json:"max_uses,omitempty"` // 0 means single-use
+	Uses        int        `json:"uses"`
+	AddressPool string     `json:"address_pool"`
+	Routes      []string   `json:"routes,omitempty"`
+	DNS         string     `json:"dns,omitempty"`
+	Server      ServerPeer `json:"server"`
+}
+
+// ParseGrant decodes a grant read from etcd.
+func ParseGrant(data []byte) (*Grant, error) {
+	var g Grant
+	if err := json.Unmarshal(data, &g); err != nil {
+		return nil, fmt.Errorf("invalid join token record: %w", err)
+	}
+	return &g, nil
+}
+
+// Marshal encodes the grant for etcd.
+func (g *Grant) Marshal() string {
+	data, _ := json.Marshal(g)
+	return string(data)
+}
+
+// Check reports why the grant can't be used with t at now, if at all.
+func (g *Grant) Check(t *Token, now time.Time) error {
+	if subtle.ConstantTimeCompare([]byte(g.SecretHash), []byte(t.SecretHash())) != 1 {
+		return fmt.Errorf("join token is invalid")
+	}
+	if !g.ExpiresAt.IsZero() && !now.Before(g.ExpiresAt) {
+		return fmt.Errorf("join token expired at %s", g.ExpiresAt.Format(time.RFC3339))
+	}
+	if g.Uses >= g.maxUses() {
+		return fmt.Errorf("join token has already been used")
+	}
+	return nil
+}
+
+// Exhausted reports whether the grant has no uses left.
+func (g *Grant) Exhausted() bool {
+	return g.Uses >= g.maxUses()
+}
+
+func (g *Grant) maxUses() int {
+	if g.MaxUses <= 0 {
+		return 1
+	}
+	return g.MaxUses
+}
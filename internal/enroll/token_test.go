@@ -0,0 +1,89 @@
+package enroll
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestToken(t *testing.T) {
+	token, err := NewToken("192.168.1.100:2379")
+	if err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+
+	parsed, err := ParseToken(token.String())
+	if err != nil {
+		t.Fatalf("Failed to parse token: %v", err)
+	}
+	if *parsed != *token {
+		t.Errorf("Expected %+v, got %+v", token, parsed)
+	}
+
+	for _, invalid := range []string{"", "kh1.", "kh1.!!!", "kh2." + token.String()[4:]} {
+		if _, err := ParseToken(invalid); err == nil {
+			t.Errorf("Expected error for token %q", invalid)
+		}
+	}
+}
+
+func TestGrantCheck(t *testing.T) {
+	token, _ := NewToken("192.168.1.100:2379")
+	other, _ := NewToken("192.168.1.100:2379")
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		grant   Grant
+		token   *Token
+		wantErr bool
+	}{
+		{"Valid", Grant{SecretHash: token.SecretHash()}, token, false},
+		{"WrongSecret", Grant{SecretHash: token.SecretHash()}, other, true},
+		{"Expired", Grant{SecretHash: token.SecretHash(), ExpiresAt: now.Add(-time.Second)}, token, true},
+		{"NotExpired", Grant{SecretHash: token.SecretHash(), ExpiresAt: now.Add(time.Hour)}, token, false},
+		{"SingleUseConsumed", Grant{SecretHash: token.SecretHash(), Uses: 1}, token, true},
+		{"MultiUse", Grant{SecretHash: token.SecretHash(), MaxUses: 3, Uses: 2}, token, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.grant.Check(tt.token, now)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNextAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		pool    string
+		used    []string
+		want    string
+		wantErr bool
+	}{
+		{"FirstHost", "10.0.0.0/24", nil, "10.0.0.1", false},
+		{"SkipUsed", "10.0.0.0/24", []string{"10.0.0.1", "10.0.0.2"}, "10.0.0.3", false},
+		{"UnmaskedPool", "10.0.0.77/24", nil, "10.0.0.1", false},
+		{"SkipBroadcast", "10.0.0.0/30", []string{"10.0.0.1", "10.0.0.2"}, "", true},
+		{"IPv6", "fd00::/64", []string{"fd00::1"}, "fd00::2", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			used := make(map[string]bool)
+			for _, u := range tt.used {
+				used[u] = true
+			}
+			got, err := NextAddress(netip.MustParsePrefix(tt.pool), used)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NextAddress() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.String() != tt.want {
+				t.Errorf("NextAddress() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
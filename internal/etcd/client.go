@@ -2,53 +2,58 @@ package etcd
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/pabotesu/kurohabaki-client/config"
 	"github.com/pabotesu/kurohabaki-client/internal/logger"
 	clientv3 "go.etcd.io/etcd/client/v3"
-	"go.uber.org/zap"
+	"google.golang.org/grpc"
 )
 
-// ConfigureEtcdLogger sets up etcd client logging based on debug mode
-func ConfigureEtcdLogger(debug bool) {
-	var zapLogConfig zap.Config
-	if debug {
-		// Even in debug mode, we want to limit the verbosity
-		zapLogConfig = zap.NewDevelopmentConfig()
-		// Only show warnings and errors, not debug messages
-		zapLogConfig.Level = zap.NewAtomicLevelAt(zap.WarnLevel)
-	} else {
-		// In production mode, completely suppress etcd logs
-		zapLogConfig = zap.NewProductionConfig()
-		zapLogConfig.Level = zap.NewAtomicLevelAt(zap.ErrorLevel)
-		// Disable output for all logs
-		zapLogConfig.OutputPaths = []string{"discard"}
-	}
+var etcdLog = logger.Named(logger.Etcd)
 
-	// Don't show caller or stacktraces even in debug mode
-	zapLogConfig.DisableCaller = true
-	zapLogConfig.DisableStacktrace = true
+// NewClient connects to the etcd server at endpoint, logging through the
+// etcd subsystem's logger. The dial options are added to the client's own,
+// e.g. to instrument its requests.
+func NewClient(endpoint string, opts ...grpc.DialOption) (*clientv3.Client, error) {
+	return clientv3.New(clientv3.Config{
+		Endpoints:   []string{endpoint},
+		DialTimeout: 5 * time.Second,
+		DialOptions: opts,
+		Logger:      etcdLog.Zap(),
+	})
+}
 
-	zapLogger, _ := zapLogConfig.Build()
+const (
+	nodesPrefix     = "/kurohabaki/nodes/"
+	pqPSKPrefix     = "/kurohabaki/pqpsk/"
+	rotationsPrefix = "/kurohabaki/rotations/"
+	revokedPrefix   = "/kurohabaki/revoked/"
 
-	// Set the global zap logger which etcd client will use
-	zap.ReplaceGlobals(zapLogger)
-}
+	aclKey = "/kurohabaki/acl/policy"
+)
 
 type Node struct {
 	PublicKey string
 	IP        string
 	Endpoint  string
 	LastSeen  time.Time
+	MLKEMKey  string
+	Hostname  string
+	Services  []config.Service
+	Tags      []string
 }
 
 func FetchPeers(cli *clientv3.Client, selfPubKey string) ([]Node, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	resp, err := cli.Get(ctx, "/kurohabaki/nodes/", clientv3.WithPrefix())
+	resp, err := cli.Get(ctx, nodesPrefix, clientv3.WithPrefix())
 	if err != nil {
 		// Provide a more user-friendly error message
 		if strings.Contains(err.Error(), "context deadline exceeded") ||
@@ -69,7 +74,7 @@ func FetchPeers(cli *clientv3.Client, selfPubKey string) ([]Node, error) {
 		field := parts[4]
 
 		if pubKey == selfPubKey {
-			logger.Printf("🚫 Skipping self pubKey: %s", pubKey)
+			etcdLog.Debugf("Skipping self pubKey: %s", pubKey)
 			continue
 		}
 
@@ -87,6 +92,20 @@ func FetchPeers(cli *clientv3.Client, selfPubKey string) ([]Node, error) {
 		case "last_seen":
 			t, _ := time.Parse(time.RFC3339, string(kv.Value))
 			node.LastSeen = t
+		case "mlkem_ek":
+			node.MLKEMKey = string(kv.Value)
+		case "hostname":
+			node.Hostname = string(kv.Value)
+		case "services":
+			if err := json.Unmarshal(kv.Value, &node.Services); err != nil {
+				etcdLog.Warnf("Ignoring invalid services of %s: %v", pubKey, err)
+				node.Services = nil
+			}
+		case "tags":
+			if err := json.Unmarshal(kv.Value, &node.Tags); err != nil {
+				etcdLog.Warnf("Ignoring invalid tags of %s: %v", pubKey, err)
+				node.Tags = nil
+			}
 		}
 	}
 
@@ -96,10 +115,278 @@ func FetchPeers(cli *clientv3.Client, selfPubKey string) ([]Node, error) {
 			peers = append(peers, *n)
 		}
 	}
+	// Keep a stable order so that unchanged peer lists compare equal
+	sort.Slice(peers, func(i, j int) bool { return peers[i].PublicKey < peers[j].PublicKey })
 
 	return peers, nil
 }
 
+// PutNodeField publishes a single field of a node record. A non-zero lease
+// makes the field disappear when the agent stops refreshing it.
+func PutNodeField(cli *clientv3.Client, pubKey, field, value string, lease clientv3.LeaseID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var opts []clientv3.OpOption
+	if lease != clientv3.NoLease {
+		opts = append(opts, clientv3.WithLease(lease))
+	}
+	if _, err := cli.Put(ctx, NodeKey(pubKey, field), value, opts...); err != nil {
+		return fmt.Errorf("failed to publish node field %s: %w", field, err)
+	}
+	return nil
+}
+
+// DeleteNodeField removes a single field of a node record.
+func DeleteNodeField(cli *clientv3.Client, pubKey, field string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := cli.Delete(ctx, NodeKey(pubKey, field)); err != nil {
+		return fmt.Errorf("failed to delete node field %s: %w", field, err)
+	}
+	return nil
+}
+
+// NodeKey returns the etcd key of a field of a node record.
+func NodeKey(pubKey, field string) string {
+	return nodesPrefix + pubKey + "/" + field
+}
+
+// FetchNodeIPs returns the addresses of all registered nodes.
+func FetchNodeIPs(cli *clientv3.Client) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := cli.Get(ctx, nodesPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch nodes from etcd: %w", err)
+	}
+
+	var ips []string
+	for _, kv := range resp.Kvs {
+		if strings.HasSuffix(string(kv.Key), "/ip") {
+			ips = append(ips, string(kv.Value))
+		}
+	}
+	return ips, nil
+}
+
+// FetchNode returns the raw fields of a single node record.
+func FetchNode(cli *clientv3.Client, pubKey string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	prefix := nodesPrefix + pubKey + "/"
+	resp, err := cli.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch node record from etcd: %w", err)
+	}
+
+	fields := make(map[string]string, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		fields[strings.TrimPrefix(string(kv.Key), prefix)] = string(kv.Value)
+	}
+	return fields, nil
+}
+
+// DeleteNode removes every field of a node record.
+func DeleteNode(cli *clientv3.Client, pubKey string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := cli.Delete(ctx, nodesPrefix+pubKey+"/", clientv3.WithPrefix()); err != nil {
+		return fmt.Errorf("failed to delete node record: %w", err)
+	}
+	return nil
+}
+
+// FetchRotations returns all key rotation records, keyed by the old public key.
+func FetchRotations(cli *clientv3.Client) (map[string][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := cli.Get(ctx, rotationsPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch key rotations from etcd: %w", err)
+	}
+
+	records := make(map[string][]byte, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		records[strings.TrimPrefix(string(kv.Key), rotationsPrefix)] = kv.Value
+	}
+	return records, nil
+}
+
+// PutRotation publishes a key rotation record that expires after ttl seconds.
+func PutRotation(cli *clientv3.Client, oldPubKey, value string, ttl int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	lease, err := cli.Grant(ctx, ttl)
+	if err != nil {
+		return fmt.Errorf("failed to grant etcd lease: %w", err)
+	}
+	if _, err := cli.Put(ctx, rotationsPrefix+oldPubKey, value, clientv3.WithLease(lease.ID)); err != nil {
+		return fmt.Errorf("failed to publish key rotation: %w", err)
+	}
+	return nil
+}
+
+// DeleteRotation removes the key rotation record of oldPubKey.
+func DeleteRotation(cli *clientv3.Client, oldPubKey string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := cli.Delete(ctx, rotationsPrefix+oldPubKey); err != nil {
+		return fmt.Errorf("failed to delete key rotation: %w", err)
+	}
+	return nil
+}
+
+// Revocation marks a public key as no longer allowed in the mesh.
+type Revocation struct {
+	PublicKey string    `json:"-"`
+	Reason    string    `json:"reason"`
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+// FetchRevocations returns all revoked keys together with the revision the
+// result corresponds to, so that a watch can continue from there.
+func FetchRevocations(cli *clientv3.Client) (map[string]Revocation, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := cli.Get(ctx, revokedPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to fetch revocations from etcd: %w", err)
+	}
+
+	revoked := make(map[string]Revocation, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		r := parseRevocation(kv.Key, kv.Value)
+		revoked[r.PublicKey] = r
+	}
+	return revoked, resp.Header.Revision, nil
+}
+
+// WatchRevocations streams changes to the revocation list after revision rev.
+func WatchRevocations(ctx context.Context, cli *clientv3.Client, rev int64) clientv3.WatchChan {
+	return cli.Watch(ctx, revokedPrefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+}
+
+// RevocationFromEvent decodes a watch event on the revocation list. It
+// reports whether the key was revoked (true) or the revocation removed.
+func RevocationFromEvent(ev *clientv3.Event) (Revocation, bool) {
+	if ev.Type == clientv3.EventTypeDelete {
+		return Revocation{PublicKey: strings.TrimPrefix(string(ev.Kv.Key), revokedPrefix)}, false
+	}
+	return parseRevocation(ev.Kv.Key, ev.Kv.Value), true
+}
+
+// parseRevocation decodes a revocation record. A record that isn't valid
+// JSON still revokes its key, since failing open would let a typo keep a
+// compromised node in the mesh.
+func parseRevocation(key, value []byte) Revocation {
+	var r Revocation
+	if err := json.Unmarshal(value, &r); err != nil {
+		r = Revocation{Reason: strings.TrimSpace(string(value))}
+	}
+	r.PublicKey = strings.TrimPrefix(string(key), revokedPrefix)
+	return r
+}
+
+// PutRevocation revokes a public key.
+func PutRevocation(cli *clientv3.Client, r Revocation) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := cli.Put(ctx, revokedPrefix+r.PublicKey, string(data)); err != nil {
+		return fmt.Errorf("failed to publish revocation: %w", err)
+	}
+	return nil
+}
+
+// FetchACL returns the ACL policy document and its modification revision.
+// The document is nil and the revision 0 if no policy is set.
+func FetchACL(cli *clientv3.Client) ([]byte, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := cli.Get(ctx, aclKey)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to fetch ACL policy from etcd: %w", err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, nil
+	}
+	return resp.Kvs[0].Value, resp.Kvs[0].ModRevision, nil
+}
+
+// ErrACLChanged is returned by PutACL when the policy was modified since it
+// was read.
+var ErrACLChanged = errors.New("ACL policy was changed concurrently")
+
+// PutACL stores the ACL policy document if it is still at revision prev
+// (0 if there was none).
+func PutACL(cli *clientv3.Client, doc []byte, prev int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(aclKey), "=", prev)).
+		Then(clientv3.OpPut(aclKey, string(doc))).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("failed to store ACL policy: %w", err)
+	}
+	if !resp.Succeeded {
+		return ErrACLChanged
+	}
+	return nil
+}
+
+// FetchPQMessages returns the post-quantum PSK exchange messages other nodes
+// have published for selfPubKey, keyed by the sender's public key.
+func FetchPQMessages(cli *clientv3.Client, selfPubKey string) (map[string][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	prefix := pqPSKPrefix + selfPubKey + "/"
+	resp, err := cli.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch PQ PSK messages from etcd: %w", err)
+	}
+
+	msgs := make(map[string][]byte, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		// Public keys are base64 and may contain '/', so the sender is
+		// everything after the recipient's prefix.
+		sender := strings.TrimPrefix(string(kv.Key), prefix)
+		msgs[sender] = kv.Value
+	}
+	return msgs, nil
+}
+
+// PutPQMessage publishes a post-quantum PSK exchange message from one node to another.
+func PutPQMessage(cli *clientv3.Client, to, from, value string, lease clientv3.LeaseID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var opts []clientv3.OpOption
+	if lease != clientv3.NoLease {
+		opts = append(opts, clientv3.WithLease(lease))
+	}
+	if _, err := cli.Put(ctx, pqPSKPrefix+to+"/"+from, value, opts...); err != nil {
+		return fmt.Errorf("failed to publish PQ PSK message: %w", err)
+	}
+	return nil
+}
+
 // CheckEtcdHealth verifies connectivity to the etcd server
 func CheckEtcdHealth(cli *clientv3.Client) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
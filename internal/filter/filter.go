@@ -0,0 +1,343 @@
+// Package filter enforces per-peer rules on the packets between the TUN
+// device and wireguard-go. New flows are checked against local rules and the
+// ACL policy; packets of flows already accepted pass on a single lookup
+// until the rules change.
+package filter
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/pabotesu/kurohabaki-client/internal/acl"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// Names of the counters for traffic the ACL policy denies, and for packets
+// too short or malformed to be checked against it.
+const (
+	ACLInbound  = "acl-in"
+	ACLOutbound = "acl-out"
+	Malformed   = "malformed"
+)
+
+// sweepInterval is how often expired flows are removed and the filter's
+// clock advances.
+const sweepInterval = time.Second
+
+// Rule is a local filter rule. Rules are checked in order and the first
+// match decides; traffic no rule matches is left to the ACL policy.
+type Rule struct {
+	Name    string
+	Drop    bool
+	Inbound bool
+	Ports   []acl.PortRange
+	// Tags selects the peers the rule applies to; empty means all.
+	Tags []string
+}
+
+// RulesFromConfig converts and validates the firewall rules of the config.
+func RulesFromConfig(rules []config.FirewallRule) ([]Rule, error) {
+	var out []Rule
+	seen := make(map[string]bool)
+	for i, r := range rules {
+		if r.Name == "" || seen[r.Name] || r.Name == ACLInbound || r.Name == ACLOutbound {
+			return nil, fmt.Errorf("firewall rule %d: name %q is empty or not unique", i, r.Name)
+		}
+		seen[r.Name] = true
+
+		if err := r.Validate(); err != nil {
+			return nil, fmt.Errorf("firewall rule %s: %w", r.Name, err)
+		}
+		rule := Rule{Name: r.Name, Tags: r.Tags, Drop: r.Action == "drop", Inbound: r.Direction == "in"}
+
+		ports := r.Ports
+		if len(ports) == 0 {
+			ports = []string{acl.Wildcard}
+		}
+		for _, spec := range ports {
+			pr, err := acl.ParsePortRange(spec)
+			if err != nil {
+				return nil, fmt.Errorf("firewall rule %s: %w", r.Name, err)
+			}
+			rule.Ports = append(rule.Ports, pr)
+		}
+		out = append(out, rule)
+	}
+	return out, nil
+}
+
+// Peer is a mesh node the filter knows the identity of.
+type Peer struct {
+	Addrs []netip.Addr
+	Tags  []string
+	// Access is what the ACL policy allows with the peer, or nil if no
+	// policy is in force.
+	Access *acl.Access
+}
+
+// Filter is a tun.Device that drops packets not allowed by its rules.
+type Filter struct {
+	tun.Device
+
+	local    []Rule
+	rules    atomic.Pointer[ruleSet]
+	flows    flowTable
+	now      atomic.Int64 // unix seconds, advanced by the sweeper
+	counters map[string]*atomic.Uint64
+
+	done chan struct{}
+	once sync.Once
+}
+
+// compiledRule is a local rule with its drop counter.
+type compiledRule struct {
+	drop    bool
+	ports   []acl.PortRange
+	counter *atomic.Uint64
+}
+
+// peerRules are the rules that apply to traffic with one remote address.
+type peerRules struct {
+	in, out []*compiledRule
+	access  *acl.Access
+}
+
+type ruleSet struct {
+	peers   map[[16]byte]*peerRules
+	unknown peerRules
+	// passAll is set when there is nothing to enforce
+	passAll bool
+}
+
+// New wraps dev with a filter enforcing rules. Until SetPeers is called only
+// local rules without tags apply.
+func New(dev tun.Device, rules []Rule) *Filter {
+	f := &Filter{
+		Device:   dev,
+		local:    rules,
+		counters: map[string]*atomic.Uint64{ACLInbound: {}, ACLOutbound: {}, Malformed: {}},
+		done:     make(chan struct{}),
+	}
+	for _, r := range rules {
+		f.counters[r.Name] = new(atomic.Uint64)
+	}
+	f.flows.init()
+	f.now.Store(time.Now().Unix())
+	f.SetPeers(nil)
+	go f.sweep()
+	return f
+}
+
+// SetPeers replaces the peer table the rules are evaluated against.
+func (f *Filter) SetPeers(peers []Peer) {
+	rs := &ruleSet{
+		peers:   make(map[[16]byte]*peerRules),
+		passAll: len(f.local) == 0,
+	}
+	rs.unknown = f.compile(nil, nil, false)
+	for _, p := range peers {
+		pr := f.compile(p.Tags, p.Access, true)
+		if p.Access != nil {
+			rs.passAll = false
+		}
+		for _, addr := range p.Addrs {
+			rs.peers[addr.As16()] = &pr
+		}
+	}
+	f.rules.Store(rs)
+}
+
+// compile selects the local rules that apply to a peer with tags.
+func (f *Filter) compile(tags []string, access *acl.Access, known bool) peerRules {
+	pr := peerRules{access: access}
+	for _, r := range f.local {
+		if len(r.Tags) > 0 && !(known && r.AppliesTo(tags)) {
+			continue
+		}
+		cr := &compiledRule{drop: r.Drop, ports: r.Ports, counter: f.counters[r.Name]}
+		if r.Inbound {
+			pr.in = append(pr.in, cr)
+		} else {
+			pr.out = append(pr.out, cr)
+		}
+	}
+	return pr
+}
+
+// AppliesTo reports whether the rule applies to a peer with tags.
+func (r Rule) AppliesTo(tags []string) bool {
+	if len(r.Tags) == 0 {
+		return true
+	}
+	for _, t := range r.Tags {
+		if t == acl.Wildcard || slices.Contains(tags, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Read filters packets leaving this node. Dropped packets get a size of 0,
+// which wireguard-go skips.
+func (f *Filter) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	n, err := f.Device.Read(bufs, sizes, offset)
+	rs := f.rules.Load()
+	if rs.passAll {
+		return n, err
+	}
+	for i := 0; i < n; i++ {
+		if sizes[i] > 0 && !f.allow(rs, bufs[i][offset:offset+sizes[i]], false) {
+			sizes[i] = 0
+		}
+	}
+	return n, err
+}
+
+// Write filters packets arriving from peers before they reach the host.
+func (f *Filter) Write(bufs [][]byte, offset int) (int, error) {
+	rs := f.rules.Load()
+	if rs.passAll {
+		return f.Device.Write(bufs, offset)
+	}
+
+	kept := bufs[:0]
+	for _, b := range bufs {
+		if f.allow(rs, b[offset:], true) {
+			kept = append(kept, b)
+		}
+	}
+	dropped := len(bufs) - len(kept)
+	if len(kept) == 0 {
+		return dropped, nil
+	}
+	n, err := f.Device.Write(kept, offset)
+	return n + dropped, err
+}
+
+// allow decides whether a packet may pass, tracking flows it accepts.
+// Packets that can't be parsed are dropped, since their ports can't be
+// checked; the IP stack would reject them anyway. Flows accepted under an
+// older rule set are checked again, so that a policy change also ends the
+// flows it no longer allows.
+func (f *Filter) allow(rs *ruleSet, b []byte, inbound bool) bool {
+	var p packet
+	if !p.parse(b) {
+		f.counters[Malformed].Add(1)
+		return false
+	}
+	if p.skip {
+		return true
+	}
+
+	// Flows are keyed from this node's side so both directions match
+	key := flowKey{proto: p.proto, local: p.src, remote: p.dst, lport: p.sport, rport: p.dport}
+	if inbound {
+		key = flowKey{proto: p.proto, local: p.dst, remote: p.src, lport: p.dport, rport: p.sport}
+	}
+	now := f.now.Load()
+	if fl := f.flows.touch(key, now); fl != nil {
+		if fl.rules.Load() == rs {
+			return true
+		}
+		if ok, _ := f.check(rs, key, fl.inbound); ok {
+			fl.rules.Store(rs)
+			return true
+		}
+		// Left for the packet to start a new flow if it may
+		f.flows.remove(key)
+	}
+
+	ok, counter := f.check(rs, key, inbound)
+	if !ok {
+		counter.Add(1)
+		return false
+	}
+	f.flows.add(key, now, rs, inbound)
+	return true
+}
+
+// check applies rs to a flow started by a packet in the given direction. If
+// the flow is denied, it also returns the counter of the rule denying it.
+func (f *Filter) check(rs *ruleSet, key flowKey, inbound bool) (bool, *atomic.Uint64) {
+	pr := rs.peers[key.remote]
+	if pr == nil {
+		pr = &rs.unknown
+	}
+	rules, access, dport := pr.out, pr.access, key.rport
+	if inbound {
+		rules, dport = pr.in, key.lport
+	}
+
+	proto := protoName(key.proto)
+	for _, r := range rules {
+		if !matchPorts(r.ports, proto, dport) {
+			continue
+		}
+		if r.drop {
+			return false, r.counter
+		}
+		return true, nil
+	}
+
+	if access != nil {
+		allowed := access.AllowsOutbound(proto, dport)
+		counter := ACLOutbound
+		if inbound {
+			allowed = access.AllowsInbound(proto, dport)
+			counter = ACLInbound
+		}
+		if !allowed {
+			return false, f.counters[counter]
+		}
+	}
+	return true, nil
+}
+
+func matchPorts(ranges []acl.PortRange, proto string, port uint16) bool {
+	for _, r := range ranges {
+		if r.Match(proto, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// Drops returns the number of packets dropped by each rule.
+func (f *Filter) Drops() map[string]uint64 {
+	drops := make(map[string]uint64, len(f.counters))
+	for name, c := range f.counters {
+		drops[name] = c.Load()
+	}
+	return drops
+}
+
+// Connections returns the number of tracked flows.
+func (f *Filter) Connections() int {
+	return f.flows.len()
+}
+
+// Close stops the filter and closes the wrapped device.
+func (f *Filter) Close() error {
+	f.once.Do(func() { close(f.done) })
+	return f.Device.Close()
+}
+
+func (f *Filter) sweep() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case t := <-ticker.C:
+			now := t.Unix()
+			f.now.Store(now)
+			f.flows.expire(now)
+		}
+	}
+}
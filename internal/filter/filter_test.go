@@ -0,0 +1,342 @@
+package filter
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"testing"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/pabotesu/kurohabaki-client/internal/acl"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+const testOffset = 16
+
+// fakeTUN returns queued packets from Read and records packets passed to Write.
+type fakeTUN struct {
+	toRead  [][]byte
+	written [][]byte
+}
+
+func (d *fakeTUN) File() *os.File           { return nil }
+func (d *fakeTUN) MTU() (int, error)        { return 1420, nil }
+func (d *fakeTUN) Name() (string, error)    { return "fake0", nil }
+func (d *fakeTUN) Events() <-chan tun.Event { return nil }
+func (d *fakeTUN) Close() error             { return nil }
+func (d *fakeTUN) BatchSize() int           { return 1 }
+
+func (d *fakeTUN) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	n := 0
+	for n < len(bufs) && len(d.toRead) > 0 {
+		sizes[n] = copy(bufs[n][offset:], d.toRead[0])
+		d.toRead = d.toRead[1:]
+		n++
+	}
+	return n, nil
+}
+
+func (d *fakeTUN) Write(bufs [][]byte, offset int) (int, error) {
+	for _, b := range bufs {
+		d.written = append(d.written, append([]byte(nil), b[offset:]...))
+	}
+	return len(bufs), nil
+}
+
+var (
+	self = netip.MustParseAddr("10.0.0.1")
+	db   = netip.MustParseAddr("10.0.0.2")
+	dev  = netip.MustParseAddr("10.0.0.3")
+)
+
+// ipv4 builds an IPv4 packet with a TCP, UDP or ICMP header.
+func ipv4(proto uint8, src, dst netip.Addr, sport, dport uint16) []byte {
+	b := make([]byte, 40)
+	b[0] = 0x45
+	b[9] = proto
+	s, d := src.As4(), dst.As4()
+	copy(b[12:16], s[:])
+	copy(b[16:20], d[:])
+	binary.BigEndian.PutUint16(b[20:22], sport)
+	binary.BigEndian.PutUint16(b[22:24], dport)
+	return b
+}
+
+// icmpEcho builds an IPv4 echo request (typ 8) or reply (typ 0).
+func icmpEcho(typ uint8, src, dst netip.Addr, id uint16) []byte {
+	b := ipv4(protoICMP, src, dst, 0, 0)
+	b[20], b[21] = typ, 0
+	binary.BigEndian.PutUint16(b[24:26], id)
+	return b
+}
+
+// send passes pkt through the filter in one direction and reports whether
+// it came out the other side.
+func send(t *testing.T, f *Filter, d *fakeTUN, pkt []byte, inbound bool) bool {
+	t.Helper()
+	buf := make([]byte, testOffset+len(pkt))
+	if inbound {
+		copy(buf[testOffset:], pkt)
+		before := len(d.written)
+		if _, err := f.Write([][]byte{buf}, testOffset); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		return len(d.written) > before
+	}
+	d.toRead = append(d.toRead, pkt)
+	sizes := []int{0}
+	n, err := f.Read([][]byte{buf}, sizes, testOffset)
+	if err != nil || n != 1 {
+		t.Fatalf("Read = %d, %v", n, err)
+	}
+	return sizes[0] > 0
+}
+
+func TestFilterACL(t *testing.T) {
+	d := &fakeTUN{}
+	f := New(d, nil)
+	defer f.Close()
+
+	policy, err := acl.Parse([]byte(`{"version": 1, "rules": [
+		{"src": ["app"], "dst": ["db"], "ports": ["tcp:5432", "icmp"]},
+		{"src": ["dev"], "dst": ["app"], "ports": ["tcp:22"]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbAccess := policy.Evaluate([]string{"app"}, []string{"db"})
+	devAccess := policy.Evaluate([]string{"app"}, []string{"dev"})
+	f.SetPeers([]Peer{
+		{Addrs: []netip.Addr{db}, Tags: []string{"db"}, Access: &dbAccess},
+		{Addrs: []netip.Addr{dev}, Tags: []string{"dev"}, Access: &devAccess},
+	})
+
+	if !send(t, f, d, ipv4(protoTCP, self, db, 40000, 5432), false) {
+		t.Error("Expected outbound postgres to pass")
+	}
+	if !send(t, f, d, ipv4(protoTCP, db, self, 5432, 40000), true) {
+		t.Error("Expected the reply of an accepted flow to pass")
+	}
+	if send(t, f, d, ipv4(protoTCP, db, self, 5432, 40001), true) {
+		t.Error("Expected unsolicited inbound traffic from db to be dropped")
+	}
+	if send(t, f, d, ipv4(protoUDP, self, db, 40000, 5432), false) {
+		t.Error("Expected outbound udp to db to be dropped")
+	}
+	if !send(t, f, d, icmpEcho(8, self, db, 7), false) || !send(t, f, d, icmpEcho(0, db, self, 7), true) {
+		t.Error("Expected ping to db and its reply to pass")
+	}
+
+	if !send(t, f, d, ipv4(protoTCP, dev, self, 50000, 22), true) {
+		t.Error("Expected inbound ssh from dev to pass")
+	}
+	if !send(t, f, d, ipv4(protoTCP, self, dev, 22, 50000), false) {
+		t.Error("Expected the ssh reply to dev to pass")
+	}
+
+	// Hosts that aren't mesh peers, e.g. behind the server, are not subject
+	// to the ACL policy
+	other := netip.MustParseAddr("192.168.1.5")
+	if !send(t, f, d, ipv4(protoTCP, other, self, 1234, 80), true) {
+		t.Error("Expected traffic from a non-peer address to pass")
+	}
+
+	drops := f.Drops()
+	if drops[ACLInbound] != 1 || drops[ACLOutbound] != 1 {
+		t.Errorf("Unexpected drop counters: %v", drops)
+	}
+	if f.Connections() != 4 {
+		t.Errorf("Expected 4 tracked flows, got %d", f.Connections())
+	}
+}
+
+func TestFilterPolicyChange(t *testing.T) {
+	d := &fakeTUN{}
+	f := New(d, nil)
+	defer f.Close()
+
+	allowed := acl.Access{Outbound: []acl.PortRange{{Proto: "tcp", From: 5432, To: 5432}}}
+	f.SetPeers([]Peer{{Addrs: []netip.Addr{db}, Access: &allowed}})
+	if !send(t, f, d, ipv4(protoTCP, self, db, 40000, 5432), false) {
+		t.Fatal("Expected outbound postgres to pass")
+	}
+
+	// An unchanged policy keeps the flow
+	f.SetPeers([]Peer{{Addrs: []netip.Addr{db}, Access: &allowed}})
+	if !send(t, f, d, ipv4(protoTCP, db, self, 5432, 40000), true) {
+		t.Error("Expected the flow to outlive an unchanged policy")
+	}
+
+	// A policy that no longer allows it ends it in both directions
+	f.SetPeers([]Peer{{Addrs: []netip.Addr{db}, Access: &acl.Access{}}})
+	if send(t, f, d, ipv4(protoTCP, db, self, 5432, 40000), true) {
+		t.Error("Expected the reply to be dropped once the policy denies the flow")
+	}
+	if send(t, f, d, ipv4(protoTCP, self, db, 40000, 5432), false) {
+		t.Error("Expected the flow to be dropped once the policy denies it")
+	}
+	if f.Connections() != 0 {
+		t.Errorf("Expected the flow to be removed, got %d flows", f.Connections())
+	}
+}
+
+func TestFilterMalformed(t *testing.T) {
+	d := &fakeTUN{}
+	f := New(d, nil)
+	defer f.Close()
+	none := acl.Access{}
+	f.SetPeers([]Peer{{Addrs: []netip.Addr{db}, Access: &none}})
+
+	truncated := ipv4(protoTCP, db, self, 1, 22)[:22]
+	if send(t, f, d, truncated, true) {
+		t.Error("Expected a truncated TCP header to be dropped")
+	}
+	if send(t, f, d, []byte{0x75, 0, 0, 0}, false) {
+		t.Error("Expected an unknown IP version to be dropped")
+	}
+	if drops := f.Drops(); drops[Malformed] != 2 || drops[ACLInbound] != 0 {
+		t.Errorf("Unexpected drop counters: %v", drops)
+	}
+}
+
+func TestFilterLocalRules(t *testing.T) {
+	rules, err := RulesFromConfig([]config.FirewallRule{
+		{Name: "no-ssh-from-dev", Action: "drop", Direction: "in", Ports: []string{"tcp:22"}, Tags: []string{"dev"}},
+		{Name: "no-smtp-out", Action: "drop", Direction: "out", Ports: []string{"tcp:25"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &fakeTUN{}
+	f := New(d, rules)
+	defer f.Close()
+	f.SetPeers([]Peer{
+		{Addrs: []netip.Addr{db}, Tags: []string{"db"}},
+		{Addrs: []netip.Addr{dev}, Tags: []string{"dev"}},
+	})
+
+	if send(t, f, d, ipv4(protoTCP, dev, self, 50000, 22), true) {
+		t.Error("Expected ssh from dev to be dropped")
+	}
+	if !send(t, f, d, ipv4(protoTCP, db, self, 50000, 22), true) {
+		t.Error("Expected ssh from db to pass")
+	}
+	if send(t, f, d, ipv4(protoTCP, self, db, 50000, 25), false) {
+		t.Error("Expected smtp to be dropped")
+	}
+	if send(t, f, d, ipv4(protoTCP, dev, self, 50001, 22), true) {
+		t.Error("Expected the second ssh attempt to be dropped too")
+	}
+
+	drops := f.Drops()
+	if drops["no-ssh-from-dev"] != 2 || drops["no-smtp-out"] != 1 {
+		t.Errorf("Unexpected drop counters: %v", drops)
+	}
+}
+
+func TestFilterDropsInBatch(t *testing.T) {
+	d := &fakeTUN{}
+	f := New(d, nil)
+	defer f.Close()
+	none := acl.Access{}
+	f.SetPeers([]Peer{{Addrs: []netip.Addr{db}, Access: &none}})
+
+	var bufs [][]byte
+	for _, pkt := range [][]byte{
+		ipv4(protoUDP, db, self, 1, 53),
+		ipv4(protoUDP, dev, self, 1, 53),
+		ipv4(protoUDP, db, self, 1, 54),
+	} {
+		buf := make([]byte, testOffset+len(pkt))
+		copy(buf[testOffset:], pkt)
+		bufs = append(bufs, buf)
+	}
+	if n, err := f.Write(bufs, testOffset); err != nil || n != 3 {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	if len(d.written) != 1 || d.written[0][12] != 10 || d.written[0][15] != 3 {
+		t.Errorf("Expected only the packet from dev to be written, got %d packet(s)", len(d.written))
+	}
+}
+
+func TestParsePacket(t *testing.T) {
+	// IPv6 UDP behind a destination options header
+	b := make([]byte, 40+8+8)
+	b[0] = 0x60
+	b[6] = 60
+	copy(b[8:24], netip.MustParseAddr("fd00::1").AsSlice())
+	copy(b[24:40], netip.MustParseAddr("fd00::2").AsSlice())
+	b[40] = protoUDP
+	binary.BigEndian.PutUint16(b[48:50], 1000)
+	binary.BigEndian.PutUint16(b[50:52], 53)
+
+	var p packet
+	if !p.parse(b) || p.skip || p.proto != protoUDP || p.sport != 1000 || p.dport != 53 {
+		t.Errorf("Unexpected IPv6 parse result: %+v", p)
+	}
+
+	// Non-first IPv4 fragments and ICMP errors are not inspected
+	frag := ipv4(protoTCP, self, db, 1, 2)
+	binary.BigEndian.PutUint16(frag[6:8], 100)
+	unreachable := ipv4(protoICMP, self, db, 0, 0)
+	unreachable[20] = 3
+	for _, b := range [][]byte{frag, unreachable} {
+		p = packet{}
+		if !p.parse(b) || !p.skip {
+			t.Errorf("Expected packet to be skipped: %+v", p)
+		}
+	}
+
+	if p := (packet{}); p.parse([]byte{0x45, 0}) {
+		t.Error("Expected a truncated packet to be rejected")
+	}
+}
+
+// benchmarkWrite measures the cost of filtering a batch of packets of an
+// established flow.
+func benchmarkWrite(b *testing.B, f *Filter) {
+	batch := make([][]byte, 128)
+	for i := range batch {
+		pkt := ipv4(protoTCP, db, self, 5432, 40000)
+		batch[i] = make([]byte, testOffset+1420)
+		copy(batch[i][testOffset:], pkt)
+	}
+	bufs := make([][]byte, len(batch))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(bufs, batch)
+		f.Write(bufs, testOffset)
+	}
+	b.SetBytes(int64(len(batch) * 1420))
+}
+
+type discardTUN struct{ fakeTUN }
+
+func (d *discardTUN) Write(bufs [][]byte, offset int) (int, error) { return len(bufs), nil }
+
+func BenchmarkWritePassthrough(b *testing.B) {
+	f := New(&discardTUN{}, nil)
+	defer f.Close()
+	benchmarkWrite(b, f)
+}
+
+func BenchmarkWriteEstablished(b *testing.B) {
+	d := &discardTUN{}
+	f := New(d, nil)
+	defer f.Close()
+	access := acl.Access{Outbound: []acl.PortRange{{Proto: "tcp", From: 5432, To: 5432}}}
+	f.SetPeers([]Peer{{Addrs: []netip.Addr{db}, Access: &access}})
+
+	// Open the flow from this side so the inbound packets are replies
+	buf := make([]byte, testOffset+40)
+	d.toRead = [][]byte{ipv4(protoTCP, self, db, 40000, 5432)}
+	f.Read([][]byte{buf}, []int{0}, testOffset)
+
+	benchmarkWrite(b, f)
+	if drops := f.Drops(); drops[ACLInbound] != 0 {
+		b.Fatalf("Established flow was dropped: %v", drops)
+	}
+}
@@ -0,0 +1,126 @@
+package filter
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Idle timeouts of tracked flows, in seconds.
+const (
+	tcpTimeout   = 300
+	udpTimeout   = 60
+	otherTimeout = 30
+)
+
+const flowShards = 64
+
+// flowKey identifies a flow from this node's side.
+type flowKey struct {
+	proto         uint8
+	lport, rport  uint16
+	local, remote [16]byte
+}
+
+type flow struct {
+	lastSeen atomic.Int64
+	// rules is the rule set the flow was last allowed by, inbound the
+	// direction of its first packet
+	rules   atomic.Pointer[ruleSet]
+	inbound bool
+}
+
+// flowTable tracks accepted flows. It is sharded so that packets of
+// different flows rarely contend on a lock.
+type flowTable struct {
+	shards [flowShards]flowShard
+}
+
+type flowShard struct {
+	mu    sync.RWMutex
+	flows map[flowKey]*flow
+}
+
+func (t *flowTable) init() {
+	for i := range t.shards {
+		t.shards[i].flows = make(map[flowKey]*flow)
+	}
+}
+
+func (t *flowTable) shard(k flowKey) *flowShard {
+	h := uint32(k.proto) ^ uint32(k.lport)<<16 ^ uint32(k.rport)
+	h ^= uint32(k.remote[15]) | uint32(k.remote[14])<<8 | uint32(k.local[15])<<16
+	h *= 0x9e3779b1
+	return &t.shards[h>>26]
+}
+
+// touch refreshes a tracked flow and returns it, or nil if there is none.
+func (t *flowTable) touch(k flowKey, now int64) *flow {
+	s := t.shard(k)
+	s.mu.RLock()
+	f := s.flows[k]
+	s.mu.RUnlock()
+	if f == nil || now-f.lastSeen.Load() > timeout(k.proto) {
+		return nil
+	}
+	if f.lastSeen.Load() != now {
+		f.lastSeen.Store(now)
+	}
+	return f
+}
+
+// add tracks a flow allowed by rules, started by a packet in the given
+// direction.
+func (t *flowTable) add(k flowKey, now int64, rules *ruleSet, inbound bool) {
+	s := t.shard(k)
+	s.mu.Lock()
+	f := s.flows[k]
+	if f == nil {
+		f = &flow{inbound: inbound}
+		s.flows[k] = f
+	}
+	f.lastSeen.Store(now)
+	f.rules.Store(rules)
+	s.mu.Unlock()
+}
+
+func (t *flowTable) remove(k flowKey) {
+	s := t.shard(k)
+	s.mu.Lock()
+	delete(s.flows, k)
+	s.mu.Unlock()
+}
+
+// expire removes flows idle for longer than their timeout.
+func (t *flowTable) expire(now int64) {
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mu.Lock()
+		for k, f := range s.flows {
+			if now-f.lastSeen.Load() > timeout(k.proto) {
+				delete(s.flows, k)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (t *flowTable) len() int {
+	n := 0
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mu.RLock()
+		n += len(s.flows)
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+func timeout(proto uint8) int64 {
+	switch proto {
+	case protoTCP:
+		return tcpTimeout
+	case protoUDP:
+		return udpTimeout
+	}
+	return otherTimeout
+}
@@ -0,0 +1,137 @@
+package filter
+
+import "encoding/binary"
+
+// IP protocol numbers
+const (
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+// packet holds the fields of an IP packet the filter looks at. Addresses are
+// kept as 16 bytes, IPv4 in its mapped form, so that flow keys are cheap to
+// compare and hash.
+type packet struct {
+	proto    uint8
+	src, dst [16]byte
+	sport    uint16
+	dport    uint16
+	// skip is set for packets that are passed without inspection: non-first
+	// fragments, which carry no ports, and ICMP errors, which PMTU discovery
+	// and error reporting depend on.
+	skip bool
+}
+
+var v4InV6Prefix = [12]byte{10: 0xff, 11: 0xff}
+
+// parse decodes the IP and transport headers of b. It reports false for
+// packets too short or malformed to classify.
+func (p *packet) parse(b []byte) bool {
+	if len(b) < 1 {
+		return false
+	}
+	switch b[0] >> 4 {
+	case 4:
+		return p.parse4(b)
+	case 6:
+		return p.parse6(b)
+	}
+	return false
+}
+
+func (p *packet) parse4(b []byte) bool {
+	if len(b) < 20 {
+		return false
+	}
+	ihl := int(b[0]&0x0f) * 4
+	if ihl < 20 || len(b) < ihl {
+		return false
+	}
+	p.proto = b[9]
+	copy(p.src[:], v4InV6Prefix[:])
+	copy(p.src[12:], b[12:16])
+	copy(p.dst[:], v4InV6Prefix[:])
+	copy(p.dst[12:], b[16:20])
+
+	if binary.BigEndian.Uint16(b[6:8])&0x1fff != 0 {
+		p.skip = true
+		return true
+	}
+	return p.parseTransport(b[ihl:])
+}
+
+func (p *packet) parse6(b []byte) bool {
+	if len(b) < 40 {
+		return false
+	}
+	copy(p.src[:], b[8:24])
+	copy(p.dst[:], b[24:40])
+
+	next, off := b[6], 40
+	for {
+		switch next {
+		case 0, 43, 60: // hop-by-hop, routing, destination options
+			if len(b) < off+8 {
+				return false
+			}
+			next, off = b[off], off+8+int(b[off+1])*8
+		case 44: // fragment
+			if len(b) < off+8 {
+				return false
+			}
+			if binary.BigEndian.Uint16(b[off+2:off+4])&0xfff8 != 0 {
+				p.proto = b[off]
+				p.skip = true
+				return true
+			}
+			next, off = b[off], off+8
+		default:
+			if len(b) < off {
+				return false
+			}
+			p.proto = next
+			return p.parseTransport(b[off:])
+		}
+	}
+}
+
+func (p *packet) parseTransport(b []byte) bool {
+	switch p.proto {
+	case protoTCP, protoUDP:
+		if len(b) < 4 {
+			return false
+		}
+		p.sport = binary.BigEndian.Uint16(b[0:2])
+		p.dport = binary.BigEndian.Uint16(b[2:4])
+	case protoICMP, protoICMPv6:
+		if len(b) < 8 {
+			return false
+		}
+		// Echo request and reply are tracked by their identifier; other
+		// messages are errors or link-level and are not filtered
+		switch typ := b[0]; {
+		case p.proto == protoICMP && (typ == 8 || typ == 0),
+			p.proto == protoICMPv6 && (typ == 128 || typ == 129):
+			id := binary.BigEndian.Uint16(b[4:6])
+			p.sport, p.dport = id, id
+		default:
+			p.skip = true
+		}
+	}
+	return true
+}
+
+// protoName returns the name used in port specs for an IP protocol.
+func protoName(proto uint8) string {
+	switch proto {
+	case protoTCP:
+		return "tcp"
+	case protoUDP:
+		return "udp"
+	case protoICMP, protoICMPv6:
+		return "icmp"
+	}
+	return ""
+}
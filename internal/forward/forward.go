@@ -0,0 +1,254 @@
+// Package forward relays TCP connections and UDP datagrams between a
+// listening address and a target, each on the host or on the mesh.
+package forward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/pabotesu/kurohabaki-client/internal/logger"
+	"github.com/pabotesu/kurohabaki-client/internal/proxy"
+)
+
+// dialTimeout bounds connecting to the target of a forward.
+const dialTimeout = 10 * time.Second
+
+// Rule is a validated forward.
+type Rule struct {
+	Name   string
+	UDP    bool
+	Remote bool
+	Listen string
+	Target string
+}
+
+// Protocol returns tcp or udp.
+func (r Rule) Protocol() string {
+	if r.UDP {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// Direction returns local or remote.
+func (r Rule) Direction() string {
+	if r.Remote {
+		return "remote"
+	}
+	return "local"
+}
+
+// RuleFromConfig validates a forward of the config.
+func RuleFromConfig(f config.Forward) (Rule, error) {
+	r := Rule{Name: f.Name, Listen: f.Listen, Target: f.Target}
+	if f.Name == "" {
+		return r, errors.New("forward name is empty")
+	}
+	if err := f.Validate(); err != nil {
+		return r, fmt.Errorf("forward %s: %w", f.Name, err)
+	}
+	r.UDP = f.Protocol == "udp"
+	r.Remote = f.Direction == "remote"
+	return r, nil
+}
+
+// RulesFromConfig validates the forwards of the config.
+func RulesFromConfig(forwards []config.Forward) ([]Rule, error) {
+	var rules []Rule
+	seen := make(map[string]bool)
+	for _, f := range forwards {
+		r, err := RuleFromConfig(f)
+		if err != nil {
+			return nil, err
+		}
+		if seen[r.Name] {
+			return nil, fmt.Errorf("forward %s: name is not unique", r.Name)
+		}
+		seen[r.Name] = true
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// Network is where a forward listens or dials: the host, or the mesh
+// through the interface.
+type Network interface {
+	Listen(network, address string) (net.Listener, error)
+	ListenPacket(network, address string) (net.PacketConn, error)
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+type hostNetwork struct{ net.Dialer }
+
+func (hostNetwork) Listen(network, address string) (net.Listener, error) {
+	return net.Listen(network, address)
+}
+
+func (hostNetwork) ListenPacket(network, address string) (net.PacketConn, error) {
+	return net.ListenPacket(network, address)
+}
+
+// Host is the host's network.
+var Host Network = &hostNetwork{}
+
+// Stats counts the connections of a forward. For UDP a connection is a
+// client address that has sent datagrams recently.
+type Stats struct {
+	Active int64
+	Total  uint64
+}
+
+// Forwarder runs one rule.
+type Forwarder struct {
+	rule Rule
+	dial Network
+	addr net.Addr
+
+	closer io.Closer
+	active atomic.Int64
+	total  atomic.Uint64
+
+	mu     sync.Mutex
+	conns  map[io.Closer]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Start listens on listen and relays to the rule's target through dial.
+func Start(rule Rule, listen, dial Network) (*Forwarder, error) {
+	f := &Forwarder{rule: rule, dial: dial, conns: make(map[io.Closer]struct{})}
+	if rule.UDP {
+		pc, err := listen.ListenPacket("udp", rule.Listen)
+		if err != nil {
+			return nil, fmt.Errorf("forward %s: %w", rule.Name, err)
+		}
+		f.closer, f.addr = pc, pc.LocalAddr()
+		f.wg.Add(1)
+		go f.serveUDP(pc)
+		return f, nil
+	}
+
+	l, err := listen.Listen("tcp", rule.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("forward %s: %w", rule.Name, err)
+	}
+	f.closer, f.addr = l, l.Addr()
+	f.wg.Add(1)
+	go f.serveTCP(l)
+	return f, nil
+}
+
+// Rule returns the rule the forwarder runs.
+func (f *Forwarder) Rule() Rule {
+	return f.rule
+}
+
+// Addr returns the address the forwarder listens on.
+func (f *Forwarder) Addr() net.Addr {
+	return f.addr
+}
+
+// Stats returns the connection counts.
+func (f *Forwarder) Stats() Stats {
+	return Stats{Active: f.active.Load(), Total: f.total.Load()}
+}
+
+// Close stops listening, closes open connections and waits for them.
+func (f *Forwarder) Close() error {
+	f.mu.Lock()
+	f.closed = true
+	err := f.closer.Close()
+	for c := range f.conns {
+		c.Close()
+	}
+	f.mu.Unlock()
+	f.wg.Wait()
+	return err
+}
+
+// track registers c to be closed with the forwarder and counts it.
+func (f *Forwarder) track(c io.Closer) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return false
+	}
+	f.conns[c] = struct{}{}
+	f.active.Add(1)
+	f.total.Add(1)
+	return true
+}
+
+func (f *Forwarder) untrack(c io.Closer) {
+	f.mu.Lock()
+	delete(f.conns, c)
+	f.mu.Unlock()
+	f.active.Add(-1)
+	c.Close()
+}
+
+func (f *Forwarder) serveTCP(l net.Listener) {
+	defer f.wg.Done()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Warnf("Forward %s: accept failed: %v", f.rule.Name, err)
+			}
+			return
+		}
+		if !f.track(conn) {
+			conn.Close()
+			return
+		}
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			defer f.untrack(conn)
+			f.handleTCP(conn)
+		}()
+	}
+}
+
+func (f *Forwarder) handleTCP(conn net.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	target, err := f.dial.DialContext(ctx, "tcp", f.rule.Target)
+	cancel()
+	if err != nil {
+		logger.Warnf("Forward %s: failed to connect to %s: %v", f.rule.Name, f.rule.Target, err)
+		return
+	}
+	if !f.addConn(target) {
+		target.Close()
+		return
+	}
+	defer f.removeConn(target)
+
+	proxy.Relay(conn, conn, target)
+}
+
+// addConn registers a connection to be closed with the forwarder without
+// counting it.
+func (f *Forwarder) addConn(c io.Closer) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return false
+	}
+	f.conns[c] = struct{}{}
+	return true
+}
+
+func (f *Forwarder) removeConn(c io.Closer) {
+	f.mu.Lock()
+	delete(f.conns, c)
+	f.mu.Unlock()
+	c.Close()
+}
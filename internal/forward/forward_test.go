@@ -0,0 +1,159 @@
+package forward
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+)
+
+func tcpEcho(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func udpEcho(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// waitFor polls cond for up to a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Timed out waiting for %s", what)
+}
+
+func echo(t *testing.T, c net.Conn, msg string) {
+	t.Helper()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != msg {
+		t.Fatalf("Expected echo %q, got %q, %v", msg, buf, err)
+	}
+}
+
+func TestTCPForward(t *testing.T) {
+	f, err := Start(Rule{Name: "echo", Listen: "127.0.0.1:0", Target: tcpEcho(t)}, Host, Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c1, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, c1, "one")
+	c2, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, c2, "two")
+	if st := f.Stats(); st.Active != 2 || st.Total != 2 {
+		t.Errorf("Expected 2 active connections, got %+v", st)
+	}
+
+	c1.Close()
+	waitFor(t, "the closed connection to be released", func() bool { return f.Stats().Active == 1 })
+
+	// Closing the forwarder closes the remaining connection
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c2.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+	if st := f.Stats(); st.Active != 0 || st.Total != 2 {
+		t.Errorf("Unexpected stats after close %+v", st)
+	}
+}
+
+func TestUDPForward(t *testing.T) {
+	f, err := Start(Rule{Name: "dns", UDP: true, Listen: "127.0.0.1:0", Target: udpEcho(t)}, Host, Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, msg := range []string{"a", "b"} {
+		c, err := net.Dial("udp", f.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		echo(t, c, msg)
+		echo(t, c, msg+msg)
+	}
+	if st := f.Stats(); st.Active != 2 || st.Total != 2 {
+		t.Errorf("Expected a session per client address, got %+v", st)
+	}
+}
+
+func TestRulesFromConfig(t *testing.T) {
+	rules, err := RulesFromConfig([]config.Forward{
+		{Name: "web", Listen: "127.0.0.1:8080", Target: "web:80"},
+		{Name: "dns", Protocol: "udp", Direction: "remote", Listen: ":53", Target: "127.0.0.1:53"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules[0].UDP || rules[0].Remote || !rules[1].UDP || !rules[1].Remote {
+		t.Errorf("Unexpected rules %+v", rules)
+	}
+
+	for _, bad := range [][]config.Forward{
+		{{Listen: ":1", Target: "a:1"}},
+		{{Name: "x", Protocol: "sctp", Listen: ":1", Target: "a:1"}},
+		{{Name: "x", Direction: "up", Listen: ":1", Target: "a:1"}},
+		{{Name: "x", Listen: "1", Target: "a:1"}},
+		{{Name: "x", Listen: ":1", Target: ":1"}},
+		{{Name: "x", Listen: ":1", Target: "a:1"}, {Name: "x", Listen: ":2", Target: "a:1"}},
+	} {
+		if _, err := RulesFromConfig(bad); err == nil {
+			t.Errorf("Expected %+v to be rejected", bad)
+		}
+	}
+}
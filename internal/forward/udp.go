@@ -0,0 +1,102 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/internal/logger"
+)
+
+// udpIdleTimeout is how long a client address keeps its session to the
+// target without datagrams in either direction.
+const udpIdleTimeout = 60 * time.Second
+
+// udpSession relays the datagrams of one client address.
+type udpSession struct {
+	conn     net.Conn
+	lastSeen atomic.Int64
+}
+
+func (s *udpSession) touch() {
+	s.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (f *Forwarder) serveUDP(pc net.PacketConn) {
+	defer f.wg.Done()
+
+	var mu sync.Mutex
+	sessions := make(map[string]*udpSession)
+
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Warnf("Forward %s: read failed: %v", f.rule.Name, err)
+			}
+			return
+		}
+
+		key := client.String()
+		mu.Lock()
+		s := sessions[key]
+		mu.Unlock()
+		if s == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+			conn, err := f.dial.DialContext(ctx, "udp", f.rule.Target)
+			cancel()
+			if err != nil {
+				logger.Warnf("Forward %s: failed to connect to %s: %v", f.rule.Name, f.rule.Target, err)
+				continue
+			}
+			if !f.track(conn) {
+				conn.Close()
+				return
+			}
+			s = &udpSession{conn: conn}
+			s.touch()
+			mu.Lock()
+			sessions[key] = s
+			mu.Unlock()
+
+			f.wg.Add(1)
+			go func() {
+				defer f.wg.Done()
+				f.replyUDP(pc, client, s)
+				mu.Lock()
+				delete(sessions, key)
+				mu.Unlock()
+				f.untrack(conn)
+			}()
+		}
+		s.touch()
+		if _, err := s.conn.Write(buf[:n]); err != nil {
+			logger.Warnf("Forward %s: write to %s failed: %v", f.rule.Name, f.rule.Target, err)
+		}
+	}
+}
+
+// replyUDP sends the target's datagrams back to the client until the
+// session has been idle for udpIdleTimeout or is closed.
+func (f *Forwarder) replyUDP(pc net.PacketConn, client net.Addr, s *udpSession) {
+	buf := make([]byte, 65535)
+	for {
+		s.conn.SetReadDeadline(time.Unix(0, s.lastSeen.Load()).Add(udpIdleTimeout))
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() && time.Since(time.Unix(0, s.lastSeen.Load())) < udpIdleTimeout {
+				continue
+			}
+			return
+		}
+		s.touch()
+		if _, err := pc.WriteTo(buf[:n], client); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Package health serves liveness and readiness endpoints for supervisors
+// and orchestrators. /healthz reports whether the process is working at all
+// and should be restarted if not, /readyz whether it is connected to the
+// mesh. Both run a set of named checks and describe each one in JSON.
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/internal/logger"
+)
+
+// Check statuses
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// CheckFunc runs a check. It returns a short description of the state on
+// success, or the reason for failing.
+type CheckFunc func() (string, error)
+
+// Result is the outcome of a single check.
+type Result struct {
+	Status string `json:"status"`
+	// Detail describes the state the check found, or why it failed
+	Detail string `json:"detail,omitempty"`
+}
+
+// Report is the body of both endpoints. Status is ok only if every check
+// passed.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+type check struct {
+	name string
+	fn   CheckFunc
+}
+
+// Server holds the liveness and readiness checks and serves them.
+type Server struct {
+	mu          sync.RWMutex
+	live, ready []check
+
+	server *http.Server
+}
+
+// New creates a server without checks, which always reports ok.
+func New() *Server {
+	return &Server{}
+}
+
+// Live adds a check to /healthz. Liveness checks also apply to /readyz.
+func (s *Server) Live(name string, fn CheckFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.live = append(s.live, check{name, fn})
+}
+
+// Ready adds a check to /readyz.
+func (s *Server) Ready(name string, fn CheckFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ready = append(s.ready, check{name, fn})
+}
+
+// Liveness runs the liveness checks.
+func (s *Server) Liveness() Report {
+	s.mu.RLock()
+	checks := append([]check(nil), s.live...)
+	s.mu.RUnlock()
+	return run(checks)
+}
+
+// Readiness runs the liveness and readiness checks.
+func (s *Server) Readiness() Report {
+	s.mu.RLock()
+	checks := append(append([]check(nil), s.live...), s.ready...)
+	s.mu.RUnlock()
+	return run(checks)
+}
+
+func run(checks []check) Report {
+	r := Report{Status: StatusOK, Checks: make(map[string]Result, len(checks))}
+	for _, c := range checks {
+		detail, err := c.fn()
+		res := Result{Status: StatusOK, Detail: detail}
+		if err != nil {
+			res = Result{Status: StatusFail, Detail: err.Error()}
+			r.Status = StatusFail
+		}
+		r.Checks[c.name] = res
+	}
+	return r
+}
+
+// Failed lists the names of the failed checks of r.
+func (r Report) Failed() []string {
+	var names []string
+	for name, res := range r.Checks {
+		if res.Status != StatusOK {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Handler serves /healthz and /readyz. They answer 200 if all checks
+// passed and 503 otherwise, with the report as the body either way.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, s.Liveness())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, s.Readiness())
+	})
+	return mux
+}
+
+func writeReport(w http.ResponseWriter, r Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Status != StatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(r)
+}
+
+// ListenAndServe serves the endpoints on addr in the background until
+// Close.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.server = &http.Server{Handler: s.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := s.server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Warnf("Health server failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Close stops serving the endpoints.
+func (s *Server) Close() error {
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Close()
+}
@@ -0,0 +1,53 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func get(t *testing.T, h http.Handler, path string) (int, Report) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	var r Report
+	if err := json.Unmarshal(rec.Body.Bytes(), &r); err != nil {
+		t.Fatalf("invalid report from %s: %v\n%s", path, err, rec.Body)
+	}
+	return rec.Code, r
+}
+
+func TestEndpoints(t *testing.T) {
+	s := New()
+	s.Live("watcher", func() (string, error) { return "ran 2s ago", nil })
+	handshake := errors.New("no handshake with the server peer")
+	s.Ready("handshake", func() (string, error) { return "", handshake })
+	h := s.Handler()
+
+	code, r := get(t, h, "/healthz")
+	if code != http.StatusOK || r.Status != StatusOK {
+		t.Errorf("/healthz = %d %s, want 200 ok", code, r.Status)
+	}
+	if _, ok := r.Checks["handshake"]; ok {
+		t.Error("Readiness check run by /healthz")
+	}
+	if got := r.Checks["watcher"]; got.Detail != "ran 2s ago" {
+		t.Errorf("watcher check = %+v", got)
+	}
+
+	code, r = get(t, h, "/readyz")
+	if code != http.StatusServiceUnavailable || r.Status != StatusFail {
+		t.Errorf("/readyz = %d %s, want 503 fail", code, r.Status)
+	}
+	if got := r.Checks["handshake"]; got.Status != StatusFail || got.Detail != handshake.Error() {
+		t.Errorf("handshake check = %+v", got)
+	}
+	if got := r.Checks["watcher"]; got.Status != StatusOK {
+		t.Errorf("Liveness check missing from /readyz: %+v", got)
+	}
+	if failed := r.Failed(); len(failed) != 1 || failed[0] != "handshake" {
+		t.Errorf("Failed() = %v", failed)
+	}
+}
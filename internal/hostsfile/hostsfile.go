@@ -0,0 +1,209 @@
+// Package hostsfile maintains a delimited block of mesh node names in a
+// hosts file, leaving every line outside the block untouched.
+package hostsfile
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// DefaultPath is the hosts file managed unless another is configured.
+const DefaultPath = "/etc/hosts"
+
+const (
+	beginMarker = "# BEGIN kurohabaki mesh nodes (managed, do not edit)"
+	endMarker   = "# END kurohabaki mesh nodes"
+)
+
+// File is a hosts file with a managed block.
+type File struct {
+	path string
+
+	mu   sync.Mutex
+	last string // block last written, to skip unchanged updates
+}
+
+// New returns a File for path, or DefaultPath if empty.
+func New(path string) *File {
+	if path == "" {
+		path = DefaultPath
+	}
+	return &File{path: path}
+}
+
+// Path returns the managed file.
+func (f *File) Path() string {
+	return f.path
+}
+
+// Update replaces the managed block with the given hosts. Each name is also
+// listed as <name>.<domain> if domain is set. It reports whether the file
+// was written.
+func (f *File) Update(hosts map[string][]netip.Addr, domain string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	block := render(hosts, domain)
+	if block == f.last {
+		return false, nil
+	}
+	if err := f.rewrite(block); err != nil {
+		return false, err
+	}
+	f.last = block
+	return true, nil
+}
+
+// Remove deletes the managed block.
+func (f *File) Remove() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.last = ""
+	return f.rewrite("")
+}
+
+func (f *File) rewrite(block string) error {
+	data, err := os.ReadFile(f.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read hosts file: %w", err)
+	}
+	content := replaceBlock(string(data), block)
+	if content == string(data) {
+		return nil
+	}
+	if err := writeFile(f.path, content); err != nil {
+		return fmt.Errorf("failed to write hosts file: %w", err)
+	}
+	return nil
+}
+
+// render returns the managed block, sorted so that unchanged tables produce
+// identical output. Names that aren't valid hostnames are left out, so that
+// they can't add entries of their own. An empty table produces no block.
+func render(hosts map[string][]netip.Addr, domain string) string {
+	names := make([]string, 0, len(hosts))
+	for name := range hosts {
+		if validName(name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	slices.Sort(names)
+	domain = strings.Trim(domain, ".")
+	if !validName(domain) {
+		domain = ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString(beginMarker + "\n")
+	for _, name := range names {
+		addrs := slices.Clone(hosts[name])
+		slices.SortFunc(addrs, func(a, b netip.Addr) int { return a.Compare(b) })
+		for _, addr := range slices.Compact(addrs) {
+			line := addr.String() + "\t" + name
+			if domain != "" {
+				line += " " + name + "." + domain
+			}
+			sb.WriteString(line + "\n")
+		}
+	}
+	sb.WriteString(endMarker + "\n")
+	return sb.String()
+}
+
+// validName reports whether name is a hostname as of RFC 1123: dot
+// separated labels of letters, digits and inner hyphens, up to 63 bytes
+// each and 253 in all.
+func validName(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range []byte(label) {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// replaceBlock swaps the managed block in content for block, appending it
+// if there is none. An empty block removes it.
+func replaceBlock(content, block string) string {
+	var before, after []string
+	lines := strings.SplitAfter(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	found := false
+	inside := false
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case !found && trimmed == beginMarker:
+			found, inside = true, true
+		case inside:
+			if trimmed == endMarker {
+				inside = false
+			}
+		case found:
+			after = append(after, line)
+		default:
+			before = append(before, line)
+		}
+	}
+
+	head := strings.Join(before, "")
+	if block != "" && head != "" && !strings.HasSuffix(head, "\n") {
+		head += "\n"
+	}
+	return head + block + strings.Join(after, "")
+}
+
+// writeFile replaces path atomically, keeping its mode. Hosts files that are
+// bind mounts, as in containers, cannot be replaced and are written in place.
+func writeFile(path, content string) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".hosts.kh-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.EXDEV) {
+		return os.WriteFile(path, []byte(content), mode)
+	}
+	return err
+}
@@ -0,0 +1,131 @@
+package hostsfile
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const original = `127.0.0.1	localhost
+# local override
+192.0.2.10	printer
+`
+
+func TestUpdateRemove(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte(original), 0640); err != nil {
+		t.Fatal(err)
+	}
+	f := New(path)
+
+	hosts := map[string][]netip.Addr{
+		"web": {netip.MustParseAddr("10.0.0.3")},
+		"db":  {netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("fd00::2")},
+	}
+	written, err := f.Update(hosts, "kh.internal")
+	if err != nil || !written {
+		t.Fatalf("Update = %v, %v", written, err)
+	}
+
+	want := original + beginMarker + "\n" +
+		"10.0.0.2\tdb db.kh.internal\n" +
+		"fd00::2\tdb db.kh.internal\n" +
+		"10.0.0.3\tweb web.kh.internal\n" +
+		endMarker + "\n"
+	assertFile(t, path, want)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("mode = %v, want 0640", info.Mode().Perm())
+	}
+
+	if written, err := f.Update(hosts, "kh.internal"); err != nil || written {
+		t.Errorf("unchanged Update = %v, %v", written, err)
+	}
+
+	// Lines added after the block by someone else are kept in place
+	data, _ := os.ReadFile(path)
+	if err := os.WriteFile(path, append(data, "192.0.2.11\tscanner\n"...), 0640); err != nil {
+		t.Fatal(err)
+	}
+	delete(hosts, "web")
+	if _, err := f.Update(hosts, ""); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	assertFile(t, path, original+beginMarker+"\n"+
+		"10.0.0.2\tdb\n"+
+		"fd00::2\tdb\n"+
+		endMarker+"\n"+
+		"192.0.2.11\tscanner\n")
+
+	if err := f.Remove(); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	assertFile(t, path, original+"192.0.2.11\tscanner\n")
+}
+
+func TestUpdateStaleBlock(t *testing.T) {
+	// A block left behind by an agent that crashed is replaced, not duplicated
+	path := filepath.Join(t.TempDir(), "hosts")
+	stale := "127.0.0.1\tlocalhost\n" + beginMarker + "\n10.0.0.9\told\n" + endMarker + "\n"
+	if err := os.WriteFile(path, []byte(stale), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := New(path)
+	if _, err := f.Update(map[string][]netip.Addr{"new": {netip.MustParseAddr("10.0.0.4")}}, ""); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	assertFile(t, path, "127.0.0.1\tlocalhost\n"+beginMarker+"\n10.0.0.4\tnew\n"+endMarker+"\n")
+}
+
+func TestReplaceBlockNoTrailingNewline(t *testing.T) {
+	got := replaceBlock("127.0.0.1 localhost", "B\n")
+	if got != "127.0.0.1 localhost\nB\n" {
+		t.Errorf("replaceBlock = %q", got)
+	}
+}
+
+func assertFile(t *testing.T, path, want string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != want {
+		t.Errorf("hosts file =\n%s\nwant\n%s", data, want)
+	}
+}
+
+func TestUpdateInvalidNames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := New(path)
+
+	addr := []netip.Addr{netip.MustParseAddr("10.0.0.2")}
+	hosts := map[string][]netip.Addr{
+		"db":                         addr,
+		"evil\n1.2.3.4 bank.example": addr,
+		"with spaces":                addr,
+		"tab\tname":                  addr,
+		"end\n" + endMarker + "\nx":  addr,
+	}
+	if _, err := f.Update(hosts, "kh.internal"); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	assertFile(t, path, original+beginMarker+"\n"+
+		"10.0.0.2\tdb db.kh.internal\n"+
+		endMarker+"\n")
+
+	// Nothing is left to write
+	if _, err := f.Update(map[string][]netip.Addr{"bad name": addr}, ""); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	assertFile(t, path, original)
+}
@@ -0,0 +1,148 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// journalSocket is where journald receives entries in its native protocol.
+const journalSocket = "/run/systemd/journal/socket"
+
+// identifier is the SYSLOG_IDENTIFIER of the agent's journal entries.
+const identifier = "kurohabaki"
+
+// JournalAvailable reports whether the process runs under systemd with its
+// output connected to the journal, so that it can log there natively.
+func JournalAvailable() bool {
+	if os.Getenv("JOURNAL_STREAM") == "" {
+		return false
+	}
+	_, err := os.Stat(journalSocket)
+	return err == nil
+}
+
+// journal sends entries to journald.
+type journal struct {
+	conn *net.UnixConn
+}
+
+func newJournal(socket string) (*journal, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journal{conn: conn}, nil
+}
+
+func (j *journal) Close() error {
+	return j.conn.Close()
+}
+
+// journalCore is a zap core writing each entry as a journal entry, with the
+// logger name in KH_SUBSYSTEM and the entry's fields as KH_<KEY>.
+type journalCore struct {
+	zapcore.LevelEnabler
+	journal *journal
+	fields  []zapcore.Field
+}
+
+func (c *journalCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := *c
+	clone.fields = append(append([]zapcore.Field(nil), c.fields...), fields...)
+	return &clone
+}
+
+func (c *journalCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *journalCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range c.fields {
+		f.AddTo(enc)
+	}
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	_, err := c.journal.conn.Write(journalEntry(ent, enc.Fields))
+	return err
+}
+
+func (c *journalCore) Sync() error {
+	return nil
+}
+
+// journalEntry encodes an entry in journald's native protocol.
+func journalEntry(ent zapcore.Entry, fields map[string]any) []byte {
+	var b bytes.Buffer
+	appendJournalField(&b, "MESSAGE", ent.Message)
+	appendJournalField(&b, "PRIORITY", journalPriority(ent.Level))
+	appendJournalField(&b, "SYSLOG_IDENTIFIER", identifier)
+	if ent.LoggerName != "" {
+		appendJournalField(&b, "KH_SUBSYSTEM", ent.LoggerName)
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		appendJournalField(&b, journalKey(k), fmt.Sprint(fields[k]))
+	}
+	return b.Bytes()
+}
+
+// appendJournalField appends KEY=value, or the length-prefixed form for
+// values spanning lines.
+func appendJournalField(b *bytes.Buffer, key, value string) {
+	b.WriteString(key)
+	if !strings.Contains(value, "\n") {
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// journalKey turns a field key into a journal field name, which may only
+// contain upper case letters, digits and underscores.
+func journalKey(key string) string {
+	name := []byte("KH_" + strings.ToUpper(key))
+	for i, c := range name {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			name[i] = '_'
+		}
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return string(name)
+}
+
+// journalPriority maps a level to a syslog priority.
+func journalPriority(l zapcore.Level) string {
+	switch {
+	case l <= zapcore.DebugLevel:
+		return "7"
+	case l == zapcore.InfoLevel:
+		return "6"
+	case l == zapcore.WarnLevel:
+		return "4"
+	default:
+		return "3"
+	}
+}
@@ -0,0 +1,50 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestJournalCore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	j, err := newJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	log := zap.New(&journalCore{LevelEnabler: zapcore.InfoLevel, journal: j}).Named(WG).Sugar()
+
+	log.Debugw("not sent")
+	log.With("interface", "kh0").Warnw("handshake failed\nretrying", "public-key", "abc")
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := "handshake failed\nretrying"
+	var want bytes.Buffer
+	want.WriteString("MESSAGE\n")
+	binary.Write(&want, binary.LittleEndian, uint64(len(msg)))
+	want.WriteString(msg + "\n")
+	want.WriteString("PRIORITY=4\nSYSLOG_IDENTIFIER=kurohabaki\nKH_SUBSYSTEM=wg\n")
+	want.WriteString("KH_INTERFACE=kh0\nKH_PUBLIC_KEY=abc\n")
+	if got := buf[:n]; !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("Journal entry = %q, want %q", got, want.Bytes())
+	}
+}
@@ -1,50 +1,248 @@
+// Package logger is the client's leveled, structured log. Every subsystem
+// (the agent, the WireGuard interface, the etcd client and wireguard-go
+// itself) logs through it to a single output, in text or JSON and each at
+// its own level.
+//
+// Nothing is logged until Init, so commands other than up stay quiet.
 package logger
 
 import (
+	"fmt"
 	"io"
-	"log"
 	"os"
+	"strings"
+	"sync"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Subsystems
+const (
+	Agent     = "agent"
+	WG        = "wg"
+	Etcd      = "etcd"
+	WireGuard = "wireguard"
+)
+
+var subsystems = []string{Agent, WG, Etcd, WireGuard}
+
+// defaultLevels are the lowest levels of subsystems too chatty for the
+// general level, unless they are configured explicitly.
+var defaultLevels = map[string]zapcore.Level{
+	Etcd: zapcore.WarnLevel,
+}
+
+// Rotation defaults of the log file
+const (
+	defaultMaxSize  = 10 // megabytes
+	defaultMaxFiles = 5
 )
 
 var (
-	// Debug mode status
-	debugMode bool
-	// Standard logger
-	stdLog *log.Logger
+	mu      sync.RWMutex
+	newCore func(zapcore.LevelEnabler) zapcore.Core
+	syncer  zapcore.WriteSyncer
+	file    io.Closer
+	levels  map[string]zapcore.Level
+	loggers map[string]*zap.SugaredLogger
 )
 
-// Init initializes the logger
-func Init(debug bool) {
-	debugMode = debug
+// Init sets up the log from cfg. Without a file it writes to stderr.
+func Init(cfg config.LogConfig) error {
+	return setup(cfg, false)
+}
+
+// InitJournal sets up the log from cfg, but sends it to journald with the
+// key-value pairs of entries as journal fields. Format and File are
+// ignored.
+func InitJournal(cfg config.LogConfig) error {
+	return setup(cfg, true)
+}
+
+func setup(cfg config.LogConfig, journal bool) error {
+	level := zapcore.InfoLevel
+	if cfg.Level != "" {
+		l, err := zapcore.ParseLevel(cfg.Level)
+		if err != nil {
+			return fmt.Errorf("invalid log level: %w", err)
+		}
+		level = l
+	}
+	lv := make(map[string]zapcore.Level, len(subsystems))
+	for _, name := range subsystems {
+		lv[name] = level
+		if d, ok := defaultLevels[name]; ok {
+			lv[name] = max(level, d)
+		}
+	}
+	for name, s := range cfg.Levels {
+		if _, ok := lv[name]; !ok {
+			return fmt.Errorf("unknown log subsystem %q, use one of %s", name, strings.Join(subsystems, ", "))
+		}
+		l, err := zapcore.ParseLevel(s)
+		if err != nil {
+			return fmt.Errorf("invalid log level of %s: %w", name, err)
+		}
+		lv[name] = l
+	}
 
-	// Configure output destination
-	var output io.Writer
-	if debugMode {
-		output = os.Stdout
-	} else {
-		output = io.Discard // No output when not in debug mode
+	encCfg := zap.NewProductionEncoderConfig()
+	encCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+	var enc zapcore.Encoder
+	switch cfg.Format {
+	case "", "text":
+		encCfg.EncodeLevel = zapcore.CapitalLevelEncoder
+		enc = zapcore.NewConsoleEncoder(encCfg)
+	case "json":
+		enc = zapcore.NewJSONEncoder(encCfg)
+	default:
+		return fmt.Errorf("unknown log format %q, use text or json", cfg.Format)
 	}
 
-	stdLog = log.New(output, "", log.LstdFlags)
+	var core func(zapcore.LevelEnabler) zapcore.Core
+	var ws zapcore.WriteSyncer
+	var closer io.Closer
+	switch {
+	case journal:
+		j, err := newJournal(journalSocket)
+		if err != nil {
+			return fmt.Errorf("failed to connect to journald: %w", err)
+		}
+		core = func(level zapcore.LevelEnabler) zapcore.Core {
+			return &journalCore{LevelEnabler: level, journal: j}
+		}
+		closer = j
+	case cfg.File != "":
+		lj := &lumberjack.Logger{
+			Filename:   cfg.File,
+			MaxSize:    defaultMaxSize,
+			MaxBackups: defaultMaxFiles,
+		}
+		if cfg.MaxSize > 0 {
+			lj.MaxSize = cfg.MaxSize
+		}
+		if cfg.MaxFiles > 0 {
+			lj.MaxBackups = cfg.MaxFiles
+		}
+		ws, closer = zapcore.AddSync(lj), lj
+	default:
+		ws = zapcore.Lock(os.Stderr)
+	}
+	if core == nil {
+		core = func(level zapcore.LevelEnabler) zapcore.Core {
+			return zapcore.NewCore(enc, ws, level)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	closeLocked()
+	newCore, syncer, file, levels = core, ws, closer, lv
+	loggers = make(map[string]*zap.SugaredLogger)
+	return nil
+}
+
+// Close flushes the log and closes its file. Nothing is logged afterwards
+// until the next Init.
+func Close() {
+	mu.Lock()
+	defer mu.Unlock()
+	closeLocked()
+	newCore, syncer, file, levels, loggers = nil, nil, nil, nil, nil
 }
 
-// Println outputs log messages only in debug mode
-func Println(v ...interface{}) {
-	if stdLog == nil {
-		Init(false)
+func closeLocked() {
+	if syncer != nil {
+		syncer.Sync()
 	}
-	stdLog.Println(v...)
+	if file != nil {
+		file.Close()
+	}
+}
+
+// Logger logs for one subsystem. It follows Init, so it can be created
+// before the log is set up, e.g. in a package variable.
+type Logger struct {
+	name string
+}
+
+// Named returns the logger of a subsystem.
+func Named(subsystem string) *Logger {
+	return &Logger{name: subsystem}
 }
 
-// Printf outputs formatted log messages only in debug mode
-func Printf(format string, v ...interface{}) {
-	if stdLog == nil {
-		Init(false)
+// sugar returns the zap logger of the subsystem under the current setup.
+func (l *Logger) sugar() *zap.SugaredLogger {
+	mu.RLock()
+	s := loggers[l.name]
+	mu.RUnlock()
+	if s != nil {
+		return s
 	}
-	stdLog.Printf(format, v...)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if newCore == nil {
+		return zap.NewNop().Sugar()
+	}
+	if s = loggers[l.name]; s == nil {
+		level, ok := levels[l.name]
+		if !ok {
+			level = levels[Agent]
+		}
+		s = zap.New(newCore(level)).Named(l.name).Sugar()
+		loggers[l.name] = s
+	}
+	return s
+}
+
+// Zap returns the subsystem's logger for libraries that log through zap.
+// Unlike the Logger, it keeps the setup of the time of the call.
+func (l *Logger) Zap() *zap.Logger {
+	return l.sugar().Desugar()
 }
 
-// IsDebugMode returns the current debug mode status
-func IsDebugMode() bool {
-	return debugMode
+// With returns a logger that adds the key-value pairs to every entry.
+// Unlike the Logger, it keeps the setup of the time of the call, so it is
+// to be created after Init.
+func (l *Logger) With(keysAndValues ...any) *zap.SugaredLogger {
+	return l.sugar().With(keysAndValues...)
+}
+
+// DebugEnabled reports whether the subsystem logs debug messages, to skip
+// building expensive ones.
+func (l *Logger) DebugEnabled() bool {
+	return l.sugar().Desugar().Core().Enabled(zapcore.DebugLevel)
+}
+
+func (l *Logger) Debugf(format string, args ...any) { l.sugar().Debugf(format, args...) }
+func (l *Logger) Infof(format string, args ...any)  { l.sugar().Infof(format, args...) }
+func (l *Logger) Warnf(format string, args ...any)  { l.sugar().Warnf(format, args...) }
+func (l *Logger) Errorf(format string, args ...any) { l.sugar().Errorf(format, args...) }
+
+// The w variants log a message with key-value pairs as structured fields.
+func (l *Logger) Debugw(msg string, keysAndValues ...any) { l.sugar().Debugw(msg, keysAndValues...) }
+func (l *Logger) Infow(msg string, keysAndValues ...any)  { l.sugar().Infow(msg, keysAndValues...) }
+func (l *Logger) Warnw(msg string, keysAndValues ...any)  { l.sugar().Warnw(msg, keysAndValues...) }
+func (l *Logger) Errorw(msg string, keysAndValues ...any) { l.sugar().Errorw(msg, keysAndValues...) }
+
+// std is the agent's logger, used by the package functions.
+var std = Named(Agent)
+
+func Debugf(format string, args ...any) { std.Debugf(format, args...) }
+func Infof(format string, args ...any)  { std.Infof(format, args...) }
+func Warnf(format string, args ...any)  { std.Warnf(format, args...) }
+func Errorf(format string, args ...any) { std.Errorf(format, args...) }
+
+func Debugw(msg string, keysAndValues ...any) { std.Debugw(msg, keysAndValues...) }
+func Infow(msg string, keysAndValues ...any)  { std.Infow(msg, keysAndValues...) }
+func Warnw(msg string, keysAndValues ...any)  { std.Warnw(msg, keysAndValues...) }
+func Errorw(msg string, keysAndValues ...any) { std.Errorw(msg, keysAndValues...) }
+
+// DebugEnabled reports whether the agent logs debug messages.
+func DebugEnabled() bool {
+	return std.DebugEnabled()
 }
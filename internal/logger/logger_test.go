@@ -0,0 +1,105 @@
+package logger
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+)
+
+func TestLevelsAndJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kh.log")
+	err := Init(config.LogConfig{
+		Format: "json",
+		File:   path,
+		Levels: map[string]string{WG: "debug"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Debugf("agent debug %d", 1) // below the default info level
+	Infow("Peers updated", "peers", 3)
+	Named(WG).Debugf("route %s", "10.0.0.0/24")
+	Named(Etcd).Infof("etcd info") // etcd defaults to warn
+	Named(Etcd).Warnf("etcd warn")
+	Close()
+	Infof("after close")
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []map[string]any
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var entry map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid JSON log line %q: %v", sc.Text(), err)
+		}
+		got = append(got, entry)
+	}
+
+	want := []struct{ logger, level, msg string }{
+		{Agent, "info", "Peers updated"},
+		{WG, "debug", "route 10.0.0.0/24"},
+		{Etcd, "warn", "etcd warn"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries, want %d: %v", len(got), len(want), got)
+	}
+	for i, w := range want {
+		if got[i]["logger"] != w.logger || got[i]["level"] != w.level || got[i]["msg"] != w.msg {
+			t.Errorf("entry %d = %v, want %+v", i, got[i], w)
+		}
+	}
+	if got[0]["peers"] != float64(3) {
+		t.Errorf("Expected the peers field in %v", got[0])
+	}
+}
+
+func TestDebugLevel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kh.log")
+	if err := Init(config.LogConfig{Level: "debug", File: path}); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+
+	for _, name := range []string{Agent, WG, WireGuard} {
+		if !Named(name).DebugEnabled() {
+			t.Errorf("Expected debug messages of %s with a debug level", name)
+		}
+	}
+	if Named(Etcd).DebugEnabled() {
+		t.Error("Expected etcd to stay at its default level")
+	}
+
+	Debugf("agent debug")
+	Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "agent debug") {
+		t.Errorf("Expected the debug message in the log, got %q", data)
+	}
+}
+
+func TestInitInvalid(t *testing.T) {
+	defer Close()
+	for _, cfg := range []config.LogConfig{
+		{Level: "verbose"},
+		{Format: "xml"},
+		{Levels: map[string]string{"dns": "debug"}},
+		{Levels: map[string]string{Etcd: "loud"}},
+	} {
+		if err := Init(cfg); err == nil {
+			t.Errorf("Init(%+v) succeeded, want an error", cfg)
+		}
+	}
+}
@@ -0,0 +1,503 @@
+package meshdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/internal/logger"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// recordTTL is short because the node table changes at runtime
+	recordTTL = 30
+	// forwardTimeout bounds a single upstream query
+	forwardTimeout = 2 * time.Second
+)
+
+// Server answers A, AAAA and PTR queries for mesh nodes named
+// <hostname>.<domain> and SRV queries for services named
+// _<service>._<protocol>.<domain> from the live node table, and forwards
+// every other query to the upstream resolvers.
+type Server struct {
+	domain    string
+	upstreams []string
+
+	mu    sync.RWMutex
+	names map[string][]netip.Addr
+	ptr   map[netip.Addr]string
+	srv   map[string][]dnsmessage.SRVResource
+
+	udp net.PacketConn
+	tcp net.Listener
+	wg  sync.WaitGroup
+}
+
+// New creates a server for domain. Upstreams are host:port addresses.
+func New(domain string, upstreams []string) *Server {
+	return &Server{
+		domain:    canonical(domain),
+		upstreams: upstreams,
+		names:     make(map[string][]netip.Addr),
+		ptr:       make(map[netip.Addr]string),
+		srv:       make(map[string][]dnsmessage.SRVResource),
+	}
+}
+
+// Service is an instance of a service on a mesh node.
+type Service struct {
+	Name     string
+	Protocol string // tcp or udp
+	Host     string // hostname of the node, without the domain
+	Port     uint16
+}
+
+// SetServices replaces the service table answered for SRV queries.
+func (s *Server) SetServices(services []Service) {
+	srv := make(map[string][]dnsmessage.SRVResource)
+	for _, svc := range services {
+		name := NormalizeHostname(svc.Name)
+		host := NormalizeHostname(svc.Host)
+		if name == "" || host == "" || (svc.Protocol != "tcp" && svc.Protocol != "udp") {
+			continue
+		}
+		key := "_" + name + "._" + svc.Protocol + "." + s.domain
+		target, err := dnsmessage.NewName(host + "." + s.domain + ".")
+		if err != nil {
+			continue
+		}
+		srv[key] = append(srv[key], dnsmessage.SRVResource{Target: target, Port: svc.Port})
+	}
+	for _, records := range srv {
+		// Stable answers regardless of the order of the node table
+		sort.Slice(records, func(i, j int) bool {
+			if records[i].Target.String() != records[j].Target.String() {
+				return records[i].Target.String() < records[j].Target.String()
+			}
+			return records[i].Port < records[j].Port
+		})
+	}
+
+	s.mu.Lock()
+	s.srv = srv
+	s.mu.Unlock()
+}
+
+// SetHosts replaces the node table. hosts maps hostnames (without the
+// domain) to their mesh addresses.
+func (s *Server) SetHosts(hosts map[string][]netip.Addr) {
+	names := make(map[string][]netip.Addr, len(hosts))
+	ptr := make(map[netip.Addr]string)
+	for host, addrs := range hosts {
+		label := NormalizeHostname(host)
+		if label == "" {
+			continue
+		}
+		fqdn := label + "." + s.domain
+		if len(fqdn) > maxNameLen {
+			continue
+		}
+		names[fqdn] = append(names[fqdn], addrs...)
+		for _, addr := range addrs {
+			ptr[addr] = fqdn
+		}
+	}
+
+	s.mu.Lock()
+	s.names = names
+	s.ptr = ptr
+	s.mu.Unlock()
+}
+
+// ListenAndServe starts serving UDP and TCP on addr in the background.
+func (s *Server) ListenAndServe(addr string) error {
+	udp, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s/udp: %w", addr, err)
+	}
+	// Use the port actually bound, in case addr asked for any port
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		udp.Close()
+		return fmt.Errorf("failed to listen on %s/tcp: %w", addr, err)
+	}
+	s.Serve(udp, tcp)
+	return nil
+}
+
+// Serve answers queries arriving on udp and tcp in the background until
+// Close is called. Either may be nil.
+func (s *Server) Serve(udp net.PacketConn, tcp net.Listener) {
+	s.udp, s.tcp = udp, tcp
+	if udp != nil {
+		s.wg.Add(1)
+		go s.serveUDP()
+	}
+	if tcp != nil {
+		s.wg.Add(1)
+		go s.serveTCP()
+	}
+}
+
+// Addr returns the UDP address the server listens on.
+func (s *Server) Addr() net.Addr {
+	return s.udp.LocalAddr()
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	var errs []error
+	if s.udp != nil {
+		errs = append(errs, s.udp.Close())
+	}
+	if s.tcp != nil {
+		errs = append(errs, s.tcp.Close())
+	}
+	s.wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Warnf("Mesh DNS: UDP read failed: %v", err)
+			}
+			return
+		}
+		req := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := s.handle(req, "udp"); resp != nil {
+				s.udp.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Warnf("Mesh DNS: TCP accept failed: %v", err)
+			}
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		req, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		resp := s.handle(req, "tcp")
+		if resp == nil {
+			return
+		}
+		if err := writeTCPMessage(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+// handle answers a single query. Names under the mesh domain and reverse
+// lookups of mesh addresses are answered locally, everything else is
+// forwarded upstream.
+func (s *Server) handle(req []byte, network string) []byte {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(req)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return s.reply(hdr, q, dnsmessage.RCodeFormatError, nil)
+	}
+
+	name := canonical(q.Name.String())
+	if name == s.domain || strings.HasSuffix(name, "."+s.domain) {
+		return s.answerMesh(hdr, q, name)
+	}
+	if q.Type == dnsmessage.TypePTR {
+		if addr, ok := parseReverseName(name); ok {
+			s.mu.RLock()
+			target, found := s.ptr[addr]
+			s.mu.RUnlock()
+			if found {
+				record, err := ptrRecord(q.Name, target)
+				if err != nil {
+					return s.reply(hdr, q, dnsmessage.RCodeServerFailure, nil)
+				}
+				return s.reply(hdr, q, dnsmessage.RCodeSuccess, []dnsmessage.Resource{record})
+			}
+		}
+	}
+
+	resp, err := s.forward(req, network)
+	if err != nil {
+		logger.Warnf("Mesh DNS: forwarding %s failed: %v", name, err)
+		return s.reply(hdr, q, dnsmessage.RCodeServerFailure, nil)
+	}
+	return resp
+}
+
+func (s *Server) answerMesh(hdr dnsmessage.Header, q dnsmessage.Question, name string) []byte {
+	s.mu.RLock()
+	addrs, found := s.names[name]
+	services, isService := s.srv[name]
+	s.mu.RUnlock()
+
+	if !found && !isService && name != s.domain {
+		return s.reply(hdr, q, dnsmessage.RCodeNameError, nil)
+	}
+
+	var answers []dnsmessage.Resource
+	if q.Type == dnsmessage.TypeSRV || q.Type == dnsmessage.TypeALL {
+		for _, srv := range services {
+			rh := dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: recordTTL}
+			body := srv
+			answers = append(answers, dnsmessage.Resource{Header: rh, Body: &body})
+		}
+	}
+	for _, addr := range addrs {
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: recordTTL}
+		switch {
+		case addr.Is4() && (q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeALL):
+			rh.Type = dnsmessage.TypeA
+			answers = append(answers, dnsmessage.Resource{Header: rh, Body: &dnsmessage.AResource{A: addr.As4()}})
+		case addr.Is6() && (q.Type == dnsmessage.TypeAAAA || q.Type == dnsmessage.TypeALL):
+			rh.Type = dnsmessage.TypeAAAA
+			answers = append(answers, dnsmessage.Resource{Header: rh, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+		}
+	}
+	return s.reply(hdr, q, dnsmessage.RCodeSuccess, answers)
+}
+
+func (s *Server) reply(hdr dnsmessage.Header, q dnsmessage.Question, rcode dnsmessage.RCode, answers []dnsmessage.Resource) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 hdr.ID,
+		Response:           true,
+		OpCode:             hdr.OpCode,
+		Authoritative:      rcode != dnsmessage.RCodeServerFailure,
+		RecursionDesired:   hdr.RecursionDesired,
+		RecursionAvailable: len(s.upstreams) > 0,
+		RCode:              rcode,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil
+	}
+	if q.Name.Length > 0 {
+		if err := b.Question(q); err != nil {
+			return nil
+		}
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil
+	}
+	for _, rr := range answers {
+		var err error
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			err = b.AResource(rr.Header, *body)
+		case *dnsmessage.AAAAResource:
+			err = b.AAAAResource(rr.Header, *body)
+		case *dnsmessage.PTRResource:
+			err = b.PTRResource(rr.Header, *body)
+		case *dnsmessage.SRVResource:
+			err = b.SRVResource(rr.Header, *body)
+		}
+		if err != nil {
+			return nil
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+// forward sends req to the upstreams in order and returns the first answer.
+func (s *Server) forward(req []byte, network string) ([]byte, error) {
+	if len(s.upstreams) == 0 {
+		return nil, fmt.Errorf("no upstream resolvers configured")
+	}
+
+	var lastErr error
+	for _, upstream := range s.upstreams {
+		resp, err := exchange(req, network, upstream)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func exchange(req []byte, network, upstream string) ([]byte, error) {
+	conn, err := net.DialTimeout(network, upstream, forwardTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(forwardTimeout))
+
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, req); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+func ptrRecord(name dnsmessage.Name, target string) (dnsmessage.Resource, error) {
+	ptr, err := dnsmessage.NewName(target + ".")
+	if err != nil {
+		return dnsmessage.Resource{}, err
+	}
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: recordTTL},
+		Body:   &dnsmessage.PTRResource{PTR: ptr},
+	}, nil
+}
+
+// canonical lowercases name and strips the trailing dot.
+func canonical(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// parseReverseName converts an in-addr.arpa or ip6.arpa name to an address.
+func parseReverseName(name string) (netip.Addr, bool) {
+	if rest, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		parts := strings.Split(rest, ".")
+		if len(parts) != 4 {
+			return netip.Addr{}, false
+		}
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+		addr, err := netip.ParseAddr(strings.Join(parts, "."))
+		return addr, err == nil && addr.Is4()
+	}
+
+	if rest, ok := strings.CutSuffix(name, ".ip6.arpa"); ok {
+		nibbles := strings.Split(rest, ".")
+		if len(nibbles) != 32 {
+			return netip.Addr{}, false
+		}
+		var sb strings.Builder
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			sb.WriteString(nibbles[i])
+			if i%4 == 0 && i > 0 {
+				sb.WriteByte(':')
+			}
+		}
+		addr, err := netip.ParseAddr(sb.String())
+		return addr, err == nil && addr.Is6()
+	}
+	return netip.Addr{}, false
+}
+
+// Length limits of RFC 1035
+const (
+	maxLabelLen = 63
+	maxNameLen  = 253
+)
+
+// NormalizeHostname turns a hostname into a single DNS label: the first
+// component, lowercased, with characters that aren't allowed replaced by '-'.
+// It returns "" for names longer than 253 bytes or whose label would be
+// longer than 63 bytes.
+func NormalizeHostname(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if len(host) > maxNameLen {
+		return ""
+	}
+	host, _, _ = strings.Cut(host, ".")
+	label := []byte(host)
+	for i, c := range label {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			label[i] = '-'
+		}
+	}
+	if len(label) > maxLabelLen {
+		return ""
+	}
+	return strings.Trim(string(label), "-")
+}
+
+// SystemUpstreams returns the nameservers listed in a resolv.conf style
+// file as host:port addresses, leaving out the addresses in exclude.
+func SystemUpstreams(path string, exclude ...string) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	skip := make(map[string]bool, len(exclude))
+	for _, e := range exclude {
+		skip[e] = true
+	}
+
+	var upstreams []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "nameserver" || skip[fields[1]] {
+			continue
+		}
+		if _, err := netip.ParseAddr(fields[1]); err != nil {
+			continue
+		}
+		upstreams = append(upstreams, net.JoinHostPort(fields[1], "53"))
+	}
+	return upstreams
+}
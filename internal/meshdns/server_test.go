@@ -0,0 +1,171 @@
+package meshdns
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startServer runs s on a random local port until the test ends.
+func startServer(t *testing.T, s *Server) {
+	t.Helper()
+	if err := s.ListenAndServe("127.0.0.1:0"); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+}
+
+// resolverFor returns a resolver that sends all queries to s over network.
+func resolverFor(s *Server, network string) *net.Resolver {
+	addr := s.Addr().String()
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+func TestServer(t *testing.T) {
+	// The upstream serves its own domain so forwarding can be observed
+	upstream := New("upstream.test", nil)
+	upstream.SetHosts(map[string][]netip.Addr{"web": {netip.MustParseAddr("192.0.2.10")}})
+	startServer(t, upstream)
+
+	s := New("mesh.internal", []string{upstream.Addr().String()})
+	s.SetHosts(map[string][]netip.Addr{
+		"Node-1.lan": {netip.MustParseAddr("10.0.0.2")},
+		"node2":      {netip.MustParseAddr("10.0.0.3"), netip.MustParseAddr("fd00::3")},
+	})
+	startServer(t, s)
+
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			r := resolverFor(s, network)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			addrs, err := r.LookupHost(ctx, "node-1.mesh.internal")
+			if err != nil || len(addrs) != 1 || addrs[0] != "10.0.0.2" {
+				t.Errorf("Expected node-1 to resolve to 10.0.0.2, got %v (err %v)", addrs, err)
+			}
+
+			addrs, err = r.LookupHost(ctx, "NODE2.mesh.internal.")
+			sort.Strings(addrs)
+			if err != nil || len(addrs) != 2 || addrs[0] != "10.0.0.3" || addrs[1] != "fd00::3" {
+				t.Errorf("Expected node2 to resolve to both addresses, got %v (err %v)", addrs, err)
+			}
+
+			names, err := r.LookupAddr(ctx, "10.0.0.3")
+			if err != nil || len(names) != 1 || names[0] != "node2.mesh.internal." {
+				t.Errorf("Expected PTR node2.mesh.internal., got %v (err %v)", names, err)
+			}
+
+			names, err = r.LookupAddr(ctx, "fd00::3")
+			if err != nil || len(names) != 1 || names[0] != "node2.mesh.internal." {
+				t.Errorf("Expected IPv6 PTR node2.mesh.internal., got %v (err %v)", names, err)
+			}
+
+			_, err = r.LookupHost(ctx, "missing.mesh.internal")
+			if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+				t.Errorf("Expected not found for unknown node, got %v", err)
+			}
+
+			addrs, err = r.LookupHost(ctx, "web.upstream.test")
+			if err != nil || len(addrs) != 1 || addrs[0] != "192.0.2.10" {
+				t.Errorf("Expected forwarded answer 192.0.2.10, got %v (err %v)", addrs, err)
+			}
+		})
+	}
+
+	t.Run("SetHostsReplacesTable", func(t *testing.T) {
+		s.SetHosts(map[string][]netip.Addr{"node3": {netip.MustParseAddr("10.0.0.4")}})
+		r := resolverFor(s, "udp")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if _, err := r.LookupHost(ctx, "node-1.mesh.internal"); err == nil {
+			t.Error("Expected removed node to no longer resolve")
+		}
+		if addrs, err := r.LookupHost(ctx, "node3.mesh.internal"); err != nil || addrs[0] != "10.0.0.4" {
+			t.Errorf("Expected node3 to resolve, got %v (err %v)", addrs, err)
+		}
+	})
+}
+
+func TestServerSRV(t *testing.T) {
+	s := New("mesh.internal", nil)
+	s.SetServices([]Service{
+		{Name: "web", Protocol: "tcp", Host: "node2", Port: 8443},
+		{Name: "web", Protocol: "tcp", Host: "Node-1.lan", Port: 443},
+		{Name: "syslog", Protocol: "udp", Host: "node2", Port: 514},
+		{Name: "bad", Protocol: "sctp", Host: "node2", Port: 1},
+	})
+	startServer(t, s)
+
+	r := resolverFor(s, "udp")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, srvs, err := r.LookupSRV(ctx, "web", "tcp", "mesh.internal")
+	if err != nil || len(srvs) != 2 {
+		t.Fatalf("Expected 2 web instances, got %v (err %v)", srvs, err)
+	}
+	got := map[string]uint16{}
+	for _, srv := range srvs {
+		got[srv.Target] = srv.Port
+	}
+	if got["node-1.mesh.internal."] != 443 || got["node2.mesh.internal."] != 8443 {
+		t.Errorf("Unexpected web instances: %v", got)
+	}
+
+	_, srvs, err = r.LookupSRV(ctx, "syslog", "udp", "mesh.internal")
+	if err != nil || len(srvs) != 1 || srvs[0].Port != 514 {
+		t.Errorf("Expected syslog on 514, got %v (err %v)", srvs, err)
+	}
+
+	for _, name := range []string{"_syslog._tcp.mesh.internal", "_bad._sctp.mesh.internal"} {
+		_, _, err = r.LookupSRV(ctx, "", "", name)
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			t.Errorf("Expected not found for %s, got %v", name, err)
+		}
+	}
+}
+
+func TestNormalizeHostname(t *testing.T) {
+	tests := map[string]string{
+		"node1":             "node1",
+		"Node1.example.com": "node1",
+		"my_laptop":         "my-laptop",
+		"  spaced ":         "spaced",
+		"-edge-":            "edge",
+		"":                  "",
+		// Too long for a label or a name
+		strings.Repeat("a", 64):                         "",
+		strings.Repeat("a", 63):                         strings.Repeat("a", 63),
+		"node." + strings.Repeat("b", 250):              "",
+		"node." + strings.Repeat("b.", 100) + "example": "node",
+	}
+	for in, want := range tests {
+		if got := NormalizeHostname(in); got != want {
+			t.Errorf("NormalizeHostname(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestPTRRecordTooLong(t *testing.T) {
+	name := dnsmessage.MustNewName("2.0.0.10.in-addr.arpa.")
+	if _, err := ptrRecord(name, strings.Repeat("a.", 130)+"mesh.internal"); err == nil {
+		t.Error("Expected an error for a target longer than 255 bytes")
+	}
+	if _, err := ptrRecord(name, "node.mesh.internal"); err != nil {
+		t.Errorf("ptrRecord failed: %v", err)
+	}
+}
@@ -0,0 +1,364 @@
+// Package metrics exports the agent's state in the Prometheus format: the
+// WireGuard counters of each peer, etcd request latency and errors, and the
+// work of the peer watcher.
+package metrics
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/pabotesu/kurohabaki-client/internal/logger"
+	"github.com/pabotesu/kurohabaki-client/internal/wg"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+)
+
+// Per-peer label names
+const (
+	LabelPublicKey = "public_key"
+	LabelHostname  = "hostname"
+)
+
+// otherPeers is the label value of peers beyond the MaxPeers limit.
+const otherPeers = "other"
+
+// Metrics holds the agent's metrics. All methods are no-ops on a nil
+// *Metrics, so callers don't need to check whether metrics are enabled.
+type Metrics struct {
+	reg      *prometheus.Registry
+	labels   []string
+	maxPeers int
+
+	etcdDuration    *prometheus.HistogramVec
+	etcdErrors      *prometheus.CounterVec
+	watchEvents     *prometheus.CounterVec
+	watchErrors     *prometheus.CounterVec
+	peerChanges     *prometheus.CounterVec
+	reconcile       prometheus.Histogram
+	reconcileErrors prometheus.Counter
+
+	peers *peerCollector
+
+	server *http.Server
+}
+
+// New creates the metrics with the per-peer label settings of cfg.
+func New(cfg config.MetricsConfig) (*Metrics, error) {
+	labels := []string{LabelPublicKey, LabelHostname}
+	if len(cfg.PeerLabels) > 0 {
+		labels = nil
+		for _, l := range cfg.PeerLabels {
+			switch l {
+			case LabelPublicKey, LabelHostname:
+				if !slices.Contains(labels, l) {
+					labels = append(labels, l)
+				}
+			case "none":
+			default:
+				return nil, fmt.Errorf("unknown peer label %q, use public_key, hostname or none", l)
+			}
+		}
+	}
+	if cfg.MaxPeers < 0 {
+		return nil, errors.New("max_peers must not be negative")
+	}
+
+	m := &Metrics{
+		reg:      prometheus.NewRegistry(),
+		labels:   labels,
+		maxPeers: cfg.MaxPeers,
+		etcdDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "kurohabaki_etcd_request_duration_seconds",
+			Help:    "Latency of etcd requests by gRPC method.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+		}, []string{"method"}),
+		etcdErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kurohabaki_etcd_request_errors_total",
+			Help: "Failed etcd requests by gRPC method.",
+		}, []string{"method"}),
+		watchEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kurohabaki_etcd_watch_events_total",
+			Help: "Events received on etcd watches.",
+		}, []string{"watch"}),
+		watchErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kurohabaki_etcd_watch_errors_total",
+			Help: "Failures of etcd watches, after which they are restarted.",
+		}, []string{"watch"}),
+		peerChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kurohabaki_peer_changes_total",
+			Help: "Peers added to or removed from the WireGuard device.",
+		}, []string{"change"}),
+		reconcile: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "kurohabaki_reconcile_duration_seconds",
+			Help:    "Duration of the peer watcher's reconcile passes.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 3, 8),
+		}),
+		reconcileErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kurohabaki_reconcile_errors_total",
+			Help: "Reconcile passes that failed.",
+		}),
+	}
+	m.peers = newPeerCollector(labels, cfg.MaxPeers)
+	m.peerChanges.WithLabelValues("added")
+	m.peerChanges.WithLabelValues("removed")
+
+	m.reg.MustRegister(m.etcdDuration, m.etcdErrors, m.watchEvents, m.watchErrors,
+		m.peerChanges, m.reconcile, m.reconcileErrors, m.peers)
+	return m, nil
+}
+
+// DialOptions instrument the requests of an etcd client.
+func (m *Metrics) DialOptions() []grpc.DialOption {
+	if m == nil {
+		return nil
+	}
+	return []grpc.DialOption{grpc.WithChainUnaryInterceptor(m.unaryInterceptor)}
+}
+
+func (m *Metrics) unaryInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	name := path.Base(method) // e.g. /etcdserverpb.KV/Range
+	m.etcdDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.etcdErrors.WithLabelValues(name).Inc()
+	}
+	return err
+}
+
+// SetPeerSource sets where the per-peer series come from: the device's
+// counters and the hostnames of the node table by public key.
+func (m *Metrics) SetPeerSource(stats func() ([]wg.PeerStat, error), hostnames func() map[string]string) {
+	if m == nil {
+		return
+	}
+	m.peers.setSource(stats, hostnames)
+}
+
+// ObservePeers records endpoint changes from a snapshot of the device's
+// counters, in addition to those seen when metrics are scraped.
+func (m *Metrics) ObservePeers(stats []wg.PeerStat) {
+	if m == nil {
+		return
+	}
+	m.peers.observe(stats)
+}
+
+// PeersChanged counts peers added to and removed from the device.
+func (m *Metrics) PeersChanged(added, removed int) {
+	if m == nil {
+		return
+	}
+	m.peerChanges.WithLabelValues("added").Add(float64(added))
+	m.peerChanges.WithLabelValues("removed").Add(float64(removed))
+}
+
+// ObserveReconcile records a reconcile pass of the peer watcher.
+func (m *Metrics) ObserveReconcile(d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.reconcile.Observe(d.Seconds())
+	if err != nil {
+		m.reconcileErrors.Inc()
+	}
+}
+
+// WatchResponse records a response of an etcd watch.
+func (m *Metrics) WatchResponse(watch string, events int, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.watchErrors.WithLabelValues(watch).Inc()
+		return
+	}
+	m.watchEvents.WithLabelValues(watch).Add(float64(events))
+}
+
+// Handler serves the metrics.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{})
+}
+
+// ListenAndServe serves the metrics on addr under /metrics in the
+// background until Close.
+func (m *Metrics) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+	m.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := m.server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Warnf("Metrics server failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Close stops the metrics server.
+func (m *Metrics) Close() error {
+	if m == nil || m.server == nil {
+		return nil
+	}
+	return m.server.Close()
+}
+
+// peerCollector exports the WireGuard counters of each peer at scrape time.
+type peerCollector struct {
+	labels   []string
+	maxPeers int
+
+	rx, tx, handshakeAge, endpointChanges, peers *prometheus.Desc
+
+	mu        sync.Mutex
+	stats     func() ([]wg.PeerStat, error)
+	hostnames func() map[string]string
+	// endpoint and number of endpoint changes of each peer
+	lastEndpoint map[string]string
+	changes      map[string]uint64
+}
+
+func newPeerCollector(labels []string, maxPeers int) *peerCollector {
+	return &peerCollector{
+		labels:   labels,
+		maxPeers: maxPeers,
+		rx: prometheus.NewDesc("kurohabaki_peer_receive_bytes_total",
+			"Bytes received from the peer.", labels, nil),
+		tx: prometheus.NewDesc("kurohabaki_peer_transmit_bytes_total",
+			"Bytes sent to the peer.", labels, nil),
+		handshakeAge: prometheus.NewDesc("kurohabaki_peer_last_handshake_age_seconds",
+			"Time since the latest handshake with the peer; the oldest one for aggregated peers.", labels, nil),
+		endpointChanges: prometheus.NewDesc("kurohabaki_peer_endpoint_changes_total",
+			"Times the peer's endpoint has changed, e.g. by roaming.", labels, nil),
+		peers: prometheus.NewDesc("kurohabaki_peers",
+			"Peers configured on the WireGuard device.", nil, nil),
+		lastEndpoint: make(map[string]string),
+		changes:      make(map[string]uint64),
+	}
+}
+
+func (c *peerCollector) setSource(stats func() ([]wg.PeerStat, error), hostnames func() map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats, c.hostnames = stats, hostnames
+}
+
+func (c *peerCollector) observe(stats []wg.PeerStat) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.observeLocked(stats)
+}
+
+func (c *peerCollector) observeLocked(stats []wg.PeerStat) {
+	seen := make(map[string]bool, len(stats))
+	for _, st := range stats {
+		key := base64.StdEncoding.EncodeToString(st.PublicKey[:])
+		seen[key] = true
+		if prev, ok := c.lastEndpoint[key]; ok && prev != "" && st.Endpoint != "" && prev != st.Endpoint {
+			c.changes[key]++
+		}
+		if st.Endpoint != "" {
+			c.lastEndpoint[key] = st.Endpoint
+		}
+	}
+	for key := range c.lastEndpoint {
+		if !seen[key] {
+			delete(c.lastEndpoint, key)
+			delete(c.changes, key)
+		}
+	}
+}
+
+func (c *peerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.rx
+	ch <- c.tx
+	ch <- c.handshakeAge
+	ch <- c.endpointChanges
+	ch <- c.peers
+}
+
+// peerSeries is the values of one series, which may aggregate peers.
+type peerSeries struct {
+	labels          []string
+	rx, tx, changes uint64
+	oldest          time.Time
+}
+
+func (c *peerCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stats == nil {
+		return
+	}
+	stats, err := c.stats()
+	if err != nil {
+		logger.Errorf("Failed to read peer stats for metrics: %v", err)
+		return
+	}
+	c.observeLocked(stats)
+	var hostnames map[string]string
+	if c.hostnames != nil {
+		hostnames = c.hostnames()
+	}
+
+	// Peers are ordered by key so that the same ones keep their own series
+	sort.Slice(stats, func(i, j int) bool {
+		return string(stats[i].PublicKey[:]) < string(stats[j].PublicKey[:])
+	})
+	series := make(map[string]*peerSeries)
+	var order []string
+	for i, st := range stats {
+		key := base64.StdEncoding.EncodeToString(st.PublicKey[:])
+		values := make([]string, len(c.labels))
+		for j, l := range c.labels {
+			switch {
+			case c.maxPeers > 0 && i >= c.maxPeers:
+				values[j] = otherPeers
+			case l == LabelPublicKey:
+				values[j] = key
+			case l == LabelHostname:
+				values[j] = hostnames[key]
+			}
+		}
+		id := fmt.Sprint(values)
+		s := series[id]
+		if s == nil {
+			s = &peerSeries{labels: values}
+			series[id] = s
+			order = append(order, id)
+		}
+		s.rx += st.RxBytes
+		s.tx += st.TxBytes
+		s.changes += c.changes[key]
+		if !st.LastHandshake.IsZero() && (s.oldest.IsZero() || st.LastHandshake.Before(s.oldest)) {
+			s.oldest = st.LastHandshake
+		}
+	}
+
+	now := time.Now()
+	for _, id := range order {
+		s := series[id]
+		ch <- prometheus.MustNewConstMetric(c.rx, prometheus.CounterValue, float64(s.rx), s.labels...)
+		ch <- prometheus.MustNewConstMetric(c.tx, prometheus.CounterValue, float64(s.tx), s.labels...)
+		ch <- prometheus.MustNewConstMetric(c.endpointChanges, prometheus.CounterValue, float64(s.changes), s.labels...)
+		if !s.oldest.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.handshakeAge, prometheus.GaugeValue, now.Sub(s.oldest).Seconds(), s.labels...)
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(c.peers, prometheus.GaugeValue, float64(len(stats)))
+}
@@ -0,0 +1,172 @@
+package metrics
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/pabotesu/kurohabaki-client/internal/wg"
+	"google.golang.org/grpc"
+)
+
+// scrape returns the metrics in the text format.
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	return string(body)
+}
+
+func testPeers(now time.Time) ([]wg.PeerStat, map[string]string) {
+	var stats []wg.PeerStat
+	hostnames := make(map[string]string)
+	for i, host := range []string{"alpha", "beta", "gamma"} {
+		var st wg.PeerStat
+		st.PublicKey[0] = byte(i + 1)
+		st.RxBytes = uint64(10 * (i + 1))
+		st.TxBytes = uint64(100 * (i + 1))
+		st.Endpoint = "192.0.2.1:51820"
+		st.LastHandshake = now.Add(-time.Duration(i+1) * time.Minute)
+		stats = append(stats, st)
+		hostnames[base64.StdEncoding.EncodeToString(st.PublicKey[:])] = host
+	}
+	return stats, hostnames
+}
+
+func TestPeerMetrics(t *testing.T) {
+	stats, hostnames := testPeers(time.Now())
+	key0 := base64.StdEncoding.EncodeToString(stats[0].PublicKey[:])
+
+	tests := []struct {
+		name string
+		cfg  config.MetricsConfig
+		want []string
+	}{
+		{
+			name: "default labels",
+			cfg:  config.MetricsConfig{},
+			want: []string{
+				`kurohabaki_peer_receive_bytes_total{hostname="alpha",public_key="` + key0 + `"} 10`,
+				`kurohabaki_peer_transmit_bytes_total{hostname="gamma",public_key=`,
+				`kurohabaki_peers 3`,
+			},
+		},
+		{
+			name: "max peers",
+			cfg:  config.MetricsConfig{MaxPeers: 1},
+			want: []string{
+				`kurohabaki_peer_receive_bytes_total{hostname="alpha",public_key="` + key0 + `"} 10`,
+				`kurohabaki_peer_receive_bytes_total{hostname="other",public_key="other"} 50`,
+				`kurohabaki_peer_last_handshake_age_seconds{hostname="other",public_key="other"} 180`,
+			},
+		},
+		{
+			name: "no labels",
+			cfg:  config.MetricsConfig{PeerLabels: []string{"none"}},
+			want: []string{
+				"kurohabaki_peer_receive_bytes_total 60",
+				"kurohabaki_peer_transmit_bytes_total 600",
+			},
+		},
+		{
+			name: "hostname only",
+			cfg:  config.MetricsConfig{PeerLabels: []string{"hostname"}},
+			want: []string{`kurohabaki_peer_receive_bytes_total{hostname="beta"} 20`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.SetPeerSource(func() ([]wg.PeerStat, error) {
+				return append([]wg.PeerStat(nil), stats...), nil
+			}, func() map[string]string { return hostnames })
+
+			out := scrape(t, m)
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("missing %q in:\n%s", want, out)
+				}
+			}
+		})
+	}
+}
+
+func TestEndpointChanges(t *testing.T) {
+	m, err := New(config.MetricsConfig{PeerLabels: []string{"hostname"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, hostnames := testPeers(time.Now())
+	m.ObservePeers(stats)
+	stats[1].Endpoint = "198.51.100.7:40000"
+	m.ObservePeers(stats)
+	m.SetPeerSource(func() ([]wg.PeerStat, error) { return stats, nil }, func() map[string]string { return hostnames })
+
+	out := scrape(t, m)
+	for _, want := range []string{
+		`kurohabaki_peer_endpoint_changes_total{hostname="alpha"} 0`,
+		`kurohabaki_peer_endpoint_changes_total{hostname="beta"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestAgentMetrics(t *testing.T) {
+	m, err := New(config.MetricsConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing := func(context.Context, string, any, any, *grpc.ClientConn, ...grpc.CallOption) error {
+		return errors.New("unavailable")
+	}
+	m.unaryInterceptor(context.Background(), "/etcdserverpb.KV/Range", nil, nil, nil, failing)
+	m.PeersChanged(3, 1)
+	m.ObserveReconcile(time.Millisecond, errors.New("failed"))
+	m.WatchResponse("revocations", 2, nil)
+	m.WatchResponse("revocations", 0, errors.New("compacted"))
+
+	out := scrape(t, m)
+	for _, want := range []string{
+		`kurohabaki_etcd_request_duration_seconds_count{method="Range"} 1`,
+		`kurohabaki_etcd_request_errors_total{method="Range"} 1`,
+		`kurohabaki_peer_changes_total{change="added"} 3`,
+		`kurohabaki_peer_changes_total{change="removed"} 1`,
+		`kurohabaki_reconcile_duration_seconds_count 1`,
+		`kurohabaki_reconcile_errors_total 1`,
+		`kurohabaki_etcd_watch_events_total{watch="revocations"} 2`,
+		`kurohabaki_etcd_watch_errors_total{watch="revocations"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	if _, err := New(config.MetricsConfig{PeerLabels: []string{"endpoint"}}); err == nil {
+		t.Error("expected an error for an unknown label")
+	}
+	if _, err := New(config.MetricsConfig{MaxPeers: -1}); err == nil {
+		t.Error("expected an error for negative max_peers")
+	}
+
+	// Disabled metrics are nil and ignore calls
+	var m *Metrics
+	m.PeersChanged(1, 1)
+	m.ObserveReconcile(time.Second, nil)
+	if opts := m.DialOptions(); opts != nil {
+		t.Errorf("DialOptions = %v, want none", opts)
+	}
+}
@@ -0,0 +1,8 @@
+// Package nft enforces the mesh firewall in the kernel with a dedicated
+// nftables table per interface, programmed over netlink.
+package nft
+
+import "errors"
+
+// ErrUnsupported is returned by New on systems without nftables.
+var ErrUnsupported = errors.New("the nftables firewall is only supported on Linux")
@@ -0,0 +1,370 @@
+//go:build linux
+
+package nft
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"github.com/pabotesu/kurohabaki-client/internal/acl"
+	"github.com/pabotesu/kurohabaki-client/internal/filter"
+	"golang.org/x/sys/unix"
+)
+
+// Firewall manages the table of one interface. Every update replaces the
+// whole table in a single netlink batch, so the kernel never sees a partial
+// rule set, and carries the drop counters over to the new rules.
+type Firewall struct {
+	ifName string
+	rules  []filter.Rule
+	table  *nftables.Table
+
+	// newConn is replaced in tests
+	newConn func() (*nftables.Conn, error)
+
+	mu sync.Mutex
+}
+
+// New returns a Firewall for the interface enforcing the local rules. Nothing
+// is installed until Update.
+func New(ifName string, rules []filter.Rule) (*Firewall, error) {
+	return &Firewall{
+		ifName: ifName,
+		rules:  rules,
+		table:  &nftables.Table{Name: "kurohabaki-" + ifName, Family: nftables.TableFamilyINet},
+		newConn: func() (*nftables.Conn, error) {
+			return nftables.New()
+		},
+	}, nil
+}
+
+// Table returns the name of the managed table.
+func (f *Firewall) Table() string {
+	return f.table.Name
+}
+
+// Update replaces the table with rules for the given peers. Like the
+// userspace filter, replies to accepted flows pass, local rules are checked
+// in order, and then the ACL access of each peer.
+func (f *Firewall) Update(peers []filter.Peer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	conn, err := f.newConn()
+	if err != nil {
+		return fmt.Errorf("failed to open netlink connection: %w", err)
+	}
+
+	// The table doesn't exist before the first update, so counting starts
+	// from zero if there are no counters to read
+	counts, _ := f.counters(conn)
+
+	// Adding before deleting makes the delete succeed whether or not the
+	// table exists, all within one transaction
+	conn.AddTable(f.table)
+	conn.DelTable(f.table)
+	conn.AddTable(f.table)
+	if err := f.build(conn, peers, counts); err != nil {
+		return err
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to update nftables table %s: %w", f.table.Name, err)
+	}
+	return nil
+}
+
+// Remove deletes the table.
+func (f *Firewall) Remove() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	conn, err := f.newConn()
+	if err != nil {
+		return fmt.Errorf("failed to open netlink connection: %w", err)
+	}
+	conn.AddTable(f.table)
+	conn.DelTable(f.table)
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to delete nftables table %s: %w", f.table.Name, err)
+	}
+	return nil
+}
+
+// Drops returns the packets dropped by each rule, from the rule counters.
+func (f *Firewall) Drops() (map[string]uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	conn, err := f.newConn()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink connection: %w", err)
+	}
+
+	counts, err := f.counters(conn)
+	if err != nil {
+		return nil, err
+	}
+	drops := map[string]uint64{filter.ACLInbound: 0, filter.ACLOutbound: 0}
+	for _, r := range f.rules {
+		drops[r.Name] = 0
+	}
+	for name, c := range counts {
+		drops[name] += c.Packets
+	}
+	return drops, nil
+}
+
+// counters returns the counters of the installed rules, summed by name.
+func (f *Firewall) counters(conn *nftables.Conn) (map[string]*expr.Counter, error) {
+	counts := make(map[string]*expr.Counter)
+	for _, chain := range []string{"input", "output"} {
+		rules, err := conn.GetRules(f.table, &nftables.Chain{Name: chain, Table: f.table})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list nftables rules: %w", err)
+		}
+		for _, r := range rules {
+			name, ok := userdata.GetString(r.UserData, userdata.TypeComment)
+			if !ok {
+				continue
+			}
+			for _, e := range r.Exprs {
+				if c, ok := e.(*expr.Counter); ok {
+					sum := counts[name]
+					if sum == nil {
+						sum = &expr.Counter{}
+						counts[name] = sum
+					}
+					sum.Packets += c.Packets
+					sum.Bytes += c.Bytes
+				}
+			}
+		}
+	}
+	return counts, nil
+}
+
+// chainRules collects the rules of one direction.
+type chainRules struct {
+	f       *Firewall
+	conn    *nftables.Conn
+	chain   *nftables.Chain
+	inbound bool
+	// counts of the replaced rules, each given to the first new rule of
+	// the same name
+	counts map[string]*expr.Counter
+}
+
+func (f *Firewall) build(conn *nftables.Conn, peers []filter.Peer, counts map[string]*expr.Counter) error {
+	if counts == nil {
+		counts = make(map[string]*expr.Counter)
+	}
+	policy := nftables.ChainPolicyAccept
+	input := &chainRules{f: f, conn: conn, counts: counts, inbound: true, chain: conn.AddChain(&nftables.Chain{
+		Name:     "input",
+		Table:    f.table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &policy,
+	})}
+	output := &chainRules{f: f, conn: conn, counts: counts, chain: conn.AddChain(&nftables.Chain{
+		Name:     "output",
+		Table:    f.table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &policy,
+	})}
+
+	// One set per peer and address family holding the peer's addresses
+	peerSets := make([][2]*nftables.Set, len(peers))
+	for i, p := range peers {
+		for fam, v6 := range []bool{false, true} {
+			var elems []nftables.SetElement
+			for _, addr := range p.Addrs {
+				if addr.Unmap().Is4() != v6 {
+					elems = append(elems, nftables.SetElement{Key: addr.Unmap().AsSlice()})
+				}
+			}
+			if len(elems) == 0 {
+				continue
+			}
+			set := &nftables.Set{Table: f.table, Name: fmt.Sprintf("peer%d_v%d", i, 4+2*fam), KeyType: nftables.TypeIPAddr}
+			if v6 {
+				set.KeyType = nftables.TypeIP6Addr
+			}
+			if err := conn.AddSet(set, elems); err != nil {
+				return fmt.Errorf("failed to add peer set: %w", err)
+			}
+			peerSets[i][fam] = set
+		}
+	}
+
+	for _, c := range []*chainRules{input, output} {
+		c.add("", established(), accept())
+
+		for _, r := range f.rules {
+			if r.Inbound != c.inbound {
+				continue
+			}
+			// Only drops are counted, as in the userspace filter
+			verdict, counter := accept(), ""
+			if r.Drop {
+				verdict, counter = drop(), r.Name
+			}
+			if len(r.Tags) == 0 {
+				c.addPorts(counter, nil, r.Ports, verdict)
+				continue
+			}
+			for i, p := range peers {
+				if !r.AppliesTo(p.Tags) {
+					continue
+				}
+				for _, set := range peerSets[i] {
+					if set != nil {
+						c.addPorts(counter, c.matchPeer(set), r.Ports, verdict)
+					}
+				}
+			}
+		}
+
+		for i, p := range peers {
+			if p.Access == nil {
+				continue
+			}
+			allowed, counter := p.Access.Outbound, filter.ACLOutbound
+			if c.inbound {
+				allowed, counter = p.Access.Inbound, filter.ACLInbound
+			}
+			for _, set := range peerSets[i] {
+				if set == nil {
+					continue
+				}
+				c.addPorts("", c.matchPeer(set), allowed, accept())
+				c.add(counter, c.matchPeer(set), drop())
+			}
+		}
+	}
+	return nil
+}
+
+// add appends a rule matching the interface and the given expressions. Rules
+// with a counter name count the packets they match.
+func (c *chainRules) add(counter string, match []expr.Any, verdict []expr.Any) {
+	key := expr.MetaKeyOIFNAME
+	if c.inbound {
+		key = expr.MetaKeyIIFNAME
+	}
+	exprs := []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(c.f.ifName)},
+	}
+	exprs = append(exprs, match...)
+
+	rule := &nftables.Rule{Table: c.f.table, Chain: c.chain}
+	if counter != "" {
+		count := &expr.Counter{}
+		if prev := c.counts[counter]; prev != nil {
+			count = prev
+			delete(c.counts, counter)
+		}
+		exprs = append(exprs, count)
+		rule.UserData = userdata.AppendString(nil, userdata.TypeComment, counter)
+	}
+	rule.Exprs = append(exprs, verdict...)
+	c.conn.AddRule(rule)
+}
+
+// addPorts adds one rule per protocol needed to match the port ranges.
+func (c *chainRules) addPorts(counter string, match []expr.Any, ports []acl.PortRange, verdict []expr.Any) {
+	for _, pr := range ports {
+		for _, m := range matchPortRange(pr) {
+			c.add(counter, append(slices.Clone(match), m...), verdict)
+		}
+	}
+}
+
+// matchPeer matches packets from (inbound) or to the addresses in set.
+func (c *chainRules) matchPeer(set *nftables.Set) []expr.Any {
+	nfproto, offset, length := byte(unix.NFPROTO_IPV4), uint32(16), uint32(4)
+	if set.KeyType == nftables.TypeIP6Addr {
+		nfproto, offset, length = unix.NFPROTO_IPV6, 24, 16
+	}
+	if c.inbound {
+		offset -= length // source address
+	}
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{nfproto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: length},
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+	}
+}
+
+// matchPortRange returns the alternative matches for a port range: one per
+// protocol it covers, or a single empty match for everything.
+func matchPortRange(pr acl.PortRange) [][]expr.Any {
+	all := pr.From == 0 && pr.To == 65535
+	switch {
+	case pr.Proto == "icmp":
+		return [][]expr.Any{l4proto(unix.IPPROTO_ICMP), l4proto(unix.IPPROTO_ICMPV6)}
+	case pr.Proto == "" && all:
+		return [][]expr.Any{nil}
+	case pr.Proto != "":
+		return [][]expr.Any{matchPort(pr.Proto, pr.From, pr.To)}
+	}
+	return [][]expr.Any{matchPort("tcp", pr.From, pr.To), matchPort("udp", pr.From, pr.To)}
+}
+
+func matchPort(proto string, from, to uint16) []expr.Any {
+	p := byte(unix.IPPROTO_TCP)
+	if proto == "udp" {
+		p = unix.IPPROTO_UDP
+	}
+	exprs := l4proto(p)
+	if from == 0 && to == 65535 {
+		return exprs
+	}
+	exprs = append(exprs, &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2})
+	if from == to {
+		return append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: port(from)})
+	}
+	return append(exprs, &expr.Range{Op: expr.CmpOpEq, Register: 1, FromData: port(from), ToData: port(to)})
+}
+
+func l4proto(p byte) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{p}},
+	}
+}
+
+// established matches replies to flows that have been accepted.
+func established() []expr.Any {
+	mask := make([]byte, 4)
+	binary.NativeEndian.PutUint32(mask, expr.CtStateBitESTABLISHED|expr.CtStateBitRELATED)
+	return []expr.Any{
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: mask, Xor: make([]byte, 4)},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: make([]byte, 4)},
+	}
+}
+
+func accept() []expr.Any { return []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}} }
+func drop() []expr.Any   { return []expr.Any{&expr.Verdict{Kind: expr.VerdictDrop}} }
+
+func port(p uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, p)
+}
+
+// ifname returns name as the kernel compares it: NUL padded to IFNAMSIZ.
+func ifname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
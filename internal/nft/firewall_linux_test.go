@@ -0,0 +1,201 @@
+package nft
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"github.com/pabotesu/kurohabaki-client/internal/acl"
+	"github.com/pabotesu/kurohabaki-client/internal/filter"
+	"golang.org/x/sys/unix"
+)
+
+// recorder captures the netlink batches a Firewall sends, and answers rule
+// listings with the rules of the last batch like the kernel would.
+type recorder struct {
+	batches [][]netlink.Message
+	// installed rules by chain
+	installed map[string][]netlink.Message
+}
+
+func (r *recorder) firewall(rules []filter.Rule) *Firewall {
+	f, _ := New("kh0", rules)
+	f.newConn = func() (*nftables.Conn, error) {
+		return nftables.New(nftables.WithTestDial(func(req []netlink.Message) ([]netlink.Message, error) {
+			// Receives for acknowledgements dial without messages
+			if len(req) == 0 {
+				return req, nil
+			}
+			if req[0].Header.Type == nftType(unix.NFT_MSG_GETRULE) {
+				return r.installed[ruleChain(req[0])], nil
+			}
+			r.batches = append(r.batches, req)
+			if count(req, unix.NFT_MSG_NEWRULE) > 0 {
+				r.install(req)
+			}
+			return req, nil
+		}))
+	}
+	return f
+}
+
+// install replaces the installed rules with the rules of batch.
+func (r *recorder) install(batch []netlink.Message) {
+	r.installed = make(map[string][]netlink.Message)
+	for _, m := range batch {
+		if m.Header.Type == nftType(unix.NFT_MSG_NEWRULE) {
+			chain := ruleChain(m)
+			r.installed[chain] = append(r.installed[chain], m)
+		}
+	}
+}
+
+// ruleChain returns the chain of a rule message.
+func ruleChain(m netlink.Message) string {
+	ad, err := netlink.NewAttributeDecoder(m.Data[4:])
+	if err != nil {
+		return ""
+	}
+	for ad.Next() {
+		if ad.Type() == unix.NFTA_RULE_CHAIN {
+			return ad.String()
+		}
+	}
+	return ""
+}
+
+func nftType(msgType int) netlink.HeaderType {
+	return netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | msgType)
+}
+
+// count returns how many messages of an nf_tables type the batch holds.
+func count(batch []netlink.Message, msgType int) int {
+	n := 0
+	for _, m := range batch {
+		if m.Header.Type == nftType(msgType) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestUpdate(t *testing.T) {
+	rules, err := filter.RulesFromConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &recorder{}
+	f := r.firewall(rules)
+
+	access := acl.Access{
+		Inbound:  []acl.PortRange{{Proto: "tcp", From: 22, To: 22}},
+		Outbound: []acl.PortRange{{From: 53, To: 53}, {Proto: "icmp"}},
+	}
+	peers := []filter.Peer{
+		{Addrs: []netip.Addr{netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("fd00::2")}, Access: &access},
+		{Addrs: []netip.Addr{netip.MustParseAddr("10.0.0.3")}},
+	}
+	if err := f.Update(peers); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	var batch []netlink.Message
+	for _, b := range r.batches {
+		if count(b, unix.NFT_MSG_NEWRULE) > 0 {
+			if batch != nil {
+				t.Fatal("Expected the update to be sent as a single batch")
+			}
+			batch = b
+		}
+	}
+	if got := count(batch, unix.NFT_MSG_DELTABLE); got != 1 {
+		t.Errorf("Expected the old table to be deleted in the same batch, got %d deletes", got)
+	}
+	if got := count(batch, unix.NFT_MSG_NEWSET); got != 3 {
+		t.Errorf("Expected 3 peer sets (v4+v6 for the first peer, v4 for the second), got %d", got)
+	}
+
+	// Per chain: the established rule, then for each set of the first peer
+	// its allows and a drop. Inbound: ssh; outbound: dns over tcp and udp,
+	// and icmp and icmpv6.
+	want := 2 + 2*(1+1) + 2*(4+1)
+	if got := count(batch, unix.NFT_MSG_NEWRULE); got != want {
+		t.Errorf("Expected %d rules, got %d", want, got)
+	}
+}
+
+func TestUpdateLocalRules(t *testing.T) {
+	rules := []filter.Rule{
+		{Name: "no-ssh", Drop: true, Inbound: true, Ports: []acl.PortRange{{Proto: "tcp", From: 22, To: 22}}},
+		{Name: "dev-only", Drop: true, Inbound: true, Tags: []string{"dev"}, Ports: []acl.PortRange{{From: 0, To: 65535}}},
+	}
+	r := &recorder{}
+	f := r.firewall(rules)
+
+	peers := []filter.Peer{
+		{Addrs: []netip.Addr{netip.MustParseAddr("10.0.0.2")}, Tags: []string{"dev"}},
+		{Addrs: []netip.Addr{netip.MustParseAddr("10.0.0.3")}, Tags: []string{"db"}},
+	}
+	if err := f.Update(peers); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	last := r.batches[len(r.batches)-1]
+	// Two established rules, no-ssh for all peers, dev-only for one peer
+	if got := count(last, unix.NFT_MSG_NEWRULE); got != 4 {
+		t.Errorf("Expected 4 rules, got %d", got)
+	}
+
+	if err := f.Remove(); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	last = r.batches[len(r.batches)-1]
+	if count(last, unix.NFT_MSG_DELTABLE) != 1 || count(last, unix.NFT_MSG_NEWRULE) != 0 {
+		t.Error("Expected Remove to only delete the table")
+	}
+}
+
+func TestUpdateKeepsCounters(t *testing.T) {
+	rules := []filter.Rule{
+		{Name: "no-ssh", Drop: true, Inbound: true, Ports: []acl.PortRange{{Proto: "tcp", From: 22, To: 22}}},
+	}
+	r := &recorder{}
+	f := r.firewall(rules)
+
+	access := acl.Access{Inbound: []acl.PortRange{{Proto: "tcp", From: 443, To: 443}}}
+	peers := []filter.Peer{
+		{Addrs: []netip.Addr{netip.MustParseAddr("10.0.0.2")}, Access: &access},
+	}
+	if err := f.Update(peers); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	// Stand in for rules that have dropped packets
+	conn, err := f.newConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed := &chainRules{f: f, conn: conn, inbound: true, chain: &nftables.Chain{Name: "input", Table: f.table}, counts: map[string]*expr.Counter{
+		"no-ssh":          {Packets: 3, Bytes: 180},
+		filter.ACLInbound: {Packets: 5, Bytes: 300},
+	}}
+	seed.add("no-ssh", nil, drop())
+	seed.add(filter.ACLInbound, nil, drop())
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second peer adds rules of the same names
+	peers = append(peers, filter.Peer{Addrs: []netip.Addr{netip.MustParseAddr("10.0.0.3")}, Access: &access})
+	if err := f.Update(peers); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	drops, err := f.Drops()
+	if err != nil {
+		t.Fatalf("Drops: %v", err)
+	}
+	if drops["no-ssh"] != 3 || drops[filter.ACLInbound] != 5 || drops[filter.ACLOutbound] != 0 {
+		t.Errorf("Expected the counters to be kept, got %v", drops)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package nft
+
+import "github.com/pabotesu/kurohabaki-client/internal/filter"
+
+// Firewall is not available on this platform.
+type Firewall struct{}
+
+// New returns ErrUnsupported.
+func New(ifName string, rules []filter.Rule) (*Firewall, error) {
+	return nil, ErrUnsupported
+}
+
+func (f *Firewall) Table() string                     { return "" }
+func (f *Firewall) Update(peers []filter.Peer) error  { return ErrUnsupported }
+func (f *Firewall) Remove() error                     { return ErrUnsupported }
+func (f *Firewall) Drops() (map[string]uint64, error) { return nil, ErrUnsupported }
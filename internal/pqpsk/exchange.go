@@ -0,0 +1,244 @@
+package pqpsk
+
+import (
+	"crypto/mlkem"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Message is published by one node for another through etcd. The initiator
+// of a pair sends offers carrying an ML-KEM ciphertext, the responder answers
+// with an acknowledgement of the epoch it has installed.
+type Message struct {
+	Epoch      int64  `json:"epoch,omitempty"`
+	EKID       string `json:"ek_id,omitempty"`
+	Ciphertext string `json:"ciphertext,omitempty"`
+	Ack        int64  `json:"ack,omitempty"`
+}
+
+// ParseMessage decodes a message read from etcd.
+func ParseMessage(data []byte) (Message, error) {
+	var m Message
+	if err := json.Unmarshal(data, &m); err != nil {
+		return Message{}, fmt.Errorf("invalid PQ PSK message: %w", err)
+	}
+	return m, nil
+}
+
+// Marshal encodes a message for etcd.
+func (m Message) Marshal() string {
+	data, _ := json.Marshal(m)
+	return string(data)
+}
+
+// PeerState describes the exchange with a single peer for status output.
+type PeerState struct {
+	Role         string    `json:"role"`
+	State        string    `json:"state"`
+	Epoch        int64     `json:"epoch,omitempty"`
+	Rotations    int       `json:"rotations"`
+	LastRotation time.Time `json:"last_rotation,omitempty"`
+}
+
+type pendingOffer struct {
+	epoch  int64
+	secret []byte
+	msg    Message
+}
+
+type peerState struct {
+	initiator   bool
+	ekID        string
+	pending     *pendingOffer
+	secret      []byte
+	epoch       int64
+	established time.Time
+	rotations   int
+}
+
+// Exchange runs the ML-KEM-768 key exchange with every peer that publishes
+// an encapsulation key. Of each pair, the node with the lexicographically
+// smaller public key encapsulates fresh secrets to the other one every
+// rotation interval; the resulting shared secrets are meant to be installed
+// as WireGuard preshared keys.
+//
+// The decapsulation key only lives in memory, so a restarted node publishes
+// a new encapsulation key and its peers start over with a fresh secret.
+type Exchange struct {
+	self     string
+	dk       *mlkem.DecapsulationKey768
+	ek       string
+	ekID     string
+	interval time.Duration
+	peers    map[string]*peerState
+}
+
+// New creates an exchange for the node with public key self.
+func New(self string, interval time.Duration) (*Exchange, error) {
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ML-KEM key: %w", err)
+	}
+	ek := base64.StdEncoding.EncodeToString(dk.EncapsulationKey().Bytes())
+	return &Exchange{
+		self:     self,
+		dk:       dk,
+		ek:       ek,
+		ekID:     keyID(ek),
+		interval: interval,
+		peers:    make(map[string]*peerState),
+	}, nil
+}
+
+// EncapsulationKey returns the base64 encapsulation key to publish.
+func (e *Exchange) EncapsulationKey() string {
+	return e.ek
+}
+
+// keyID identifies an encapsulation key so that offers made to a previous
+// key of a restarted node can be recognised and ignored.
+func keyID(ek string) string {
+	sum := sha256.Sum256([]byte(ek))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Step advances the exchange. peerKeys maps the public key of every current
+// peer to its published encapsulation key and inbound holds the latest
+// message each peer has published for this node. It returns the messages
+// this node should currently have published, keyed by recipient.
+func (e *Exchange) Step(now time.Time, peerKeys map[string]string, inbound map[string]Message) map[string]Message {
+	for pub := range e.peers {
+		if _, ok := peerKeys[pub]; !ok {
+			delete(e.peers, pub)
+		}
+	}
+
+	out := make(map[string]Message)
+	for pub, ek := range peerKeys {
+		st := e.peers[pub]
+		if st == nil {
+			st = &peerState{initiator: e.self < pub}
+			e.peers[pub] = st
+		}
+
+		var msg *Message
+		if st.initiator {
+			msg = e.stepInitiator(now, st, ek, inbound[pub])
+		} else {
+			msg = e.stepResponder(now, st, inbound[pub])
+		}
+		if msg != nil {
+			out[pub] = *msg
+		}
+	}
+	return out
+}
+
+func (e *Exchange) stepInitiator(now time.Time, st *peerState, ek string, in Message) *Message {
+	if st.pending != nil && in.Ack == st.pending.epoch {
+		st.secret = st.pending.secret
+		st.epoch = st.pending.epoch
+		st.established = now
+		st.rotations++
+		st.pending = nil
+	}
+
+	id := keyID(ek)
+	rotate := st.secret == nil || now.Sub(st.established) >= e.interval
+	if id != st.ekID || (st.pending == nil && rotate) {
+		if err := e.offer(now, st, ek); err != nil {
+			return nil
+		}
+		st.ekID = id
+	}
+
+	if st.pending != nil {
+		return &st.pending.msg
+	}
+	return nil
+}
+
+func (e *Exchange) offer(now time.Time, st *peerState, ek string) error {
+	raw, err := base64.StdEncoding.DecodeString(ek)
+	if err != nil {
+		return err
+	}
+	key, err := mlkem.NewEncapsulationKey768(raw)
+	if err != nil {
+		return err
+	}
+	secret, ct := key.Encapsulate()
+
+	epoch := now.UnixNano()
+	if epoch <= st.epoch {
+		epoch = st.epoch + 1
+	}
+	st.pending = &pendingOffer{
+		epoch:  epoch,
+		secret: secret,
+		msg: Message{
+			Epoch:      epoch,
+			EKID:       keyID(ek),
+			Ciphertext: base64.StdEncoding.EncodeToString(ct),
+		},
+	}
+	return nil
+}
+
+func (e *Exchange) stepResponder(now time.Time, st *peerState, in Message) *Message {
+	if in.Ciphertext != "" && in.EKID == e.ekID && in.Epoch != st.epoch {
+		ct, err := base64.StdEncoding.DecodeString(in.Ciphertext)
+		if err == nil {
+			if secret, err := e.dk.Decapsulate(ct); err == nil {
+				st.secret = secret
+				st.epoch = in.Epoch
+				st.established = now
+				st.rotations++
+			}
+		}
+	}
+
+	if st.epoch == 0 {
+		return nil
+	}
+	return &Message{Ack: st.epoch}
+}
+
+// Secret returns the shared secret currently installed for peer, or nil.
+func (e *Exchange) Secret(peer string) []byte {
+	if st := e.peers[peer]; st != nil {
+		return st.secret
+	}
+	return nil
+}
+
+// State returns the exchange state of every peer, keyed by public key.
+func (e *Exchange) State() map[string]PeerState {
+	states := make(map[string]PeerState, len(e.peers))
+	for pub, st := range e.peers {
+		ps := PeerState{
+			Role:         "responder",
+			State:        "waiting",
+			Epoch:        st.epoch,
+			Rotations:    st.rotations,
+			LastRotation: st.established,
+		}
+		if st.initiator {
+			ps.Role = "initiator"
+		}
+		switch {
+		case st.secret != nil && st.pending != nil:
+			ps.State = "rotating"
+		case st.secret != nil:
+			ps.State = "established"
+		case st.pending != nil:
+			ps.State = "pending"
+		}
+		states[pub] = ps
+	}
+	return states
+}
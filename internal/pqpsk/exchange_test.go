@@ -0,0 +1,96 @@
+package pqpsk
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// runRound lets a and b each take one step, feeding them the messages the
+// other side published in the previous round.
+func runRound(now time.Time, a, b *Exchange, aOut, bOut map[string]Message) (map[string]Message, map[string]Message) {
+	aIn := map[string]Message{}
+	if m, ok := bOut[a.self]; ok {
+		aIn[b.self] = m
+	}
+	bIn := map[string]Message{}
+	if m, ok := aOut[b.self]; ok {
+		bIn[a.self] = m
+	}
+	return a.Step(now, map[string]string{b.self: b.EncapsulationKey()}, aIn),
+		b.Step(now, map[string]string{a.self: a.EncapsulationKey()}, bIn)
+}
+
+func TestExchange(t *testing.T) {
+	// "a" sorts before "b", so a initiates
+	a, err := New("a", time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create exchange: %v", err)
+	}
+	b, err := New("b", time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create exchange: %v", err)
+	}
+
+	now := time.Now()
+	var aOut, bOut map[string]Message
+	for i := 0; i < 3; i++ {
+		aOut, bOut = runRound(now, a, b, aOut, bOut)
+	}
+
+	first := a.Secret("b")
+	if first == nil || !bytes.Equal(first, b.Secret("a")) {
+		t.Fatalf("Expected both sides to share a secret, got %x and %x", first, b.Secret("a"))
+	}
+	if st := a.State()["b"]; st.Role != "initiator" || st.State != "established" || st.Rotations != 1 {
+		t.Errorf("Unexpected initiator state: %+v", st)
+	}
+	if st := b.State()["a"]; st.Role != "responder" || st.State != "established" {
+		t.Errorf("Unexpected responder state: %+v", st)
+	}
+
+	t.Run("Rotation", func(t *testing.T) {
+		later := now.Add(2 * time.Minute)
+		aOut, bOut = runRound(later, a, b, aOut, bOut)
+		if st := a.State()["b"]; st.State != "rotating" {
+			t.Errorf("Expected initiator to be rotating, got %+v", st)
+		}
+		for i := 0; i < 2; i++ {
+			aOut, bOut = runRound(later, a, b, aOut, bOut)
+		}
+
+		second := a.Secret("b")
+		if bytes.Equal(first, second) {
+			t.Error("Expected a new secret after the rotation interval")
+		}
+		if !bytes.Equal(second, b.Secret("a")) {
+			t.Error("Expected both sides to share the rotated secret")
+		}
+	})
+
+	t.Run("ResponderRestart", func(t *testing.T) {
+		old := a.Secret("b")
+		b, err = New("b", time.Minute)
+		if err != nil {
+			t.Fatalf("Failed to create exchange: %v", err)
+		}
+		bOut = nil
+		for i := 0; i < 3; i++ {
+			aOut, bOut = runRound(now, a, b, aOut, bOut)
+		}
+
+		if bytes.Equal(old, a.Secret("b")) {
+			t.Error("Expected a new secret after the responder's key changed")
+		}
+		if !bytes.Equal(a.Secret("b"), b.Secret("a")) {
+			t.Error("Expected both sides to share a secret after the restart")
+		}
+	})
+
+	t.Run("PeerRemoved", func(t *testing.T) {
+		a.Step(now, map[string]string{}, nil)
+		if a.Secret("b") != nil {
+			t.Error("Expected state to be dropped for removed peers")
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+var errNoAddress = errors.New("no address")
+
+// ContextDialer is implemented by net.Dialer and the userspace network
+// stack.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Dialer connects to mesh destinations through the network stack and to
+// everything else directly from the host.
+type Dialer struct {
+	// Mesh dials addresses in Prefixes
+	Mesh     ContextDialer
+	Prefixes []netip.Prefix
+	// Direct dials other addresses; nil refuses them
+	Direct ContextDialer
+	// Lookup returns the addresses of a mesh name, or none if it isn't one
+	Lookup func(name string) []netip.Addr
+	// Resolver looks up other names; defaults to the host resolver
+	Resolver *net.Resolver
+}
+
+// DialContext resolves the host of address, preferring mesh names, and dials
+// its addresses in turn until one connects.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := d.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var firstErr error
+	for _, addr := range addrs {
+		target := net.JoinHostPort(addr.String(), port)
+		dialer := d.Direct
+		if d.isMesh(addr) {
+			dialer = d.Mesh
+		}
+		if dialer == nil {
+			err = fmt.Errorf("%s is not a mesh address", addr)
+		} else {
+			var conn net.Conn
+			if conn, err = dialer.DialContext(ctx, network, target); err == nil {
+				return conn, nil
+			}
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+func (d *Dialer) resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+	if d.Lookup != nil {
+		if addrs := d.Lookup(strings.TrimSuffix(strings.ToLower(host), ".")); len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	if d.Direct == nil {
+		return nil, fmt.Errorf("%s: %w", host, errNoAddress)
+	}
+
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	for i := range addrs {
+		addrs[i] = addrs[i].Unmap()
+	}
+	return addrs, nil
+}
+
+func (d *Dialer) isMesh(addr netip.Addr) bool {
+	for _, p := range d.Prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
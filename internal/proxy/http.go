@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// handleHTTP serves one HTTP proxy client: CONNECT tunnels, and plain
+// requests with an absolute URL, which are forwarded one per connection.
+func (s *Server) handleHTTP(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return
+	}
+
+	if req.Method == http.MethodConnect {
+		dst, err := s.dialTarget(req.Host)
+		if err != nil {
+			httpError(conn, http.StatusBadGateway, err)
+			return
+		}
+		defer dst.Close()
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		Relay(struct {
+			io.Reader
+			io.Writer
+		}{r, conn}, conn, dst)
+		return
+	}
+
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		httpError(conn, http.StatusBadRequest, fmt.Errorf("unsupported request target %q", req.RequestURI))
+		return
+	}
+	host := req.URL.Host
+	if req.URL.Port() == "" {
+		host = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	dst, err := s.dialTarget(host)
+	if err != nil {
+		httpError(conn, http.StatusBadGateway, err)
+		return
+	}
+	defer dst.Close()
+
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+	req.Close = true
+	if err := req.Write(dst); err != nil {
+		httpError(conn, http.StatusBadGateway, err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	io.Copy(conn, dst)
+}
+
+func httpError(w io.Writer, code int, err error) {
+	msg := err.Error() + "\n"
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		code, http.StatusText(code), len(msg), msg)
+}
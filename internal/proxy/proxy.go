@@ -0,0 +1,145 @@
+// Package proxy exposes the mesh to local applications through SOCKS5 and
+// HTTP CONNECT proxies, for when the interface runs on a userspace network
+// stack that the host cannot route to.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/internal/logger"
+)
+
+// handshakeTimeout bounds how long a client may take to send its request.
+const handshakeTimeout = 30 * time.Second
+
+// DialFunc opens a connection to address, a host:port whose host may be a
+// name.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Server accepts proxy clients on any number of listeners and connects them
+// with Dial.
+type Server struct {
+	dial DialFunc
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// New returns a server that dials destinations with dial.
+func New(dial DialFunc) *Server {
+	return &Server{dial: dial, conns: make(map[net.Conn]struct{})}
+}
+
+// ServeSOCKS5 accepts SOCKS5 clients on l in the background.
+func (s *Server) ServeSOCKS5(l net.Listener) {
+	s.serve(l, s.handleSOCKS5)
+}
+
+// ServeHTTP accepts HTTP proxy clients on l in the background.
+func (s *Server) ServeHTTP(l net.Listener) {
+	s.serve(l, s.handleHTTP)
+}
+
+func (s *Server) serve(l net.Listener, handle func(net.Conn)) {
+	s.mu.Lock()
+	s.listeners = append(s.listeners, l)
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					logger.Warnf("Proxy accept on %s failed: %v", l.Addr(), err)
+				}
+				return
+			}
+			if !s.track(conn) {
+				conn.Close()
+				return
+			}
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				defer s.untrack(conn)
+				handle(conn)
+			}()
+		}
+	}()
+}
+
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	conn.Close()
+}
+
+// Close stops accepting clients, closes open connections and waits for
+// their handlers to return.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+// dialTarget dials address on behalf of a client.
+func (s *Server) dialTarget(address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	return s.dial(ctx, "tcp", address)
+}
+
+// Relay copies between the client and the target until both directions are
+// done, half-closing each side once the other has nothing more to send.
+// client is read instead of clientConn, so that it may hold data buffered
+// while reading a request; pass clientConn if there is none.
+func Relay(client io.ReadWriter, clientConn, target net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(target, client)
+		closeWrite(target)
+		close(done)
+	}()
+	io.Copy(clientConn, target)
+	closeWrite(clientConn)
+	<-done
+}
+
+// closeWrite half-closes conn if it supports it, so that the other side
+// sees EOF while replies can still arrive.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+// meshDialer stands in for the network stack: it connects every mesh
+// address to a local listener and records the targets.
+type meshDialer struct {
+	listener string
+	targets  []string
+}
+
+func (m *meshDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	m.targets = append(m.targets, address)
+	var d net.Dialer
+	return d.DialContext(ctx, network, m.listener)
+}
+
+func echoServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// startProxy runs both proxies with a dialer that routes 10.0.0.0/24 to
+// mesh and resolves db.kh.internal.
+func startProxy(t *testing.T, mesh *meshDialer) (socks, httpAddr string) {
+	t.Helper()
+	d := &Dialer{
+		Mesh:     mesh,
+		Prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")},
+		Direct:   &net.Dialer{},
+		Lookup: func(name string) []netip.Addr {
+			if name == "db.kh.internal" || name == "db" {
+				return []netip.Addr{netip.MustParseAddr("10.0.0.2")}
+			}
+			return nil
+		},
+	}
+	s := New(d.DialContext)
+	t.Cleanup(func() { s.Close() })
+
+	for _, serve := range []func(net.Listener){s.ServeSOCKS5, s.ServeHTTP} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		serve(l)
+		if socks == "" {
+			socks = l.Addr().String()
+		} else {
+			httpAddr = l.Addr().String()
+		}
+	}
+	return socks, httpAddr
+}
+
+func roundTrip(t *testing.T, c net.Conn, msg string) {
+	t.Helper()
+	if _, err := io.WriteString(c, msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != msg {
+		t.Fatalf("Expected echo %q, got %q, %v", msg, buf, err)
+	}
+}
+
+func TestSOCKS5(t *testing.T) {
+	mesh := &meshDialer{listener: echoServer(t)}
+	socks, _ := startProxy(t, mesh)
+
+	client, err := xproxy.SOCKS5("tcp", socks, nil, xproxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := client.Dial("tcp", "db.kh.internal:5432")
+	if err != nil {
+		t.Fatalf("Dial via SOCKS5: %v", err)
+	}
+	defer c.Close()
+	roundTrip(t, c, "hello")
+
+	if len(mesh.targets) != 1 || mesh.targets[0] != "10.0.0.2:5432" {
+		t.Errorf("Expected the mesh name to be dialed through the mesh, got %v", mesh.targets)
+	}
+
+	// Non-mesh destinations are dialed directly
+	direct := echoServer(t)
+	c2, err := client.Dial("tcp", direct)
+	if err != nil {
+		t.Fatalf("Dial via SOCKS5: %v", err)
+	}
+	defer c2.Close()
+	roundTrip(t, c2, "direct")
+	if len(mesh.targets) != 1 {
+		t.Errorf("Expected a direct dial, got mesh targets %v", mesh.targets)
+	}
+}
+
+func TestSOCKS5Refused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+	socks, _ := startProxy(t, &meshDialer{listener: closed})
+
+	c, err := net.Dial("tcp", socks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// No auth, then CONNECT 10.0.0.9:80
+	c.Write([]byte{5, 1, 0, 5, 1, 0, 1, 10, 0, 0, 9, 0, 80})
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socksNoAuth || reply[3] != socksConnectionRefused {
+		t.Errorf("Expected connection refused, got %v", reply)
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	mesh := &meshDialer{listener: echoServer(t)}
+	_, httpAddr := startProxy(t, mesh)
+
+	c, err := net.Dial("tcp", httpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Data sent right behind the request must not be lost
+	fmt.Fprintf(c, "CONNECT db:22 HTTP/1.1\r\nHost: db:22\r\n\r\nearly")
+	r := bufio.NewReader(c)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %v, %v", resp, err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "early" {
+		t.Fatalf("Expected early data echoed, got %q, %v", buf, err)
+	}
+	if mesh.targets[0] != "10.0.0.2:22" {
+		t.Errorf("Unexpected mesh target %v", mesh.targets)
+	}
+
+	// Names that are neither mesh names nor resolvable fail with 502
+	c2, err := net.Dial("tcp", httpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	fmt.Fprintf(c2, "CONNECT nowhere.invalid:22 HTTP/1.1\r\nHost: nowhere.invalid:22\r\n\r\n")
+	resp, err = http.ReadResponse(bufio.NewReader(c2), nil)
+	if err != nil || resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected 502, got %v, %v", resp, err)
+	}
+}
+
+func TestHTTPForward(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Host, r.URL.Path)
+	}))
+	defer web.Close()
+	mesh := &meshDialer{listener: strings.TrimPrefix(web.URL, "http://")}
+	_, httpAddr := startProxy(t, mesh)
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: httpAddr}),
+	}}
+	resp, err := client.Get("http://db.kh.internal/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "db.kh.internal /metrics" {
+		t.Errorf("Unexpected response %q", body)
+	}
+	if mesh.targets[0] != "10.0.0.2:80" {
+		t.Errorf("Unexpected mesh target %v", mesh.targets)
+	}
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// SOCKS5 protocol values (RFC 1928)
+const (
+	socksVersion = 5
+
+	socksNoAuth       = 0x00
+	socksNoAcceptable = 0xff
+
+	socksConnect = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksSucceeded           = 0x00
+	socksGeneralFailure      = 0x01
+	socksNetworkUnreachable  = 0x03
+	socksHostUnreachable     = 0x04
+	socksConnectionRefused   = 0x05
+	socksCommandNotSupported = 0x07
+	socksAddrNotSupported    = 0x08
+)
+
+// handleSOCKS5 serves one SOCKS5 client. Only the CONNECT command without
+// authentication is supported; the listener is meant to be local.
+func (s *Server) handleSOCKS5(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	r := bufio.NewReader(conn)
+
+	target, code, err := socksRequest(r, conn)
+	if err != nil {
+		if code != 0 {
+			socksReply(conn, code, nil)
+		}
+		return
+	}
+
+	dst, err := s.dialTarget(target)
+	if err != nil {
+		socksReply(conn, socksErrorCode(err), nil)
+		return
+	}
+	defer dst.Close()
+
+	if err := socksReply(conn, socksSucceeded, dst.LocalAddr()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	Relay(struct {
+		io.Reader
+		io.Writer
+	}{r, conn}, conn, dst)
+}
+
+// socksRequest negotiates the method and reads the request. On failure it
+// returns the reply code to send, or 0 if no reply is due.
+func socksRequest(r *bufio.Reader, w io.Writer) (string, byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", 0, err
+	}
+	if hdr[0] != socksVersion {
+		return "", 0, fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", 0, err
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := w.Write([]byte{socksVersion, method}); err != nil {
+		return "", 0, err
+	}
+	if method == socksNoAcceptable {
+		return "", 0, errors.New("client does not support unauthenticated SOCKS")
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(r, req[:]); err != nil {
+		return "", 0, err
+	}
+	if req[0] != socksVersion {
+		return "", 0, fmt.Errorf("unsupported SOCKS version %d", req[0])
+	}
+
+	var host string
+	switch req[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		b := make([]byte, 4)
+		if req[3] == socksAddrIPv6 {
+			b = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", 0, err
+		}
+		addr, _ := netip.AddrFromSlice(b)
+		host = addr.String()
+	case socksAddrDomain:
+		n, err := r.ReadByte()
+		if err != nil {
+			return "", 0, err
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", 0, err
+		}
+		host = string(b)
+	default:
+		return "", socksAddrNotSupported, fmt.Errorf("unsupported address type %d", req[3])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", 0, err
+	}
+	if req[1] != socksConnect {
+		return "", socksCommandNotSupported, fmt.Errorf("unsupported command %d", req[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), 0, nil
+}
+
+// socksReply sends a reply with the bound address, if any.
+func socksReply(w io.Writer, code byte, bound net.Addr) error {
+	addr := netip.IPv4Unspecified()
+	var port uint16
+	if ap, err := netip.ParseAddrPort(fmt.Sprint(bound)); err == nil {
+		addr, port = ap.Addr().Unmap(), ap.Port()
+	}
+
+	b := []byte{socksVersion, code, 0, socksAddrIPv4}
+	if addr.Is6() {
+		b[3] = socksAddrIPv6
+	}
+	b = append(b, addr.AsSlice()...)
+	b = binary.BigEndian.AppendUint16(b, port)
+	_, err := w.Write(b)
+	return err
+}
+
+// socksErrorCode maps a dial error to a reply code.
+func socksErrorCode(err error) byte {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, errNoAddress):
+		return socksHostUnreachable
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return socksHostUnreachable
+	}
+	return socksGeneralFailure
+}
@@ -0,0 +1,145 @@
+package resolver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// maxNameservers is the number of nameserver lines the libc resolver reads.
+const maxNameservers = 3
+
+const resolvConfHeader = "# Generated by kurohabaki while the mesh is up; the original is restored on down.\n"
+
+// backupFile records the current resolv.conf, which may be a symlink, e.g.
+// to a resolver stub file.
+func backupFile(path string) (state, error) {
+	st := state{Mode: ModeFile, Path: path, Perm: 0644}
+
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return st, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if st.Symlink, err = os.Readlink(path); err != nil {
+			return st, fmt.Errorf("failed to read link %s: %w", path, err)
+		}
+	} else {
+		st.Perm = info.Mode().Perm()
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return st, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	st.Content = string(data)
+	return st, nil
+}
+
+// restoreFile puts back the resolv.conf recorded by backupFile.
+func restoreFile(st state) error {
+	if st.Symlink != "" {
+		tmp := st.Path + ".kh-tmp"
+		os.Remove(tmp)
+		if err := os.Symlink(st.Symlink, tmp); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, st.Path); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return nil
+	}
+	if st.Content == "" {
+		err := os.Remove(st.Path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return writeResolvConf(st.Path, st.Perm, st.Content)
+}
+
+// renderResolvConf puts the configured servers first and search domains in
+// front of the original ones. resolv.conf cannot route by domain, so the
+// original nameservers are kept as fallbacks and its options are preserved.
+func renderResolvConf(cfg Config, original string) string {
+	var sb strings.Builder
+	sb.WriteString(resolvConfHeader)
+
+	var nameservers, search, rest []string
+	for _, addr := range cfg.Servers {
+		nameservers = append(nameservers, addr.String())
+	}
+	search = append(search, cfg.Domains...)
+
+	scanner := bufio.NewScanner(strings.NewReader(original))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		fields := strings.Fields(line)
+		if len(fields) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if len(fields) > 1 && !slices.Contains(nameservers, fields[1]) {
+				nameservers = append(nameservers, fields[1])
+			}
+		case "search", "domain":
+			for _, d := range fields[1:] {
+				if !slices.Contains(search, d) {
+					search = append(search, d)
+				}
+			}
+		default:
+			rest = append(rest, line)
+		}
+	}
+
+	if len(nameservers) > maxNameservers {
+		nameservers = nameservers[:maxNameservers]
+	}
+	for _, ns := range nameservers {
+		fmt.Fprintf(&sb, "nameserver %s\n", ns)
+	}
+	if len(search) > 0 {
+		fmt.Fprintf(&sb, "search %s\n", strings.Join(search, " "))
+	}
+	for _, line := range rest {
+		sb.WriteString(line + "\n")
+	}
+	return sb.String()
+}
+
+// writeResolvConf replaces path atomically. A symlink at path is replaced
+// rather than followed.
+func writeResolvConf(path string, perm os.FileMode, content string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".resolv.conf.kh-*")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package resolver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	resolvedDest    = "org.freedesktop.resolve1"
+	resolvedPath    = "/org/freedesktop/resolve1"
+	resolvedManager = "org.freedesktop.resolve1.Manager"
+
+	// resolvedStub is the listener systemd-resolved points resolv.conf at
+	resolvedStub = "127.0.0.53"
+)
+
+// linkAddress and linkDomain match the D-Bus signatures (iay) and (sb).
+type linkAddress struct {
+	Family  int32
+	Address []byte
+}
+
+type linkDomain struct {
+	Domain      string
+	RoutingOnly bool
+}
+
+// resolvedActive reports whether systemd-resolved manages the host resolver.
+func resolvedActive(resolvConf string) bool {
+	if _, err := os.Stat("/run/systemd/resolve"); err != nil {
+		return false
+	}
+	f, err := os.Open(resolvConf)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[0] == "nameserver" && fields[1] == resolvedStub {
+			return true
+		}
+	}
+	return false
+}
+
+// setLinkDNS sets per-link DNS servers and domains on the interface. With
+// split domains only those are routed to the link; otherwise the link
+// takes all queries.
+func setLinkDNS(ifName string, cfg Config) error {
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %w", ifName, err)
+	}
+	index := int32(iface.Index)
+
+	addrs := make([]linkAddress, 0, len(cfg.Servers))
+	for _, s := range cfg.Servers {
+		family := int32(2) // AF_INET
+		if s.Is6() && !s.Is4In6() {
+			family = 10 // AF_INET6
+		}
+		addrs = append(addrs, linkAddress{Family: family, Address: s.Unmap().AsSlice()})
+	}
+
+	domains := []linkDomain{{Domain: ".", RoutingOnly: true}}
+	if len(cfg.Domains) > 0 {
+		domains = domains[:0]
+		for _, d := range cfg.Domains {
+			domains = append(domains, linkDomain{Domain: strings.TrimSuffix(d, "."), RoutingOnly: true})
+		}
+	}
+
+	return withResolved(func(obj dbus.BusObject) error {
+		if err := obj.Call(resolvedManager+".SetLinkDNS", 0, index, addrs).Err; err != nil {
+			return fmt.Errorf("SetLinkDNS: %w", err)
+		}
+		if err := obj.Call(resolvedManager+".SetLinkDomains", 0, index, domains).Err; err != nil {
+			return fmt.Errorf("SetLinkDomains: %w", err)
+		}
+		// Not supported before systemd 240, where routing-only domains
+		// already keep the link out of the default route
+		obj.Call(resolvedManager+".SetLinkDefaultRoute", 0, index, len(cfg.Domains) == 0)
+		return nil
+	})
+}
+
+// revertLink drops everything set on the interface. A link that no longer
+// exists has nothing left to revert.
+func revertLink(ifName string) error {
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return nil
+	}
+	return withResolved(func(obj dbus.BusObject) error {
+		if err := obj.Call(resolvedManager+".RevertLink", 0, int32(iface.Index)).Err; err != nil {
+			var dbusErr dbus.Error
+			if errors.As(err, &dbusErr) && dbusErr.Name == "org.freedesktop.resolve1.NoSuchLink" {
+				return nil
+			}
+			return fmt.Errorf("RevertLink: %w", err)
+		}
+		return nil
+	})
+}
+
+func withResolved(fn func(obj dbus.BusObject) error) error {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return fmt.Errorf("failed to connect to system bus: %w", err)
+	}
+	defer conn.Close()
+	return fn(conn.Object(resolvedDest, dbus.ObjectPath(resolvedPath)))
+}
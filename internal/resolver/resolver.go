@@ -0,0 +1,205 @@
+// Package resolver points the host resolver at the mesh DNS servers while
+// the agent is up and puts the original configuration back afterwards.
+package resolver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Modes select how the host resolver is configured.
+const (
+	ModeAuto     = "auto"
+	ModeResolved = "resolved"
+	ModeFile     = "file"
+	ModeOff      = "off"
+)
+
+// DefaultResolvConf is the file managed in file mode.
+const DefaultResolvConf = "/etc/resolv.conf"
+
+// Config is the resolver configuration applied while the agent is up.
+type Config struct {
+	Servers []netip.Addr
+	// Domains, if set, are the only names sent to Servers (split DNS).
+	// Otherwise Servers become the default for all queries.
+	Domains []string
+}
+
+// state records what was changed so that it can be undone, even by a later
+// process after a crash.
+type state struct {
+	Mode      string `json:"mode"`
+	Interface string `json:"interface,omitempty"`
+
+	// File mode: the original resolv.conf
+	Path    string      `json:"path,omitempty"`
+	Symlink string      `json:"symlink,omitempty"`
+	Content string      `json:"content,omitempty"`
+	Perm    os.FileMode `json:"perm,omitempty"`
+}
+
+// Manager applies a Config and restores the original configuration.
+type Manager struct {
+	mode       string
+	ifName     string
+	statePath  string
+	resolvConf string
+	applied    bool
+}
+
+// New returns a Manager for the given mode and interface. The state file
+// keeps what is needed to restore the original configuration.
+func New(mode, ifName, statePath string) (*Manager, error) {
+	switch mode {
+	case "":
+		mode = ModeAuto
+	case ModeAuto, ModeResolved, ModeFile, ModeOff:
+	default:
+		return nil, fmt.Errorf("unknown DNS mode %q", mode)
+	}
+	return &Manager{
+		mode:       mode,
+		ifName:     ifName,
+		statePath:  statePath,
+		resolvConf: DefaultResolvConf,
+	}, nil
+}
+
+// Apply configures the host resolver. In auto mode systemd-resolved is used
+// when it manages the host, falling back to resolv.conf otherwise.
+func (m *Manager) Apply(cfg Config) (string, error) {
+	if m.mode == ModeOff || len(cfg.Servers) == 0 {
+		return ModeOff, nil
+	}
+	if _, err := os.Stat(m.statePath); err == nil {
+		return "", fmt.Errorf("resolver state %s exists, restore it first", m.statePath)
+	}
+
+	mode := m.mode
+	if mode == ModeAuto {
+		mode = ModeFile
+		if resolvedActive(m.resolvConf) {
+			mode = ModeResolved
+		}
+	}
+
+	if mode == ModeResolved {
+		err := m.applyResolved(cfg)
+		if err == nil || m.mode == ModeResolved {
+			return mode, err
+		}
+		// systemd-resolved looked active but is not reachable
+		mode = ModeFile
+	}
+	return mode, m.applyFile(cfg)
+}
+
+func (m *Manager) applyResolved(cfg Config) error {
+	// Written first: a crash in between leaves at most a link revert to do
+	if err := writeState(m.statePath, state{Mode: ModeResolved, Interface: m.ifName}); err != nil {
+		return err
+	}
+	if err := setLinkDNS(m.ifName, cfg); err != nil {
+		os.Remove(m.statePath)
+		return err
+	}
+	m.applied = true
+	return nil
+}
+
+func (m *Manager) applyFile(cfg Config) error {
+	st, err := backupFile(m.resolvConf)
+	if err != nil {
+		return err
+	}
+	if err := writeState(m.statePath, st); err != nil {
+		return err
+	}
+	if err := writeResolvConf(m.resolvConf, st.Perm, renderResolvConf(cfg, st.Content)); err != nil {
+		restoreFile(st)
+		os.Remove(m.statePath)
+		return err
+	}
+	m.applied = true
+	return nil
+}
+
+// Restore undoes Apply. It does nothing if Apply made no changes.
+func (m *Manager) Restore() error {
+	if !m.applied {
+		return nil
+	}
+	m.applied = false
+	_, err := Recover(m.statePath)
+	return err
+}
+
+// Recover restores the configuration recorded in the state file, for example
+// one left behind by an agent that crashed. It reports whether there was
+// anything to restore.
+func Recover(statePath string) (bool, error) {
+	data, err := os.ReadFile(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read resolver state: %w", err)
+	}
+
+	var st state
+	if err := json.Unmarshal(data, &st); err != nil {
+		return false, fmt.Errorf("failed to parse resolver state: %w", err)
+	}
+
+	switch st.Mode {
+	case ModeResolved:
+		err = revertLink(st.Interface)
+	case ModeFile:
+		err = restoreFile(st)
+	default:
+		err = fmt.Errorf("unknown mode %q", st.Mode)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to restore resolver configuration: %w", err)
+	}
+	if err := os.Remove(statePath); err != nil {
+		return true, fmt.Errorf("failed to remove resolver state: %w", err)
+	}
+	return true, nil
+}
+
+// ParseServers parses a list of DNS server addresses separated by commas or
+// spaces, as in interface.dns.
+func ParseServers(s string) ([]netip.Addr, error) {
+	var servers []netip.Addr
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNS server %q: %w", field, err)
+		}
+		servers = append(servers, addr)
+	}
+	return servers, nil
+}
+
+func writeState(path string, st state) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create resolver state directory: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write resolver state: %w", err)
+	}
+	return nil
+}
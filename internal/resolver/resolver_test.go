@@ -0,0 +1,147 @@
+package resolver
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const originalResolvConf = `# managed by the network
+nameserver 192.0.2.53
+nameserver 192.0.2.54
+search example.com
+options edns0
+`
+
+func newFileManager(t *testing.T, resolvConf string) *Manager {
+	t.Helper()
+	m, err := New(ModeFile, "kh0", filepath.Join(t.TempDir(), "state", "resolv.json"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	m.resolvConf = resolvConf
+	return m
+}
+
+func TestFileApplyRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(path, []byte(originalResolvConf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := newFileManager(t, path)
+
+	cfg := Config{
+		Servers: []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+		Domains: []string{"kh.internal"},
+	}
+	mode, err := m.Apply(cfg)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if mode != ModeFile {
+		t.Errorf("mode = %q, want %q", mode, ModeFile)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(data)
+	for _, want := range []string{
+		"nameserver 10.0.0.1\nnameserver 192.0.2.53\nnameserver 192.0.2.54\n",
+		"search kh.internal example.com\n",
+		"options edns0\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("resolv.conf missing %q:\n%s", want, got)
+		}
+	}
+
+	// A second agent must not overwrite the backup
+	if _, err := m.Apply(cfg); err == nil {
+		t.Error("Apply succeeded with existing state")
+	}
+
+	if err := m.Restore(); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	data, _ = os.ReadFile(path)
+	if string(data) != originalResolvConf {
+		t.Errorf("restored resolv.conf = %q, want %q", data, originalResolvConf)
+	}
+	if _, err := os.Stat(m.statePath); !os.IsNotExist(err) {
+		t.Errorf("state file left behind: %v", err)
+	}
+}
+
+func TestRecoverSymlink(t *testing.T) {
+	dir := t.TempDir()
+	stub := filepath.Join(dir, "stub-resolv.conf")
+	if err := os.WriteFile(stub, []byte("nameserver 127.0.0.53\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "resolv.conf")
+	if err := os.Symlink(stub, path); err != nil {
+		t.Fatal(err)
+	}
+	m := newFileManager(t, path)
+
+	if _, err := m.Apply(Config{Servers: []netip.Addr{netip.MustParseAddr("fd00::1")}}); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	// The symlink is replaced, not written through
+	if data, _ := os.ReadFile(stub); string(data) != "nameserver 127.0.0.53\n" {
+		t.Errorf("stub modified: %q", data)
+	}
+
+	// Simulate a crash: a new process recovers from the state file alone
+	restored, err := Recover(m.statePath)
+	if err != nil || !restored {
+		t.Fatalf("Recover = %v, %v", restored, err)
+	}
+	target, err := os.Readlink(path)
+	if err != nil || target != stub {
+		t.Errorf("resolv.conf link = %q, %v; want %q", target, err, stub)
+	}
+
+	if restored, err := Recover(m.statePath); err != nil || restored {
+		t.Errorf("second Recover = %v, %v", restored, err)
+	}
+}
+
+func TestApplyWithoutServers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	m := newFileManager(t, path)
+	mode, err := m.Apply(Config{})
+	if err != nil || mode != ModeOff {
+		t.Fatalf("Apply = %q, %v", mode, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("resolv.conf created: %v", err)
+	}
+	if err := m.Restore(); err != nil {
+		t.Errorf("Restore: %v", err)
+	}
+}
+
+func TestParseServers(t *testing.T) {
+	got, err := ParseServers("10.0.0.1, fd00::1 10.0.0.2")
+	if err != nil {
+		t.Fatalf("ParseServers: %v", err)
+	}
+	want := []string{"10.0.0.1", "fd00::1", "10.0.0.2"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].String() != want[i] {
+			t.Errorf("server %d = %s, want %s", i, got[i], want[i])
+		}
+	}
+
+	if _, err := ParseServers("10.0.0.1,bogus"); err == nil {
+		t.Error("ParseServers accepted an invalid address")
+	}
+}
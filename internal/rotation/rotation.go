@@ -0,0 +1,129 @@
+package rotation
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/internal/wg"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Record links a node's old public key to its new one. It is published by
+// the rotate-key command and signed with both keys, so peers know the new key
+// belongs to the same node and the node actually holds it.
+//
+// Until SwitchAt peers accept both keys; after it the node uses the new key
+// and its old record is retired.
+type Record struct {
+	OldPublicKey string    `json:"old_public_key"`
+	NewPublicKey string    `json:"new_public_key"`
+	SwitchAt     time.Time `json:"switch_at"`
+	OldSignature []byte    `json:"old_signature"`
+	NewSignature []byte    `json:"new_signature"`
+}
+
+// New creates a record for the rotation from oldKey to newKey.
+func New(oldKey, newKey wgtypes.Key, switchAt time.Time) (*Record, error) {
+	r := &Record{
+		OldPublicKey: oldKey.PublicKey().String(),
+		NewPublicKey: newKey.PublicKey().String(),
+		SwitchAt:     switchAt.UTC().Truncate(time.Second),
+	}
+
+	var err error
+	if r.OldSignature, err = wg.Sign(oldKey, r.message()); err != nil {
+		return nil, fmt.Errorf("failed to sign with old key: %w", err)
+	}
+	if r.NewSignature, err = wg.Sign(newKey, r.message()); err != nil {
+		return nil, fmt.Errorf("failed to sign with new key: %w", err)
+	}
+	return r, nil
+}
+
+// Parse decodes a record read from etcd and verifies its signatures.
+func Parse(data []byte) (*Record, error) {
+	var r Record
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("invalid rotation record: %w", err)
+	}
+	if err := r.Verify(); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Marshal encodes the record for etcd.
+func (r *Record) Marshal() string {
+	data, _ := json.Marshal(r)
+	return string(data)
+}
+
+// Verify checks that both keys signed the record.
+func (r *Record) Verify() error {
+	oldPub, err := wgtypes.ParseKey(r.OldPublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid old public key: %w", err)
+	}
+	newPub, err := wgtypes.ParseKey(r.NewPublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid new public key: %w", err)
+	}
+	if !wg.Verify(oldPub, r.message(), r.OldSignature) {
+		return fmt.Errorf("rotation record for %s has an invalid old key signature", r.OldPublicKey)
+	}
+	if !wg.Verify(newPub, r.message(), r.NewSignature) {
+		return fmt.Errorf("rotation record for %s has an invalid new key signature", r.OldPublicKey)
+	}
+	return nil
+}
+
+func (r *Record) message() []byte {
+	return []byte("kurohabaki key rotation v1\n" +
+		r.OldPublicKey + "\n" +
+		r.NewPublicKey + "\n" +
+		r.SwitchAt.UTC().Format(time.RFC3339) + "\n")
+}
+
+// Apply adjusts peers for nodes that are rotating their key. While both the
+// old and new key of a node are present, the new key is installed without
+// allowed IPs so that it can complete a handshake but doesn't take over the
+// node's traffic. Once the switch time has passed, or the new key has
+// completed a more recent handshake than the old one, the old key is dropped
+// and the new key takes over.
+func Apply(peers []wg.WGPeerConfig, records map[string]*Record, handshakes map[device.NoisePublicKey]time.Time, now time.Time) []wg.WGPeerConfig {
+	index := make(map[string]int, len(peers))
+	for i, p := range peers {
+		index[base64.StdEncoding.EncodeToString(p.PublicKey[:])] = i
+	}
+
+	drop := make(map[int]bool)
+	for _, r := range records {
+		oldIdx, okOld := index[r.OldPublicKey]
+		newIdx, okNew := index[r.NewPublicKey]
+		if !okOld || !okNew {
+			continue
+		}
+
+		oldShake := handshakes[peers[oldIdx].PublicKey]
+		newShake := handshakes[peers[newIdx].PublicKey]
+		if !now.Before(r.SwitchAt) || (!newShake.IsZero() && newShake.After(oldShake)) {
+			drop[oldIdx] = true
+		} else {
+			peers[newIdx].AllowedIPs = nil
+		}
+	}
+
+	if len(drop) == 0 {
+		return peers
+	}
+	kept := make([]wg.WGPeerConfig, 0, len(peers)-len(drop))
+	for i, p := range peers {
+		if !drop[i] {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
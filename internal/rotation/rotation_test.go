@@ -0,0 +1,93 @@
+package rotation
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/internal/wg"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestRecord(t *testing.T) {
+	oldKey, _ := wgtypes.GeneratePrivateKey()
+	newKey, _ := wgtypes.GeneratePrivateKey()
+
+	r, err := New(oldKey, newKey, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+
+	parsed, err := Parse([]byte(r.Marshal()))
+	if err != nil {
+		t.Fatalf("Expected record to verify, got %v", err)
+	}
+	if parsed.NewPublicKey != newKey.PublicKey().String() {
+		t.Errorf("Expected new key %s, got %s", newKey.PublicKey(), parsed.NewPublicKey)
+	}
+
+	t.Run("ForgedNewKey", func(t *testing.T) {
+		attacker, _ := wgtypes.GeneratePrivateKey()
+		forged := *r
+		forged.NewPublicKey = attacker.PublicKey().String()
+		if _, err := Parse([]byte(forged.Marshal())); err == nil {
+			t.Error("Expected record with a substituted new key to be rejected")
+		}
+	})
+
+	t.Run("ExtendedSwitchTime", func(t *testing.T) {
+		forged := *r
+		forged.SwitchAt = r.SwitchAt.Add(time.Hour)
+		if _, err := Parse([]byte(forged.Marshal())); err == nil {
+			t.Error("Expected record with a modified switch time to be rejected")
+		}
+	})
+}
+
+func TestApply(t *testing.T) {
+	oldKey, _ := wgtypes.GeneratePrivateKey()
+	newKey, _ := wgtypes.GeneratePrivateKey()
+	now := time.Now()
+	r, err := New(oldKey, newKey, now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+	records := map[string]*Record{r.OldPublicKey: r}
+
+	_, ipnet, _ := net.ParseCIDR("10.0.0.5/32")
+	peers := func() []wg.WGPeerConfig {
+		return []wg.WGPeerConfig{
+			{PublicKey: device.NoisePublicKey(oldKey.PublicKey()), AllowedIPs: []net.IPNet{*ipnet}},
+			{PublicKey: device.NoisePublicKey(newKey.PublicKey()), AllowedIPs: []net.IPNet{*ipnet}},
+		}
+	}
+
+	t.Run("Overlap", func(t *testing.T) {
+		got := Apply(peers(), records, nil, now)
+		if len(got) != 2 {
+			t.Fatalf("Expected both keys during the overlap, got %d peers", len(got))
+		}
+		if len(got[0].AllowedIPs) != 1 || len(got[1].AllowedIPs) != 0 {
+			t.Error("Expected the old key to keep the allowed IPs during the overlap")
+		}
+	})
+
+	t.Run("NewKeyHandshake", func(t *testing.T) {
+		handshakes := map[device.NoisePublicKey]time.Time{
+			device.NoisePublicKey(oldKey.PublicKey()): now.Add(-time.Minute),
+			device.NoisePublicKey(newKey.PublicKey()): now,
+		}
+		got := Apply(peers(), records, handshakes, now)
+		if len(got) != 1 || got[0].PublicKey != device.NoisePublicKey(newKey.PublicKey()) || len(got[0].AllowedIPs) != 1 {
+			t.Errorf("Expected the new key to take over after its handshake, got %+v", got)
+		}
+	})
+
+	t.Run("AfterSwitch", func(t *testing.T) {
+		got := Apply(peers(), records, nil, now.Add(2*time.Minute))
+		if len(got) != 1 || got[0].PublicKey != device.NoisePublicKey(newKey.PublicKey()) {
+			t.Errorf("Expected only the new key after the switch time, got %+v", got)
+		}
+	})
+}
@@ -0,0 +1,47 @@
+// Package sandbox confines the agent once the interface is set up. It keeps
+// only the capabilities needed to manage the mesh and denies system calls
+// the agent never makes, so that a bug, e.g. in parsing etcd records,
+// cannot become a root compromise.
+//
+// The agent stays root: the hosts file, resolver configuration and state
+// files it restores on shutdown are owned by root, and systemd-resolved
+// only accepts link DNS changes from privileged callers.
+package sandbox
+
+import "errors"
+
+// ErrUnsupported is returned by Apply on systems without capabilities or
+// seccomp.
+var ErrUnsupported = errors.New("sandboxing is only supported on Linux")
+
+// Capabilities kept by Apply: managing the interface, routes and firewall,
+// and binding the mesh DNS and forwards to privileged ports.
+const (
+	capNetBindService = 10
+	capNetAdmin       = 12
+)
+
+// deniedSyscalls fail with EPERM once the filter is loaded. Names unknown
+// on the running architecture are skipped.
+var deniedSyscalls = []string{
+	// Running other programs
+	"execve", "execveat",
+	// Inspecting or changing other processes
+	"ptrace", "process_vm_readv", "process_vm_writev",
+	// Changing credentials
+	"setuid", "setgid", "setreuid", "setregid", "setresuid", "setresgid",
+	"setgroups", "setfsuid", "setfsgid", "capset",
+	// Kernel modules, kexec and power
+	"init_module", "finit_module", "delete_module",
+	"kexec_load", "kexec_file_load", "reboot",
+	// Mounts and namespaces
+	"mount", "umount2", "pivot_root", "chroot", "unshare", "setns",
+	"fsopen", "fsconfig", "fsmount", "move_mount", "open_tree",
+	"open_by_handle_at", "name_to_handle_at",
+	// Other host-wide state
+	"swapon", "swapoff", "acct", "quotactl", "syslog", "vhangup",
+	"settimeofday", "clock_settime", "clock_adjtime", "adjtimex",
+	"iopl", "ioperm", "personality", "uselib", "lookup_dcookie",
+	// Interfaces often used in kernel exploits
+	"bpf", "perf_event_open", "userfaultfd", "keyctl", "add_key", "request_key",
+}
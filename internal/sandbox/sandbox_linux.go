@@ -0,0 +1,115 @@
+//go:build linux
+
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	seccomp "github.com/elastic/go-seccomp-bpf"
+	"github.com/elastic/go-seccomp-bpf/arch"
+	"golang.org/x/sys/unix"
+	"kernel.org/pub/linux/libs/security/libcap/psx"
+)
+
+// Apply drops all capabilities but CAP_NET_ADMIN and CAP_NET_BIND_SERVICE
+// and loads the seccomp filter, in every thread of the process. Neither
+// can be undone.
+func Apply() error {
+	if err := dropCapabilities(); err != nil {
+		return err
+	}
+	return loadFilter()
+}
+
+// dropCapabilities reduces the capabilities of all threads to the kept
+// ones. Capabilities are per thread, so the changes go through psx, which
+// makes them on every thread of the Go and C runtimes.
+func dropCapabilities() error {
+	// Without CAP_SETPCAP, as when not run as root, the bounding set can't
+	// be changed; no_new_privs keeps capabilities from being regained
+	if _, _, errno := psx.Syscall3(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
+		return fmt.Errorf("failed to set no_new_privs: %w", errno)
+	}
+	for c := 0; c <= lastCap(); c++ {
+		if c == capNetAdmin || c == capNetBindService {
+			continue
+		}
+		_, _, errno := psx.Syscall3(unix.SYS_PRCTL, unix.PR_CAPBSET_DROP, uintptr(c), 0)
+		if errno == unix.EPERM {
+			break
+		}
+		if errno != 0 && errno != unix.EINVAL {
+			return fmt.Errorf("failed to drop capability %d from the bounding set: %w", c, errno)
+		}
+	}
+	if _, _, errno := psx.Syscall6(unix.SYS_PRCTL, unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0, 0); errno != 0 && errno != unix.EINVAL {
+		return fmt.Errorf("failed to clear ambient capabilities: %w", errno)
+	}
+
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("failed to read capabilities: %w", err)
+	}
+	// Only capabilities the process has can be kept
+	keep := data[0].Permitted & (1<<capNetAdmin | 1<<capNetBindService)
+	data[0] = unix.CapUserData{Effective: keep, Permitted: keep}
+	data[1] = unix.CapUserData{}
+	if _, _, errno := psx.Syscall3(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("failed to drop capabilities: %w", errno)
+	}
+	return nil
+}
+
+// lastCap returns the highest capability the kernel knows.
+func lastCap() int {
+	data, err := os.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return unix.CAP_LAST_CAP
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return unix.CAP_LAST_CAP
+	}
+	return last
+}
+
+// loadFilter loads the seccomp filter denying deniedSyscalls into all
+// threads.
+func loadFilter() error {
+	info, err := arch.GetInfo("")
+	if err != nil {
+		return errors.Join(ErrUnsupported, err)
+	}
+	var names []string
+	for _, name := range deniedSyscalls {
+		if _, ok := info.SyscallNames[name]; ok {
+			names = append(names, name)
+		}
+	}
+
+	filter := seccomp.Filter{
+		NoNewPrivs: true,
+		Flag:       seccomp.FilterFlagTSync,
+		Policy: seccomp.Policy{
+			DefaultAction: seccomp.ActionAllow,
+			Syscalls: []seccomp.SyscallGroup{
+				{Action: seccomp.ActionErrno, Names: names},
+			},
+		},
+	}
+	// no_new_privs and the filter are set on the calling thread, from
+	// which the filter is synchronized to the others
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := seccomp.LoadFilter(filter); err != nil {
+		return fmt.Errorf("failed to load seccomp filter: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+//go:build linux
+
+package sandbox
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestApply runs the sandboxed checks in a child process, since the
+// sandbox can't be lifted again.
+func TestApply(t *testing.T) {
+	if os.Getenv("KH_SANDBOX_CHILD") == "1" {
+		sandboxedChild()
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestApply$")
+	cmd.Env = append(os.Environ(), "KH_SANDBOX_CHILD=1")
+	out, err := cmd.CombinedOutput()
+	if strings.Contains(string(out), "SKIP:") {
+		t.Skip(strings.TrimSpace(string(out)))
+	}
+	if err != nil {
+		t.Fatalf("Sandboxed child failed: %v\n%s", err, out)
+	}
+}
+
+func sandboxedChild() {
+	fail := func(format string, args ...any) {
+		fmt.Printf(format+"\n", args...)
+		os.Exit(1)
+	}
+	if err := Apply(); err != nil {
+		if errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EINVAL) || errors.Is(err, ErrUnsupported) {
+			fmt.Printf("SKIP: seccomp not available: %v\n", err)
+			os.Exit(0)
+		}
+		fail("Apply failed: %v", err)
+	}
+
+	// Any thread may run the exec
+	for i := 0; i < 4; i++ {
+		err := exec.Command("/bin/true").Run()
+		if !errors.Is(err, syscall.EPERM) {
+			fail("exec returned %v, want EPERM", err)
+		}
+	}
+
+	allowed := uint64(1<<capNetAdmin | 1<<capNetBindService)
+	for _, field := range []string{"CapEff", "CapPrm", "CapBnd"} {
+		caps, err := capabilities(field)
+		if err != nil {
+			fail("%v", err)
+		}
+		if caps&^allowed != 0 {
+			fail("%s = %x, want at most %x", field, caps, allowed)
+		}
+	}
+	os.Exit(0)
+}
+
+// capabilities reads a capability set of the process from /proc.
+func capabilities(field string) (uint64, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if value, ok := strings.CutPrefix(sc.Text(), field+":"); ok {
+			return strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		}
+	}
+	return 0, fmt.Errorf("%s missing from /proc/self/status", field)
+}
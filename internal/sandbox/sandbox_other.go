@@ -0,0 +1,8 @@
+//go:build !linux
+
+package sandbox
+
+// Apply returns ErrUnsupported.
+func Apply() error {
+	return ErrUnsupported
+}
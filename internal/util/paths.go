@@ -9,26 +9,54 @@ import (
 // GetPidFilePath returns the appropriate path for the PID file
 // based on the current OS and user permissions
 func GetPidFilePath() string {
+	return runtimeFilePath("kh-client.pid")
+}
+
+// GetStatusFilePath returns the path of the status file the agent writes,
+// next to the PID file
+func GetStatusFilePath() string {
+	return runtimeFilePath("kh-client.status.json")
+}
+
+// GetResolverStatePath returns the path of the backup of the host resolver
+// configuration. It must survive a reboot, since the changes it undoes do.
+func GetResolverStatePath() string {
+	if runtime.GOOS != "windows" && os.Geteuid() == 0 {
+		return filepath.Join("/var/lib/kurohabaki", "resolver.json")
+	}
+	return runtimeFilePath("kh-client.resolver.json")
+}
+
+// GetLogFilePath returns the log file of the background agent
+func GetLogFilePath() string {
+	if runtime.GOOS != "windows" && os.Geteuid() == 0 {
+		return "/var/log/kh-client.log"
+	}
+	return runtimeFilePath("kh-client.log")
+}
+
+// runtimeFilePath returns the location of a runtime file with the given name
+func runtimeFilePath(name string) string {
 	// For Windows
 	if runtime.GOOS == "windows" {
 		// Use %TEMP% directory on Windows
-		return filepath.Join(os.TempDir(), "kh-client.pid")
+		return filepath.Join(os.TempDir(), name)
 	}
 
 	// For Unix-like systems (Linux, macOS)
 	// Check if we're running as root
 	if os.Geteuid() == 0 {
 		// Standard location for system daemons
-		return "/var/run/kh-client.pid"
+		return filepath.Join("/var/run", name)
 	}
 
 	// For non-root users on Unix systems
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		// Fallback to temporary directory if home directory is unavailable
-		return filepath.Join(os.TempDir(), "kh-client.pid")
+		return filepath.Join(os.TempDir(), name)
 	}
 
 	// Use hidden file in user's home directory
-	return filepath.Join(homeDir, ".kh-client.pid")
+	return filepath.Join(homeDir, "."+name)
 }
@@ -1,7 +1,7 @@
 package wg
 
 import (
-	"log"
+	"fmt"
 	"net"
 
 	"github.com/pabotesu/kurohabaki-client/config"
@@ -24,62 +24,63 @@ type WGPeerConfig struct {
 	PersistentKeepaliveInterval *uint16
 	ReplaceAllowedIPs           bool
 	AllowedIPs                  []net.IPNet
+	PresharedKey                *device.NoisePresharedKey
 }
 
-func BuildWGConfig(cfg *config.Config) *WGConfig {
-	privateKey := mustParseKey(cfg.Interface.PrivateKey)
-	// Replace 'ServerPeer' with the correct field name from config.Config, e.g., 'Peer' or 'Server'
-	publicKey := mustParseKey(cfg.ServerConfig.PublicKey)
+// BuildWGConfig builds the WireGuard config of the interface and the
+// server peer from cfg.
+func BuildWGConfig(cfg *config.Config) (*WGConfig, error) {
+	privateKey, err := wgtypes.ParseKey(cfg.Interface.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	publicKey, err := ParsePublicKey(cfg.ServerConfig.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer public key: %w", err)
+	}
+	endpoint, err := net.ResolveUDPAddr("udp", cfg.ServerConfig.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer endpoint: %w", err)
+	}
+	_, allowedIP, err := net.ParseCIDR(cfg.ServerConfig.AllowedIPs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer allowed IPs: %w", err)
+	}
 
-	devicePrivateKey := device.NoisePrivateKey{}
-	copy(devicePrivateKey[:], privateKey[:])
-	devicePublicKey := device.NoisePublicKey{}
-	copy(devicePublicKey[:], publicKey[:])
-	endpoint := resolveUDPAddr(cfg.ServerConfig.Endpoint)
-	allowedIP := parseCIDR(cfg.ServerConfig.AllowedIPs)
+	var presharedKey *device.NoisePresharedKey
+	if cfg.ServerConfig.PresharedKey != "" {
+		key, err := wgtypes.ParseKey(cfg.ServerConfig.PresharedKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer preshared key: %w", err)
+		}
+		psk := device.NoisePresharedKey(key)
+		presharedKey = &psk
+	}
 
+	var listenPort *int
+	if cfg.Interface.ListenPort != 0 {
+		listenPort = &cfg.Interface.ListenPort
+	}
+
+	devicePrivateKey := device.NoisePrivateKey(privateKey)
 	return &WGConfig{
 		PrivateKey:   &devicePrivateKey,
-		ListenPort:   nil, // optional: set to nil for auto
+		ListenPort:   listenPort, // nil for auto
 		ReplacePeers: true,
 		Peers: []WGPeerConfig{
 			{
-				PublicKey:                   devicePublicKey,
+				PublicKey:                   publicKey,
 				Endpoint:                    endpoint,
 				PersistentKeepaliveInterval: uint16Ptr(cfg.ServerConfig.PersistentKeepalive),
 				ReplaceAllowedIPs:           true,
 				AllowedIPs: []net.IPNet{
-					allowedIP,
+					*allowedIP,
 				},
+				PresharedKey: presharedKey,
 			},
 		},
 		Routes: cfg.Interface.Routes,
-	}
-}
-
-// mustParseKey converts a base64 WireGuard key string to wgtypes.Key or panics if invalid.
-func mustParseKey(b64 string) wgtypes.Key {
-	key, err := wgtypes.ParseKey(b64)
-	if err != nil {
-		log.Fatalf("invalid WireGuard key: %v", err)
-	}
-	return key
-}
-
-func resolveUDPAddr(endpoint string) *net.UDPAddr {
-	addr, err := net.ResolveUDPAddr("udp", endpoint)
-	if err != nil {
-		log.Fatalf("invalid endpoint format: %v", err)
-	}
-	return addr
-}
-
-func parseCIDR(cidr string) net.IPNet {
-	_, ipnet, err := net.ParseCIDR(cidr)
-	if err != nil {
-		log.Fatalf("invalid CIDR: %v", err)
-	}
-	return *ipnet
+	}, nil
 }
 
 func uint16Ptr(v int) *uint16 {
@@ -87,36 +88,55 @@ func uint16Ptr(v int) *uint16 {
 	return &u
 }
 
-func ConvertNodesToPeers(nodes []etcd.Node) ([]WGPeerConfig, error) {
+// ConvertNodesToPeers builds the peers of the nodes. A node with an invalid
+// key, endpoint or address is skipped with a warning, so that it doesn't
+// cost the others their peers.
+func ConvertNodesToPeers(nodes []etcd.Node) []WGPeerConfig {
 	var peers []WGPeerConfig
 	for _, n := range nodes {
-		pubKey := mustParseDevicePublicKey(n.PublicKey)
-		endpoint, err := net.ResolveUDPAddr("udp", n.Endpoint)
-		if err != nil {
-			return nil, err
-		}
-		_, ipnet, err := net.ParseCIDR(n.IP + "/32")
+		peer, err := nodePeer(n)
 		if err != nil {
-			return nil, err
+			name := n.Hostname
+			if name == "" {
+				name = n.PublicKey
+			}
+			wgLog.Warnf("Skipping node %s: %v", name, err)
+			continue
 		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
 
-		peers = append(peers, WGPeerConfig{
-			PublicKey:                   pubKey,
-			Endpoint:                    endpoint,
-			AllowedIPs:                  []net.IPNet{*ipnet},
-			ReplaceAllowedIPs:           true,
-			PersistentKeepaliveInterval: uint16Ptr(5),
-		})
-	}
-	return peers, nil
+func nodePeer(n etcd.Node) (WGPeerConfig, error) {
+	pubKey, err := ParsePublicKey(n.PublicKey)
+	if err != nil {
+		return WGPeerConfig{}, fmt.Errorf("invalid public key %q: %w", n.PublicKey, err)
+	}
+	endpoint, err := net.ResolveUDPAddr("udp", n.Endpoint)
+	if err != nil {
+		return WGPeerConfig{}, fmt.Errorf("invalid endpoint: %w", err)
+	}
+	_, ipnet, err := net.ParseCIDR(n.IP + "/32")
+	if err != nil {
+		return WGPeerConfig{}, fmt.Errorf("invalid address: %w", err)
+	}
+	return WGPeerConfig{
+		PublicKey:                   pubKey,
+		Endpoint:                    endpoint,
+		AllowedIPs:                  []net.IPNet{*ipnet},
+		ReplaceAllowedIPs:           true,
+		PersistentKeepaliveInterval: uint16Ptr(5),
+	}, nil
 }
 
-// mustParseDevicePublicKey converts a base64 WireGuard key string to wgtypes.Key or panics if invalid.
-func mustParseDevicePublicKey(b64 string) device.NoisePublicKey {
-	key := mustParseKey(b64)
-	var npk device.NoisePublicKey
-	copy(npk[:], key[:])
-	return npk
+// ParsePublicKey converts a base64 WireGuard public key string to device.NoisePublicKey.
+func ParsePublicKey(b64 string) (device.NoisePublicKey, error) {
+	key, err := wgtypes.ParseKey(b64)
+	if err != nil {
+		return device.NoisePublicKey{}, err
+	}
+	return device.NoisePublicKey(key), nil
 }
 
 func SamePeers(a, b []WGPeerConfig) bool {
@@ -134,7 +154,31 @@ func SamePeers(a, b []WGPeerConfig) bool {
 		} else if a[i].Endpoint.String() != b[i].Endpoint.String() {
 			return false
 		}
-		// 他のフィールドも必要なら追加
+		if !samePresharedKey(a[i].PresharedKey, b[i].PresharedKey) {
+			return false
+		}
+		if !sameAllowedIPs(a[i].AllowedIPs, b[i].AllowedIPs) {
+			return false
+		}
+	}
+	return true
+}
+
+func samePresharedKey(a, b *device.NoisePresharedKey) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func sameAllowedIPs(a, b []net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].String() != b[i].String() {
+			return false
+		}
 	}
 	return true
 }
@@ -4,6 +4,8 @@ import (
 	"net"
 	"testing"
 
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/pabotesu/kurohabaki-client/internal/etcd"
 	"golang.zx2c4.com/wireguard/device"
 )
 
@@ -37,6 +39,15 @@ func TestSamePeers(t *testing.T) {
 		return &u
 	}
 
+	// Helper function to create a test preshared key
+	createPSK := func(b byte) *device.NoisePresharedKey {
+		var key device.NoisePresharedKey
+		for i := range key {
+			key[i] = b
+		}
+		return &key
+	}
+
 	tests := []struct {
 		name     string
 		peersA   []WGPeerConfig
@@ -123,6 +134,58 @@ func TestSamePeers(t *testing.T) {
 			},
 			expected: false,
 		},
+		{
+			name: "Different preshared keys",
+			peersA: []WGPeerConfig{
+				{
+					PublicKey:    createPubKey(1),
+					Endpoint:     createUDPAddr("192.168.1.1", 51820),
+					PresharedKey: createPSK(1),
+				},
+			},
+			peersB: []WGPeerConfig{
+				{
+					PublicKey:    createPubKey(1),
+					Endpoint:     createUDPAddr("192.168.1.1", 51820),
+					PresharedKey: createPSK(2),
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "Preshared key removed",
+			peersA: []WGPeerConfig{
+				{
+					PublicKey:    createPubKey(1),
+					Endpoint:     createUDPAddr("192.168.1.1", 51820),
+					PresharedKey: createPSK(1),
+				},
+			},
+			peersB: []WGPeerConfig{
+				{
+					PublicKey: createPubKey(1),
+					Endpoint:  createUDPAddr("192.168.1.1", 51820),
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "Different allowed IPs",
+			peersA: []WGPeerConfig{
+				{
+					PublicKey:  createPubKey(1),
+					Endpoint:   createUDPAddr("192.168.1.1", 51820),
+					AllowedIPs: []net.IPNet{createAllowedIP("10.0.0.1/32")},
+				},
+			},
+			peersB: []WGPeerConfig{
+				{
+					PublicKey: createPubKey(1),
+					Endpoint:  createUDPAddr("192.168.1.1", 51820),
+				},
+			},
+			expected: false,
+		},
 		{
 			name: "Nil endpoint in one peer",
 			peersA: []WGPeerConfig{
@@ -166,3 +229,52 @@ func TestSamePeers(t *testing.T) {
 		})
 	}
 }
+
+func TestBuildWGConfig(t *testing.T) {
+	key := "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+	cfg := &config.Config{
+		Interface: config.InterfaceConfig{PrivateKey: key, ListenPort: 51820},
+		ServerConfig: config.ServerPeer{
+			PublicKey:           key,
+			Endpoint:            "192.168.1.1:51820",
+			AllowedIPs:          "10.0.0.1/32",
+			PersistentKeepalive: 25,
+		},
+	}
+	conf, err := BuildWGConfig(cfg)
+	if err != nil {
+		t.Fatalf("BuildWGConfig failed: %v", err)
+	}
+	if *conf.ListenPort != 51820 || len(conf.Peers) != 1 || conf.Peers[0].AllowedIPs[0].String() != "10.0.0.1/32" {
+		t.Errorf("Unexpected WireGuard config: %+v", conf)
+	}
+
+	// Invalid values are errors instead of ending the process
+	for name, mutate := range map[string]func(c *config.Config){
+		"private key":   func(c *config.Config) { c.Interface.PrivateKey = "bad" },
+		"public key":    func(c *config.Config) { c.ServerConfig.PublicKey = "" },
+		"endpoint":      func(c *config.Config) { c.ServerConfig.Endpoint = "192.168.1.1" },
+		"allowed IPs":   func(c *config.Config) { c.ServerConfig.AllowedIPs = "10.0.0.1" },
+		"preshared key": func(c *config.Config) { c.ServerConfig.PresharedKey = "bad" },
+	} {
+		c := *cfg
+		mutate(&c)
+		if _, err := BuildWGConfig(&c); err == nil {
+			t.Errorf("Expected an invalid %s to be an error", name)
+		}
+	}
+}
+
+func TestConvertNodesToPeers(t *testing.T) {
+	nodes := []etcd.Node{
+		{Hostname: "bad", PublicKey: "not-a-key", Endpoint: "192.168.1.2:51820", IP: "10.0.0.2"},
+		{Hostname: "good", PublicKey: "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=", Endpoint: "192.168.1.3:51820", IP: "10.0.0.3"},
+	}
+	peers := ConvertNodesToPeers(nodes)
+	if len(peers) != 1 {
+		t.Fatalf("Expected only the good node, got %d peers", len(peers))
+	}
+	if peers[0].Endpoint.String() != "192.168.1.3:51820" || peers[0].AllowedIPs[0].String() != "10.0.0.3/32" {
+		t.Errorf("Unexpected peer %+v", peers[0])
+	}
+}
@@ -3,24 +3,34 @@ package wg
 import (
 	"encoding/hex"
 	"fmt"
+	"net/netip"
 	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/pabotesu/kurohabaki-client/internal/logger"
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/netstack"
 )
 
 type WireGuardInterface struct {
 	ifName string
 	dev    *device.Device
 	lock   sync.Mutex
+	// net is the userspace network stack, nil for a TUN device
+	net *netstack.Net
 }
 
+// TUNWrapper wraps the TUN device before it is handed to WireGuard, e.g. to
+// filter packets.
+type TUNWrapper func(tun.Device) tun.Device
+
 // NewWireGuardInterface creates and initializes a new WireGuard TUN interface (Linux only)
-func NewWireGuardInterface(ifname string) (*WireGuardInterface, error) {
+func NewWireGuardInterface(ifname string, wrappers ...TUNWrapper) (*WireGuardInterface, error) {
 	// Create the TUN device
 	tunDev, err := tun.CreateTUN(ifname, device.DefaultMTU)
 	if err != nil {
@@ -28,35 +38,73 @@ func NewWireGuardInterface(ifname string) (*WireGuardInterface, error) {
 	}
 
 	// Log the creation of the TUN device
-	logger.Println("Created TUN device:", ifname)
+	wgLog.Debugf("Created TUN device: %s", ifname)
 
-	// Set logging for WireGuard device based on debug mode
-	// Set log level to error by default; change to LogLevelVerbose for more detailed logs if needed.
-	logLevel := device.LogLevelError // only log errors by default
+	return newInterface(ifname, tunDev, wrappers), nil
+}
 
-	// If debug mode is enabled, set log level to verbose
-	// This allows for more detailed logging during development or troubleshooting.
-	if logger.IsDebugMode() {
-		logLevel = device.LogLevelVerbose
+// NewNetstackInterface creates a WireGuard interface on a userspace network
+// stack with the given addresses instead of a TUN device. It needs no
+// privileges; the mesh is reached through Net.
+func NewNetstackInterface(ifname string, addrs []netip.Addr, wrappers ...TUNWrapper) (*WireGuardInterface, error) {
+	tunDev, tnet, err := netstack.CreateNetTUN(addrs, nil, device.DefaultMTU)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create network stack: %w", err)
 	}
+	wgLog.Debugf("Created userspace network stack: %s", ifname)
+
+	w := newInterface(ifname, tunDev, wrappers)
+	w.net = tnet
+	return w, nil
+}
 
-	// Create WireGuard device with appropriate log level
-	dev := device.NewDevice(tunDev, conn.NewDefaultBind(), device.NewLogger(logLevel, fmt.Sprintf("[WG-%s] ", ifname)))
+var wgLog = logger.Named(logger.WG)
+
+func newInterface(ifname string, tunDev tun.Device, wrappers []TUNWrapper) *WireGuardInterface {
+	for _, wrap := range wrappers {
+		tunDev = wrap(tunDev)
+	}
+
+	// wireguard-go's verbose messages are logged at debug level, so the
+	// wireguard subsystem's level decides what is shown
+	devLog := logger.Named(logger.WireGuard).With("interface", ifname)
+	dev := device.NewDevice(tunDev, conn.NewDefaultBind(), &device.Logger{
+		Verbosef: devLog.Debugf,
+		Errorf:   devLog.Errorf,
+	})
 
 	return &WireGuardInterface{
 		ifName: ifname,
 		dev:    dev,
-	}, nil
+	}
 }
 
-// AddAddress assigns an IP address to the interface (Linux only)
+// Name returns the name of the interface
+func (w *WireGuardInterface) Name() string {
+	return w.ifName
+}
+
+// Net returns the userspace network stack, or nil if the interface is a TUN
+// device.
+func (w *WireGuardInterface) Net() *netstack.Net {
+	return w.net
+}
+
+// AddAddress assigns an IP address to the interface (Linux only). The
+// addresses of a network stack are set when it is created.
 func (w *WireGuardInterface) AddAddress(ipWithCIDR string) error {
+	if w.net != nil {
+		return nil
+	}
 	cmd := exec.Command("ip", "addr", "add", ipWithCIDR, "dev", w.ifName)
 	return cmd.Run()
 }
 
 // SetUpInterface brings the interface up (Linux only)
 func (w *WireGuardInterface) SetUpInterface() error {
+	if w.net != nil {
+		return nil
+	}
 	cmd := exec.Command("ip", "link", "set", "up", "dev", w.ifName)
 	return cmd.Run()
 }
@@ -70,37 +118,27 @@ func (w *WireGuardInterface) Up(cfg *WGConfig) error {
 	if err := w.dev.IpcSet(fmt.Sprintf("private_key=%s\n", privateKeyHex)); err != nil {
 		return fmt.Errorf("failed to set private_key: %w", err)
 	}
+	if cfg.ListenPort != nil {
+		if err := w.dev.IpcSet(fmt.Sprintf("listen_port=%d\n", *cfg.ListenPort)); err != nil {
+			return fmt.Errorf("failed to set listen_port: %w", err)
+		}
+	}
 	// Apply peer settings
 	for _, peer := range cfg.Peers {
 		var sb strings.Builder
 
-		// Encode public key to base64
-		publicKeyHex := hex.EncodeToString(peer.PublicKey[:])
-		sb.WriteString("public_key=" + publicKeyHex + "\n")
-
-		if peer.Endpoint != nil {
-			sb.WriteString("endpoint=" + peer.Endpoint.String() + "\n")
-		}
-		if peer.PersistentKeepaliveInterval != nil {
-			sb.WriteString(fmt.Sprintf("persistent_keepalive_interval=%d\n", *peer.PersistentKeepaliveInterval))
-		}
-
-		sb.WriteString("replace_allowed_ips=true\n")
-
-		for _, ipnet := range peer.AllowedIPs {
-			sb.WriteString("allowed_ip=" + ipnet.String() + "\n")
-		}
+		writePeerConfig(&sb, peer)
 
 		if err := w.dev.IpcSet(sb.String()); err != nil {
 			return err
 		}
 	}
 
-	// Add route to the peer subnet (Linux only)
-	if len(cfg.Routes) > 0 {
+	// Add route to the peer subnet (Linux only). A network stack sends
+	// everything it does not have locally to WireGuard.
+	if len(cfg.Routes) > 0 && w.net == nil {
 		for _, route := range cfg.Routes {
-			// ルート追加のログ
-			logger.Printf("Adding route to %s via %s", route, w.ifName)
+			wgLog.Debugf("Adding route to %s via %s", route, w.ifName)
 			cmd := exec.Command("ip", "route", "add", route, "dev", w.ifName)
 			if err := cmd.Run(); err != nil {
 				return fmt.Errorf("failed to add route: %w", err)
@@ -108,7 +146,7 @@ func (w *WireGuardInterface) Up(cfg *WGConfig) error {
 		}
 	}
 	// Bring the interface up
-	logger.Println("WireGuard interface is up")
+	wgLog.Infof("WireGuard interface is up")
 	return nil
 }
 
@@ -119,24 +157,142 @@ func (w *WireGuardInterface) UpdatePeers(peers []WGPeerConfig) error {
 	var sb strings.Builder
 
 	for _, peer := range peers {
-		publicKeyHex := hex.EncodeToString(peer.PublicKey[:])
-		sb.WriteString("public_key=" + publicKeyHex + "\n")
+		writePeerConfig(&sb, peer)
+		for _, ipnet := range peer.AllowedIPs {
+			wgLog.Debugf("AllowedIP: %s", ipnet.String())
+		}
+	}
 
-		if peer.Endpoint != nil {
-			sb.WriteString("endpoint=" + peer.Endpoint.String() + "\n")
+	return w.dev.IpcSet(sb.String())
+}
+
+// RemovePeers removes the given peers from the device.
+func (w *WireGuardInterface) RemovePeers(keys []device.NoisePublicKey) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	var sb strings.Builder
+	for _, key := range keys {
+		sb.WriteString("public_key=" + hex.EncodeToString(key[:]) + "\n")
+		sb.WriteString("remove=true\n")
+	}
+	return w.dev.IpcSet(sb.String())
+}
+
+// SetPrivateKey replaces the private key of the device.
+func (w *WireGuardInterface) SetPrivateKey(key device.NoisePrivateKey) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.dev.IpcSet("private_key=" + hex.EncodeToString(key[:]) + "\n")
+}
+
+// PeerStat holds the counters of one peer as reported by the device.
+type PeerStat struct {
+	PublicKey device.NoisePublicKey
+	Endpoint  string
+	// LastHandshake is zero if no handshake has completed
+	LastHandshake time.Time
+	RxBytes       uint64
+	TxBytes       uint64
+}
+
+// PeerStats returns the counters of all peers.
+func (w *WireGuardInterface) PeerStats() ([]PeerStat, error) {
+	dump, err := w.dev.IpcGet()
+	if err != nil {
+		return nil, err
+	}
+
+	var stats []PeerStat
+	var current *PeerStat
+	var sec, nsec int64
+	flush := func() {
+		if current != nil {
+			if sec != 0 || nsec != 0 {
+				current.LastHandshake = time.Unix(sec, nsec)
+			}
+			stats = append(stats, *current)
+		}
+	}
+
+	for _, line := range strings.Split(dump, "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
 		}
-		if peer.PersistentKeepaliveInterval != nil {
-			sb.WriteString(fmt.Sprintf("persistent_keepalive_interval=%d\n", *peer.PersistentKeepaliveInterval))
+		if key == "public_key" {
+			flush()
+			current, sec, nsec = nil, 0, 0
+			raw, err := hex.DecodeString(value)
+			if err != nil || len(raw) != device.NoisePublicKeySize {
+				continue
+			}
+			current = &PeerStat{}
+			copy(current.PublicKey[:], raw)
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		switch key {
+		case "endpoint":
+			current.Endpoint = value
+		case "last_handshake_time_sec":
+			sec, _ = strconv.ParseInt(value, 10, 64)
+		case "last_handshake_time_nsec":
+			nsec, _ = strconv.ParseInt(value, 10, 64)
+		case "rx_bytes":
+			current.RxBytes, _ = strconv.ParseUint(value, 10, 64)
+		case "tx_bytes":
+			current.TxBytes, _ = strconv.ParseUint(value, 10, 64)
 		}
+	}
+	flush()
+	return stats, nil
+}
 
-		sb.WriteString("replace_allowed_ips=true\n")
-		for _, ipnet := range peer.AllowedIPs {
-			sb.WriteString("allowed_ip=" + ipnet.String() + "\n")
-			logger.Printf("📌 AllowedIP: %s", ipnet.String())
+// PeerHandshakes returns the time of the latest handshake with each peer.
+// Peers that have never completed a handshake are omitted.
+func (w *WireGuardInterface) PeerHandshakes() (map[device.NoisePublicKey]time.Time, error) {
+	stats, err := w.PeerStats()
+	if err != nil {
+		return nil, err
+	}
+	handshakes := make(map[device.NoisePublicKey]time.Time)
+	for _, st := range stats {
+		if !st.LastHandshake.IsZero() {
+			handshakes[st.PublicKey] = st.LastHandshake
 		}
 	}
+	return handshakes, nil
+}
 
-	return w.dev.IpcSet(sb.String())
+// writePeerConfig appends the UAPI settings for a single peer to sb.
+func writePeerConfig(sb *strings.Builder, peer WGPeerConfig) {
+	// Encode public key to hex
+	publicKeyHex := hex.EncodeToString(peer.PublicKey[:])
+	sb.WriteString("public_key=" + publicKeyHex + "\n")
+
+	if peer.Endpoint != nil {
+		sb.WriteString("endpoint=" + peer.Endpoint.String() + "\n")
+	}
+	if peer.PersistentKeepaliveInterval != nil {
+		sb.WriteString(fmt.Sprintf("persistent_keepalive_interval=%d\n", *peer.PersistentKeepaliveInterval))
+	}
+
+	// An all-zero key disables the preshared key, so always writing it
+	// also clears a key that has been removed from the config.
+	var psk device.NoisePresharedKey
+	if peer.PresharedKey != nil {
+		psk = *peer.PresharedKey
+	}
+	sb.WriteString("preshared_key=" + hex.EncodeToString(psk[:]) + "\n")
+
+	sb.WriteString("replace_allowed_ips=true\n")
+	for _, ipnet := range peer.AllowedIPs {
+		sb.WriteString("allowed_ip=" + ipnet.String() + "\n")
+	}
 }
 
 // Close shuts down the WireGuard device.
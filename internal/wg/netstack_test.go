@@ -0,0 +1,88 @@
+package wg
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// netstackNode brings up a netstack interface listening on port.
+func netstackNode(t *testing.T, addr string, port int) (*WireGuardInterface, wgtypes.Key) {
+	t.Helper()
+	w, err := NewNetstackInterface("test", []netip.Addr{netip.MustParseAddr(addr)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(w.Close)
+
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv := device.NoisePrivateKey(key)
+	if err := w.Up(&WGConfig{PrivateKey: &priv, ListenPort: &port}); err != nil {
+		t.Fatal(err)
+	}
+	return w, key
+}
+
+func TestNetstackInterface(t *testing.T) {
+	a, keyA := netstackNode(t, "10.99.0.1", 51901)
+	b, keyB := netstackNode(t, "10.99.0.2", 51902)
+
+	peer := func(key wgtypes.Key, ip string, port int) []WGPeerConfig {
+		return []WGPeerConfig{{
+			PublicKey:  device.NoisePublicKey(key.PublicKey()),
+			Endpoint:   &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port},
+			AllowedIPs: []net.IPNet{{IP: net.ParseIP(ip), Mask: net.CIDRMask(32, 32)}},
+		}}
+	}
+	if err := a.UpdatePeers(peer(keyB, "10.99.0.2", 51902)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.UpdatePeers(peer(keyA, "10.99.0.1", 51901)); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := b.Net().ListenTCP(&net.TCPAddr{Port: 8000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	c, err := a.Net().Dial("tcp", "10.99.0.2:8000")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("Expected the echo over the tunnel, got %q, %v", buf, err)
+	}
+
+	if hs, err := a.PeerHandshakes(); err != nil || len(hs) != 1 {
+		t.Errorf("Expected a handshake with the peer, got %v, %v", hs, err)
+	}
+	stats, err := a.PeerStats()
+	if err != nil || len(stats) != 1 {
+		t.Fatalf("Expected stats of one peer, got %v, %v", stats, err)
+	}
+	if st := stats[0]; st.RxBytes == 0 || st.TxBytes == 0 || st.Endpoint != "127.0.0.1:51902" {
+		t.Errorf("Unexpected peer stats %+v", st)
+	}
+}
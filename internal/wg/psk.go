@@ -0,0 +1,68 @@
+package wg
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/sha256"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// pskInfo and pqPSKInfo bind derived keys to their purpose so the input
+// secrets can't be reused to produce keys for anything else.
+const (
+	pskInfo   = "kurohabaki peer psk v1"
+	pqPSKInfo = "kurohabaki pq psk v1"
+)
+
+// DerivePresharedKey derives the preshared key for the pair (a, b) from the
+// network secret. The result does not depend on the order of a and b, so both
+// ends of a pair compute the same key without any exchange.
+func DerivePresharedKey(secret []byte, a, b device.NoisePublicKey) device.NoisePresharedKey {
+	return deriveKey(secret, pairSalt(a, b), pskInfo)
+}
+
+// MixPresharedKey derives the preshared key for the pair (a, b) from a
+// post-quantum shared secret. A key already configured for the pair is mixed
+// in, so the result is at least as strong as either input.
+func MixPresharedKey(base *device.NoisePresharedKey, secret []byte, a, b device.NoisePublicKey) device.NoisePresharedKey {
+	ikm := append([]byte(nil), secret...)
+	if base != nil {
+		ikm = append(ikm, base[:]...)
+	}
+	return deriveKey(ikm, pairSalt(a, b), pqPSKInfo)
+}
+
+// pairSalt returns both public keys in a fixed order.
+func pairSalt(a, b device.NoisePublicKey) []byte {
+	if bytes.Compare(a[:], b[:]) > 0 {
+		a, b = b, a
+	}
+	salt := make([]byte, 0, len(a)+len(b))
+	salt = append(salt, a[:]...)
+	return append(salt, b[:]...)
+}
+
+func deriveKey(secret, salt []byte, info string) device.NoisePresharedKey {
+	var psk device.NoisePresharedKey
+	key, err := hkdf.Key(sha256.New, secret, salt, info, len(psk))
+	if err != nil {
+		// Only possible if the requested length exceeds the HKDF limit.
+		panic(err)
+	}
+	copy(psk[:], key)
+	return psk
+}
+
+// SetPresharedKeys assigns every peer the key derived for it and self.
+// A nil secret clears the keys.
+func SetPresharedKeys(peers []WGPeerConfig, secret []byte, self device.NoisePublicKey) {
+	for i := range peers {
+		if secret == nil {
+			peers[i].PresharedKey = nil
+			continue
+		}
+		psk := DerivePresharedKey(secret, self, peers[i].PublicKey)
+		peers[i].PresharedKey = &psk
+	}
+}
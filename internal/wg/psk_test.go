@@ -0,0 +1,57 @@
+package wg
+
+import (
+	"testing"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+func TestDerivePresharedKey(t *testing.T) {
+	createPubKey := func(b byte) device.NoisePublicKey {
+		var key device.NoisePublicKey
+		for i := range key {
+			key[i] = b
+		}
+		return key
+	}
+
+	a := createPubKey(1)
+	b := createPubKey(2)
+	c := createPubKey(3)
+	secret := []byte("network-secret")
+
+	t.Run("Symmetric", func(t *testing.T) {
+		if DerivePresharedKey(secret, a, b) != DerivePresharedKey(secret, b, a) {
+			t.Error("Expected the same key regardless of argument order")
+		}
+	})
+
+	t.Run("DifferentPairs", func(t *testing.T) {
+		if DerivePresharedKey(secret, a, b) == DerivePresharedKey(secret, a, c) {
+			t.Error("Expected different keys for different pairs")
+		}
+	})
+
+	t.Run("DifferentSecrets", func(t *testing.T) {
+		if DerivePresharedKey(secret, a, b) == DerivePresharedKey([]byte("rotated-secret"), a, b) {
+			t.Error("Expected a different key after the secret changes")
+		}
+	})
+
+	t.Run("SetAndClear", func(t *testing.T) {
+		peers := []WGPeerConfig{{PublicKey: b}, {PublicKey: c}}
+		SetPresharedKeys(peers, secret, a)
+		for _, p := range peers {
+			if p.PresharedKey == nil || *p.PresharedKey != DerivePresharedKey(secret, a, p.PublicKey) {
+				t.Errorf("Expected derived key for peer %x", p.PublicKey[:4])
+			}
+		}
+
+		SetPresharedKeys(peers, nil, a)
+		for _, p := range peers {
+			if p.PresharedKey != nil {
+				t.Errorf("Expected key to be cleared for peer %x", p.PublicKey[:4])
+			}
+		}
+	})
+}
@@ -0,0 +1,85 @@
+package wg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+
+	"filippo.io/edwards25519"
+	"filippo.io/edwards25519/field"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Sign signs msg with a WireGuard private key using XEdDSA, so that anyone
+// who knows the node's public key can verify it without a separate signing key.
+// The signature is a standard 64-byte Ed25519 signature.
+func Sign(priv wgtypes.Key, msg []byte) ([]byte, error) {
+	k, err := edwards25519.NewScalar().SetBytesWithClamping(priv[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// The Edwards public key must have a zero sign bit; negate the scalar
+	// if the point it produces doesn't.
+	A := new(edwards25519.Point).ScalarBaseMult(k).Bytes()
+	a := k
+	if A[31]&0x80 != 0 {
+		a = edwards25519.NewScalar().Negate(k)
+		A[31] &= 0x7f
+	}
+
+	var z [64]byte
+	if _, err := rand.Read(z[:]); err != nil {
+		return nil, fmt.Errorf("failed to read random bytes: %w", err)
+	}
+
+	h := sha512.New()
+	h.Write([]byte{0xfe})
+	for i := 0; i < 31; i++ {
+		h.Write([]byte{0xff})
+	}
+	h.Write(a.Bytes())
+	h.Write(msg)
+	h.Write(z[:])
+	r, err := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	R := new(edwards25519.Point).ScalarBaseMult(r).Bytes()
+
+	h.Reset()
+	h.Write(R)
+	h.Write(A)
+	h.Write(msg)
+	c, err := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	s := edwards25519.NewScalar().MultiplyAdd(c, a, r)
+
+	return append(R, s.Bytes()...), nil
+}
+
+// Verify reports whether sig is a valid XEdDSA signature of msg by the
+// WireGuard public key pub.
+func Verify(pub wgtypes.Key, msg, sig []byte) bool {
+	if len(sig) != ed25519.SignatureSize {
+		return false
+	}
+
+	// Convert the Montgomery u-coordinate to the Edwards y-coordinate,
+	// y = (u - 1) / (u + 1), and use the point with a zero sign bit.
+	u, err := new(field.Element).SetBytes(pub[:])
+	if err != nil {
+		return false
+	}
+	one := new(field.Element).One()
+	num := new(field.Element).Subtract(u, one)
+	den := new(field.Element).Add(u, one)
+	y := new(field.Element).Multiply(num, new(field.Element).Invert(den))
+
+	A := y.Bytes()
+	A[31] &= 0x7f
+	return ed25519.Verify(ed25519.PublicKey(A), msg, sig)
+}
@@ -0,0 +1,45 @@
+package wg
+
+import (
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestSignVerify(t *testing.T) {
+	msg := []byte("kurohabaki test message")
+
+	// Cover keys whose Edwards point has either sign bit
+	for i := 0; i < 8; i++ {
+		priv, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			t.Fatalf("Failed to generate key: %v", err)
+		}
+		pub := priv.PublicKey()
+
+		sig, err := Sign(priv, msg)
+		if err != nil {
+			t.Fatalf("Failed to sign: %v", err)
+		}
+		if !Verify(pub, msg, sig) {
+			t.Fatal("Expected signature to verify")
+		}
+		if Verify(pub, []byte("another message"), sig) {
+			t.Error("Expected signature over another message to fail")
+		}
+
+		other, _ := wgtypes.GeneratePrivateKey()
+		if Verify(other.PublicKey(), msg, sig) {
+			t.Error("Expected signature to fail with another public key")
+		}
+
+		sig[0] ^= 1
+		if Verify(pub, msg, sig) {
+			t.Error("Expected tampered signature to fail")
+		}
+	}
+
+	if Verify(wgtypes.Key{}, msg, []byte("short")) {
+		t.Error("Expected malformed signature to fail")
+	}
+}
@@ -0,0 +1,271 @@
+// Package khnet runs a kurohabaki mesh node inside a Go process. The node's
+// interface is a userspace network stack, so no root privileges or TUN
+// device are needed, and the process reaches other nodes with Dial and
+// accepts their connections with Listen.
+//
+//	cfg, err := config.Load("config.yaml")
+//	...
+//	mesh, err := khnet.Start(cfg)
+//	...
+//	defer mesh.Close()
+//	conn, err := mesh.Dial(ctx, "tcp", "db.kh.internal:5432")
+package khnet
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"github.com/pabotesu/kurohabaki-client/internal/agent"
+	"github.com/pabotesu/kurohabaki-client/internal/etcd"
+	"github.com/pabotesu/kurohabaki-client/internal/filter"
+	"github.com/pabotesu/kurohabaki-client/internal/wg"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Status is a snapshot of the node's state, as shown by the status command.
+type Status = agent.Status
+
+// PeerStatus describes one WireGuard peer in a Status.
+type PeerStatus = agent.PeerStatus
+
+// Node is a member of the mesh as published in etcd.
+type Node struct {
+	PublicKey string
+	Addr      netip.Addr
+	Hostname  string
+	Endpoint  string
+	Tags      []string
+	Services  []config.Service
+	LastSeen  time.Time
+}
+
+// Mesh is a running mesh node.
+type Mesh struct {
+	cfg  *config.Config
+	addr netip.Addr
+	wgIf *wg.WireGuardInterface
+	net  *netstack.Net
+
+	// agent and etcd are nil without an etcd endpoint
+	agent *agent.Agent
+	etcd  *clientv3.Client
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Start brings up a mesh node with cfg. The node joins the mesh through
+// the configured peer and, if cfg.Etcd.Endpoint is set, discovers the other
+// nodes through etcd like the agent does; without it only the configured
+// peer is reachable. Host integrations (hosts file, resolver, nftables) are
+// never applied, and the SOCKS5 and HTTP proxies only run if their
+// addresses are set in cfg.Netstack. An encrypted private key must be
+// unlocked first with cfg.Interface.ResolvePrivateKey.
+func Start(cfg *config.Config) (*Mesh, error) {
+	// The agent works on its own copy, with the proxies off by default
+	c := *cfg
+	if err := c.Interface.ResolvePrivateKey(nil); err != nil {
+		return nil, fmt.Errorf("failed to load private key: %w", err)
+	}
+	wgConf, err := wg.BuildWGConfig(&c)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := netip.ParsePrefix(c.Interface.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid interface address: %w", err)
+	}
+
+	c.Netstack.Enabled = true
+	if c.Netstack.SOCKS5 == "" {
+		c.Netstack.SOCKS5 = "off"
+	}
+	if c.Netstack.HTTP == "" {
+		c.Netstack.HTTP = "off"
+	}
+	c.HostsFile.Enabled = false
+	c.Interface.DNS = ""
+
+	var wrappers []wg.TUNWrapper
+	var packetFilter *filter.Filter
+	switch c.Firewall.Mode {
+	case "", "off":
+	case "userspace":
+		rules, err := filter.RulesFromConfig(c.Firewall.Rules)
+		if err != nil {
+			return nil, err
+		}
+		wrappers = append(wrappers, func(dev tun.Device) tun.Device {
+			packetFilter = filter.New(dev, rules)
+			return packetFilter
+		})
+	default:
+		return nil, fmt.Errorf("firewall mode %q is not available in a library node", c.Firewall.Mode)
+	}
+
+	wgIf, err := wg.NewNetstackInterface("khnet", []netip.Addr{prefix.Addr()}, wrappers...)
+	if err != nil {
+		return nil, err
+	}
+	if err := wgIf.Up(wgConf); err != nil {
+		wgIf.Close()
+		return nil, fmt.Errorf("failed to apply WireGuard config: %w", err)
+	}
+
+	m := &Mesh{
+		cfg:  &c,
+		addr: prefix.Addr(),
+		wgIf: wgIf,
+		net:  wgIf.Net(),
+		done: make(chan struct{}),
+	}
+	if c.Etcd.Endpoint == "" {
+		m.cancel = func() {}
+		close(m.done)
+		return m, nil
+	}
+
+	m.etcd, err = etcd.NewClient(c.Etcd.Endpoint)
+	if err != nil {
+		wgIf.Close()
+		return nil, fmt.Errorf("failed to connect to etcd: %w", err)
+	}
+	privKey, _ := wgtypes.ParseKey(c.Interface.PrivateKey)
+	pubKey := privKey.PublicKey()
+
+	m.agent = agent.New(&c, wgIf, m.etcd, base64.StdEncoding.EncodeToString(pubKey[:]))
+	m.agent.SetFilter(packetFilter)
+	m.agent.SetStatusPath("")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	go func() {
+		defer close(m.done)
+		m.agent.Run(ctx)
+	}()
+	return m, nil
+}
+
+// Addr returns the node's mesh address.
+func (m *Mesh) Addr() netip.Addr {
+	return m.addr
+}
+
+// Dial connects to address on the mesh. The host may be a mesh address or
+// a node name, <hostname> or <hostname>.<domain>; network is tcp or udp.
+func (m *Mesh) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if m.agent != nil {
+		return m.agent.MeshDialer().DialContext(ctx, network, address)
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err != nil {
+		return nil, fmt.Errorf("cannot resolve %s without etcd", host)
+	}
+	return m.net.DialContext(ctx, network, address)
+}
+
+// Listen accepts TCP connections from the mesh. The address must be a port
+// on this node's mesh address or on no address, e.g. ":8080".
+func (m *Mesh) Listen(network, address string) (net.Listener, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+	addr, err := m.localAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	return m.net.ListenTCPAddrPort(addr)
+}
+
+// ListenPacket receives UDP datagrams from the mesh on address, as Listen.
+func (m *Mesh) ListenPacket(network, address string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+	addr, err := m.localAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	return m.net.ListenUDPAddrPort(addr)
+}
+
+func (m *Mesh) localAddr(address string) (netip.AddrPort, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid port %q", portStr)
+	}
+	if host != "" {
+		if addr, err := netip.ParseAddr(host); err != nil || addr != m.addr {
+			return netip.AddrPort{}, fmt.Errorf("%s is not this node's mesh address %s", host, m.addr)
+		}
+	}
+	return netip.AddrPortFrom(m.addr, uint16(port)), nil
+}
+
+// Nodes returns the mesh nodes discovered through etcd, without this node.
+func (m *Mesh) Nodes() []Node {
+	if m.agent == nil {
+		return nil
+	}
+	var nodes []Node
+	for _, n := range m.agent.Nodes() {
+		addr, _ := netip.ParseAddr(n.IP)
+		nodes = append(nodes, Node{
+			PublicKey: n.PublicKey,
+			Addr:      addr,
+			Hostname:  n.Hostname,
+			Endpoint:  n.Endpoint,
+			Tags:      n.Tags,
+			Services:  n.Services,
+			LastSeen:  n.LastSeen,
+		})
+	}
+	return nodes
+}
+
+// Status returns the latest status snapshot of the node.
+func (m *Mesh) Status() *Status {
+	if m.agent != nil {
+		return m.agent.Status()
+	}
+	privKey, _ := wgtypes.ParseKey(m.cfg.Interface.PrivateKey)
+	pubKey := privKey.PublicKey()
+	return &Status{
+		Interface: m.wgIf.Name(),
+		PublicKey: base64.StdEncoding.EncodeToString(pubKey[:]),
+		UpdatedAt: time.Now(),
+	}
+}
+
+// Close leaves the mesh, waiting for the agent to clean up.
+func (m *Mesh) Close() error {
+	m.cancel()
+	<-m.done
+	if m.etcd != nil {
+		m.etcd.Close()
+	}
+	if m.agent == nil {
+		m.wgIf.Close()
+	}
+	return nil
+}
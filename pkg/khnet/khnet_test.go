@@ -0,0 +1,113 @@
+package khnet
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pabotesu/kurohabaki-client/config"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// peeredConfigs returns the configs of two nodes that use each other as
+// their configured peer.
+func peeredConfigs(t *testing.T) (*config.Config, *config.Config) {
+	t.Helper()
+	keyA, _ := wgtypes.GeneratePrivateKey()
+	keyB, _ := wgtypes.GeneratePrivateKey()
+
+	node := func(key, peer wgtypes.Key, addr, peerAddr string, port, peerPort int) *config.Config {
+		cfg := &config.Config{}
+		cfg.Interface.PrivateKey = key.String()
+		cfg.Interface.Address = addr + "/24"
+		cfg.Interface.ListenPort = port
+		cfg.ServerConfig.PublicKey = peer.PublicKey().String()
+		cfg.ServerConfig.Endpoint = "127.0.0.1:" + strconv.Itoa(peerPort)
+		cfg.ServerConfig.AllowedIPs = peerAddr + "/32"
+		return cfg
+	}
+	return node(keyA, keyB, "10.98.0.1", "10.98.0.2", 51911, 51912),
+		node(keyB, keyA, "10.98.0.2", "10.98.0.1", 51912, 51911)
+}
+
+func TestDialListen(t *testing.T) {
+	cfgA, cfgB := peeredConfigs(t)
+	a, err := Start(cfgA)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer a.Close()
+	b, err := Start(cfgB)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer b.Close()
+
+	l, err := b.Listen("tcp", ":7000")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := a.Dial(ctx, "tcp", "10.98.0.2:7000")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("mesh")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "mesh" {
+		t.Fatalf("Expected the echo, got %q, %v", buf, err)
+	}
+
+	if st := a.Status(); st.PublicKey == "" || st.Interface != "khnet" {
+		t.Errorf("Unexpected status %+v", st)
+	}
+	if _, err := a.Dial(ctx, "tcp", "db:5432"); err == nil {
+		t.Error("Expected names not to resolve without etcd")
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	cfg, _ := peeredConfigs(t)
+	cfg.Interface.ListenPort = 0
+	m, err := Start(cfg)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer m.Close()
+
+	if _, err := m.Listen("tcp", "10.98.0.9:80"); err == nil {
+		t.Error("Expected listening on another node's address to fail")
+	}
+	if _, err := m.Listen("unix", "/tmp/sock"); err == nil {
+		t.Error("Expected an unsupported network to fail")
+	}
+	pc, err := m.ListenPacket("udp", "10.98.0.1:5353")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	pc.Close()
+}
+
+func TestStartInvalidConfig(t *testing.T) {
+	cfg, _ := peeredConfigs(t)
+	cfg.ServerConfig.PublicKey = "not a key"
+	if _, err := Start(cfg); err == nil {
+		t.Error("Expected an invalid peer key to be rejected")
+	}
+}